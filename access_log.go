@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Access log formats
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+// redactedQueryParams carry credentials in presigned URLs
+var redactedQueryParams = []string{"X-Amz-Signature", "X-Amz-Security-Token", "Signature"}
+
+// accessRecord collects what the access log reports about one request
+type accessRecord struct {
+	identity string
+	status   int
+	sent     int64
+	received int64
+}
+
+type accessRecordKey struct{}
+
+// setAccessIdentity records the access key ID a request authenticated with
+func setAccessIdentity(r *http.Request, accessKeyID string) {
+	if record, ok := r.Context().Value(accessRecordKey{}).(*accessRecord); ok {
+		record.identity = accessKeyID
+	}
+}
+
+// AccessLog writes one line per request to its own destination, regardless
+// of the application log level. Only the verified access key ID identifies
+// the client; auth headers are never logged and presigned signatures are
+// redacted.
+type AccessLog struct {
+	wrapped http.Handler
+	format  string
+	path    string
+
+	mu  sync.Mutex
+	out io.WriteCloser
+}
+
+// NewAccessLog opens the access log at dest, "-" being stdout
+func NewAccessLog(dest, format string, wrapped http.Handler) (*AccessLog, error) {
+	l := &AccessLog{wrapped: wrapped, format: format}
+	if dest == "-" {
+		l.out = nopWriteCloser{os.Stdout}
+		return l, nil
+	}
+	l.path = dest
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reopen opens the log file again, so it can be rotated
+func (l *AccessLog) Reopen() error {
+	if l.path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.out != nil {
+		l.out.Close()
+	}
+	l.out = f
+	return nil
+}
+
+func (l *AccessLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	record := &accessRecord{identity: "-"}
+	r = r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, record))
+	if r.Body != nil {
+		r.Body = &accessBody{ReadCloser: r.Body, record: record}
+	}
+
+	l.wrapped.ServeHTTP(&accessWriter{ResponseWriter: w, record: record}, r)
+	if record.status == 0 {
+		record.status = http.StatusOK
+	}
+
+	line := l.formatLine(r, record, start, time.Since(start))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+func (l *AccessLog) formatLine(r *http.Request, record *accessRecord, start time.Time, duration time.Duration) []byte {
+	bucket, key := splitBucketKey(r.URL.Path)
+	uri := redactedURI(r.URL)
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if l.format == AccessLogJSON {
+		var line bytes.Buffer
+		encoder := json.NewEncoder(&line)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(struct {
+			Time       time.Time `json:"time"`
+			RemoteAddr string    `json:"remote_addr"`
+			Identity   string    `json:"identity"`
+			Method     string    `json:"method"`
+			URI        string    `json:"uri"`
+			Bucket     string    `json:"bucket"`
+			Key        string    `json:"key"`
+			Status     int       `json:"status"`
+			BytesSent  int64     `json:"bytes_sent"`
+			BytesRecv  int64     `json:"bytes_received"`
+			DurationMS float64   `json:"duration_ms"`
+			UserAgent  string    `json:"user_agent"`
+		}{
+			Time:       start.UTC(),
+			RemoteAddr: host,
+			Identity:   record.identity,
+			Method:     r.Method,
+			URI:        uri,
+			Bucket:     bucket,
+			Key:        key,
+			Status:     record.status,
+			BytesSent:  record.sent,
+			BytesRecv:  record.received,
+			DurationMS: float64(duration.Microseconds()) / 1000,
+			UserAgent:  r.UserAgent(),
+		})
+		return line.Bytes()
+	}
+
+	// Apache combined, with the duration in microseconds appended
+	referer, userAgent := r.Referer(), r.UserAgent()
+	if referer == "" {
+		referer = "-"
+	}
+	if userAgent == "" {
+		userAgent = "-"
+	}
+	return []byte(fmt.Sprintf("%s - %s [%s] %q %d %d %q %q %d\n",
+		host,
+		record.identity,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+uri+" "+r.Proto,
+		record.status,
+		record.sent,
+		referer,
+		userAgent,
+		duration.Microseconds(),
+	))
+}
+
+// redactedURI returns the request URI with presigned credentials masked
+func redactedURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.EscapedPath()
+	}
+	query := u.Query()
+	for _, name := range redactedQueryParams {
+		if query.Has(name) {
+			query.Set(name, "REDACTED")
+		}
+	}
+	return u.EscapedPath() + "?" + query.Encode()
+}
+
+// accessWriter records the status and size of a response
+type accessWriter struct {
+	http.ResponseWriter
+	record *accessRecord
+}
+
+func (a *accessWriter) WriteHeader(code int) {
+	if a.record.status == 0 {
+		a.record.status = code
+	}
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *accessWriter) Write(b []byte) (int, error) {
+	if a.record.status == 0 {
+		a.record.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(b)
+	a.record.sent += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (a *accessWriter) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
+
+// accessBody counts the request bytes read by the handler
+type accessBody struct {
+	io.ReadCloser
+	record *accessRecord
+}
+
+func (a *accessBody) Read(p []byte) (int, error) {
+	n, err := a.ReadCloser.Read(p)
+	a.record.received += int64(n)
+	return n, err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
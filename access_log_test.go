@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+func TestAccessLog(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "logged"})
+	s := newTestServer(t, f, "-subdir-buckets", "-access-key-id", "AKIDACCESSLOG", "-secret-key", "access-log-secret")
+	store := NewCredentialsStore()
+	if err := store.Load(s.config); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewAuthMiddleware(store, AuthPolicy{}, s)
+
+	// logRequest serves r through an access log in format and returns its line
+	logRequest := func(t *testing.T, format string, r *http.Request) string {
+		t.Helper()
+		dest := filepath.Join(t.TempDir(), "access.log")
+		log, err := NewAccessLog(dest, format, handler)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log.ServeHTTP(httptest.NewRecorder(), r)
+		data, err := os.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(data), "\n"); lines != 1 {
+			t.Fatalf("%d lines logged, want 1: %s", lines, data)
+		}
+		if signature := r.URL.Query().Get("X-Amz-Signature"); signature != "" && strings.Contains(string(data), signature) {
+			t.Errorf("access log leaks the presigned signature: %s", data)
+		}
+		return string(data)
+	}
+
+	t.Run("json", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/bucket/file.txt", nil)
+		query := r.URL.Query()
+		query.Set("X-Amz-Expires", "300")
+		r.URL.RawQuery = query.Encode()
+		creds := aws.Credentials{AccessKeyID: "AKIDACCESSLOG", SecretAccessKey: "access-log-secret"}
+		signed, _, err := v4.NewSigner().PresignHTTP(context.Background(), creds, r, unsignedPayload, "s3", "us-east-1", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.URL, _ = r.URL.Parse(signed)
+		r.RequestURI = r.URL.RequestURI()
+
+		var line struct {
+			Identity  string `json:"identity"`
+			Method    string `json:"method"`
+			URI       string `json:"uri"`
+			Bucket    string `json:"bucket"`
+			Key       string `json:"key"`
+			Status    int    `json:"status"`
+			BytesSent int64  `json:"bytes_sent"`
+		}
+		logged := logRequest(t, AccessLogJSON, r)
+		if err := json.Unmarshal([]byte(logged), &line); err != nil {
+			t.Fatalf("%v: %s", err, logged)
+		}
+		if line.Identity != "AKIDACCESSLOG" || line.Method != http.MethodGet || line.Bucket != "bucket" ||
+			line.Key != "file.txt" || line.Status != http.StatusOK || line.BytesSent != int64(len("logged")) {
+			t.Errorf("logged %+v", line)
+		}
+		if !strings.Contains(line.URI, "X-Amz-Signature=REDACTED") {
+			t.Errorf("presigned signature not redacted: %s", line.URI)
+		}
+	})
+
+	t.Run("combined", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPut, "/bucket/new.txt", strings.NewReader("data"))
+		signRequest(t, r, "AKIDACCESSLOG", "access-log-secret")
+		r.Header.Set("User-Agent", "test-agent")
+		logged := logRequest(t, AccessLogCombined, r)
+		pattern := regexp.MustCompile(`^192\.0\.2\.1 - AKIDACCESSLOG \[[^\]]+\] "PUT /bucket/new.txt HTTP/1.1" 200 0 "-" "test-agent" \d+\n$`)
+		if !pattern.MatchString(logged) {
+			t.Errorf("logged %q", logged)
+		}
+		if strings.Contains(logged, "access-log-secret") || strings.Contains(logged, "Credential=") {
+			t.Errorf("access log leaks the auth header: %s", logged)
+		}
+	})
+
+	t.Run("anonymous", func(t *testing.T) {
+		logged := logRequest(t, AccessLogCombined, httptest.NewRequest(http.MethodGet, "/bucket/file.txt", nil))
+		if !strings.Contains(logged, "192.0.2.1 - - [") || !strings.Contains(logged, `" 403 `) {
+			t.Errorf("logged %q", logged)
+		}
+	})
+}
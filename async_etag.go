@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+)
+
+// etagQueueSize bounds the objects waiting to be hashed in the background
+const etagQueueSize = 1024
+
+type etagJob struct {
+	path       string
+	generation uint64
+}
+
+// etagHasher computes the MD5 of uploaded objects in the background by
+// reading them back from the FTP server. Each worker has its own FTP
+// connection so hashing doesn't take connections from the request pool.
+type etagHasher struct {
+	queue   chan etagJob
+	digests *digestStore
+}
+
+func newETagHasher(config *Config, digests *digestStore, workers int) *etagHasher {
+	h := &etagHasher{
+		queue:   make(chan etagJob, etagQueueSize),
+		digests: digests,
+	}
+	for i := 0; i < workers; i++ {
+		go h.work(NewFTPClient(config))
+	}
+	return h
+}
+
+// enqueue schedules the object at path for hashing. When the queue is full
+// the object is skipped and simply keeps an unknown digest.
+func (h *etagHasher) enqueue(path string) {
+	job := etagJob{path: path, generation: h.digests.begin(path)}
+	select {
+	case h.queue <- job:
+	default:
+		slog.Warn("ETag hashing queue full, skipping object", "path", path)
+		h.digests.remove(path)
+	}
+}
+
+func (h *etagHasher) work(client *FTPClient) {
+	for job := range h.queue {
+		reader, err := client.Get(job.path)
+		if err != nil {
+			// Most likely deleted before its turn came
+			slog.Debug("failed to read object for hashing", "path", job.path, "error", err)
+			continue
+		}
+		digest := newDigestReader(reader)
+		_, err = io.Copy(io.Discard, digest)
+		reader.Close()
+		if err != nil {
+			slog.Warn("failed to hash object", "path", job.path, "error", err)
+			continue
+		}
+		if !h.digests.putIfCurrent(job.path, job.generation, digest.digest()) {
+			slog.Debug("object changed while hashing, discarding digest", "path", job.path)
+			continue
+		}
+		slog.Debug("computed object digest", "path", job.path, "size", digest.size)
+	}
+}
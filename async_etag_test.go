@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAsyncETag(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+	s := newTestServer(t, f, "-subdir-buckets", "-async-etag-workers", "1")
+
+	w := serve(s, http.MethodPut, "/bucket/file.txt", "hashed later")
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+	// The upload doesn't wait for the digest
+	if etag := w.Header().Get("ETag"); !strings.HasSuffix(etag, `-1"`) {
+		t.Errorf("PUT ETag = %s, want a synthetic one", etag)
+	}
+
+	sum := md5.Sum([]byte("hashed later"))
+	want := `"` + hex.EncodeToString(sum[:]) + `"`
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		etag := serve(s, http.MethodHead, "/bucket/file.txt", "").Header().Get("ETag")
+		if etag == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("HEAD ETag = %s, want %s once hashed", etag, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// encoding/xml escapes the quotes
+	listed := "<ETag>&#34;" + hex.EncodeToString(sum[:]) + "&#34;</ETag>"
+	if body := serve(s, http.MethodGet, "/bucket?list-type=2", "").Body.String(); !strings.Contains(body, listed) {
+		t.Errorf("listing doesn't carry the real ETag %s: %s", want, body)
+	}
+}
+
+func TestDigestDiscardedWhenChanged(t *testing.T) {
+	d := newDigestStore()
+	digest := newDigestReader(strings.NewReader("old"))
+	digest.Read(make([]byte, 8))
+
+	// Deleted while hashing
+	generation := d.begin("/bucket/file.txt")
+	d.remove("/bucket/file.txt")
+	if d.putIfCurrent("/bucket/file.txt", generation, digest.digest()) {
+		t.Error("digest of a deleted object was recorded")
+	}
+
+	// Overwritten and queued again while hashing
+	generation = d.begin("/bucket/file.txt")
+	current := d.begin("/bucket/file.txt")
+	if d.putIfCurrent("/bucket/file.txt", generation, digest.digest()) {
+		t.Error("digest of an overwritten object was recorded")
+	}
+	if !d.putIfCurrent("/bucket/file.txt", current, digest.digest()) {
+		t.Error("digest of the current object was discarded")
+	}
+	if _, ok := d.etag("/bucket/file.txt", 3); !ok {
+		t.Error("recorded digest has no ETag")
+	}
+}
@@ -2,13 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 )
 
 type Credentials struct {
@@ -17,6 +17,7 @@ type Credentials struct {
 }
 
 type CredentialsStore struct {
+	mu          sync.RWMutex
 	credentials map[string]Credentials
 }
 
@@ -27,6 +28,8 @@ func NewCredentialsStore() *CredentialsStore {
 }
 
 func (store *CredentialsStore) AddCredentials(accessKeyID, secretAccessKey string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
 	store.credentials[accessKeyID] = Credentials{
 		AccessKeyID:     accessKeyID,
 		SecretAccessKey: secretAccessKey,
@@ -35,22 +38,147 @@ func (store *CredentialsStore) AddCredentials(accessKeyID, secretAccessKey strin
 }
 
 func (store *CredentialsStore) GetCredentials(accessKeyID string) (Credentials, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
 	creds, ok := store.credentials[accessKeyID]
 	return creds, ok
 }
 
+// Count returns the number of key pairs in the store
+func (store *CredentialsStore) Count() int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return len(store.credentials)
+}
+
+// SigV4 hashed-payload values
+const (
+	// unsignedPayload marks a request whose body isn't part of the signature
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// emptyPayloadHash is the SHA-256 of an empty body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// payloadHash returns the hashed payload a request was signed with, taken
+// from x-amz-content-sha256. The body is never read for it: UNSIGNED-PAYLOAD
+// and streaming uploads are signed without hashing the body, and uploads of
+// any size stream straight through to FTP. Presigned URLs are always
+// unsigned.
+func payloadHash(r *http.Request) string {
+	hash := r.Header.Get("X-Amz-Content-Sha256")
+	switch {
+	case hash == unsignedPayload, strings.HasPrefix(hash, "STREAMING-"):
+		return hash
+	case len(hash) == 64 && strings.Trim(strings.ToLower(hash), "0123456789abcdef") == "":
+		return hash
+	case r.URL.Query().Has("X-Amz-Signature"):
+		return unsignedPayload
+	}
+	return emptyPayloadHash
+}
+
+// Operations that can be individually marked as requiring authentication
+const (
+	OpListBuckets = "ListBuckets"
+	OpListObjects = "ListObjects"
+	OpGet         = "Get"
+	OpPut         = "Put"
+	OpDelete      = "Delete"
+)
+
+// OpAdmin covers the /admin/ endpoints, which always require authentication
+const OpAdmin = "Admin"
+
+// AuthPolicy maps an operation to whether it requires authentication.
+// Operations missing from the policy require authentication only when
+// credentials are configured.
+type AuthPolicy map[string]bool
+
+// ParseAuthPolicy parses a comma-separated list of operation=mode pairs,
+// e.g. "ListBuckets=anonymous,Put=required".
+func ParseAuthPolicy(spec string) (AuthPolicy, error) {
+	policy := make(AuthPolicy)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		op, mode, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid auth policy entry %q, expected operation=mode", entry)
+		}
+		switch op {
+		case OpListBuckets, OpListObjects, OpGet, OpPut, OpDelete:
+		default:
+			return nil, fmt.Errorf("unknown operation %q in auth policy", op)
+		}
+		switch mode {
+		case "required":
+			policy[op] = true
+		case "anonymous":
+			policy[op] = false
+		default:
+			return nil, fmt.Errorf("invalid auth mode %q for %s, expected required or anonymous", mode, op)
+		}
+	}
+	return policy, nil
+}
+
+// classifyOperation determines which configurable operation a request performs
+func classifyOperation(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, adminPrefix) {
+		return OpAdmin
+	}
+	switch r.Method {
+	case http.MethodPost:
+		if r.URL.Query().Has("delete") {
+			return OpDelete
+		}
+		return OpPut
+	case http.MethodPut:
+		return OpPut
+	case http.MethodDelete:
+		return OpDelete
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "" {
+		query := r.URL.Query()
+		if query.Get("list-type") != "" || query.Get("prefix") != "" {
+			return OpListObjects
+		}
+		return OpListBuckets
+	}
+	if !strings.Contains(path, "/") {
+		return OpListObjects
+	}
+	return OpGet
+}
+
 type AuthMiddleware struct {
 	store   *CredentialsStore
+	policy  AuthPolicy
 	wrapped http.Handler
 }
 
-func NewAuthMiddleware(store *CredentialsStore, wrapped http.Handler) *AuthMiddleware {
+func NewAuthMiddleware(store *CredentialsStore, policy AuthPolicy, wrapped http.Handler) *AuthMiddleware {
 	return &AuthMiddleware{
 		store:   store,
+		policy:  policy,
 		wrapped: wrapped,
 	}
 }
 
+func (m *AuthMiddleware) requiresAuth(op string) bool {
+	if op == OpAdmin {
+		return true
+	}
+	if required, ok := m.policy[op]; ok {
+		return required
+	}
+	return m.store.Count() > 0
+}
+
 func (m *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	slog.Debug("processing request",
 		"method", r.Method,
@@ -58,67 +186,91 @@ func (m *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"headers", r.Header,
 	)
 
-	// Skip auth for healthcheck or if no credentials are configured
-	if len(m.store.credentials) == 0 || r.URL.Path == "/health" {
+	// Skip auth for health and readiness checks, favicon or if the operation doesn't require it
+	op := classifyOperation(r)
+	if r.URL.Path == "/health" || r.URL.Path == "/ready" || r.URL.Path == "/favicon.ico" || !m.requiresAuth(op) {
 		slog.Debug("skipping authentication",
 			"path", r.URL.Path,
-			"no_credentials", len(m.store.credentials) == 0,
+			"operation", op,
+			"no_credentials", m.store.Count() == 0,
 			"is_health_check", r.URL.Path == "/health",
 		)
 		m.wrapped.ServeHTTP(w, r)
 		return
 	}
 
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
-		slog.Debug("missing Authorization header")
-		http.Error(w, "Authorization header required", http.StatusUnauthorized)
-		return
-	}
-
-	// Parse AWS Signature v4 header to get access key
-	parts := strings.SplitN(auth, " ", 2)
-	if len(parts) != 2 || parts[0] != "AWS4-HMAC-SHA256" {
-		slog.Debug("invalid Authorization header format", "auth", auth)
-		http.Error(w, "Invalid Authorization header format", http.StatusUnauthorized)
-		return
-	}
-
-	credStr := strings.Split(parts[1], ",")[0]
-	credParts := strings.Split(strings.Split(credStr, "=")[1], "/")
-	if len(credParts) != 5 {
-		slog.Debug("invalid credential format", "credential_str", credStr)
-		http.Error(w, "Invalid credential format", http.StatusUnauthorized)
-		return
+	// Presigned URLs carry the signature in the query string
+	var sig *sigV4Auth
+	if r.URL.Query().Has("X-Amz-Algorithm") {
+		var err error
+		sig, err = parsePresigned(r.URL.Query())
+		if err != nil {
+			slog.Debug("invalid presigned URL parameters", "error", err)
+			writeS3Error(w, http.StatusBadRequest, "AuthorizationQueryParametersError", err.Error(), r.URL.Path)
+			return
+		}
+	} else {
+		auth := r.Header.Get("Authorization")
+		if auth == "" {
+			slog.Debug("missing Authorization header")
+			writeS3Error(w, http.StatusForbidden, "AccessDenied", "Access Denied", r.URL.Path)
+			return
+		}
+		var err error
+		sig, err = parseAuthorization(auth)
+		if err != nil {
+			slog.Debug("invalid Authorization header format", "auth", auth, "error", err)
+			writeS3Error(w, http.StatusBadRequest, "AuthorizationHeaderMalformed",
+				"The authorization header is malformed: "+err.Error(), r.URL.Path)
+			return
+		}
 	}
 
-	accessKeyID := credParts[0]
+	accessKeyID := sig.accessKeyID
 	slog.Debug("authenticating request", "access_key_id", accessKeyID)
 
 	creds, ok := m.store.GetCredentials(accessKeyID)
 	if !ok {
 		slog.Debug("invalid access key ID", "access_key_id", accessKeyID)
-		http.Error(w, "Invalid access key ID", http.StatusUnauthorized)
+		writeS3Error(w, http.StatusForbidden, "InvalidAccessKeyId",
+			"The AWS Access Key Id you provided does not exist in our records.", r.URL.Path)
 		return
 	}
 
-	// Get AWS credentials
-	awsCreds := aws.Credentials{
-		AccessKeyID:     creds.AccessKeyID,
-		SecretAccessKey: creds.SecretAccessKey,
-	}
-
-	// Create a new signer for each request
-	signer := v4.NewSigner()
-
 	// Verify the request signature
-	err := signer.SignHTTP(context.Background(), awsCreds, r, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "s3", "us-east-1", time.Now())
-	if err != nil {
-		slog.Error("signature verification failed", "error", err)
-		http.Error(w, "Signature verification failed", http.StatusUnauthorized)
+	switch err := sig.verify(r, creds.SecretAccessKey, time.Now()); {
+	case errors.Is(err, errRequestExpired):
+		slog.Debug("presigned URL expired", "access_key_id", accessKeyID, "date", sig.amzDate, "expires", sig.expires)
+		writeS3Error(w, http.StatusForbidden, "ExpiredToken", "Request has expired", r.URL.Path)
+		return
+	case errors.Is(err, errRequestTimeSkewed):
+		slog.Debug("request time too skewed", "access_key_id", accessKeyID, "date", r.Header.Get("X-Amz-Date"))
+		writeS3Error(w, http.StatusForbidden, "RequestTimeTooSkewed",
+			"The difference between the request time and the server's time is too large", r.URL.Path)
+		return
+	case err != nil:
+		slog.Debug("signature verification failed", "access_key_id", accessKeyID, "error", err)
+		writeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch",
+			"The request signature we calculated does not match the signature you provided. Check your key and signing method.", r.URL.Path)
 		return
 	}
 
+	// A body signed with its hash is checked as it streams to the handler
+	if hash := payloadHash(r); hash != unsignedPayload && !strings.HasPrefix(hash, "STREAMING-") && r.Body != nil {
+		r.Body = newPayloadVerifier(r.Body, hash)
+	}
+
 	slog.Debug("authentication successful", "access_key_id", accessKeyID)
+	setAccessIdentity(r, accessKeyID)
+	r = r.WithContext(context.WithValue(r.Context(), authenticatedKey{}, accessKeyID))
 	m.wrapped.ServeHTTP(w, r)
 }
+
+type authenticatedKey struct{}
+
+// authenticatedAs returns the access key ID a request's signature was
+// verified with, or "" for anonymous requests
+func authenticatedAs(r *http.Request) string {
+	accessKeyID, _ := r.Context().Value(authenticatedKey{}).(string)
+	return accessKeyID
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// signRequest signs r with SigV4 like an S3 client, leaving the body unsigned
+func signRequest(t *testing.T, r *http.Request, accessKeyID, secretKey string) {
+	t.Helper()
+	r.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	creds := aws.Credentials{AccessKeyID: accessKeyID, SecretAccessKey: secretKey}
+	if err := v4.NewSigner().SignHTTP(context.Background(), creds, r, unsignedPayload, "s3", "us-east-1", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseAuthPolicy(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    AuthPolicy
+		wantErr bool
+	}{
+		{"", AuthPolicy{}, false},
+		{"Get=anonymous, Put=required", AuthPolicy{OpGet: false, OpPut: true}, false},
+		{"ListBuckets=anonymous,ListObjects=anonymous,Delete=required", AuthPolicy{OpListBuckets: false, OpListObjects: false, OpDelete: true}, false},
+		{"Get", nil, true},
+		{"Admin=anonymous", nil, true},
+		{"Copy=required", nil, true},
+		{"Get=optional", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAuthPolicy(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAuthPolicy(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseAuthPolicy(%q) = %v, want %v", tt.spec, got, tt.want)
+			continue
+		}
+		for op, required := range tt.want {
+			if got[op] != required {
+				t.Errorf("ParseAuthPolicy(%q)[%s] = %v, want %v", tt.spec, op, got[op], required)
+			}
+		}
+	}
+}
+
+func TestAuthPolicyAnonymousReads(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "public"})
+	s := newTestServer(t, f, "-subdir-buckets", "-access-key-id", "AKIDWRITER", "-secret-key", "writer-secret")
+	store := NewCredentialsStore()
+	if err := store.Load(s.config); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := ParseAuthPolicy("ListBuckets=anonymous,ListObjects=anonymous,Get=anonymous")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewAuthMiddleware(store, policy, s)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		signed bool
+		want   int
+	}{
+		{"anonymous GET", http.MethodGet, "/bucket/file.txt", "", false, http.StatusOK},
+		{"anonymous HEAD", http.MethodHead, "/bucket/file.txt", "", false, http.StatusOK},
+		{"anonymous listing", http.MethodGet, "/bucket?list-type=2", "", false, http.StatusOK},
+		{"anonymous PUT", http.MethodPut, "/bucket/new.txt", "data", false, http.StatusForbidden},
+		{"anonymous DELETE", http.MethodDelete, "/bucket/file.txt", "", false, http.StatusForbidden},
+		{"anonymous multi-object delete", http.MethodPost, "/bucket?delete", "<Delete><Object><Key>file.txt</Key></Object></Delete>", false, http.StatusForbidden},
+		{"anonymous admin", http.MethodGet, "/admin/usage", "", false, http.StatusForbidden},
+		{"signed PUT", http.MethodPut, "/bucket/new.txt", "data", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.signed {
+				signRequest(t, r, "AKIDWRITER", "writer-secret")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+
+	if body, _ := f.file("/bucket/file.txt"); body != "public" {
+		t.Errorf("anonymous write changed the object to %q", body)
+	}
+	if body, _ := f.file("/bucket/new.txt"); body != "data" {
+		t.Errorf("signed PUT stored %q", body)
+	}
+}
+
+func TestUnsignedPayload(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "unsigned"})
+	s := newTestServer(t, f, "-subdir-buckets", "-access-key-id", "AKIDUNSIGNED", "-secret-key", "unsigned-secret")
+	store := NewCredentialsStore()
+	if err := store.Load(s.config); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewAuthMiddleware(store, AuthPolicy{}, s))
+	t.Cleanup(server.Close)
+	creds := aws.Credentials{AccessKeyID: "AKIDUNSIGNED", SecretAccessKey: "unsigned-secret"}
+	presign := func(r *http.Request) {
+		t.Helper()
+		query := r.URL.Query()
+		query.Set("X-Amz-Expires", "300")
+		r.URL.RawQuery = query.Encode()
+		signed, _, err := v4.NewSigner().PresignHTTP(context.Background(), creds, r, unsignedPayload, "s3", "us-east-1", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.URL, _ = r.URL.Parse(signed)
+	}
+
+	t.Run("GET", func(t *testing.T) {
+		for _, sign := range []func(*http.Request){
+			func(r *http.Request) { signRequest(t, r, "AKIDUNSIGNED", "unsigned-secret") },
+			presign,
+		} {
+			r, _ := http.NewRequest(http.MethodGet, server.URL+"/bucket/file.txt", nil)
+			sign(r)
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "unsigned" {
+				t.Errorf("status = %d: %s", resp.StatusCode, body)
+			}
+		}
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodGet, server.URL+"/bucket/file.txt", nil)
+		signRequest(t, r, "AKIDUNSIGNED", "other-secret")
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("status = %d, want 403", resp.StatusCode)
+		}
+	})
+
+	for name, sign := range map[string]func(*http.Request){
+		"streaming PUT":           func(r *http.Request) { signRequest(t, r, "AKIDUNSIGNED", "unsigned-secret") },
+		"presigned streaming PUT": presign,
+	} {
+		t.Run(name, func(t *testing.T) {
+			// The second half is only sent once STOR started, so verifying
+			// the signature can't have waited for the whole body
+			started := make(chan struct{})
+			var once sync.Once
+			f.setStorHook(func(string) error {
+				once.Do(func() { close(started) })
+				return nil
+			})
+			t.Cleanup(func() { f.setStorHook(nil) })
+			half := strings.Repeat("x", 1<<20)
+			pr, pw := io.Pipe()
+			go func() {
+				pw.Write([]byte(half))
+				select {
+				case <-started:
+					pw.Write([]byte(half))
+					pw.Close()
+				case <-time.After(5 * time.Second):
+					pw.CloseWithError(errors.New("upload wasn't streamed"))
+				}
+			}()
+
+			key := strings.ReplaceAll(name, " ", "-")
+			r, _ := http.NewRequest(http.MethodPut, server.URL+"/bucket/"+key, pr)
+			r.ContentLength = 2 << 20
+			sign(r)
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d", resp.StatusCode)
+			}
+			if body, _ := f.file("/bucket/" + key); len(body) != 2<<20 {
+				t.Errorf("stored %d bytes", len(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var browserIndexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>FTP-over-S3</title>
+</head>
+<body>
+<h1>FTP-over-S3</h1>
+<p>This is an S3-compatible gateway. Point an S3 client at this URL to access the buckets below.</p>
+<ul>
+{{range .}}<li>{{.Name}}</li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// sdkUserAgents are User-Agent prefixes of S3 clients that always want XML
+var sdkUserAgents = []string{"aws-sdk", "aws-cli", "boto", "botocore", "rclone", "minio", "s3cmd"}
+
+// wantsHTML reports whether the request comes from a web browser rather than
+// an S3 client, based on the Accept header and User-Agent
+func wantsHTML(r *http.Request) bool {
+	userAgent := strings.ToLower(r.Header.Get("User-Agent"))
+	for _, prefix := range sdkUserAgents {
+		if strings.HasPrefix(userAgent, prefix) {
+			return false
+		}
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func (s *S3Server) handleBrowserIndex(w http.ResponseWriter, r *http.Request) {
+	buckets, err := s.listBuckets()
+	if err != nil {
+		slog.Error("failed to list buckets", "error", err)
+		if isPermissionError(err) {
+			writeListAccessDenied(w, r, ".")
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := browserIndexTemplate.Execute(w, buckets); err != nil {
+		slog.Error("failed to render browser index", "error", err)
+	}
+}
+
+// notFoundPage is the -not-found-document served to web browsers asking for a
+// missing object, like the error document of an S3 static website
+type notFoundPage struct {
+	body        []byte
+	contentType string
+}
+
+func loadNotFoundPage(file string) (*notFoundPage, error) {
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(file))
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+	return &notFoundPage{body: body, contentType: contentType}, nil
+}
+
+func (p *notFoundPage) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", p.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(p.body)))
+	w.WriteHeader(http.StatusNotFound)
+	if _, err := w.Write(p.body); err != nil {
+		slog.Debug("failed to write not found page", "error", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBrowserIndex(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/photos/cat.jpg": "meow"})
+	s := newTestServer(t, f, "-subdir-buckets", "-browser-index")
+
+	const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+	tests := []struct {
+		name      string
+		accept    string
+		userAgent string
+		wantHTML  bool
+	}{
+		{"browser", browserAccept, "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0", true},
+		{"sdk", browserAccept, "aws-sdk-go-v2/1.30.0 os/linux", false},
+		{"cli", "application/xml", "aws-cli/2.15.0", false},
+		{"no accept header", "", "curl/8.5.0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept", tt.accept)
+			r.Header.Set("User-Agent", tt.userAgent)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+			}
+			contentType := w.Header().Get("Content-Type")
+			if got := strings.HasPrefix(contentType, "text/html"); got != tt.wantHTML {
+				t.Fatalf("Content-Type = %q, want HTML %v", contentType, tt.wantHTML)
+			}
+			want := "<Name>photos</Name>"
+			if tt.wantHTML {
+				want = "<li>photos</li>"
+			}
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("body doesn't contain %s: %s", want, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets")
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", browserAccept)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/xml" {
+			t.Errorf("Content-Type = %q, want application/xml", contentType)
+		}
+	})
+
+	t.Run("favicon", func(t *testing.T) {
+		if w := serve(s, http.MethodGet, "/favicon.ico", ""); w.Code != http.StatusNoContent {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusNoContent)
+		}
+	})
+}
+
+func TestNotFoundDocument(t *testing.T) {
+	const page = "<h1>Nothing here</h1>"
+	document := filepath.Join(t.TempDir(), "404.html")
+	if err := os.WriteFile(document, []byte(page), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f := startFakeFTP(t, map[string]string{"/photos/cat.jpg": "meow"})
+	s := newTestServer(t, f, "-subdir-buckets", "-not-found-document", document)
+
+	const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+	request := func(s *S3Server, method, target, accept, userAgent string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("Accept", accept)
+		r.Header.Set("User-Agent", userAgent)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	wantNoSuchKey := func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		var doc S3Error
+		if err := xml.Unmarshal(w.Body.Bytes(), &doc); err != nil || w.Code != http.StatusNotFound || doc.Code != "NoSuchKey" {
+			t.Errorf("status = %d, want NoSuchKey XML: %s", w.Code, w.Body.String())
+		}
+	}
+
+	t.Run("browser", func(t *testing.T) {
+		w := request(s, http.MethodGet, "/photos/dog.jpg", browserAccept, "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0")
+		if w.Code != http.StatusNotFound || w.Body.String() != page {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+			t.Errorf("Content-Type = %q, want text/html", contentType)
+		}
+	})
+
+	t.Run("browser HEAD", func(t *testing.T) {
+		w := request(s, http.MethodHead, "/photos/dog.jpg", browserAccept, "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0")
+		if w.Code != http.StatusNotFound || w.Body.Len() != 0 {
+			t.Errorf("status = %d, body %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("sdk", func(t *testing.T) {
+		wantNoSuchKey(t, request(s, http.MethodGet, "/photos/dog.jpg", browserAccept, "aws-sdk-go-v2/1.30.0 os/linux"))
+		wantNoSuchKey(t, request(s, http.MethodGet, "/photos/dog.jpg", "", "curl/8.5.0"))
+	})
+
+	t.Run("existing object", func(t *testing.T) {
+		w := request(s, http.MethodGet, "/photos/cat.jpg", browserAccept, "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0")
+		if w.Code != http.StatusOK || w.Body.String() != "meow" {
+			t.Errorf("status = %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// bucketNamePattern follows the S3 naming rules for new buckets
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// bucketDefaults are headers applied to a bucket's objects unless their own
+// metadata sets them
+type bucketDefaults struct {
+	CacheControl string
+	ContentType  string
+	StorageClass string
+}
+
+// bucketConfig is a bucket's entry in the bucket map
+type bucketConfig struct {
+	root     string
+	defaults bucketDefaults
+}
+
+// LoadBucketMap reads bucket to FTP directory mappings from file, one
+// "bucket = path" pair per line, optionally followed by default headers as
+// "; name=value" options, e.g.
+//
+//	assets = www/assets; cache-control=max-age=86400; content-type=text/css
+//
+// Blank lines and lines starting with # are ignored. Paths are relative to
+// the FTP login directory, "." maps a bucket to the login directory itself.
+func LoadBucketMap(file string) (map[string]bucketConfig, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buckets := make(map[string]bucketConfig)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, dir, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected bucket = path", file, lineNo)
+		}
+		dir, options, _ := strings.Cut(dir, ";")
+		name = strings.TrimSpace(name)
+		dir = strings.TrimSpace(dir)
+		if !bucketNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("%s:%d: invalid bucket name %q", file, lineNo, name)
+		}
+		if _, exists := buckets[name]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate bucket %q", file, lineNo, name)
+		}
+		root, err := cleanBucketRoot(dir)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, lineNo, err)
+		}
+		defaults, err := parseBucketDefaults(options)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, lineNo, err)
+		}
+		buckets[name] = bucketConfig{root: root, defaults: defaults}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("%s: no buckets defined", file)
+	}
+	return buckets, nil
+}
+
+// parseBucketDefaults parses the "; name=value" options of a bucket map line
+func parseBucketDefaults(options string) (bucketDefaults, error) {
+	var defaults bucketDefaults
+	for _, option := range strings.Split(options, ";") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return defaults, fmt.Errorf("invalid option %q, expected name=value", option)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "cache-control":
+			defaults.CacheControl = value
+		case "content-type":
+			defaults.ContentType = value
+		case "storage-class":
+			value = strings.ToUpper(value)
+			if !validStorageClasses[value] {
+				return defaults, fmt.Errorf("unknown storage class %q", value)
+			}
+			defaults.StorageClass = value
+		default:
+			return defaults, fmt.Errorf("unknown option %q", name)
+		}
+	}
+	return defaults, nil
+}
+
+// cleanBucketRoot normalizes a mapped FTP directory, refusing paths that
+// escape the login directory
+func cleanBucketRoot(dir string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("empty path")
+	}
+	for _, part := range strings.Split(dir, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("path %q escapes the FTP root", dir)
+		}
+	}
+	return strings.TrimPrefix(path.Clean("/"+dir), "/"), nil
+}
+
+// ReloadBucketMap reloads -bucket-map and swaps it in atomically, requests
+// already in flight keep the mapping they resolved their bucket with. The
+// current mapping stays in place when the file is invalid.
+func (s *S3Server) ReloadBucketMap() error {
+	buckets, err := LoadBucketMap(s.config.BucketMapFile)
+	if err != nil {
+		return err
+	}
+	var previous map[string]bucketConfig
+	if old := s.bucketMap.Swap(&buckets); old != nil {
+		previous = *old
+	}
+
+	added, removed, changed := diffBucketMaps(previous, buckets)
+	slog.Info("reloaded bucket mappings",
+		"buckets", len(buckets),
+		"added", added,
+		"removed", removed,
+		"changed", changed,
+	)
+	return nil
+}
+
+// diffBucketMaps returns the sorted names of buckets added, removed and
+// remapped between two mappings
+func diffBucketMaps(previous, current map[string]bucketConfig) (added, removed, changed []string) {
+	for name, bucket := range current {
+		if old, ok := previous[name]; !ok {
+			added = append(added, name)
+		} else if old != bucket {
+			changed = append(changed, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := current[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+// mappedBuckets returns the current bucket map snapshot, nil when no
+// -bucket-map is configured
+func (s *S3Server) mappedBuckets() map[string]bucketConfig {
+	if buckets := s.bucketMap.Load(); buckets != nil {
+		return *buckets
+	}
+	return nil
+}
+
+// bucketDefaults returns the default headers of bucket, which only mapped
+// buckets have
+func (s *S3Server) bucketDefaults(bucket string) bucketDefaults {
+	return s.mappedBuckets()[bucket].defaults
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWithinRoot(t *testing.T) {
+	tests := []struct {
+		root, ftpPath string
+		want          bool
+	}{
+		{"", "file.txt", true},
+		{"", "dir/file.txt", true},
+		{"", "..", false},
+		{"", "../other/file.txt", false},
+		{"", "/etc/passwd", false},
+		{"data/alpha", "data/alpha/file.txt", true},
+		{"data/alpha", "data/alpha", true},
+		{"data/alpha", "data/beta/file.txt", false},
+		{"data/alpha", "data/alphabet/file.txt", false},
+		{"data/alpha", "data", false},
+	}
+	for _, tt := range tests {
+		if got := withinRoot(tt.root, tt.ftpPath); got != tt.want {
+			t.Errorf("withinRoot(%q, %q) = %v, want %v", tt.root, tt.ftpPath, got, tt.want)
+		}
+	}
+}
+
+func TestBucketMapIsolation(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/data/alpha/file.txt": "alpha",
+		"/data/beta/file.txt":  "beta",
+		"/data/shared.txt":     "shared",
+	})
+	mapFile := filepath.Join(t.TempDir(), "buckets.conf")
+	if err := os.WriteFile(mapFile, []byte("alpha = data/alpha\nbeta = data/beta\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, f, "-bucket-map", mapFile)
+
+	tests := []struct {
+		method string
+		target string
+		want   int
+	}{
+		{http.MethodGet, "/alpha/file.txt", http.StatusOK},
+		{http.MethodGet, "/beta/file.txt", http.StatusOK},
+		{http.MethodGet, "/alpha/../beta/file.txt", http.StatusBadRequest},
+		{http.MethodGet, "/alpha/../shared.txt", http.StatusBadRequest},
+		{http.MethodGet, "/alpha/sub/../../beta/file.txt", http.StatusBadRequest},
+		{http.MethodGet, "/alpha//data/beta/file.txt", http.StatusNotFound},
+		{http.MethodPut, "/alpha/../beta/file.txt", http.StatusBadRequest},
+		{http.MethodDelete, "/alpha/../beta/file.txt", http.StatusBadRequest},
+		{http.MethodGet, "/alpha?prefix=../beta/", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			w := serve(s, tt.method, tt.target, "replaced")
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+
+	if body, ok := f.file("/data/beta/file.txt"); !ok || body != "beta" {
+		t.Errorf("beta's object was changed through alpha: %q, exists %v", body, ok)
+	}
+}
+
+func TestBucketDefaults(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/www/assets/logo":      "logo",
+		"/downloads/setup.bin":  "setup",
+		"/downloads/readme.txt": "readme",
+	})
+	mapFile := filepath.Join(t.TempDir(), "buckets.conf")
+	config := "assets = www/assets; cache-control=max-age=86400; content-type=image/png\n" +
+		"downloads = downloads; cache-control=no-cache\n"
+	if err := os.WriteFile(mapFile, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, f, "-bucket-map", mapFile, "-sidecar-metadata")
+
+	tests := []struct {
+		target       string
+		cacheControl string
+		contentType  string
+	}{
+		{"/assets/logo", "max-age=86400", "image/png"},
+		{"/downloads/setup.bin", "no-cache", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			w := serve(s, method, tt.target, "")
+			if got := w.Header().Get("Cache-Control"); got != tt.cacheControl {
+				t.Errorf("%s %s: Cache-Control = %q, want %q", method, tt.target, got, tt.cacheControl)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("%s %s: Content-Type = %q, want %q", method, tt.target, got, tt.contentType)
+			}
+		}
+	}
+
+	// The object's own metadata wins over the bucket's default
+	r := httptest.NewRequest(http.MethodPut, "/downloads/cached.txt", strings.NewReader("cached"))
+	r.Header.Set("Cache-Control", "max-age=60")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+	if got := serve(s, http.MethodHead, "/downloads/cached.txt", "").Header().Get("Cache-Control"); got != "max-age=60" {
+		t.Errorf("Cache-Control = %q, want the object's own", got)
+	}
+
+	if err := os.WriteFile(mapFile, []byte("assets = www/assets; expires=never\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadBucketMap(mapFile); err == nil {
+		t.Error("unknown bucket option accepted")
+	}
+}
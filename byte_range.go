@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errRangeUnsatisfiable is returned for ranges starting beyond the object
+var errRangeUnsatisfiable = errors.New("range not satisfiable")
+
+// byteRange is an inclusive range of object bytes
+type byteRange struct {
+	start, end int64
+}
+
+func (r byteRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+// contentRange formats the Content-Range header of the range
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// parseRange resolves a Range header against an object of size bytes. Like
+// S3 it serves a single range only: nil is returned for headers that are
+// ignored, such as multiple ranges, other units, malformed values or an
+// unknown size, and the whole object is served instead.
+func parseRange(header string, size int64) (*byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || size < 0 || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil, nil
+	}
+
+	if first == "" {
+		// Suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return nil, nil
+		}
+		if n == 0 || size == 0 {
+			return nil, errRangeUnsatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return &byteRange{start: size - n, end: size - 1}, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return nil, nil
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return nil, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return nil, errRangeUnsatisfiable
+	}
+	return &byteRange{start: start, end: end}, nil
+}
+
+// limitedResponse reads at most a range's length from an FTP download and
+// closes the download with it
+type limitedResponse struct {
+	io.ReadCloser
+	r io.Reader
+}
+
+func newLimitedResponse(rc io.ReadCloser, n int64) limitedResponse {
+	return limitedResponse{ReadCloser: rc, r: io.LimitReader(rc, n)}
+}
+
+func (l limitedResponse) Read(p []byte) (int, error) {
+	return l.r.Read(p)
+}
+
+// SetDeadline lets the idle watchdog unblock the underlying data connection
+func (l limitedResponse) SetDeadline(t time.Time) error {
+	if conn, ok := l.ReadCloser.(interface{ SetDeadline(time.Time) error }); ok {
+		return conn.SetDeadline(t)
+	}
+	return nil
+}
+
+// getRange opens the bytes of rng of the object at ftpPath. Servers with REST
+// start the download at the offset. Without REST the object comes from the
+// range cache when it fits, and is otherwise read and discarded up to the
+// offset.
+func (s *S3Server) getRange(ftpPath string, rng *byteRange, size int64) (io.ReadCloser, error) {
+	reader, err := s.ftp.GetFrom(ftpPath, rng.start)
+	if err == nil {
+		return newLimitedResponse(reader, rng.length()), nil
+	}
+	if !errors.Is(err, errRESTUnsupported) {
+		return nil, err
+	}
+
+	if s.rangeCache.fits(size) {
+		file, err := s.rangeCache.open(ftpPath, size, s.ftp.Get)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := file.Seek(rng.start, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return newLimitedResponse(file, rng.length()), nil
+	}
+
+	reader, err = s.ftp.Get(ftpPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, reader, rng.start); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return newLimitedResponse(reader, rng.length()), nil
+}
+
+// rangeCacheEntry is an object downloaded in full for serving ranges
+type rangeCacheEntry struct {
+	name    string
+	size    int64
+	expires time.Time
+}
+
+// rangeCache keeps whole objects in temporary files for a short while, so
+// ranged GETs against servers without REST download each object once. The
+// files are bounded in total size and removed once expired; open files stay
+// readable after removal.
+type rangeCache struct {
+	maxSize int64
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*rangeCacheEntry
+	used    int64
+}
+
+func newRangeCache(maxSize int64, ttl time.Duration) *rangeCache {
+	return &rangeCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		entries: make(map[string]*rangeCacheEntry),
+	}
+}
+
+// fits reports whether an object of size bytes may be cached
+func (c *rangeCache) fits(size int64) bool {
+	return c != nil && size >= 0 && size <= c.maxSize
+}
+
+// open returns the cached copy of the object at ftpPath, downloading it with
+// get first when it isn't cached or its size changed
+func (c *rangeCache) open(ftpPath string, size int64, get func(string) (io.ReadCloser, error)) (*os.File, error) {
+	c.mu.Lock()
+	c.evictLocked(0)
+	if entry, ok := c.entries[ftpPath]; ok && entry.size == size {
+		file, err := os.Open(entry.name)
+		c.mu.Unlock()
+		if err == nil {
+			slog.Debug("serving range from cache", "path", ftpPath)
+		}
+		return file, err
+	}
+	c.mu.Unlock()
+
+	reader, err := get(ftpPath)
+	if err != nil {
+		return nil, err
+	}
+	spool, written, err := spoolToTempFile(reader)
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+	file := spool.(tempSpool).File
+	if written != size {
+		// Changed since its size was taken, serve it once without caching
+		slog.Debug("object changed while caching it for ranges", "path", ftpPath, "expected", size, "size", written)
+		os.Remove(file.Name())
+		return file, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(ftpPath)
+	c.evictLocked(written)
+	c.entries[ftpPath] = &rangeCacheEntry{name: file.Name(), size: written, expires: time.Now().Add(c.ttl)}
+	c.used += written
+	slog.Debug("cached object for ranges", "path", ftpPath, "size", written)
+	return file, nil
+}
+
+// evictLocked removes expired entries, then the entries expiring first until
+// need more bytes fit
+func (c *rangeCache) evictLocked(need int64) {
+	now := time.Now()
+	for ftpPath, entry := range c.entries {
+		if now.After(entry.expires) {
+			c.removeLocked(ftpPath)
+		}
+	}
+	for c.used+need > c.maxSize && len(c.entries) > 0 {
+		var oldest string
+		for ftpPath, entry := range c.entries {
+			if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+				oldest = ftpPath
+			}
+		}
+		c.removeLocked(oldest)
+	}
+}
+
+func (c *rangeCache) removeLocked(ftpPath string) {
+	entry, ok := c.entries[ftpPath]
+	if !ok {
+		return
+	}
+	os.Remove(entry.name)
+	c.used -= entry.size
+	delete(c.entries, ftpPath)
+}
+
+// invalidate drops the cached copy of an object that was overwritten or
+// deleted
+func (c *rangeCache) invalidate(ftpPath string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(ftpPath)
+}
+
+// flush drops every cached object and returns how many there were
+func (c *rangeCache) flush() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := len(c.entries)
+	for ftpPath := range c.entries {
+		c.removeLocked(ftpPath)
+	}
+	return n
+}
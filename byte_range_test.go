@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangedGet requests the bytes from start to end of target
+func rangedGet(handler http.Handler, target string, start, end int) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestRangesWithoutREST(t *testing.T) {
+	body := strings.Repeat("0123456789", 100)
+	f := startFakeFTP(t, map[string]string{"/bucket/object.bin": body})
+
+	tests := []struct {
+		name  string
+		args  []string
+		retrs int
+	}{
+		// Every range is read from the start and discarded up to its offset
+		{"without range cache", nil, 3},
+		// The object is downloaded once and ranges come from the temp file
+		{"range cache", []string{"-range-cache-size", "4096"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, f, append([]string{"-subdir-buckets"}, tt.args...)...)
+			before := f.retrCount()
+			for _, rng := range [][2]int{{10, 19}, {500, 504}, {995, 999}} {
+				w := rangedGet(s, "/bucket/object.bin", rng[0], rng[1])
+				if w.Code != http.StatusPartialContent {
+					t.Fatalf("range %v: status = %d: %s", rng, w.Code, w.Body.String())
+				}
+				if want := body[rng[0] : rng[1]+1]; w.Body.String() != want {
+					t.Errorf("range %v = %q, want %q", rng, w.Body.String(), want)
+				}
+			}
+			if retrs := f.retrCount() - before; retrs != tt.retrs {
+				t.Errorf("served with %d downloads, want %d", retrs, tt.retrs)
+			}
+		})
+	}
+}
+
+// BenchmarkParallelRangedGets downloads an object as concurrent ranged GETs,
+// each resuming with REST over a pooled connection of its own, so it speeds
+// up with the connections available
+func BenchmarkParallelRangedGets(b *testing.B) {
+	const size, parts = 1 << 20, 8
+	f := startFakeFTP(b, map[string]string{"/bucket/object.bin": strings.Repeat("x", size)})
+	f.mu.Lock()
+	f.rest, f.retrDelay = true, 5*time.Millisecond
+	f.mu.Unlock()
+
+	for _, conns := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("conns=%d", conns), func(b *testing.B) {
+			s := newTestServer(b, f, "-subdir-buckets", "-max-ftp-conns", fmt.Sprint(conns))
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for part := 0; part < parts; part++ {
+					wg.Add(1)
+					go func(start int) {
+						defer wg.Done()
+						w := rangedGet(s, "/bucket/object.bin", start, start+size/parts-1)
+						if w.Code != http.StatusPartialContent || w.Body.Len() != size/parts {
+							b.Errorf("range at %d: status %d, %d bytes", start, w.Code, w.Body.Len())
+						}
+					}(part * size / parts)
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
+
+func TestRangeAfterLate226(t *testing.T) {
+	// The body outgrows the socket buffers, so cutting it short fails the
+	// server's write
+	large := strings.Repeat("0123456789", 1<<20)
+	f := startFakeFTP(t, map[string]string{
+		"/bucket/large.bin": large,
+		"/bucket/small.txt": "small",
+	})
+	f.mu.Lock()
+	f.rest, f.late226 = true, true
+	f.mu.Unlock()
+	// One connection, so every request reuses the session of the range
+	s := newTestServer(t, f, "-subdir-buckets", "-max-ftp-conns", "1")
+
+	for i := 0; i < 3; i++ {
+		w := rangedGet(s, "/bucket/large.bin", 10, 19)
+		if w.Code != http.StatusPartialContent || w.Body.String() != "0123456789" {
+			t.Fatalf("range %d: status = %d, body %q", i, w.Code, w.Body.String())
+		}
+		w = serve(s, http.MethodGet, "/bucket/small.txt", "")
+		if w.Code != http.StatusOK || w.Body.String() != "small" {
+			t.Fatalf("GET after range %d: status = %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type listingCacheEntry struct {
+	files   []FileInfo
+	expires time.Time
+}
+
+// listingCache keeps recent directory listings keyed by cleaned FTP path
+type listingCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]listingCacheEntry
+}
+
+func newListingCache(ttl time.Duration) *listingCache {
+	return &listingCache{
+		ttl:     ttl,
+		entries: make(map[string]listingCacheEntry),
+	}
+}
+
+func (lc *listingCache) get(dir string) ([]FileInfo, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	entry, ok := lc.entries[dir]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(lc.entries, dir)
+		return nil, false
+	}
+	// Callers may sort or modify the result, so hand out a copy
+	return append([]FileInfo(nil), entry.files...), true
+}
+
+func (lc *listingCache) put(dir string, files []FileInfo) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.entries[dir] = listingCacheEntry{
+		files:   files,
+		expires: time.Now().Add(lc.ttl),
+	}
+}
+
+// invalidate drops the listings of every directory that may contain p,
+// since writes can also create intermediate directories
+func (lc *listingCache) invalidate(p string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	delete(lc.entries, p)
+	for dir := path.Dir(p); ; dir = path.Dir(dir) {
+		delete(lc.entries, dir)
+		if dir == "." || dir == "/" || !strings.Contains(dir, "/") {
+			delete(lc.entries, ".")
+			return
+		}
+	}
+}
+
+// flush drops every listing and returns how many there were
+func (lc *listingCache) flush() int {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	n := len(lc.entries)
+	lc.entries = make(map[string]listingCacheEntry)
+	return n
+}
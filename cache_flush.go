@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Caches that can be flushed on demand
+const (
+	CacheListing  = "listing"  // FTP directory listings
+	CacheMetadata = "metadata" // MD5 digests behind real ETags and Content-MD5
+	CacheDownload = "download" // whole objects kept for ranged GETs
+)
+
+var flushableCaches = []string{CacheListing, CacheMetadata, CacheDownload}
+
+// FlushCaches clears the named in-memory caches, all of them when none are
+// named, and returns how many entries each held. Every cache has its own
+// lock, so requests running meanwhile see either the old or no entry.
+func (s *S3Server) FlushCaches(caches []string) map[string]int {
+	if len(caches) == 0 {
+		caches = flushableCaches
+	}
+	flushed := make(map[string]int, len(caches))
+	for _, cache := range caches {
+		switch cache {
+		case CacheListing:
+			flushed[cache] = s.ftp.FlushListings()
+		case CacheMetadata:
+			flushed[cache] = s.digests.flush()
+		case CacheDownload:
+			flushed[cache] = s.rangeCache.flush()
+		}
+	}
+	slog.Info("flushed caches", "entries", flushed)
+	return flushed
+}
+
+// handleFlushCache serves POST /admin/flush-cache. The optional cache query
+// parameter selects caches as a comma-separated list.
+func (s *S3Server) handleFlushCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var caches []string
+	if selected := r.URL.Query().Get("cache"); selected != "" {
+		for _, cache := range strings.Split(selected, ",") {
+			cache = strings.TrimSpace(cache)
+			if cache != CacheListing && cache != CacheMetadata && cache != CacheDownload {
+				http.Error(w, "unknown cache \""+cache+"\", expected "+strings.Join(flushableCaches, ", "), http.StatusBadRequest)
+				return
+			}
+			caches = append(caches, cache)
+		}
+	}
+
+	flushed := s.FlushCaches(caches)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(map[string]map[string]int{"flushed": flushed}); err != nil {
+		slog.Error("failed to encode flush report", "error", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFlushCache(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/old.txt": "old"})
+	s := newTestServer(t, f, "-subdir-buckets", "-list-cache-ttl", "1h")
+	flush := func(query string) map[string]int {
+		t.Helper()
+		w := serve(s, http.MethodPost, adminPrefix+"flush-cache"+query, "")
+		var report struct {
+			Flushed map[string]int `json:"flushed"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		return report.Flushed
+	}
+	listed := func() string {
+		return serve(s, http.MethodGet, "/bucket?list-type=2", "").Body.String()
+	}
+
+	if w := serve(s, http.MethodPut, "/bucket/put.txt", "put"); w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+	listed()
+	// Written behind the gateway's back, the cached listing hides it
+	f.put("/bucket/new.txt", "new")
+	if strings.Contains(listed(), "new.txt") {
+		t.Fatal("listing wasn't cached")
+	}
+
+	if flushed := flush("?cache=listing"); flushed[CacheListing] == 0 || len(flushed) != 1 {
+		t.Errorf("flushed %v, want only listings", flushed)
+	}
+	if !strings.Contains(listed(), "new.txt") {
+		t.Error("cached listing survived the flush")
+	}
+	if _, ok := s.digests.etag("bucket/put.txt", 3); !ok {
+		t.Error("flushing listings dropped the digests")
+	}
+
+	if flushed := flush(""); flushed[CacheMetadata] != 1 {
+		t.Errorf("flushed %v, want the digest of put.txt", flushed)
+	}
+	if _, ok := s.digests.etag("bucket/put.txt", 3); ok {
+		t.Error("digest survived the flush")
+	}
+
+	if w := serve(s, http.MethodPost, adminPrefix+"flush-cache?cache=listing,everything", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown cache: status = %d", w.Code)
+	}
+	if w := serve(s, http.MethodGet, adminPrefix+"flush-cache", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status = %d", w.Code)
+	}
+
+	// Flushing while requests use the caches
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.FlushCaches(nil)
+		}()
+		go func() {
+			defer wg.Done()
+			listed()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// evaluatePreconditions applies If-Match, If-None-Match and If-Modified-Since
+// in the order of RFC 7232 section 6. file is nil when the object doesn't
+// exist. It returns http.StatusPreconditionFailed, http.StatusNotModified or 0
+// when the request goes on.
+//
+// ETags are compared weakly: synthetic ETags are weak validators, and a strong
+// If-Match comparison could never succeed for objects that weren't uploaded
+// through the gateway.
+func evaluatePreconditions(r *http.Request, file *FileInfo, etag string) int {
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	if header := r.Header.Get("If-Match"); header != "" {
+		if file == nil || !etagListMatches(header, etag) {
+			return http.StatusPreconditionFailed
+		}
+	}
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if file != nil && etagListMatches(header, etag) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+		// If-Modified-Since is ignored next to If-None-Match
+		return 0
+	}
+	if safe && file != nil && notModifiedSince(r, file.ModTime) {
+		return http.StatusNotModified
+	}
+	return 0
+}
+
+// etagListMatches reports whether an If-Match or If-None-Match list holds
+// etag, "*" matching any. The comparison is weak, ignoring W/ prefixes.
+func etagListMatches(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if opaqueTag(strings.TrimSpace(candidate)) == opaqueTag(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// opaqueTag strips the weakness indicator from an entity tag
+func opaqueTag(etag string) string {
+	return strings.TrimPrefix(etag, "W/")
+}
+
+// ifRangeMatches evaluates If-Range, which decides whether a Range applies.
+// RFC 7233 requires a strong match, so a weak ETag never matches and the
+// whole object is sent. A date matches the second-precise modification time.
+func ifRangeMatches(r *http.Request, etag string, weak bool, modTime time.Time) bool {
+	header := r.Header.Get("If-Range")
+	if header == "" {
+		return true
+	}
+	if strings.HasPrefix(header, `"`) || strings.HasPrefix(header, "W/") {
+		return !weak && header == etag
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
+		slog.Debug("ignoring Range with malformed If-Range", "value", header)
+		return false
+	}
+	return modTime.Truncate(time.Second).Equal(date)
+}
+
+// writePreconditionFailed answers a request whose If-Match or If-None-Match
+// condition didn't hold
+func writePreconditionFailed(w http.ResponseWriter, r *http.Request) {
+	writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed",
+		"At least one of the pre-conditions you specified did not hold", r.URL.Path)
+}
+
+// checkPutPreconditions evaluates If-Match and If-None-Match of a PUT against
+// the object it replaces, "If-None-Match: *" only creating new objects. It
+// reports whether the upload may go on, having answered the request if not.
+func (s *S3Server) checkPutPreconditions(w http.ResponseWriter, r *http.Request, ftpPath string) bool {
+	if r.Header.Get("If-Match") == "" && r.Header.Get("If-None-Match") == "" {
+		return true
+	}
+	file, err := s.statObjectExact(ftpPath)
+	if err != nil {
+		slog.Error("failed to stat object for conditional write", "path", ftpPath, "error", err)
+		writeInternalError(w, r, err)
+		return false
+	}
+	etag := ""
+	if file != nil {
+		if file.IsDir {
+			file = nil
+		} else {
+			etag = s.objectETag(ftpPath, file.Size, file.ModTime)
+		}
+	}
+	if evaluatePreconditions(r, file, etag) != 0 {
+		slog.Debug("rejecting conditional write", "path", ftpPath, "etag", etag)
+		writePreconditionFailed(w, r)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIfModifiedSince(t *testing.T) {
+	// The fake server reports every file modified at 2024-01-01 00:00:00 UTC
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "content"})
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"equal", "Mon, 01 Jan 2024 00:00:00 GMT", http.StatusNotModified},
+		{"numeric zone isn't an HTTP date", "Mon, 01 Jan 2024 01:00:00 +0100", http.StatusOK},
+		{"before", "Sun, 31 Dec 2023 23:59:59 GMT", http.StatusOK},
+		{"after", "Sat, 01 Jun 2024 12:00:00 GMT", http.StatusNotModified},
+		{"future", time.Now().Add(24 * time.Hour).UTC().Format(http.TimeFormat), http.StatusOK},
+		{"malformed", "yesterday", http.StatusOK},
+		{"RFC 850", "Monday, 01-Jan-24 00:00:00 GMT", http.StatusNotModified},
+		{"ANSI C", "Mon Jan  1 00:00:00 2024", http.StatusNotModified},
+	}
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		for _, tt := range tests {
+			t.Run(method+" "+tt.name, func(t *testing.T) {
+				r := httptest.NewRequest(method, "/bucket/file.txt", nil)
+				r.Header.Set("If-Modified-Since", tt.header)
+				w := httptest.NewRecorder()
+				s.ServeHTTP(w, r)
+				if w.Code != tt.want {
+					t.Fatalf("status = %d, want %d", w.Code, tt.want)
+				}
+				if tt.want == http.StatusNotModified && w.Body.Len() != 0 {
+					t.Errorf("304 has a body: %q", w.Body.String())
+				}
+			})
+		}
+	}
+}
+
+func TestNotModifiedSinceSubsecond(t *testing.T) {
+	// HTTP dates have whole seconds, the fraction of the modification time
+	// mustn't make the object look newer
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 500_000_000, time.UTC)
+	r := httptest.NewRequest(http.MethodGet, "/bucket/file.txt", nil)
+	r.Header.Set("If-Modified-Since", "Mon, 01 Jan 2024 00:00:00 GMT")
+	if !notModifiedSince(r, modTime) {
+		t.Error("object modified within the second of If-Modified-Since counts as modified")
+	}
+}
+
+func TestWeakETags(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "content"})
+	s := newTestServer(t, f, "-subdir-buckets", "-weak-etags")
+
+	request := func(method, target string, header map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// A file written behind the gateway's back only has a synthetic ETag
+	weak := request(http.MethodHead, "/bucket/file.txt", nil).Header().Get("ETag")
+	if !strings.HasPrefix(weak, `W/"`) {
+		t.Fatalf("ETag = %q, want a weak validator", weak)
+	}
+	strong := strings.TrimPrefix(weak, "W/")
+
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		want   int
+	}{
+		{"If-None-Match weak", http.MethodGet, map[string]string{"If-None-Match": weak}, http.StatusNotModified},
+		{"If-None-Match opaque", http.MethodHead, map[string]string{"If-None-Match": strong}, http.StatusNotModified},
+		{"If-None-Match list", http.MethodGet, map[string]string{"If-None-Match": `"other", ` + weak}, http.StatusNotModified},
+		{"If-Match weak", http.MethodGet, map[string]string{"If-Match": weak}, http.StatusOK},
+		{"If-Match mismatch", http.MethodGet, map[string]string{"If-Match": `W/"other"`}, http.StatusPreconditionFailed},
+		// A strong comparison never holds for a weak ETag, so the whole object is sent
+		{"If-Range weak", http.MethodGet, map[string]string{"Range": "bytes=0-2", "If-Range": weak}, http.StatusOK},
+		{"If-Range opaque", http.MethodGet, map[string]string{"Range": "bytes=0-2", "If-Range": strong}, http.StatusOK},
+		{"If-Range date", http.MethodGet, map[string]string{"Range": "bytes=0-2", "If-Range": "Mon, 01 Jan 2024 00:00:00 GMT"}, http.StatusPartialContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(tt.method, "/bucket/file.txt", tt.header)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("PUT If-None-Match *", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPut, "/bucket/file.txt", strings.NewReader("replaced"))
+		r.Header.Set("If-None-Match", "*")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusPreconditionFailed {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusPreconditionFailed)
+		}
+		if got, _ := f.file("/bucket/file.txt"); got != "content" {
+			t.Errorf("object = %q, want it untouched", got)
+		}
+	})
+
+	t.Run("strong after upload", func(t *testing.T) {
+		w := serve(s, http.MethodPut, "/bucket/uploaded.txt", "uploaded")
+		if w.Code != http.StatusOK {
+			t.Fatalf("PUT status = %d: %s", w.Code, w.Body.String())
+		}
+		etag := w.Header().Get("ETag")
+		if strings.HasPrefix(etag, "W/") {
+			t.Fatalf("ETag of an upload = %q, want a strong validator", etag)
+		}
+		got := request(http.MethodGet, "/bucket/uploaded.txt", map[string]string{"Range": "bytes=0-2", "If-Range": etag})
+		if got.Code != http.StatusPartialContent || got.Body.String() != "upl" {
+			t.Errorf("status = %d, body %q, want the range", got.Code, got.Body.String())
+		}
+	})
+}
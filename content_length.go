@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// needsContentLength reports whether a GET response must carry a fixed
+// Content-Length instead of being streamed with chunked encoding. HTTP/1.0
+// has no chunked encoding, and some proxies in front of HTTP/1.1 clients
+// don't handle it either.
+func (s *S3Server) needsContentLength(r *http.Request) bool {
+	return s.config.ForceContentLength || !r.ProtoAtLeast(1, 1)
+}
+
+// objectSize determines the size of the object at path with SIZE, falling
+// back to its directory listing. It returns -1 when the size is unknown.
+func (s *S3Server) objectSize(path string) int64 {
+	size, err := s.ftp.FileSize(path)
+	if err == nil {
+		return size
+	}
+	slog.Debug("SIZE failed, falling back to listing", "path", path, "error", err)
+
+	file, err := s.statObject(path)
+	if err != nil || file == nil {
+		slog.Debug("failed to determine object size", "path", path, "error", err)
+		return -1
+	}
+	return file.Size
+}
+
+// tempSpool is a temporary file that is removed when closed
+type tempSpool struct {
+	*os.File
+}
+
+func (t tempSpool) Close() error {
+	err := t.File.Close()
+	os.Remove(t.Name())
+	return err
+}
+
+// spoolToTempFile copies r into a temporary file to learn its size, the last
+// resort when neither SIZE nor LIST report it
+func spoolToTempFile(r io.Reader) (io.ReadCloser, int64, error) {
+	f, err := os.CreateTemp("", "ftp-over-s3-spool-")
+	if err != nil {
+		return nil, 0, err
+	}
+	spool := tempSpool{f}
+
+	size, err := io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spool.Close()
+		return nil, 0, err
+	}
+	return spool, size, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+	// ended is whether the reader got to the end of its data or failed,
+	// rather than being abandoned by its consumer
+	ended bool
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil {
+		c.ended = true
+	}
+	return n, err
+}
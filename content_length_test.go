@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFixedContentLength(t *testing.T) {
+	// Larger than net/http buffers, so it can't set Content-Length itself
+	body := strings.Repeat("x", 256<<10)
+	f := startFakeFTP(t, map[string]string{"/bucket/big.txt": body})
+
+	get := func(t *testing.T, s *S3Server, proto string) *http.Response {
+		t.Helper()
+		server := httptest.NewServer(s)
+		t.Cleanup(server.Close)
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "GET /bucket/big.txt %s\r\nHost: gateway\r\n\r\n", proto)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		if err != nil || string(data) != body {
+			t.Fatalf("read %d bytes: %v", len(data), err)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name  string
+		proto string
+		args  []string
+	}{
+		{"HTTP/1.0", "HTTP/1.0", nil},
+		{"HTTP/1.1 forced", "HTTP/1.1", []string{"-force-content-length"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, f, append([]string{"-subdir-buckets"}, tt.args...)...)
+			resp := get(t, s, tt.proto)
+			if resp.ContentLength != int64(len(body)) || len(resp.TransferEncoding) > 0 {
+				t.Errorf("Content-Length = %d, Transfer-Encoding %v, want a fixed length of %d",
+					resp.ContentLength, resp.TransferEncoding, len(body))
+			}
+		})
+	}
+}
+
+func TestSpoolToTempFile(t *testing.T) {
+	spool, size, err := spoolToTempFile(strings.NewReader("spooled"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := spool.(tempSpool).Name()
+	data, err := io.ReadAll(spool)
+	if err != nil || string(data) != "spooled" || size != int64(len(data)) {
+		t.Errorf("spooled %q of size %d: %v", data, size, err)
+	}
+	spool.Close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// copySourceHeader names the object a PUT copies instead of reading its body
+const copySourceHeader = "x-amz-copy-source"
+
+// moveHeader set to "true" turns a copy into a move, removing the source.
+// Within a bucket the source is renamed on the FTP server, moving no data.
+const moveHeader = "x-ftp-s3-move"
+
+// S3 CopyObject XML structure
+type CopyObjectResult struct {
+	XMLName      xml.Name  `xml:"CopyObjectResult"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+}
+
+// parseCopySource splits an x-amz-copy-source value, "/bucket/key" or
+// "bucket/key" URL-encoded and optionally followed by ?versionId=, into
+// bucket and key
+func parseCopySource(header string) (bucket, key string, ok bool) {
+	source, _, _ := strings.Cut(header, "?")
+	source, err := url.PathUnescape(strings.TrimPrefix(source, "/"))
+	if err != nil {
+		return "", "", false
+	}
+	bucket, key = splitBucketKey("/" + source)
+	return bucket, key, bucket != "" && key != ""
+}
+
+// streamBetween returns r for storing while it is still being read from FTP,
+// which needs a download and an upload connection at once. When too many
+// transfers already do so r is spooled to a local temporary file first and
+// source, the download behind r, is closed to free its connection before the
+// upload waits for one. The returned function ends the transfer.
+func (s *S3Server) streamBetween(r io.Reader, source io.Closer) (io.Reader, func(), error) {
+	if release, ok := s.ftp.ReserveStream(); ok {
+		return r, release, nil
+	}
+	spool, _, err := spoolToTempFile(r)
+	source.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	return spool, func() { spool.Close() }, nil
+}
+
+// handleCopyObject serves a PUT with x-amz-copy-source by downloading the
+// source from FTP and storing it at the destination
+func (s *S3Server) handleCopyObject(w http.ResponseWriter, r *http.Request) {
+	dstPath, ok := s.resolveObject(w, r)
+	if !ok {
+		return
+	}
+	if !checkSSE(w, r) {
+		return
+	}
+
+	srcBucket, srcKey, ok := parseCopySource(r.Header.Get(copySourceHeader))
+	if !ok {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument",
+			"Copy Source must mention the source bucket and key: sourcebucket/sourcekey", r.URL.Path)
+		return
+	}
+	if escapesBucket(srcBucket + "/" + srcKey) {
+		slog.Warn("rejecting copy source escaping its bucket", "source", r.Header.Get(copySourceHeader), "remote_addr", r.RemoteAddr)
+		writeInvalidKey(w, r)
+		return
+	}
+	srcRoot, ok := s.bucketRoot(srcBucket)
+	if !ok {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist", "/"+srcBucket)
+		return
+	}
+	srcPath := s.objectPath(srcRoot, srcKey)
+	if !withinRoot(srcRoot, srcPath) {
+		slog.Warn("rejecting copy source escaping its bucket", "source", r.Header.Get(copySourceHeader), "remote_addr", r.RemoteAddr)
+		writeInvalidKey(w, r)
+		return
+	}
+
+	// Metadata is copied unless the request replaces it
+	replace := r.Header.Get("x-amz-metadata-directive") == "REPLACE"
+	meta := metadataFromRequest(r)
+	if !replace {
+		meta = s.readMetadata(srcPath)
+	} else if meta.userMetadataSize() > maxUserMetadataSize {
+		writeS3Error(w, http.StatusBadRequest, "MetadataTooLarge",
+			"Your metadata headers exceed the maximum allowed metadata size", r.URL.Path)
+		return
+	}
+
+	if srcPath == dstPath {
+		if !replace {
+			writeS3Error(w, http.StatusBadRequest, "InvalidRequest",
+				"This copy request is illegal because it is trying to copy an object to itself without changing the object's metadata, storage class, website redirect location or encryption attributes.", r.URL.Path)
+			return
+		}
+		s.replaceMetadata(w, r, dstPath, meta)
+		return
+	}
+
+	unlock := s.lockWrite(r, dstPath)
+	defer unlock()
+	if !s.checkWORMOverwrite(w, r, dstPath) {
+		return
+	}
+
+	move := strings.EqualFold(r.Header.Get(moveHeader), "true")
+	if move {
+		// Moving removes the source, which write-once buckets protect
+		if reason := s.wormDeleteError(srcBucket, srcPath); reason != "" {
+			writeS3Error(w, http.StatusForbidden, "AccessDenied", reason, r.URL.Path)
+			return
+		}
+		dstBucket, _ := splitBucketKey(r.URL.Path)
+		if dstBucket == srcBucket && s.renameObject(srcPath, dstPath) {
+			s.finishMove(w, r, srcPath, dstPath, meta)
+			return
+		}
+	}
+
+	reader, err := s.ftp.Get(srcPath)
+	if err != nil {
+		if strings.Contains(err.Error(), "550") {
+			slog.Debug("copy source not found", "path", srcPath, "error", err)
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.", "/"+srcBucket+"/"+srcKey)
+			return
+		}
+		slog.Error("failed to read copy source", "path", srcPath, "error", err)
+		writeInternalError(w, r, err)
+		return
+	}
+	slog.Debug("copying object", "source", srcPath, "destination", dstPath)
+
+	s.writeBuffer.Cancel(dstPath)
+	s.rangeCache.invalidate(dstPath)
+
+	digest := newDigestReader(reader)
+	body, cleanup, err := s.streamBetween(digest, reader)
+	if err == nil {
+		err = s.ftp.Put(dstPath, body)
+		cleanup()
+	}
+	reader.Close()
+	if err == nil && s.config.VerifyUploads {
+		err = s.ftp.VerifyUpload(dstPath, digest.size)
+	}
+	if err != nil {
+		s.digests.remove(dstPath)
+		slog.Error("failed to copy object", "source", srcPath, "destination", dstPath, "error", err)
+		switch {
+		case isQuotaError(err):
+			writeS3Error(w, http.StatusInsufficientStorage, "QuotaExceeded",
+				"The FTP server has no storage space left for this object", r.URL.Path)
+		case errors.Is(err, errUploadUnverified):
+			writeUploadUnverified(w, r)
+		default:
+			writeInternalError(w, r, err)
+		}
+		return
+	}
+	sum := digest.digest()
+	s.digests.put(dstPath, sum)
+
+	if err := s.writeMetadata(dstPath, meta); err != nil {
+		slog.Error("failed to store object metadata", "path", dstPath, "error", err)
+		writeInternalError(w, r, err)
+		return
+	}
+	s.chmodUpload(r, dstPath)
+	s.siteAfterUpload(dstPath)
+
+	if move {
+		if err := s.deleteObject(srcPath); err != nil {
+			slog.Error("failed to remove moved object", "path", srcPath, "error", err)
+			writeInternalError(w, r, err)
+			return
+		}
+		s.digests.remove(srcPath)
+		s.removeMetadata(srcPath)
+	}
+
+	writeCopyObjectResult(w, time.Now(), digestETag(sum.md5))
+}
+
+// renameObject moves the object at srcPath to dstPath with an FTP rename. It
+// reports whether that worked; the caller copies the data instead otherwise.
+func (s *S3Server) renameObject(srcPath, dstPath string) bool {
+	s.writeBuffer.Cancel(dstPath)
+	s.rangeCache.invalidate(dstPath)
+	if err := s.ftp.Rename(srcPath, dstPath); err != nil {
+		slog.Warn("failed to rename object, copying it instead", "source", srcPath, "destination", dstPath, "error", err)
+		return false
+	}
+	slog.Debug("renamed object", "source", srcPath, "destination", dstPath)
+	s.rangeCache.invalidate(srcPath)
+	s.digests.move(srcPath, dstPath)
+	return true
+}
+
+// finishMove stores the metadata of an object renamed by renameObject, whose
+// sidecar stays behind at the source, and answers the copy request
+func (s *S3Server) finishMove(w http.ResponseWriter, r *http.Request, srcPath, dstPath string, meta objectMetadata) {
+	s.removeMetadata(srcPath)
+	if err := s.writeMetadata(dstPath, meta); err != nil {
+		slog.Error("failed to store object metadata", "path", dstPath, "error", err)
+		writeInternalError(w, r, err)
+		return
+	}
+	s.chmodUpload(r, dstPath)
+	s.siteAfterUpload(dstPath)
+
+	modTime, etag := time.Now(), ""
+	if file := s.objectInfo(dstPath); file != nil {
+		modTime, etag = file.ModTime, s.objectETag(dstPath, file.Size, file.ModTime)
+	}
+	writeCopyObjectResult(w, modTime, etag)
+}
+
+// replaceMetadata serves a copy of an object onto itself, which only
+// replaces its metadata
+func (s *S3Server) replaceMetadata(w http.ResponseWriter, r *http.Request, ftpPath string, meta objectMetadata) {
+	file := s.objectInfo(ftpPath)
+	if file == nil {
+		s.writeNoSuchKey(w, r)
+		return
+	}
+	if !s.config.SidecarMetadata {
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented",
+			"Replacing object metadata requires -sidecar-metadata", r.URL.Path)
+		return
+	}
+	if err := s.writeMetadata(ftpPath, meta); err != nil {
+		slog.Error("failed to store object metadata", "path", ftpPath, "error", err)
+		writeInternalError(w, r, err)
+		return
+	}
+	writeCopyObjectResult(w, file.ModTime, s.objectETag(ftpPath, file.Size, file.ModTime))
+}
+
+func writeCopyObjectResult(w http.ResponseWriter, modTime time.Time, etag string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-amz-version-id", "null") // Buckets are unversioned
+	if err := xml.NewEncoder(w).Encode(CopyObjectResult{
+		LastModified: modTime.UTC(),
+		ETag:         etag,
+	}); err != nil {
+		slog.Error("failed to encode XML response", "error", err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCopyObjectSourceTraversal(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/public/a.txt":   "a",
+		"/private/secret": "classified",
+		"/outside.txt":    "outside",
+	})
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	tests := []struct {
+		source string
+		want   int
+	}{
+		{"/public/a.txt", http.StatusOK},
+		{"/public/../private/secret", http.StatusBadRequest},
+		{"public/%2e%2e/private/secret", http.StatusBadRequest},
+		{"/public/dir/../../outside.txt", http.StatusBadRequest},
+		{"/../outside.txt", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/public/copy.txt", nil)
+			r.Header.Set(copySourceHeader, tt.source)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if body, _ := f.file("/public/copy.txt"); tt.want != http.StatusOK && body != "a" {
+				t.Errorf("copy of a rejected source stored %q", body)
+			}
+		})
+	}
+}
+
+func TestConcurrentCopiesSmallPool(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/source.txt": "source"})
+	s := newTestServer(t, f, "-subdir-buckets", "-max-ftp-conns", "2")
+
+	const copies = 8
+	var wg sync.WaitGroup
+	codes := make(chan int, copies)
+	for i := 0; i < copies; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/bucket/copy-%d.txt", i), nil)
+			r.Header.Set(copySourceHeader, "/bucket/source.txt")
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			codes <- w.Code
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("concurrent copies deadlocked on the connection pool")
+	}
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("copy failed with status %d", code)
+		}
+	}
+}
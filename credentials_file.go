@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// credentialsEntry is one key pair of a JSON credentials file
+type credentialsEntry struct {
+	AccessKeyID string `json:"accessKeyId"`
+	SecretKey   string `json:"secretKey"`
+}
+
+// LoadCredentialsFile reads S3 key pairs from a JSON file, an array of
+// {"accessKeyId": ..., "secretKey": ...} objects, or, for any other
+// extension, a CSV file of accessKeyId,secretKey lines. A CSV header line
+// naming the columns is skipped, as are lines starting with #. A file
+// without any key pair is an error.
+func LoadCredentialsFile(file string) (map[string]Credentials, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []credentialsEntry
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		if err := json.NewDecoder(f).Decode(&entries); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	} else {
+		reader := csv.NewReader(f)
+		reader.Comment = '#'
+		reader.FieldsPerRecord = 2
+		reader.TrimLeadingSpace = true
+		for {
+			record, err := reader.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", file, err)
+			}
+			if len(entries) == 0 && strings.EqualFold(record[0], "accessKeyId") {
+				continue
+			}
+			entries = append(entries, credentialsEntry{AccessKeyID: record[0], SecretKey: record[1]})
+		}
+	}
+
+	// An empty file would silently turn authentication off
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no credentials", file)
+	}
+	creds := make(map[string]Credentials, len(entries))
+	for i, entry := range entries {
+		if entry.AccessKeyID == "" || entry.SecretKey == "" {
+			return nil, fmt.Errorf("%s: entry %d: access key ID and secret key are required", file, i+1)
+		}
+		if _, exists := creds[entry.AccessKeyID]; exists {
+			return nil, fmt.Errorf("%s: duplicate access key ID %q", file, entry.AccessKeyID)
+		}
+		creds[entry.AccessKeyID] = Credentials{AccessKeyID: entry.AccessKeyID, SecretAccessKey: entry.SecretKey}
+	}
+	return creds, nil
+}
+
+// Load replaces the store's key pairs with those of -credentials-file and
+// the -access-key-id/-secret-key pair. The store is left unchanged when the
+// file can't be loaded.
+func (store *CredentialsStore) Load(config *Config) error {
+	creds := make(map[string]Credentials)
+	if config.CredentialsFile != "" {
+		loaded, err := LoadCredentialsFile(config.CredentialsFile)
+		if err != nil {
+			return err
+		}
+		creds = loaded
+	}
+	if config.AccessKeyID != "" && config.SecretKey != "" {
+		creds[config.AccessKeyID] = Credentials{AccessKeyID: config.AccessKeyID, SecretAccessKey: config.SecretKey}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.credentials = creds
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCredentialsFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    int
+		wantErr bool
+	}{
+		{"json", "creds.json", `[{"accessKeyId": "a", "secretKey": "s"}, {"accessKeyId": "b", "secretKey": "t"}]`, 2, false},
+		{"csv", "creds.csv", "accessKeyId,secretKey\na,s\n# comment\nb,t\n", 2, false},
+		{"empty json array", "creds.json", "[]", 0, true},
+		{"json null", "creds.json", "null", 0, true},
+		{"csv header only", "creds.csv", "accessKeyId,secretKey\n", 0, true},
+		{"empty csv", "creds.csv", "", 0, true},
+		{"csv comments only", "creds.csv", "# nobody\n", 0, true},
+		{"missing secret", "creds.json", `[{"accessKeyId": "a"}]`, 0, true},
+		{"duplicate key", "creds.csv", "a,s\na,t\n", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(file, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			creds, err := LoadCredentialsFile(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(creds) != tt.want {
+				t.Errorf("loaded %d key pairs, want %d", len(creds), tt.want)
+			}
+		})
+	}
+}
+
+func TestCredentialsReloadKeepsPairsOfEmptyFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "creds.csv")
+	if err := os.WriteFile(file, []byte("a,s\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{CredentialsFile: file}
+	store := NewCredentialsStore()
+	if err := store.Load(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(file, []byte("accessKeyId,secretKey\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Load(config); err == nil {
+		t.Fatal("reloading an emptied credentials file succeeded")
+	}
+	if _, ok := store.GetCredentials("a"); !ok || store.Count() != 1 {
+		t.Errorf("reload dropped the current key pairs, %d left", store.Count())
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// maxDeleteObjects is the S3 limit on keys in a single DeleteObjects request
+const maxDeleteObjects = 1000
+
+// S3 DeleteObjects XML structures
+type ObjectIdentifier struct {
+	Key string `xml:"Key"`
+}
+
+type DeletedObject struct {
+	XMLName xml.Name `xml:"Deleted"`
+	Key     string   `xml:"Key"`
+}
+
+type DeleteError struct {
+	XMLName xml.Name `xml:"Error"`
+	Key     string   `xml:"Key"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// errTooManyObjects is returned when a delete request exceeds maxDeleteObjects
+var errTooManyObjects = errors.New("too many objects in delete request")
+
+// parseDeleteRequest reads the <Delete> document token by token, so at most
+// maxDeleteObjects keys are ever held in memory no matter how large the body
+// is. The quiet flag reports whether only errors should be returned.
+func parseDeleteRequest(body io.Reader) (keys []string, quiet bool, err error) {
+	decoder := xml.NewDecoder(body)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "Object":
+			if len(keys) == maxDeleteObjects {
+				return nil, false, errTooManyObjects
+			}
+			var object ObjectIdentifier
+			if err := decoder.DecodeElement(&object, &start); err != nil {
+				return nil, false, err
+			}
+			if object.Key == "" {
+				return nil, false, errors.New("object without a key")
+			}
+			keys = append(keys, object.Key)
+		case "Quiet":
+			if err := decoder.DecodeElement(&quiet, &start); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, false, errors.New("no objects in delete request")
+	}
+	return keys, quiet, nil
+}
+
+// deleteObject removes the object at ftpPath, dropping any upload of it still
+// waiting in the write buffer first
+func (s *S3Server) deleteObject(ftpPath string) error {
+	s.writeBuffer.Cancel(ftpPath)
+	s.rangeCache.invalidate(ftpPath)
+	return s.ftp.Delete(ftpPath)
+}
+
+// deleteError reports a key that failed to delete without failing the batch.
+// A missing file is NoSuchKey, a refused one AccessDenied.
+func deleteError(key, ftpPath string, err error) DeleteError {
+	switch {
+	case isPermissionError(err):
+		slog.Debug("permission denied deleting file", "path", ftpPath, "error", err)
+		return DeleteError{Key: key, Code: "AccessDenied", Message: "Access Denied"}
+	case strings.Contains(err.Error(), "550"):
+		slog.Debug("file to delete doesn't exist", "path", ftpPath, "error", err)
+		return DeleteError{Key: key, Code: "NoSuchKey", Message: "The specified key does not exist."}
+	}
+	slog.Error("failed to delete file from FTP",
+		"path", ftpPath,
+		"error", err,
+	)
+	return DeleteError{Key: key, Code: "InternalError", Message: err.Error()}
+}
+
+func (s *S3Server) handleDeleteObjects(w http.ResponseWriter, r *http.Request) {
+	bucket, root, ok := s.resolveBucket(w, r)
+	if !ok {
+		return
+	}
+
+	keys, quiet, err := parseDeleteRequest(r.Body)
+	if err != nil {
+		slog.Debug("invalid delete request", "bucket", bucket, "error", err)
+		message := "The XML you provided was not well-formed or did not validate against our published schema"
+		if errors.Is(err, errTooManyObjects) {
+			message = fmt.Sprintf("A delete request may contain at most %d objects", maxDeleteObjects)
+		}
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML", message, r.URL.Path)
+		return
+	}
+
+	slog.Debug("deleting objects", "bucket", bucket, "count", len(keys), "quiet", quiet)
+
+	// Results are streamed out as each key is deleted
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	encoder := xml.NewEncoder(w)
+	resultStart := xml.StartElement{Name: xml.Name{Local: "DeleteResult"}}
+	if err := encoder.EncodeToken(resultStart); err != nil {
+		slog.Error("failed to encode XML response", "error", err)
+		return
+	}
+
+	for _, key := range keys {
+		var result interface{}
+		ftpPath := s.objectPath(root, key)
+		if escapesBucket(key) || !withinRoot(root, ftpPath) {
+			slog.Warn("rejecting key escaping its bucket", "bucket", bucket, "key", key, "remote_addr", r.RemoteAddr)
+			result = DeleteError{Key: key, Code: "InvalidArgument", Message: "Keys must not contain \"..\" segments"}
+		} else if err := s.checkPathLength(ftpPath); err != nil {
+			result = DeleteError{Key: key, Code: "KeyTooLongError", Message: err.Error()}
+		} else if reason := s.wormDeleteError(bucket, ftpPath); reason != "" {
+			result = DeleteError{Key: key, Code: "AccessDenied", Message: reason}
+		} else if err := s.deleteObject(ftpPath); err != nil {
+			result = deleteError(key, ftpPath, err)
+		} else {
+			s.digests.remove(ftpPath)
+			s.removeMetadata(ftpPath)
+			slog.Debug("successfully deleted file", "path", ftpPath)
+			if quiet {
+				continue
+			}
+			result = DeletedObject{Key: key}
+		}
+
+		if err := encoder.Encode(result); err != nil {
+			slog.Error("failed to encode XML response", "error", err)
+			return
+		}
+	}
+
+	if err := encoder.EncodeToken(resultStart.End()); err != nil {
+		slog.Error("failed to encode XML response", "error", err)
+		return
+	}
+	if err := encoder.Flush(); err != nil {
+		slog.Error("failed to encode XML response", "error", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDeleteObjectsRejectsTraversal(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/public/a.txt":   "a",
+		"/private/secret": "classified",
+		"/outside.txt":    "outside",
+	})
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	body := `<Delete>
+		<Object><Key>a.txt</Key></Object>
+		<Object><Key>../private/secret</Key></Object>
+		<Object><Key>dir/../../outside.txt</Key></Object>
+	</Delete>`
+	w := serve(s, http.MethodPost, "/public?delete", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		want string
+	}{
+		{"<Deleted><Key>a.txt</Key></Deleted>"},
+		{"<Error><Key>../private/secret</Key><Code>InvalidArgument</Code>"},
+		{"<Error><Key>dir/../../outside.txt</Key><Code>InvalidArgument</Code>"},
+	}
+	for _, tt := range tests {
+		if !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("response lacks %s: %s", tt.want, w.Body.String())
+		}
+	}
+	for _, name := range []string{"/private/secret", "/outside.txt"} {
+		if _, ok := f.file(name); !ok {
+			t.Errorf("%s outside the bucket was deleted", name)
+		}
+	}
+}
+
+// endlessDelete is a <Delete> document with an unbounded number of objects
+type endlessDelete struct {
+	read    int
+	pending []byte
+}
+
+func (e *endlessDelete) Read(p []byte) (int, error) {
+	if len(e.pending) == 0 {
+		if e.read == 0 {
+			e.pending = []byte("<Delete>")
+		} else {
+			e.pending = []byte("<Object><Key>key</Key></Object>")
+		}
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	e.read += n
+	return n, nil
+}
+
+func TestDeleteObjectsBatch(t *testing.T) {
+	files := make(map[string]string)
+	var body strings.Builder
+	body.WriteString("<Delete>")
+	for i := 0; i < maxDeleteObjects; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		// Every other key exists
+		if i%2 == 0 {
+			files["/bucket/"+key] = "x"
+		}
+		fmt.Fprintf(&body, "<Object><Key>%s</Key></Object>", key)
+	}
+	body.WriteString("</Delete>")
+	f := startFakeFTP(t, files)
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	w := serve(s, http.MethodPost, "/bucket?delete", body.String())
+	var result struct {
+		Deleted []DeletedObject
+		Error   []DeleteError
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	if len(result.Deleted) != maxDeleteObjects/2 || len(result.Error) != maxDeleteObjects/2 {
+		t.Fatalf("%d deleted and %d errors, want %d each", len(result.Deleted), len(result.Error), maxDeleteObjects/2)
+	}
+	for _, e := range result.Error {
+		if e.Code != "NoSuchKey" {
+			t.Errorf("key %s: error %s, want NoSuchKey", e.Key, e.Code)
+		}
+	}
+	for name := range files {
+		if _, ok := f.file(name); ok {
+			t.Errorf("%s wasn't deleted", name)
+		}
+	}
+
+	t.Run("too many", func(t *testing.T) {
+		over := strings.Replace(body.String(), "</Delete>", "<Object><Key>one-more</Key></Object></Delete>", 1)
+		w := serve(s, http.MethodPost, "/bucket?delete", over)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "<Code>MalformedXML</Code>") {
+			t.Errorf("status = %d, want 400 MalformedXML: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		// Parsing stops at the limit instead of reading the whole body
+		endless := &endlessDelete{}
+		if _, _, err := parseDeleteRequest(endless); !errors.Is(err, errTooManyObjects) {
+			t.Fatalf("error = %v, want %v", err, errTooManyObjects)
+		}
+		if limit := 2 * maxDeleteObjects * len("<Object><Key>key</Key></Object>"); endless.read > limit {
+			t.Errorf("read %d bytes of the body, want at most %d", endless.read, limit)
+		}
+	})
+}
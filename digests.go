@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// maxDigests bounds the number of remembered object digests
+const maxDigests = 100000
+
+// objectDigest is the MD5 of an object as uploaded through the gateway
+type objectDigest struct {
+	md5  [md5.Size]byte
+	size int64
+	// etag is the ETag of a multipart upload, "" when it is the MD5
+	etag string
+}
+
+// digestStore remembers the MD5 of objects written through the gateway, keyed
+// by cleaned FTP path. Files changed directly on the FTP server aren't
+// tracked, so a digest is only trusted while the object size still matches.
+type digestStore struct {
+	mu      sync.Mutex
+	entries map[string]objectDigest
+	// pending tracks objects queued for background hashing, a digest is
+	// only recorded if the object wasn't written or deleted in the meantime
+	pending    map[string]uint64
+	generation uint64
+}
+
+func newDigestStore() *digestStore {
+	return &digestStore{
+		entries: make(map[string]objectDigest),
+		pending: make(map[string]uint64),
+	}
+}
+
+func digestKey(ftpPath string) string {
+	return strings.TrimPrefix(path.Clean("/"+ftpPath), "/")
+}
+
+func (d *digestStore) put(ftpPath string, digest objectDigest) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := digestKey(ftpPath)
+	delete(d.pending, key)
+	d.store(key, digest)
+}
+
+func (d *digestStore) store(key string, digest objectDigest) {
+	if _, ok := d.entries[key]; !ok && len(d.entries) >= maxDigests {
+		// Forget an arbitrary entry, a missing digest only hides Content-MD5
+		for evict := range d.entries {
+			delete(d.entries, evict)
+			break
+		}
+	}
+	d.entries[key] = digest
+}
+
+// get returns the MD5 of the object at ftpPath if it is known and the object
+// still has the recorded size
+func (d *digestStore) get(ftpPath string, size int64) ([md5.Size]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	digest, ok := d.entries[digestKey(ftpPath)]
+	if !ok || digest.size != size {
+		return [md5.Size]byte{}, false
+	}
+	return digest.md5, true
+}
+
+// etag returns the ETag of the object at ftpPath if its digest is known and
+// the object still has the recorded size: the multipart ETag it was completed
+// with, otherwise its MD5
+func (d *digestStore) etag(ftpPath string, size int64) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	digest, ok := d.entries[digestKey(ftpPath)]
+	if !ok || digest.size != size {
+		return "", false
+	}
+	if digest.etag != "" {
+		return digest.etag, true
+	}
+	return digestETag(digest.md5), true
+}
+
+func (d *digestStore) remove(ftpPath string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := digestKey(ftpPath)
+	delete(d.entries, key)
+	delete(d.pending, key)
+}
+
+// move carries the digest of a renamed object over to its new path
+func (d *digestStore) move(from, to string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fromKey, toKey := digestKey(from), digestKey(to)
+	digest, ok := d.entries[fromKey]
+	delete(d.entries, fromKey)
+	delete(d.pending, fromKey)
+	delete(d.entries, toKey)
+	delete(d.pending, toKey)
+	if ok {
+		d.store(toKey, digest)
+	}
+}
+
+// flush forgets every digest and returns how many there were. Pending
+// background hashes still record theirs.
+func (d *digestStore) flush() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := len(d.entries)
+	d.entries = make(map[string]objectDigest)
+	return n
+}
+
+// begin forgets the digest of the object at ftpPath ahead of hashing it in
+// the background and returns the generation to pass to putIfCurrent
+func (d *digestStore) begin(ftpPath string) uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := digestKey(ftpPath)
+	d.generation++
+	delete(d.entries, key)
+	d.pending[key] = d.generation
+	return d.generation
+}
+
+// putIfCurrent records a background digest unless the object was written or
+// deleted since begin
+func (d *digestStore) putIfCurrent(ftpPath string, generation uint64, digest objectDigest) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := digestKey(ftpPath)
+	if d.pending[key] != generation {
+		return false
+	}
+	delete(d.pending, key)
+	d.store(key, digest)
+	return true
+}
+
+// digestReader hashes and counts the bytes read through it
+type digestReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func newDigestReader(r io.Reader) *digestReader {
+	return &digestReader{r: r, hash: md5.New()}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	d.size += int64(n)
+	return n, err
+}
+
+func (d *digestReader) digest() objectDigest {
+	var digest objectDigest
+	copy(digest.md5[:], d.hash.Sum(nil))
+	digest.size = d.size
+	return digest
+}
+
+// setContentMD5 sets the Content-MD5 header when -content-md5 is enabled and
+// the real digest of the object is known. It is never derived from the
+// synthetic ETag.
+func (s *S3Server) setContentMD5(w http.ResponseWriter, ftpPath string, size int64) {
+	if !s.config.ContentMD5 {
+		return
+	}
+	if sum, ok := s.digests.get(ftpPath, size); ok {
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+func TestContentMD5(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/seeded.txt": "seeded"})
+	s := newTestServer(t, f, "-subdir-buckets", "-content-md5")
+	if w := serve(s, http.MethodPut, "/bucket/uploaded.txt", "uploaded"); w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+	sum := md5.Sum([]byte("uploaded"))
+	want := base64.StdEncoding.EncodeToString(sum[:])
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if got := serve(s, method, "/bucket/uploaded.txt", "").Header().Get("Content-MD5"); got != want {
+			t.Errorf("%s uploaded: Content-MD5 = %q, want %q", method, got, want)
+		}
+		// Only a synthetic ETag is known for objects stored behind the gateway's back
+		if got := serve(s, method, "/bucket/seeded.txt", "").Header().Get("Content-MD5"); got != "" {
+			t.Errorf("%s seeded: Content-MD5 = %q, want none", method, got)
+		}
+	}
+
+	// A file rewritten on the FTP server no longer matches its digest
+	f.put("/bucket/uploaded.txt", "rewritten elsewhere")
+	if got := serve(s, http.MethodHead, "/bucket/uploaded.txt", "").Header().Get("Content-MD5"); got != "" {
+		t.Errorf("HEAD rewritten: Content-MD5 = %q, want none", got)
+	}
+
+	disabled := newTestServer(t, f, "-subdir-buckets")
+	if w := serve(disabled, http.MethodPut, "/bucket/other.txt", "other"); w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+	if got := serve(disabled, http.MethodGet, "/bucket/other.txt", "").Header().Get("Content-MD5"); got != "" {
+		t.Errorf("Content-MD5 = %q without -content-md5", got)
+	}
+}
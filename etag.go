@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"path"
+	"time"
+)
+
+// emptyETag is the ETag of an empty object, such as a folder marker
+const emptyETag = `"d41d8cd98f00b204e9800998ecf8427e"`
+
+// digestETag formats an MD5 as an ETag
+func digestETag(sum [md5.Size]byte) string {
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// objectETag returns the ETag of the object at ftpPath: its MD5 when the
+// gateway knows it for the object's current size, otherwise a synthetic one
+// derived from size and modification time
+func (s *S3Server) objectETag(ftpPath string, size int64, modTime time.Time) string {
+	etag, _ := s.entityTag(ftpPath, size, modTime)
+	return etag
+}
+
+// entityTag returns the ETag of the object at ftpPath and whether it is a weak
+// validator. A synthetic ETag is: objects written within the same minute with
+// the same size share it.
+func (s *S3Server) entityTag(ftpPath string, size int64, modTime time.Time) (etag string, weak bool) {
+	if etag, ok := s.digests.etag(ftpPath, size); ok {
+		return etag, false
+	}
+	return syntheticETag(size, modTime), true
+}
+
+// advertisedETag returns the ETag header value, marked W/ when it is weak and
+// -weak-etags is set
+func (s *S3Server) advertisedETag(etag string, weak bool) string {
+	if weak && s.config.WeakETags {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// listedETag returns the ETag of a file in the listing of a bucket with the
+// given root
+func (s *S3Server) listedETag(root, key string, file FileInfo) string {
+	if file.IsDir {
+		return emptyETag
+	}
+	return s.objectETag(s.objectPath(root, key), file.Size, file.ModTime)
+}
+
+// syntheticETag changes whenever an object's size or modification time does.
+// It ends in "-1" like the ETag of a multipart upload, which integrity checks
+// of S3 clients never compare against the content's MD5. Times are truncated
+// to the minute, the best LIST offers, so listings and HEAD agree.
+func syntheticETag(size int64, modTime time.Time) string {
+	sum := md5.Sum([]byte(fmt.Sprintf("%d:%d", size, modTime.Truncate(time.Minute).Unix())))
+	return `"` + hex.EncodeToString(sum[:]) + `-1"`
+}
+
+// objectInfo returns the size and modification time of the object at
+// ftpPath, or nil when they can't be determined
+func (s *S3Server) objectInfo(ftpPath string) *FileInfo {
+	file, err := s.statObjectExact(ftpPath)
+	if err != nil {
+		slog.Debug("failed to stat object", "path", ftpPath, "error", err)
+		return nil
+	}
+	return file
+}
+
+// statObjectExact looks up the object at ftpPath like statObject, preferring
+// SIZE and MDTM. They are cheaper than listing a large parent directory,
+// unless a cached listing answers, and SIZE is exact where LIST truncates or
+// omits sizes. The listing is used when SIZE fails, as it does on servers
+// refusing it in ASCII mode, and for the time when MDTM does.
+func (s *S3Server) statObjectExact(ftpPath string) (*FileInfo, error) {
+	if _, cached := s.ftp.CachedList(path.Dir(ftpPath)); cached {
+		return s.statObject(ftpPath)
+	}
+	size, err := s.ftp.FileSize(ftpPath)
+	if err != nil || !s.ftp.plausibleSize(size) {
+		return s.statObject(ftpPath)
+	}
+	if modTime, err := s.ftp.ModTime(ftpPath); err == nil {
+		return &FileInfo{Name: path.Base(ftpPath), Size: size, ModTime: modTime}, nil
+	}
+	file, err := s.statObject(ftpPath)
+	if file != nil && !file.IsDir {
+		file.Size = size
+	}
+	return file, err
+}
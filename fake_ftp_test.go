@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFTP is an in-memory FTP server for tests. Files are keyed by absolute
+// path, their parent directories exist implicitly.
+type fakeFTP struct {
+	mu    sync.Mutex
+	files map[string]string
+	dirs  map[string]bool
+	addr  string
+	// storHook runs before a STOR is accepted, an error rejects it with
+	// 553, or with its own code when it starts with one
+	storHook func(name string) error
+	// listDelay holds up every LIST, like a distant server
+	listDelay time.Duration
+	// listedSize replaces the size LIST prints for these files, e.g. with
+	// an overflowed one
+	listedSize map[string]string
+	// listReversed lists entries in reverse name order instead of sorted,
+	// like servers listing in directory or mtime order
+	listReversed bool
+	// listFullNames prints every entry with the listed directory in front,
+	// directories with a trailing slash, and "." and "..", like some
+	// servers do
+	listFullNames bool
+	// listDenied names the directories whose LIST is refused with 550,
+	// like an account that may not read them
+	listDenied map[string]bool
+	// rest enables REST, without it the command is unknown
+	rest bool
+	// retrDelay holds up every RETR before its data flows
+	retrDelay time.Duration
+	// retrStall pauses every download halfway through its data
+	retrStall time.Duration
+	// retrs counts the RETR commands served
+	retrs int
+	// commands counts every command received
+	commands int
+	// logins counts the USER commands, one per control connection
+	logins int
+	// loginDelay holds up every PASS reply, like a slow authentication
+	// backend; loggingIn and maxLoggingIn track the connections opened but
+	// not yet logged in
+	loginDelay   time.Duration
+	loggingIn    int
+	maxLoggingIn int
+	// mkdExists is the 550 reply text for MKD of an existing directory
+	mkdExists string
+	// clockOffset sets the server's clock ahead of the local one, or behind
+	// when negative
+	clockOffset time.Duration
+	// stored holds the STOR time of uploaded files, which MDTM reports
+	// instead of the fixed time of seeded ones
+	stored map[string]time.Time
+	// pasvOnly answers EPSV but refuses its transfers with 425, like
+	// embedded servers that only open a passive port after PASV
+	pasvOnly bool
+	// pasvHost replaces the host advertised in PASV replies, like a server
+	// behind NAT announcing its private address, e.g. "127,0,0,2"
+	pasvHost string
+	// late226 follows the 426 of a download the client cut short with a
+	// late 226, as some servers do
+	late226 bool
+	// quota caps the bytes a STOR writes, a larger upload is left partial
+	// and answered with 552
+	quota int
+	// truncate is the number of coming STORs that silently keep only the
+	// first half of their data, like a glitching server
+	truncate int
+	// banner replaces the welcome message, e.g. to pose as known software
+	banner string
+	// hangUp names a command the server once hangs up on without a reply
+	hangUp string
+	// refuse hangs up on every new connection, like a server going down
+	refuse bool
+	// sites records the arguments of every SITE command
+	sites []string
+	// siteUnsupported answers SITE with 502, like servers without it
+	siteUnsupported bool
+	// clientIPs records the source IP of every control and data connection
+	clientIPs []string
+}
+
+// startFakeFTP serves files until the test ends
+func startFakeFTP(t testing.TB, files map[string]string) *fakeFTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeFTP{files: make(map[string]string), dirs: map[string]bool{"/": true}, stored: make(map[string]time.Time), addr: ln.Addr().String()}
+	for name, body := range files {
+		f.put(name, body)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// put stores a file, creating its parent directories
+func (f *fakeFTP) put(name, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[name] = body
+	for dir := path.Dir(name); dir != "/"; dir = path.Dir(dir) {
+		f.dirs[dir] = true
+	}
+}
+
+// file returns the content of a file and whether it exists
+func (f *fakeFTP) file(name string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, ok := f.files[name]
+	return body, ok
+}
+
+// setStorHook installs hook to run before every STOR
+func (f *fakeFTP) setStorHook(hook func(name string) error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.storHook = hook
+}
+
+// retrCount returns how many downloads were served
+func (f *fakeFTP) retrCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.retrs
+}
+
+// connectedFrom returns the source IPs of all connections so far
+func (f *fakeFTP) connectedFrom() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.clientIPs...)
+}
+
+// recordClient notes the source IP of conn
+func (f *fakeFTP) recordClient(conn net.Conn) {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	f.mu.Lock()
+	f.clientIPs = append(f.clientIPs, host)
+	f.mu.Unlock()
+}
+
+// commandCount returns how many commands were received
+func (f *fakeFTP) commandCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commands
+}
+
+// loginCount returns the number of logins, i.e. control connections
+func (f *fakeFTP) loginCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.logins
+}
+
+func (f *fakeFTP) port() int {
+	_, port, _ := net.SplitHostPort(f.addr)
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// listing renders the LIST lines of dir, false when it doesn't exist
+func (f *fakeFTP) listing(dir string) ([]string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirs[dir] {
+		return nil, false
+	}
+	lines := make(map[string]string)
+	for sub := range f.dirs {
+		if sub != "/" && path.Dir(sub) == dir {
+			lines[path.Base(sub)] = "drwxr-xr-x 1 u g 0 Jan 01 2024 " + path.Base(sub)
+		}
+	}
+	for name, body := range f.files {
+		if path.Dir(name) == dir {
+			size := strconv.Itoa(len(body))
+			if listed, ok := f.listedSize[name]; ok {
+				size = listed
+			}
+			lines[path.Base(name)] = fmt.Sprintf("-rw-r--r-- 1 u g %s Jan 01 2024 %s", size, path.Base(name))
+		}
+	}
+	names := make([]string, 0, len(lines))
+	for name := range lines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if f.listReversed {
+		sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	}
+	listed := make([]string, len(names))
+	for i, name := range names {
+		listed[i] = lines[name]
+		if f.listFullNames {
+			full := path.Join(dir, name)
+			if f.dirs[full] {
+				full += "/"
+			}
+			listed[i] = strings.TrimSuffix(listed[i], name) + full
+		}
+	}
+	if f.listFullNames {
+		listed = append([]string{
+			"drwxr-xr-x 1 u g 0 Jan 01 2024 .",
+			"drwxr-xr-x 1 u g 0 Jan 01 2024 ..",
+		}, listed...)
+	}
+	return listed, true
+}
+
+// fakeReply is the final reply of a transfer that failed on the server side
+type fakeReply string
+
+func (r fakeReply) Error() string { return string(r) }
+
+func (f *fakeFTP) serve(conn net.Conn) {
+	defer conn.Close()
+	f.recordClient(conn)
+	f.mu.Lock()
+	refuse := f.refuse
+	f.mu.Unlock()
+	if refuse {
+		return
+	}
+	f.mu.Lock()
+	f.loggingIn++
+	f.maxLoggingIn = max(f.maxLoggingIn, f.loggingIn)
+	f.mu.Unlock()
+	loggedIn := false
+	defer func() {
+		if !loggedIn {
+			f.mu.Lock()
+			f.loggingIn--
+			f.mu.Unlock()
+		}
+	}()
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...any) { fmt.Fprintf(conn, format+"\r\n", args...) }
+	f.mu.Lock()
+	banner := f.banner
+	f.mu.Unlock()
+	if banner == "" {
+		banner = "220 fake FTP"
+	}
+	reply("%s", banner)
+
+	var data net.Listener
+	// viaPASV is whether data was opened by PASV, each lasts one transfer
+	var viaPASV bool
+	var offset int
+	cwd := "/"
+	abs := func(p string) string {
+		if !strings.HasPrefix(p, "/") {
+			p = path.Join(cwd, p)
+		}
+		return path.Clean(p)
+	}
+	// transfer runs fn on the next data connection, a failing fn means
+	// the client closed it early unless it is a fakeReply
+	transfer := func(fn func(net.Conn) error) {
+		f.mu.Lock()
+		pasvOnly := f.pasvOnly
+		f.mu.Unlock()
+		if pasvOnly && !viaPASV {
+			data.Close()
+			reply("425 can't open data connection")
+			return
+		}
+		viaPASV = false
+		reply("150 opening data connection")
+		dc, err := data.Accept()
+		data.Close()
+		if err != nil {
+			reply("425 no data connection")
+			return
+		}
+		f.recordClient(dc)
+		err = fn(dc)
+		dc.Close()
+		if err == nil {
+			reply("226 transfer complete")
+			return
+		}
+		if final, ok := err.(fakeReply); ok {
+			reply("%s", final)
+			return
+		}
+		reply("426 Failure writing network stream.")
+		f.mu.Lock()
+		late := f.late226
+		f.mu.Unlock()
+		if late {
+			time.Sleep(20 * time.Millisecond)
+			reply("226 transfer complete")
+		}
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		f.mu.Lock()
+		f.commands++
+		hangUp := strings.EqualFold(cmd, f.hangUp)
+		if hangUp {
+			f.hangUp = ""
+		}
+		f.mu.Unlock()
+		if hangUp {
+			return
+		}
+		switch strings.ToUpper(cmd) {
+		case "USER":
+			f.mu.Lock()
+			f.logins++
+			f.mu.Unlock()
+			reply("331 password required")
+		case "PASS":
+			f.mu.Lock()
+			delay := f.loginDelay
+			f.mu.Unlock()
+			time.Sleep(delay)
+			f.mu.Lock()
+			if !loggedIn {
+				f.loggingIn--
+				loggedIn = true
+			}
+			f.mu.Unlock()
+			reply("230 logged in")
+		case "FEAT":
+			reply("211-Features:\r\n SIZE\r\n MDTM\r\n211 End")
+		case "TYPE", "OPTS", "NOOP":
+			reply("200 ok")
+		case "SITE":
+			f.mu.Lock()
+			unsupported := f.siteUnsupported
+			f.sites = append(f.sites, arg)
+			f.mu.Unlock()
+			if unsupported {
+				reply("502 command not implemented")
+				continue
+			}
+			reply("200 ok")
+		case "PWD":
+			reply("257 %q", cwd)
+		case "CWD":
+			f.mu.Lock()
+			ok := f.dirs[abs(arg)]
+			f.mu.Unlock()
+			if !ok {
+				reply("550 no such directory")
+				continue
+			}
+			cwd = abs(arg)
+			reply("250 ok")
+		case "EPSV":
+			data, _ = net.Listen("tcp", "127.0.0.1:0")
+			viaPASV = false
+			_, port, _ := net.SplitHostPort(data.Addr().String())
+			reply("229 Entering Extended Passive Mode (|||%s|)", port)
+		case "PASV":
+			data, _ = net.Listen("tcp", "127.0.0.1:0")
+			viaPASV = true
+			port := data.Addr().(*net.TCPAddr).Port
+			f.mu.Lock()
+			host := f.pasvHost
+			f.mu.Unlock()
+			if host == "" {
+				host = "127,0,0,1"
+			}
+			reply("227 Entering Passive Mode (%s,%d,%d)", host, port/256, port%256)
+		case "LIST":
+			if strings.HasPrefix(arg, "-") {
+				arg = ""
+			}
+			f.mu.Lock()
+			delay, denied := f.listDelay, f.listDenied[abs(arg)]
+			f.mu.Unlock()
+			time.Sleep(delay)
+			if denied {
+				data.Close()
+				reply("550 Permission denied")
+				continue
+			}
+			lines, ok := f.listing(abs(arg))
+			if !ok {
+				data.Close()
+				reply("550 no such directory")
+				continue
+			}
+			transfer(func(dc net.Conn) error {
+				for _, line := range lines {
+					fmt.Fprintf(dc, "%s\r\n", line)
+				}
+				return nil
+			})
+		case "SIZE":
+			body, ok := f.file(abs(arg))
+			if !ok {
+				reply("550 no such file")
+				continue
+			}
+			reply("213 %d", len(body))
+		case "MDTM":
+			if _, ok := f.file(abs(arg)); !ok {
+				reply("550 no such file")
+				continue
+			}
+			f.mu.Lock()
+			stored, ok := f.stored[abs(arg)]
+			f.mu.Unlock()
+			if !ok {
+				reply("213 20240101000000")
+				continue
+			}
+			reply("213 %s", stored.UTC().Format("20060102150405"))
+		case "REST":
+			f.mu.Lock()
+			rest := f.rest
+			f.mu.Unlock()
+			if !rest {
+				reply("502 command not implemented")
+				continue
+			}
+			offset, _ = strconv.Atoi(arg)
+			reply("350 restarting at %d", offset)
+		case "RETR":
+			body, ok := f.file(abs(arg))
+			start := offset
+			offset = 0
+			if !ok || start > len(body) {
+				data.Close()
+				reply("550 no such file")
+				continue
+			}
+			f.mu.Lock()
+			f.retrs++
+			delay, stall := f.retrDelay, f.retrStall
+			f.mu.Unlock()
+			time.Sleep(delay)
+			transfer(func(dc net.Conn) error {
+				data := body[start:]
+				if stall > 0 {
+					if _, err := io.WriteString(dc, data[:len(data)/2]); err != nil {
+						return err
+					}
+					time.Sleep(stall)
+					data = data[len(data)/2:]
+				}
+				_, err := io.WriteString(dc, data)
+				return err
+			})
+		case "STOR":
+			name := abs(arg)
+			f.mu.Lock()
+			hook := f.storHook
+			f.mu.Unlock()
+			if hook != nil {
+				if err := hook(name); err != nil {
+					data.Close()
+					if _, convErr := strconv.Atoi(strings.SplitN(err.Error(), " ", 2)[0]); convErr == nil {
+						reply("%v", err)
+					} else {
+						reply("553 %v", err)
+					}
+					continue
+				}
+			}
+			transfer(func(dc net.Conn) error {
+				body, _ := io.ReadAll(dc)
+				f.mu.Lock()
+				quota := f.quota
+				if f.truncate > 0 {
+					f.truncate--
+					body = body[:len(body)/2]
+				}
+				f.mu.Unlock()
+				if quota > 0 && len(body) > quota {
+					f.put(name, string(body[:quota]))
+					return fakeReply("552 Exceeded storage allocation")
+				}
+				f.put(name, string(body))
+				f.mu.Lock()
+				f.stored[name] = time.Now().Add(f.clockOffset)
+				f.mu.Unlock()
+				return nil
+			})
+		case "DELE":
+			f.mu.Lock()
+			_, ok := f.files[abs(arg)]
+			delete(f.files, abs(arg))
+			f.mu.Unlock()
+			if !ok {
+				reply("550 no such file")
+				continue
+			}
+			reply("250 deleted")
+		case "MKD":
+			f.mu.Lock()
+			exists := f.dirs[abs(arg)]
+			f.dirs[abs(arg)] = true
+			message := f.mkdExists
+			f.mu.Unlock()
+			if exists {
+				if message == "" {
+					message = "directory already exists"
+				}
+				reply("550 %s", message)
+				continue
+			}
+			reply("257 created")
+		case "RMD":
+			f.mu.Lock()
+			delete(f.dirs, abs(arg))
+			f.mu.Unlock()
+			reply("250 removed")
+		case "RNFR":
+			from := abs(arg)
+			reply("350 ready for RNTO")
+			line, _ := reader.ReadString('\n')
+			_, to, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+			body, ok := f.file(from)
+			if !ok {
+				reply("550 no such file")
+				continue
+			}
+			f.mu.Lock()
+			delete(f.files, from)
+			f.mu.Unlock()
+			f.put(abs(to), body)
+			reply("250 renamed")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+// newTestServer builds an S3Server for the fake FTP server from command line
+// arguments, as main does
+func newTestServer(t testing.TB, f *fakeFTP, args ...string) *S3Server {
+	t.Helper()
+	s, err := NewS3Server(testConfig(t, f, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.ftp.Close)
+	return s
+}
+
+// testConfig parses command line arguments for the fake FTP server
+func testConfig(t testing.TB, f *fakeFTP, args ...string) *Config {
+	t.Helper()
+	savedArgs, savedFlags := os.Args, flag.CommandLine
+	t.Cleanup(func() { os.Args, flag.CommandLine = savedArgs, savedFlags })
+
+	flag.CommandLine = flag.NewFlagSet("ftp-over-s3", flag.ContinueOnError)
+	os.Args = append([]string{"ftp-over-s3",
+		"-ftp-host", "127.0.0.1",
+		"-ftp-port", strconv.Itoa(f.port()),
+		"-ftp-user", "user",
+		"-ftp-password", "password",
+	}, args...)
+	return parseConfig()
+}
+
+// serve sends a request to handler and returns the recorded response
+func serve(handler http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, target, reader))
+	return w
+}
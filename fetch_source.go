@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fetchSourceHeader makes a PUT store the body of an http(s) URL instead of
+// its own, so ingest pipelines don't relay the bytes
+const fetchSourceHeader = "x-ftp-s3-fetch-source"
+
+// errFetchTooLarge fails a fetched upload that outgrew -fetch-source-max-size
+var errFetchTooLarge = errors.New("fetched object exceeds the maximum size")
+
+// parseFetchHosts parses the comma-separated -fetch-source-hosts allowlist. A
+// "*.example.com" entry allows the subdomains of example.com.
+func parseFetchHosts(spec string) ([]string, error) {
+	var hosts []string
+	for _, host := range strings.Split(spec, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		if strings.Contains(strings.TrimPrefix(host, "*."), "*") || strings.ContainsAny(host, "/:") {
+			return nil, fmt.Errorf("invalid fetch source host %q, expected a host name such as example.com or *.example.com", host)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// fetchAllowed reports whether the URL is http(s) on an allowlisted host
+func fetchAllowed(allowlist []string, u *url.URL) bool {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range allowlist {
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// newFetchClient returns the HTTP client for fetch sources. Every redirect
+// must stay within the allowlist too.
+func newFetchClient(allowlist []string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if !fetchAllowed(allowlist, req.URL) {
+				return fmt.Errorf("redirect to %s is not allowed", req.URL.Host)
+			}
+			return nil
+		},
+	}
+}
+
+// openFetchSource replaces the body of a PUT carrying x-ftp-s3-fetch-source
+// with the remote object, whose Content-Type is returned. It reports whether
+// the upload may go on, having answered the request if not; the caller closes
+// r.Body.
+func (s *S3Server) openFetchSource(w http.ResponseWriter, r *http.Request) (string, bool) {
+	source := r.Header.Get(fetchSourceHeader)
+	if s.fetchClient == nil {
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented",
+			"Fetching objects from a URL requires -fetch-source-hosts", r.URL.Path)
+		return "", false
+	}
+	if r.ContentLength > 0 {
+		writeS3Error(w, http.StatusBadRequest, "InvalidRequest",
+			"A PUT with "+fetchSourceHeader+" must not have a body", r.URL.Path)
+		return "", false
+	}
+	u, err := url.Parse(source)
+	if err != nil || !fetchAllowed(s.fetchHosts, u) {
+		slog.Warn("rejecting fetch from a host that isn't allowed", "source", source)
+		writeS3Error(w, http.StatusForbidden, "AccessDenied",
+			"Fetching from this URL is not allowed", r.URL.Path)
+		return "", false
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "Invalid fetch source URL", r.URL.Path)
+		return "", false
+	}
+	slog.Debug("fetching object", "source", u.Redacted())
+	resp, err := s.fetchClient.Do(req)
+	if err != nil {
+		slog.Warn("failed to fetch object", "source", u.Redacted(), "error", err)
+		writeS3Error(w, http.StatusBadGateway, "InvalidArgument",
+			"Failed to fetch the source URL", r.URL.Path)
+		return "", false
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		slog.Warn("fetch source didn't answer 200", "source", u.Redacted(), "status", resp.StatusCode)
+		writeS3Error(w, http.StatusBadGateway, "InvalidArgument",
+			"The source URL answered "+strconv.Itoa(resp.StatusCode), r.URL.Path)
+		return "", false
+	}
+	if resp.ContentLength > s.config.FetchSourceMaxSize {
+		resp.Body.Close()
+		writeS3Error(w, http.StatusBadRequest, "EntityTooLarge",
+			"The fetched object exceeds the maximum allowed size", r.URL.Path)
+		return "", false
+	}
+
+	r.Body = &fetchBody{ReadCloser: resp.Body, remaining: s.config.FetchSourceMaxSize}
+	r.ContentLength = resp.ContentLength
+	return resp.Header.Get("Content-Type"), true
+}
+
+// fetchBody fails once more than the maximum size was read, for sources that
+// didn't declare their length
+type fetchBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *fetchBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errFetchTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, errFetchTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/md5"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFetchAllowed(t *testing.T) {
+	allowlist, err := parseFetchHosts("Example.com, *.cdn.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		source string
+		want   bool
+	}{
+		{"https://example.com/file", true},
+		{"http://EXAMPLE.com:8080/file", true},
+		{"https://sub.example.com/file", false},
+		{"https://eu.cdn.example.org/file", true},
+		{"https://cdn.example.org/file", false},
+		{"https://evilcdn.example.org/file", false},
+		{"ftp://example.com/file", false},
+		{"file:///etc/passwd", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fetchAllowed(allowlist, u); got != tt.want {
+			t.Errorf("fetchAllowed(%q) = %v, want %v", tt.source, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"example.com:443", "https://example.com", "*.*.example.com", "ex*ample.com"} {
+		if _, err := parseFetchHosts(spec); err == nil {
+			t.Errorf("parseFetchHosts(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestFetchSource(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file.txt":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Write([]byte("fetched"))
+		case "/large":
+			w.Write([]byte(strings.Repeat("x", 64)))
+		case "/streamed":
+			// Flushing first drops Content-Length, so only the read is limited
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			for i := 0; i < 8; i++ {
+				w.Write([]byte(strings.Repeat("x", 8)))
+				w.(http.Flusher).Flush()
+			}
+		case "/redirect":
+			http.Redirect(w, r, "http://localhost/file.txt", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(source.Close)
+	host, err := url.Parse(source.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+	s := newTestServer(t, f, "-subdir-buckets", "-sidecar-metadata", "-fetch-source-hosts", host.Hostname(), "-fetch-source-max-size", "32")
+	fetch := func(target, from string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, target, nil)
+		r.Header.Set(fetchSourceHeader, from)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("stored", func(t *testing.T) {
+		w := fetch("/bucket/file.txt", source.URL+"/file.txt")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		if body, _ := f.file("/bucket/file.txt"); body != "fetched" {
+			t.Errorf("stored %q, want the fetched body", body)
+		}
+		if got, want := w.Header().Get("ETag"), digestETag(md5.Sum([]byte("fetched"))); got != want {
+			t.Errorf("ETag = %s, want %s", got, want)
+		}
+		head := serve(s, http.MethodHead, "/bucket/file.txt", "")
+		if got := head.Header().Get("Content-Type"); got != "text/csv" {
+			t.Errorf("Content-Type = %q, want the source's", got)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		source string
+		want   int
+	}{
+		{"host not allowed", "/bucket/blocked.txt", strings.Replace(source.URL, host.Hostname(), "localhost", 1) + "/file.txt", http.StatusForbidden},
+		{"scheme not allowed", "/bucket/blocked.txt", "file:///etc/passwd", http.StatusForbidden},
+		{"redirect off the allowlist", "/bucket/blocked.txt", source.URL + "/redirect", http.StatusBadGateway},
+		{"source fails", "/bucket/blocked.txt", source.URL + "/missing", http.StatusBadGateway},
+		{"declared too large", "/bucket/blocked.txt", source.URL + "/large", http.StatusBadRequest},
+		{"streamed too large", "/bucket/blocked.txt", source.URL + "/streamed", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := fetch(tt.target, tt.source)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if _, ok := f.file(tt.target); ok {
+				t.Errorf("%s was stored", tt.target)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets")
+		r := httptest.NewRequest(http.MethodPut, "/bucket/disabled.txt", nil)
+		r.Header.Set(fetchSourceHeader, source.URL+"/file.txt")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusNotImplemented {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusNotImplemented)
+		}
+	})
+
+	t.Run("body with fetch source", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPut, "/bucket/both.txt", strings.NewReader("body"))
+		r.Header.Set(fetchSourceHeader, source.URL+"/file.txt")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+		}
+	})
+}
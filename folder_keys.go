@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Policies for object keys ending in "/"
+const (
+	// TrailingSlashPassthrough strips the slash and treats the key as a file
+	TrailingSlashPassthrough = "passthrough"
+	// TrailingSlashFolderMarker maps the key to an FTP directory
+	TrailingSlashFolderMarker = "folder-marker"
+	// TrailingSlashError rejects the key
+	TrailingSlashError = "error"
+)
+
+// handleFolderKey applies the trailing-slash policy to object requests on keys
+// ending in "/". It reports whether the request has been handled.
+func (s *S3Server) handleFolderKey(w http.ResponseWriter, r *http.Request) bool {
+	_, key := splitBucketKey(r.URL.Path)
+	if !strings.HasSuffix(key, "/") || s.config.TrailingSlash == TrailingSlashPassthrough {
+		return false
+	}
+
+	if s.config.TrailingSlash == TrailingSlashError {
+		slog.Debug("rejecting key with trailing slash", "key", key)
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "Object keys ending in \"/\" are not supported", r.URL.Path)
+		return true
+	}
+
+	path, ok := s.resolveObject(w, r)
+	if !ok {
+		return true
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		slog.Debug("creating folder marker", "path", path)
+		if err := s.ftp.MakeDir(path); err != nil {
+			slog.Error("failed to create FTP directory", "path", path, "error", err)
+			writeInternalError(w, r, err)
+			return true
+		}
+		w.Header().Set("ETag", emptyETag)
+		w.Header().Set("x-amz-version-id", "null") // Buckets are unversioned
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		isDir, err := s.ftp.IsDir(path)
+		if err != nil {
+			slog.Error("failed to check FTP directory", "path", path, "error", err)
+			writeInternalError(w, r, err)
+			return true
+		}
+		// A directory is only a folder marker where listings show it as one
+		if !isDir || s.config.ListDirectories != ListDirectoriesKeys {
+			s.writeNoSuchKey(w, r)
+			return true
+		}
+		// Folder markers are empty objects
+		w.Header().Set("Content-Type", "application/x-directory")
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("ETag", emptyETag)
+		w.Header().Set("x-amz-version-id", "null") // Buckets are unversioned
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		slog.Debug("removing folder marker", "path", path)
+		if err := s.ftp.RemoveDir(path); err != nil {
+			slog.Error("failed to remove FTP directory", "path", path, "error", err)
+			if strings.Contains(err.Error(), "550") {
+				s.writeNoSuchKey(w, r)
+				return true
+			}
+			writeInternalError(w, r, err)
+			return true
+		}
+		w.WriteHeader(s.config.DeleteResponseStatus)
+	default:
+		return false
+	}
+	return true
+}
+
+// typeCollision reports a file/directory clash that would make writing a file
+// at ftpPath fail: a directory already at ftpPath, or a file where one of its
+// parent directories should be. It returns "" when there is none.
+func (s *S3Server) typeCollision(ftpPath string) (string, error) {
+	parts := strings.Split(strings.Trim(ftpPath, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		ancestor := strings.Join(parts[:i], "/")
+		isDir, err := s.ftp.IsDir(ancestor)
+		if err != nil {
+			return "", err
+		}
+		if isDir {
+			continue
+		}
+		file, err := s.statObject(ancestor)
+		if err != nil && !strings.Contains(err.Error(), "550") {
+			return "", err
+		}
+		if file != nil && !file.IsDir {
+			return "\"" + ancestor + "\" is a file on the FTP server, so it can't contain other objects", nil
+		}
+		// Nothing exists below a missing directory
+		return "", nil
+	}
+
+	isDir, err := s.ftp.IsDir(ftpPath)
+	if err != nil {
+		return "", err
+	}
+	if isDir {
+		return "\"" + ftpPath + "\" is a directory on the FTP server, so it can't be written as an object", nil
+	}
+	return "", nil
+}
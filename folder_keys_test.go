@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTrailingSlashPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		// Statuses of PUT, HEAD, GET and DELETE of "dir/", in that order
+		want [4]int
+		// Whether the PUT created a directory and a file respectively
+		dir, file bool
+	}{
+		{TrailingSlashFolderMarker, [4]int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusNoContent}, true, false},
+		{TrailingSlashError, [4]int{http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest}, false, false},
+		{TrailingSlashPassthrough, [4]int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusNoContent}, false, true},
+	}
+	methods := []string{http.MethodPut, http.MethodHead, http.MethodGet, http.MethodDelete}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+			s := newTestServer(t, f, "-subdir-buckets", "-trailing-slash", tt.policy)
+
+			for i, method := range methods {
+				w := serve(s, method, "/bucket/dir/", "")
+				if w.Code != tt.want[i] {
+					t.Fatalf("%s: status = %d, want %d: %s", method, w.Code, tt.want[i], w.Body.String())
+				}
+				if method != http.MethodPut {
+					continue
+				}
+				f.mu.Lock()
+				dir := f.dirs["/bucket/dir"]
+				f.mu.Unlock()
+				_, file := f.file("/bucket/dir")
+				if dir != tt.dir || file != tt.file {
+					t.Fatalf("PUT created directory %v and file %v, want %v and %v", dir, file, tt.dir, tt.file)
+				}
+			}
+			f.mu.Lock()
+			dir := f.dirs["/bucket/dir"]
+			f.mu.Unlock()
+			if _, file := f.file("/bucket/dir"); dir || file {
+				t.Errorf("dir/ still exists after DELETE")
+			}
+		})
+	}
+
+	t.Run("missing folder marker", func(t *testing.T) {
+		f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+		s := newTestServer(t, f, "-subdir-buckets", "-trailing-slash", TrailingSlashFolderMarker)
+		for _, method := range []string{http.MethodHead, http.MethodGet} {
+			if w := serve(s, method, "/bucket/missing/", ""); w.Code != http.StatusNotFound {
+				t.Errorf("%s: status = %d, want 404", method, w.Code)
+			}
+		}
+	})
+}
+
+func TestTypeCollisions(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/bucket/file.txt":      "file",
+		"/bucket/dir/inner.txt": "inner",
+	})
+	s := newTestServer(t, f, "-subdir-buckets", "-check-type-collisions")
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"directory at the key", "/bucket/dir", http.StatusConflict},
+		{"file as the parent", "/bucket/file.txt/child.txt", http.StatusConflict},
+		{"file as a grandparent", "/bucket/file.txt/sub/child.txt", http.StatusConflict},
+		{"new directories", "/bucket/new/deep/file.txt", http.StatusOK},
+		{"existing directory", "/bucket/dir/other.txt", http.StatusOK},
+		{"overwrite", "/bucket/file.txt", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s, http.MethodPut, tt.target, "body")
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if tt.want == http.StatusConflict && !strings.Contains(w.Body.String(), "<Code>InvalidRequest</Code>") {
+				t.Errorf("body = %s, want InvalidRequest", w.Body.String())
+			}
+		})
+	}
+}
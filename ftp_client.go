@@ -1,11 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"net/textproto"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jlaffaye/ftp"
@@ -13,7 +18,31 @@ import (
 
 type FTPClient struct {
 	config *Config
-	conn   *ftp.ServerConn
+	// pool is shared by all operations unless -ftp-read-conns,
+	// -ftp-write-conns or -ftp-meta-conns give them a partition of their own
+	pool      *connPool
+	readPool  *connPool
+	writePool *connPool
+	metaPool  *connPool
+	// streams bounds the transfers holding a download and an upload
+	// connection at once, see ReserveStream
+	streams   chan struct{}
+	location  *time.Location
+	listCache *listingCache
+	// site runs SITE commands, which the ftp library doesn't expose
+	site *siteSession
+	// tls is shared by all connections so data connections can resume the
+	// control connection's TLS session, which many servers require
+	tls *tls.Config
+
+	// quirks are detected from the first connection's welcome banner
+	quirksMu       sync.Mutex
+	quirks         ftpQuirks
+	quirkOverrides map[string]bool
+	quirksDetected bool
+
+	reconnects reconnectStats
+	metrics    *metrics
 }
 
 type FileInfo struct {
@@ -21,87 +50,434 @@ type FileInfo struct {
 	Size    int64
 	ModTime time.Time
 	IsDir   bool
+
+	// HasSidecar is set by listings for objects with a metadata sidecar
+	HasSidecar bool
 }
 
 func NewFTPClient(config *Config) *FTPClient {
-	return &FTPClient{
-		config: config,
+	// LIST times carry no zone info, so they are parsed in the server's timezone
+	location, err := time.LoadLocation(config.FTPServerTimezone)
+	if err != nil {
+		location = time.UTC
+	}
+	quirkOverrides, err := ParseQuirkOverrides(config.FTPQuirks)
+	if err != nil {
+		slog.Warn("invalid FTP quirk overrides, ignoring", "error", err)
+	}
+	client := &FTPClient{
+		config:         config,
+		pool:           newConnPool(config.MaxFTPConns, config.FTPConnIdleTTL),
+		location:       location,
+		quirks:         defaultQuirks.withOverrides(quirkOverrides),
+		quirkOverrides: quirkOverrides,
+		site:           newSiteSession(config),
+	}
+	client.readPool = partitionPool(client.pool, config.FTPReadConns, config.FTPConnIdleTTL)
+	client.writePool = partitionPool(client.pool, config.FTPWriteConns, config.FTPConnIdleTTL)
+	client.metaPool = partitionPool(client.pool, config.FTPMetaConns, config.FTPConnIdleTTL)
+	client.streams = make(chan struct{}, streamSlots(client.readPool, client.writePool))
+	if config.ListCacheTTL > 0 {
+		client.listCache = newListingCache(config.ListCacheTTL)
+	}
+	if config.FTPTLS != FTPTLSNone {
+		client.tls = newFTPTLSConfig(config)
+	}
+	return client
+}
+
+// FTP TLS modes
+const (
+	FTPTLSNone     = "none"
+	FTPTLSExplicit = "explicit" // AUTH TLS on the plain control port
+	FTPTLSImplicit = "implicit" // TLS from the first byte, usually port 990
+)
+
+func newFTPTLSConfig(config *Config) *tls.Config {
+	return &tls.Config{
+		ServerName:         config.FTPHost,
+		InsecureSkipVerify: config.FTPTLSInsecureSkipVerify,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+}
+
+// dialOptions builds the ftp library options derived from the configuration
+func (c *FTPClient) dialOptions() []ftp.DialOption {
+	options := []ftp.DialOption{
+		ftp.DialWithLocation(c.location),
+	}
+
+	var dialer net.Dialer
+	if c.config.FTPLocalAddr != "" {
+		// Bind both control and data connections to the configured local IP
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(c.config.FTPLocalAddr)}
+	}
+	dialer.Timeout = c.config.FTPDialTimeout
+	options = append(options, ftp.DialWithDialer(dialer))
+	options = append(options, ftp.DialWithDialFunc(c.sessionDialFunc(dialer)))
+
+	switch c.config.FTPTLS {
+	case FTPTLSExplicit:
+		options = append(options, ftp.DialWithExplicitTLS(c.tls))
+	case FTPTLSImplicit:
+		options = append(options, ftp.DialWithTLS(c.tls))
+	}
+
+	options = append(options, c.currentQuirks().dialOptions()...)
+
+	if c.config.FTPDisableEPSV {
+		// The library negotiates a passive port for every transfer anyway
+		// and only falls back to PASV when the EPSV command itself fails,
+		// not when the server then refuses the data connection
+		options = append(options, ftp.DialWithDisabledEPSV(true))
+	}
+
+	return options
+}
+
+// acquire borrows a logged-in session from pool, one of the client's pools,
+// for the named operation. It must be handed back with release. The
+// operation gets a fresh retry budget for its sub-steps.
+func (c *FTPClient) acquire(pool *connPool, operation string) (*ftpSession, error) {
+	session := pool.get()
+	session.retries = c.config.FTPRetryBudget
+	session.operation, session.acquired = operation, time.Now()
+	// A server turning connections away with 421 gets retried like a command
+	if err := c.retry(session, func() error { return c.connect(session) }); err != nil {
+		pool.put(session)
+		return nil, err
+	}
+	return session, nil
+}
+
+func (c *FTPClient) release(session *ftpSession) {
+	c.metrics.observeFTP(session.operation, time.Since(session.acquired))
+	session.pool.put(session)
+}
+
+// LiveConnections returns the number of logged-in pooled FTP connections
+func (c *FTPClient) LiveConnections() int64 {
+	live := c.pool.live.Load()
+	for _, pool := range []*connPool{c.readPool, c.writePool, c.metaPool} {
+		if pool != c.pool {
+			live += pool.live.Load()
+		}
+	}
+	return live
+}
+
+// streamSlots is how many transfers may hold one connection while waiting
+// for the other. Each holds at most one, so they can only wait for each other
+// once they hold every connection of both pools.
+func streamSlots(readPool, writePool *connPool) int {
+	if readPool == writePool {
+		return cap(readPool.slots) - 1
 	}
+	return cap(readPool.slots) + cap(writePool.slots) - 1
 }
 
-func (c *FTPClient) connect() error {
-	if c.conn != nil {
+// ReserveStream reserves a transfer that stores a download while it is still
+// being read, holding a read and a write connection at once. It returns false
+// when that could deadlock with other such transfers, the caller then spools
+// the download first. The returned function ends the reservation.
+func (c *FTPClient) ReserveStream() (func(), bool) {
+	select {
+	case c.streams <- struct{}{}:
+		return func() { <-c.streams }, true
+	default:
+		return nil, false
+	}
+}
+
+// Close logs out of the idle pooled connections and the SITE session, for a
+// clean shutdown once no operation is running
+func (c *FTPClient) Close() {
+	closed := c.pool.closeIdle()
+	for _, pool := range []*connPool{c.readPool, c.writePool, c.metaPool} {
+		if pool != c.pool {
+			closed += pool.closeIdle()
+		}
+	}
+	c.site.close()
+	slog.Debug("closed FTP connections", "count", closed)
+}
+
+// currentQuirks returns the quirks new connections are dialed with
+func (c *FTPClient) currentQuirks() ftpQuirks {
+	c.quirksMu.Lock()
+	defer c.quirksMu.Unlock()
+
+	return c.quirks
+}
+
+func (c *FTPClient) connect(session *ftpSession) (err error) {
+	if session.conn != nil {
 		return nil
 	}
+	// New sessions fail the same way as reconnects when the server is down
+	defer func() { c.reconnects.dialed(err) }()
 
 	addr := fmt.Sprintf("%s:%d", c.config.FTPHost, c.config.FTPPort)
 	slog.Debug("connecting to FTP server", "address", addr)
 
-	conn, err := ftp.Dial(addr)
+	options := c.dialOptions()
+	var banner *bannerRecorder
+	c.quirksMu.Lock()
+	if !c.quirksDetected {
+		banner = &bannerRecorder{}
+		options = append(options, ftp.DialWithDebugOutput(banner))
+	}
+	c.quirksMu.Unlock()
+
+	release := dialLimiterFor(c.config).acquire()
+	conn, err := ftp.Dial(addr, options...)
 	if err != nil {
+		release()
+		warnConnectionLimit(err)
 		return fmt.Errorf("failed to connect to FTP server: %v", err)
 	}
 
 	slog.Debug("logging into FTP server", "username", c.config.FTPUser)
 	err = conn.Login(c.config.FTPUser, c.config.FTPPassword)
+	release()
 	if err != nil {
 		conn.Quit()
+		warnConnectionLimit(err)
 		return fmt.Errorf("failed to login to FTP server: %v", err)
 	}
 
-	c.conn = conn
+	session.conn = conn
+	session.pool.live.Add(1)
+	if banner != nil {
+		c.detectQuirks(session, banner.String())
+	}
 	return nil
 }
 
-func (c *FTPClient) reconnect() error {
-	if c.conn != nil {
-		c.conn.Quit()
-		c.conn = nil
+// detectQuirks adapts to the server software once the first connection is
+// established, redialing when the detected quirks change dial options
+func (c *FTPClient) detectQuirks(session *ftpSession, banner string) {
+	c.quirksMu.Lock()
+	if c.quirksDetected {
+		// Another session connecting at the same time got there first
+		c.quirksMu.Unlock()
+		return
+	}
+	c.quirksDetected = true
+	server, quirks := detectQuirks(banner)
+	quirks = quirks.withOverrides(c.quirkOverrides)
+	changed := quirks != c.quirks
+	c.quirks = quirks
+	c.quirksMu.Unlock()
+
+	slog.Info("detected FTP server",
+		"server", server,
+		"banner", banner,
+		"mlsd", quirks.MLSD && session.conn.IsTimePreciseInList(),
+		"mdtm", session.conn.IsGetTimeSupported(),
+		"mdtm_write", quirks.MDTMWrite,
+		"utf8", quirks.UTF8,
+	)
+
+	if !changed {
+		return
+	}
+	if err := c.reconnect(session); err != nil {
+		slog.Warn("failed to reconnect with detected FTP quirks", "error", err)
+	}
+}
+
+func (c *FTPClient) reconnect(session *ftpSession) error {
+	session.close()
+	return c.connect(session)
+}
+
+// connectionErrorCategory classifies errors that indicate a broken FTP
+// connection. It returns "" for errors that don't warrant a reconnect.
+func connectionErrorCategory(err error) string {
+	errMsg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(errMsg, "broken pipe"):
+		return "broken_pipe"
+	case strings.Contains(errMsg, "connection reset"):
+		return "connection_reset"
+	case strings.Contains(errMsg, "connection refused"):
+		return "connection_refused"
+	case strings.Contains(errMsg, "i/o timeout"):
+		return "timeout"
+	case strings.Contains(errMsg, "no connection"):
+		return "no_connection"
+	case strings.Contains(errMsg, "connection closed"),
+		strings.Contains(errMsg, "use of closed network connection"),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// Some minimal servers hang up after a command without a 421
+		return "connection_closed"
+	case isConnectionLimitError(err):
+		return "connection_limit"
 	}
-	return c.connect()
+	return ""
 }
 
-func (c *FTPClient) handleConnectionError(err error) error {
+func (c *FTPClient) handleConnectionError(session *ftpSession, err error) error {
 	if err == nil {
 		return nil
 	}
 
-	errMsg := strings.ToLower(err.Error())
-	if strings.Contains(errMsg, "broken pipe") ||
-		strings.Contains(errMsg, "connection reset") ||
-		strings.Contains(errMsg, "connection refused") ||
-		strings.Contains(errMsg, "i/o timeout") ||
-		strings.Contains(errMsg, "no connection") ||
-		strings.Contains(errMsg, "connection closed") {
-		slog.Debug("connection error detected, attempting reconnect", "error", err)
-		return c.reconnect()
+	category := connectionErrorCategory(err)
+	if category == "" {
+		return err
 	}
-	return err
+
+	// Sub-steps share the budget, so a flaky connection can't keep one
+	// operation reconnecting
+	if session.retries <= 0 {
+		slog.Debug("FTP operation used up its retry budget", "error", err, "category", category)
+		session.close()
+		return err
+	}
+	session.retries--
+
+	slog.Debug("connection error detected, attempting reconnect", "error", err, "category", category)
+	reconnErr := c.reconnect(session)
+	c.reconnects.record(category, err, reconnErr)
+	return reconnErr
 }
 
-func (c *FTPClient) List(path string) ([]FileInfo, error) {
-	if err := c.connect(); err != nil {
-		return nil, err
+// reconnectWarnInterval rate-limits the reconnect warning log
+const reconnectWarnInterval = 10 * time.Second
+
+// reconnectStats counts reconnects by triggering error category and tracks
+// consecutive failed connection attempts to detect a degraded backend
+type reconnectStats struct {
+	mu                  sync.Mutex
+	counts              map[string]uint64
+	consecutiveFailures int
+	lastWarn            time.Time
+	suppressed          int
+}
+
+func (rs *reconnectStats) record(category string, cause, reconnErr error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.counts == nil {
+		rs.counts = make(map[string]uint64)
 	}
+	rs.counts[category]++
 
+	if time.Since(rs.lastWarn) < reconnectWarnInterval {
+		rs.suppressed++
+		return
+	}
+	slog.Warn("FTP connection error triggered a reconnect",
+		"category", category,
+		"error", cause,
+		"reconnect_error", reconnErr,
+		"consecutive_failures", rs.consecutiveFailures,
+		"suppressed_since_last_warning", rs.suppressed,
+	)
+	rs.lastWarn = time.Now()
+	rs.suppressed = 0
+}
+
+// dialed tracks the outcome of an attempt to connect, for new sessions and
+// reconnects alike
+func (rs *reconnectStats) dialed(err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if err != nil {
+		rs.consecutiveFailures++
+	} else {
+		rs.consecutiveFailures = 0
+	}
+}
+
+// ReconnectCounts returns the number of reconnects per error category
+func (c *FTPClient) ReconnectCounts() map[string]uint64 {
+	c.reconnects.mu.Lock()
+	defer c.reconnects.mu.Unlock()
+
+	counts := make(map[string]uint64, len(c.reconnects.counts))
+	for category, count := range c.reconnects.counts {
+		counts[category] = count
+	}
+	return counts
+}
+
+// Degraded reports whether the last connection attempts kept failing
+func (c *FTPClient) Degraded() bool {
+	c.reconnects.mu.Lock()
+	defer c.reconnects.mu.Unlock()
+
+	return c.config.FTPDegradedAfter > 0 && c.reconnects.consecutiveFailures >= c.config.FTPDegradedAfter
+}
+
+// isQuotaError reports whether err is an FTP reply signalling exhausted
+// storage: 452 (insufficient storage) or 552 (exceeded storage allocation)
+func isQuotaError(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code == ftp.Status452 || protoErr.Code == ftp.StatusExceededStorage
+	}
+	errMsg := err.Error()
+	return strings.HasPrefix(errMsg, "452 ") || strings.HasPrefix(errMsg, "552 ")
+}
+
+// isPermissionError reports whether err is an FTP reply denying access. Such
+// replies usually share code 550 with missing paths, so the reply text decides.
+func isPermissionError(err error) bool {
+	var protoErr *textproto.Error
+	msg := err.Error()
+	if errors.As(err, &protoErr) {
+		switch protoErr.Code {
+		case ftp.StatusNotLoggedIn, ftp.StatusFileActionIgnored, ftp.StatusFileUnavailable, ftp.StatusBadFileName:
+		default:
+			return false
+		}
+		msg = protoErr.Msg
+	}
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "permission") || strings.Contains(msg, "denied") || strings.Contains(msg, "not allowed")
+}
+
+func (c *FTPClient) List(path string) ([]FileInfo, error) {
 	// Clean the path and remove leading slash
 	path = strings.TrimPrefix(filepath.Clean(path), "/")
 	if path == "" {
 		path = "."
 	}
 
+	if files, ok := c.CachedList(path); ok {
+		slog.Debug("using cached FTP directory listing", "path", path)
+		return files, nil
+	}
+	return c.ListUncached(path)
+}
+
+// ListUncached lists path on the FTP server even when a cached listing is
+// still fresh, and caches the result
+func (c *FTPClient) ListUncached(path string) ([]FileInfo, error) {
+	path = strings.TrimPrefix(filepath.Clean(path), "/")
+	if path == "" {
+		path = "."
+	}
+
+	session, err := c.acquire(c.metaPool, "list")
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(session)
+
 	slog.Debug("listing FTP directory", "path", path)
 
-	entries, err := c.conn.List(path)
+	var entries []*ftp.Entry
+	err = c.retry(session, func() error {
+		entries, err = session.conn.List(path)
+		return err
+	})
 	if err != nil {
-		if reconnErr := c.handleConnectionError(err); reconnErr != nil {
-			return nil, fmt.Errorf("failed to list directory: %v", err)
-		}
-		// Try again after reconnection
-		entries, err = c.conn.List(path)
-		if err != nil {
-			return nil, fmt.Errorf("failed to list directory after reconnect: %v", err)
-		}
+		return nil, fmt.Errorf("failed to list directory: %w", err)
 	}
 
 	var files []FileInfo
@@ -118,114 +494,440 @@ func (c *FTPClient) List(path string) ([]FileInfo, error) {
 			"time", entry.Time,
 		)
 
-		files = append(files, FileInfo{
-			Name:    entry.Name,
+		// Some servers mark directories with a trailing slash or return
+		// names with the listed path in front, keys need the bare name
+		name := strings.TrimSuffix(entry.Name, "/")
+		name = name[strings.LastIndex(name, "/")+1:]
+		if name == "" || name == "." || name == ".." {
+			continue
+		}
+
+		file := FileInfo{
+			Name:    name,
 			Size:    int64(entry.Size),
 			ModTime: entry.Time,
-			IsDir:   entry.Type == ftp.EntryTypeFolder,
-		})
+			IsDir:   entry.Type == ftp.EntryTypeFolder || strings.HasSuffix(entry.Name, "/"),
+		}
+		if !file.IsDir && !c.plausibleSize(file.Size) {
+			file.Size = c.correctListedSize(session, filepath.Join(path, name), file.Size)
+		}
+		files = append(files, file)
 	}
 
+	if c.listCache != nil {
+		c.listCache.put(path, files)
+	}
 	return files, nil
 }
 
+// plausibleSize reports whether a listed size could be real. Buggy servers
+// print sizes that overflowed, which parse as huge or negative numbers.
+func (c *FTPClient) plausibleSize(size int64) bool {
+	return size >= 0 && size <= c.config.MaxObjectSize
+}
+
+// correctListedSize replaces an implausible listed size with the one SIZE
+// reports, or 0 when that doesn't help either
+func (c *FTPClient) correctListedSize(session *ftpSession, path string, listed int64) int64 {
+	if c.config.ListSizeRecheck {
+		size, err := session.conn.FileSize(path)
+		if err == nil && c.plausibleSize(size) {
+			slog.Warn("corrected implausible size in FTP listing", "path", path, "listed", listed, "size", size)
+			return size
+		}
+		slog.Debug("SIZE didn't confirm listed size", "path", path, "error", err, "size", size)
+	}
+	slog.Warn("reporting implausible size in FTP listing as 0", "path", path, "listed", listed)
+	return 0
+}
+
+// FlushListings drops every cached directory listing and returns how many
+// there were
+func (c *FTPClient) FlushListings() int {
+	if c.listCache == nil {
+		return 0
+	}
+	return c.listCache.flush()
+}
+
+// CachedList returns the cached listing of path without contacting the FTP
+// server. It reports false when the listing cache is disabled or has no entry.
+func (c *FTPClient) CachedList(path string) ([]FileInfo, bool) {
+	if c.listCache == nil {
+		return nil, false
+	}
+	path = strings.TrimPrefix(filepath.Clean(path), "/")
+	if path == "" {
+		path = "."
+	}
+	return c.listCache.get(path)
+}
+
+// invalidateListing drops cached listings affected by a change to path
+func (c *FTPClient) invalidateListing(path string) {
+	if c.listCache != nil {
+		c.listCache.invalidate(path)
+	}
+}
+
+// IsDir reports whether path is an existing directory on the FTP server
+func (c *FTPClient) IsDir(path string) (bool, error) {
+	// Cached listings answer without FTP: the parent's has the entry, and
+	// a listing of path itself means a directory, unless it is the single
+	// entry some servers list for a file
+	base := filepath.Base(path)
+	if files, ok := c.CachedList(filepath.Dir(path)); ok {
+		for _, file := range files {
+			if file.Name == base {
+				return file.IsDir, nil
+			}
+		}
+		return false, nil
+	}
+	if files, ok := c.CachedList(path); ok && !(len(files) == 1 && !files[0].IsDir && files[0].Name == base) {
+		return true, nil
+	}
+	session, err := c.acquire(c.metaPool, "is_dir")
+	if err != nil {
+		return false, err
+	}
+	defer c.release(session)
+
+	// Clean the path and remove leading slash
+	path = strings.TrimPrefix(filepath.Clean(path), "/")
+	return c.directoryExists(session, path), nil
+}
+
+// Ping checks that the FTP server is reachable and the session is usable
+func (c *FTPClient) Ping() error {
+	session, err := c.acquire(c.metaPool, "ping")
+	if err != nil {
+		return err
+	}
+	defer c.release(session)
+
+	err = session.conn.NoOp()
+	if err != nil {
+		if reconnErr := c.handleConnectionError(session, err); reconnErr != nil {
+			return err
+		}
+		// Try again after reconnection
+		return session.conn.NoOp()
+	}
+	return nil
+}
+
+// FileSize returns the size of the file at path as reported by SIZE
+func (c *FTPClient) FileSize(path string) (int64, error) {
+	session, err := c.acquire(c.metaPool, "size")
+	if err != nil {
+		return 0, err
+	}
+	defer c.release(session)
+
+	// Clean the path and remove leading slash
+	path = strings.TrimPrefix(filepath.Clean(path), "/")
+	slog.Debug("getting file size from FTP", "path", path)
+	var size int64
+	err = c.retry(session, func() error {
+		size, err = session.conn.FileSize(path)
+		return err
+	})
+	return size, err
+}
+
+// errMDTMDisabled is returned by ModTime when -use-mdtm is off
+var errMDTMDisabled = errors.New("MDTM is disabled by -use-mdtm")
+
+// ModTime returns the modification time reported by MDTM, which is always UTC.
+// Callers fall back to the LIST time when it fails.
+func (c *FTPClient) ModTime(path string) (time.Time, error) {
+	if !c.config.UseMDTM {
+		return time.Time{}, errMDTMDisabled
+	}
+	session, err := c.acquire(c.metaPool, "mod_time")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer c.release(session)
+
+	// Clean the path and remove leading slash
+	path = strings.TrimPrefix(filepath.Clean(path), "/")
+	if !session.conn.IsGetTimeSupported() {
+		return time.Time{}, fmt.Errorf("MDTM is not supported by the FTP server")
+	}
+
+	slog.Debug("getting modification time from FTP", "path", path)
+	var modTime time.Time
+	err = c.retry(session, func() error {
+		modTime, err = session.conn.GetTime(path)
+		return err
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return modTime.UTC(), nil
+}
+
 func (c *FTPClient) Get(path string) (io.ReadCloser, error) {
-	if err := c.connect(); err != nil {
+	return c.GetFrom(path, 0)
+}
+
+// errRESTUnsupported is returned by GetFrom when the server can't resume
+// downloads at an offset
+var errRESTUnsupported = errors.New("REST is not supported by the FTP server")
+
+// GetFrom retrieves the file at path starting at offset, using REST
+func (c *FTPClient) GetFrom(path string, offset int64) (io.ReadCloser, error) {
+	if offset > 0 && !c.currentQuirks().REST {
+		return nil, errRESTUnsupported
+	}
+	session, err := c.acquire(c.readPool, "get")
+	if err != nil {
 		return nil, err
 	}
 
 	// Clean the path and remove leading slash
 	path = strings.TrimPrefix(filepath.Clean(path), "/")
-	slog.Debug("retrieving file from FTP", "path", path)
+	slog.Debug("retrieving file from FTP", "path", path, "offset", offset)
 
-	reader, err := c.conn.Retr(path)
+	var reader *ftp.Response
+	err = c.retry(session, func() error {
+		reader, err = session.conn.RetrFrom(path, uint64(offset))
+		return err
+	})
 	if err != nil {
-		if reconnErr := c.handleConnectionError(err); reconnErr != nil {
-			return nil, err
+		c.release(session)
+		if offset > 0 && isCommandUnsupported(err) {
+			slog.Info("FTP server rejected REST, serving ranges without it", "error", err)
+			c.quirksMu.Lock()
+			c.quirks.REST = false
+			c.quirksMu.Unlock()
+			return nil, errRESTUnsupported
 		}
-		// Try again after reconnection
-		reader, err = c.conn.Retr(path)
-		if err != nil {
-			return nil, err
+		return nil, err
+	}
+
+	// The session stays borrowed until the download is closed. One closed
+	// early, like a range, is aborted with a 426 some servers follow with a
+	// late 226, which would answer the session's next command, so the
+	// session isn't reused.
+	return &pooledResponse{Response: reader, release: func(err error, complete bool) {
+		if !complete {
+			slog.Debug("discarding FTP session after an interrupted download", "path", path, "error", err)
+			session.close()
+		} else if err != nil && connectionErrorCategory(err) != "" {
+			session.close()
 		}
+		c.release(session)
+	}}, nil
+}
+
+// isCommandUnsupported reports whether err is a reply rejecting the command
+// itself: 500 (unrecognized), 502 (not implemented) or 504 (parameter not
+// implemented)
+func isCommandUnsupported(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code == 500 || protoErr.Code == 502 || protoErr.Code == 504
 	}
-	return reader, nil
+	return false
 }
 
 func (c *FTPClient) Put(path string, reader io.Reader) error {
-	if err := c.connect(); err != nil {
+	session, err := c.acquire(c.writePool, "put")
+	if err != nil {
 		return err
 	}
+	defer c.release(session)
 
 	// Clean the path and remove leading slash
 	path = strings.TrimPrefix(filepath.Clean(path), "/")
 	slog.Debug("storing file to FTP", "path", path)
+	defer c.invalidateListing(path)
 
 	// Create parent directories if they don't exist
 	dir := filepath.Dir(path)
 	if dir != "." {
-		if err := c.createDirectories(dir); err != nil {
-			if reconnErr := c.handleConnectionError(err); reconnErr != nil {
-				return fmt.Errorf("failed to create directories: %v", err)
-			}
-			// Try creating directories again after reconnection
-			if err := c.createDirectories(dir); err != nil {
-				return fmt.Errorf("failed to create directories after reconnect: %v", err)
-			}
+		if err := c.createDirectories(session, dir); err != nil {
+			return fmt.Errorf("failed to create directories: %w", err)
 		}
 	}
 
-	err := c.conn.Stor(path, reader)
-	if err != nil {
-		if reconnErr := c.handleConnectionError(err); reconnErr != nil {
-			return err
+	// A store is only retried when the body can start over, not after part
+	// of a body that can't be rewound was consumed
+	body := &storBody{reader: reader}
+	var storErr error
+	err = c.retry(session, func() error {
+		if storErr != nil && !body.rewind() {
+			return fmt.Errorf("connection lost after %d bytes were sent, the upload can't be resent: %w", body.sent, storErr)
 		}
-		// Try storing again after reconnection
-		err = c.conn.Stor(path, reader)
-		if err != nil {
-			return err
+		storErr = session.conn.Stor(path, body)
+		return storErr
+	})
+	if err != nil && isQuotaError(err) {
+		// Don't leave a partial file behind when the server ran out of space
+		slog.Debug("FTP storage exhausted, removing partial file", "path", path, "error", err)
+		if delErr := session.conn.Delete(path); delErr != nil {
+			slog.Debug("failed to remove partial file", "path", path, "error", delErr)
 		}
 	}
-	return nil
+	return err
+}
+
+// storBody counts the bytes STOR read from an upload body, so a store that
+// failed on a dropped connection is only retried when it can start over
+type storBody struct {
+	reader io.Reader
+	sent   int64
+}
+
+func (b *storBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.sent += int64(n)
+	return n, err
+}
+
+// rewind prepares the body to be sent again from its start. It fails when
+// bytes were read from a body that isn't seekable.
+func (b *storBody) rewind() bool {
+	if b.sent == 0 {
+		return true
+	}
+	seeker, ok := b.reader.(io.Seeker)
+	if !ok {
+		return false
+	}
+	if _, err := seeker.Seek(-b.sent, io.SeekCurrent); err != nil {
+		return false
+	}
+	b.sent = 0
+	return true
 }
 
 func (c *FTPClient) Delete(path string) error {
-	if err := c.connect(); err != nil {
+	session, err := c.acquire(c.metaPool, "delete")
+	if err != nil {
 		return err
 	}
+	defer c.release(session)
 
 	// Clean the path and remove leading slash
 	path = strings.TrimPrefix(filepath.Clean(path), "/")
 	slog.Debug("deleting file from FTP", "path", path)
+	defer c.invalidateListing(path)
+
+	return c.retry(session, func() error {
+		return session.conn.Delete(path)
+	})
+}
 
-	err := c.conn.Delete(path)
+// Rename moves the file at from to to with RNFR and RNTO, creating the
+// parent directories of to first
+func (c *FTPClient) Rename(from, to string) error {
+	session, err := c.acquire(c.metaPool, "rename")
 	if err != nil {
-		if reconnErr := c.handleConnectionError(err); reconnErr != nil {
-			return err
-		}
-		// Try deleting again after reconnection
-		err = c.conn.Delete(path)
-		if err != nil {
-			return err
+		return err
+	}
+	defer c.release(session)
+
+	// Clean the paths and remove leading slashes
+	from = strings.TrimPrefix(filepath.Clean(from), "/")
+	to = strings.TrimPrefix(filepath.Clean(to), "/")
+	slog.Debug("renaming file on FTP", "from", from, "to", to)
+	defer c.invalidateListing(from)
+	defer c.invalidateListing(to)
+
+	dir := filepath.Dir(to)
+	if dir != "." {
+		if err := c.createDirectories(session, dir); err != nil {
+			return fmt.Errorf("failed to create directories: %w", err)
 		}
 	}
-	return nil
+
+	return c.retry(session, func() error {
+		return session.conn.Rename(from, to)
+	})
+}
+
+// MakeDir creates path and any missing parent directories
+func (c *FTPClient) MakeDir(path string) error {
+	session, err := c.acquire(c.metaPool, "make_dir")
+	if err != nil {
+		return err
+	}
+	defer c.release(session)
+
+	// Clean the path and remove leading slash
+	path = strings.TrimPrefix(filepath.Clean(path), "/")
+	defer c.invalidateListing(path)
+
+	return c.createDirectories(session, path)
 }
 
-func (c *FTPClient) directoryExists(path string) bool {
+// RemoveDir removes the empty directory at path
+func (c *FTPClient) RemoveDir(path string) error {
+	session, err := c.acquire(c.metaPool, "remove_dir")
+	if err != nil {
+		return err
+	}
+	defer c.release(session)
+
+	// Clean the path and remove leading slash
+	path = strings.TrimPrefix(filepath.Clean(path), "/")
+	slog.Debug("removing FTP directory", "path", path)
+	defer c.invalidateListing(path)
+
+	return c.retry(session, func() error {
+		return session.conn.RemoveDir(path)
+	})
+}
+
+// directoryExists reports whether path is an existing directory. LIST of a
+// missing path succeeds with no entries on some servers, so this changes into
+// the directory and back instead.
+func (c *FTPClient) directoryExists(session *ftpSession, path string) bool {
 	if path == "" || path == "." {
 		return true
 	}
 
-	// Try to list the directory
-	entries, err := c.conn.List(path)
+	cwd, err := session.conn.CurrentDir()
 	if err != nil {
 		return false
 	}
-	return len(entries) >= 0 // If we can list it, it exists
+	if err := session.conn.ChangeDir(path); err != nil {
+		return false
+	}
+	if err := session.conn.ChangeDir(cwd); err != nil {
+		slog.Warn("failed to restore FTP working directory", "path", cwd, "error", err)
+	}
+	return true
+}
+
+// isAlreadyExistsError reports whether a MKD error means the directory is
+// already there
+func isAlreadyExistsError(err error) bool {
+	errMsg := strings.ToLower(err.Error())
+	return strings.Contains(errMsg, "file exists") ||
+		strings.Contains(errMsg, "directory exists") ||
+		strings.Contains(errMsg, "already exists")
 }
 
-func (c *FTPClient) createDirectories(path string) error {
+// makeDir creates a single directory, treating an existing directory as
+// success so concurrent creation of the same path never fails
+func (c *FTPClient) makeDir(session *ftpSession, path string) error {
+	err := session.conn.MakeDir(path)
+	if err == nil {
+		return nil
+	}
+	if isAlreadyExistsError(err) || c.directoryExists(session, path) {
+		slog.Debug("directory already exists, continuing", "path", path)
+		return nil
+	}
+	return err
+}
+
+func (c *FTPClient) createDirectories(session *ftpSession, path string) error {
 	// Split path into components and remove leading slash
 	path = strings.TrimPrefix(filepath.Clean(path), "/")
 	parts := strings.Split(path, "/")
@@ -240,51 +942,13 @@ func (c *FTPClient) createDirectories(path string) error {
 		} else {
 			current = current + "/" + part
 		}
-		slog.Debug("checking directory", "path", current)
-
-		// First check if directory exists
-		if c.directoryExists(current) {
-			slog.Debug("directory already exists", "path", current)
-			continue
-		}
 
 		slog.Debug("creating FTP directory", "path", current)
-		err := c.conn.MakeDir(current)
+		err := c.retry(session, func() error {
+			return c.makeDir(session, current)
+		})
 		if err != nil {
-			// Even if we checked, the directory might have been created in the meantime
-			// So still handle "directory exists" errors gracefully
-			errMsg := strings.ToLower(err.Error())
-			if strings.Contains(errMsg, "file exists") ||
-				strings.Contains(errMsg, "directory exists") ||
-				strings.Contains(errMsg, "already exists") ||
-				strings.Contains(errMsg, "cannot create") ||
-				strings.Contains(errMsg, "create directory operation failed") {
-				slog.Debug("directory already exists (race condition), continuing", "path", current)
-				continue
-			}
-
-			// Handle connection errors
-			if reconnErr := c.handleConnectionError(err); reconnErr != nil {
-				return err
-			}
-			// Try creating directory again after reconnection
-			if c.directoryExists(current) {
-				slog.Debug("directory exists after reconnect", "path", current)
-				continue
-			}
-			err = c.conn.MakeDir(current)
-			if err != nil {
-				errMsg := strings.ToLower(err.Error())
-				if strings.Contains(errMsg, "file exists") ||
-					strings.Contains(errMsg, "directory exists") ||
-					strings.Contains(errMsg, "already exists") ||
-					strings.Contains(errMsg, "cannot create") ||
-					strings.Contains(errMsg, "create directory operation failed") {
-					slog.Debug("directory already exists after reconnect (race condition), continuing", "path", current)
-					continue
-				}
-				return err
-			}
+			return err
 		}
 	}
 
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsAlreadyExistsError(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  bool
+	}{
+		{"550 a: File exists", true},
+		{"550 Directory exists", true},
+		{"550 directory already exists", true},
+		{"521 \"/a\" directory already exists", true},
+		{"550 Create directory operation failed.", false},
+		{"550 Permission denied", false},
+	}
+	for _, tt := range tests {
+		if got := isAlreadyExistsError(errors.New(tt.reply)); got != tt.want {
+			t.Errorf("isAlreadyExistsError(%q) = %v, want %v", tt.reply, got, tt.want)
+		}
+	}
+}
+
+func TestConcurrentCreateDirectories(t *testing.T) {
+	tests := []struct {
+		name      string
+		mkdExists string
+	}{
+		{"exists reply", "directory already exists"},
+		// vsftpd doesn't say why MKD failed, the directory is checked with CWD
+		{"unspecific reply", "Create directory operation failed."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := startFakeFTP(t, nil)
+			f.mu.Lock()
+			f.mkdExists = tt.mkdExists
+			f.mu.Unlock()
+			s := newTestServer(t, f, "-max-ftp-conns", "8")
+
+			const writers = 16
+			var wg sync.WaitGroup
+			errs := make(chan error, writers)
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs <- s.ftp.Put(fmt.Sprintf("deep/a/b/c/d/file-%d.txt", i), strings.NewReader("x"))
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Errorf("concurrent Put failed: %v", err)
+				}
+			}
+			for i := 0; i < writers; i++ {
+				if _, ok := f.file(fmt.Sprintf("/deep/a/b/c/d/file-%d.txt", i)); !ok {
+					t.Errorf("file-%d.txt is missing", i)
+				}
+			}
+		})
+	}
+}
+
+func TestDisableEPSV(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "content"})
+	f.mu.Lock()
+	f.pasvOnly = true
+	f.mu.Unlock()
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"EPSV", nil, http.StatusInternalServerError},
+		{"PASV", []string{"-ftp-disable-epsv"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, f, append([]string{"-subdir-buckets"}, tt.args...)...)
+			// Every transfer needs its own PASV, so repeat them
+			for i := 0; i < 3; i++ {
+				if w := serve(s, http.MethodGet, "/bucket/file.txt", ""); w.Code != tt.want {
+					t.Fatalf("GET %d: status = %d, want %d: %s", i, w.Code, tt.want, w.Body.String())
+				}
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if w := serve(s, http.MethodPut, "/bucket/new.txt", "new"); w.Code != http.StatusOK {
+				t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+			}
+			if w := serve(s, http.MethodGet, "/bucket?list-type=2", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "new.txt") {
+				t.Fatalf("listing: status = %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestFTPLocalAddr(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "content"})
+	// Any 127/8 address is local on Linux, unlike the default 127.0.0.1
+	s := newTestServer(t, f, "-subdir-buckets", "-ftp-local-addr", "127.0.0.2")
+
+	if w := serve(s, http.MethodGet, "/bucket/file.txt", ""); w.Code != http.StatusOK {
+		t.Fatalf("GET: status = %d: %s", w.Code, w.Body.String())
+	}
+	ips := f.connectedFrom()
+	// A control and a data connection at least
+	if len(ips) < 2 {
+		t.Fatalf("connections = %v, want control and data", ips)
+	}
+	for _, ip := range ips {
+		if ip != "127.0.0.2" {
+			t.Errorf("connection from %s, want 127.0.0.2", ip)
+		}
+	}
+}
+
+func TestReconnectCounted(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "content"})
+	s := newTestServer(t, f, "-subdir-buckets", "-ftp-degraded-after", "2", "-ftp-retry-backoff", "0")
+
+	// Establish the session first, then drop it during a command
+	if w := serve(s, http.MethodGet, "/bucket/file.txt", ""); w.Code != http.StatusOK {
+		t.Fatalf("GET: status = %d: %s", w.Code, w.Body.String())
+	}
+	f.mu.Lock()
+	f.hangUp = "SIZE"
+	f.mu.Unlock()
+	if w := serve(s, http.MethodGet, "/bucket/file.txt", ""); w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Fatalf("GET after the connection dropped: status = %d: %s", w.Code, w.Body.String())
+	}
+	if got := s.ftp.ReconnectCounts()["connection_closed"]; got != 1 {
+		t.Errorf("connection_closed reconnects = %d, want 1 (all: %v)", got, s.ftp.ReconnectCounts())
+	}
+	if s.ftp.Degraded() {
+		t.Error("degraded after a successful reconnect")
+	}
+
+	// Reconnects that keep failing mark the backend degraded
+	f.mu.Lock()
+	f.hangUp = "SIZE"
+	f.refuse = true
+	f.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if w := serve(s, http.MethodGet, "/bucket/file.txt", ""); w.Code == http.StatusOK {
+			t.Fatalf("GET %d succeeded without a server", i)
+		}
+	}
+	if w := serve(s, http.MethodGet, "/ready", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("ready with a failing backend: status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestPartitionedPools(t *testing.T) {
+	const stall = time.Second
+	f := startFakeFTP(t, map[string]string{
+		"/bucket/big.bin":  strings.Repeat("x", 1<<20),
+		"/bucket/list.txt": "x",
+	})
+	f.mu.Lock()
+	f.retrStall = stall
+	f.mu.Unlock()
+
+	// listDuringDownload times a listing made while a download holds its
+	// connection, stalled on the FTP server
+	listDuringDownload := func(t *testing.T, s *S3Server) time.Duration {
+		t.Helper()
+		retrs := f.retrCount()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			serve(s, http.MethodGet, "/bucket/big.bin", "")
+		}()
+		t.Cleanup(func() { <-done })
+		for f.retrCount() == retrs {
+			time.Sleep(time.Millisecond)
+		}
+		start := time.Now()
+		if w := serve(s, http.MethodGet, "/bucket?list-type=2", ""); w.Code != http.StatusOK {
+			t.Fatalf("list: status = %d: %s", w.Code, w.Body.String())
+		}
+		return time.Since(start)
+	}
+
+	t.Run("shared", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets", "-max-ftp-conns", "1")
+		if _, ok := s.ftp.ReserveStream(); ok {
+			t.Error("a single shared connection can stream between a download and an upload")
+		}
+		if elapsed := listDuringDownload(t, s); elapsed < stall/2 {
+			t.Errorf("listing took %v, want it to wait for the download's connection", elapsed)
+		}
+	})
+
+	t.Run("partitioned", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets", "-max-ftp-conns", "1",
+			"-ftp-read-conns", "1", "-ftp-write-conns", "1", "-ftp-meta-conns", "1")
+		release, ok := s.ftp.ReserveStream()
+		if !ok {
+			t.Fatal("read and write partitions can't stream between each other")
+		}
+		release()
+		if elapsed := listDuringDownload(t, s); elapsed >= stall/2 {
+			t.Errorf("listing took %v while a download held the read pool", elapsed)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// dialLimiter bounds how many FTP connections are being established at once
+// across the gateway. Servers that cap connections per client IP reply 421
+// when a burst of workers connects simultaneously.
+type dialLimiter struct {
+	slots chan struct{}
+}
+
+var (
+	sharedDialLimiterOnce sync.Once
+	sharedDialLimiter     *dialLimiter
+)
+
+// dialLimiterFor returns the limiter shared by all FTP clients, nil when
+// -ftp-dial-concurrency is 0
+func dialLimiterFor(config *Config) *dialLimiter {
+	sharedDialLimiterOnce.Do(func() {
+		if config.FTPDialConcurrency > 0 {
+			sharedDialLimiter = &dialLimiter{slots: make(chan struct{}, config.FTPDialConcurrency)}
+		}
+	})
+	return sharedDialLimiter
+}
+
+// acquire blocks until a connection may be established and returns the
+// function releasing the slot once the login finished
+func (l *dialLimiter) acquire() func() {
+	if l == nil {
+		return func() {}
+	}
+	l.slots <- struct{}{}
+	return func() { <-l.slots }
+}
+
+// isConnectionLimitError reports whether err is a 421 reply, which servers
+// send when refusing a connection over their per-client limit
+func isConnectionLimitError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "421")
+}
+
+// warnConnectionLimit points the operator at the settings that open FTP
+// connections when the server refused one with 421
+func warnConnectionLimit(err error) {
+	if isConnectionLimitError(err) {
+		slog.Warn("FTP server refused a connection, likely over its per-client connection limit; "+
+			"lower -ftp-dial-concurrency or the worker counts", "error", err)
+	}
+}
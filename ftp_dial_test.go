@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDialConcurrencyLimit(t *testing.T) {
+	f := startFakeFTP(t, nil)
+	f.mu.Lock()
+	f.loginDelay = 50 * time.Millisecond
+	f.mu.Unlock()
+	config := testConfig(t, f, "-max-ftp-conns", "8")
+	c := NewFTPClient(config)
+	t.Cleanup(c.Close)
+	// The limiter is shared by the whole process, the first config sets it
+	limit := cap(dialLimiterFor(config).slots)
+
+	// Growing the pool under load opens every session at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Ping(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.logins < 2 {
+		t.Fatalf("%d logins, want the pool to grow", f.logins)
+	}
+	if f.maxLoggingIn > limit {
+		t.Errorf("%d connections established at once, want at most %d", f.maxLoggingIn, limit)
+	}
+}
+
+func TestIsConnectionLimitError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("421 Too many connections (8) from this IP"), true},
+		{errors.New("failed to connect to FTP server: 421 Sorry, max 4 users"), true},
+		{errors.New("530 Login incorrect"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isConnectionLimitError(tt.err); got != tt.want {
+			t.Errorf("isConnectionLimitError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
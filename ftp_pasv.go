@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+)
+
+// dataAddress is where a data connection to address, as advertised by the
+// server in its PASV reply, is opened. EPSV replies carry no host and the
+// library already fills in the control connection's.
+func (c *FTPClient) dataAddress(controlHost, address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == controlHost || !c.config.FTPIgnorePasvIP {
+		return address
+	}
+	slog.Debug("ignoring FTP passive-mode address",
+		"advertised", address,
+		"control_host", controlHost,
+	)
+	return net.JoinHostPort(controlHost, port)
+}
+
+// logUnreachableDataAddress points at -ftp-ignore-pasv-ip when a data
+// connection to a passive-mode address other than the control connection's
+// host fails, the usual sign of a server behind NAT advertising its private
+// address
+func (c *FTPClient) logUnreachableDataAddress(controlHost, address string, err error) {
+	host, _, splitErr := net.SplitHostPort(address)
+	if splitErr != nil || host == controlHost {
+		return
+	}
+	slog.Warn("FTP data connection to the server's passive-mode address failed, the server may be advertising an address that is unreachable from here; -ftp-ignore-pasv-ip connects to the control connection's host instead",
+		"advertised", address,
+		"control_host", controlHost,
+		"error", err,
+	)
+}
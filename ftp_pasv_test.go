@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIgnorePasvIP(t *testing.T) {
+	var logs bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+
+	// The fake only listens on 127.0.0.1, so data connections to the
+	// advertised 127.0.0.2 are refused
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "content"})
+	f.mu.Lock()
+	f.pasvHost = "127,0,0,2"
+	f.mu.Unlock()
+
+	t.Run("advertised address", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets", "-ftp-disable-epsv", "-ftp-retry-budget", "0")
+		if w := serve(s, http.MethodGet, "/bucket/file.txt", ""); w.Code == http.StatusOK {
+			t.Fatal("GET succeeded over an unreachable passive-mode address")
+		}
+		if !strings.Contains(logs.String(), "-ftp-ignore-pasv-ip") || !strings.Contains(logs.String(), "advertised=127.0.0.2:") {
+			t.Errorf("unreachable passive-mode address wasn't reported: %s", logs.String())
+		}
+	})
+
+	t.Run("control connection's host", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets", "-ftp-disable-epsv", "-ftp-ignore-pasv-ip")
+		if w := serve(s, http.MethodGet, "/bucket/file.txt", ""); w.Code != http.StatusOK || w.Body.String() != "content" {
+			t.Fatalf("GET: status = %d: %s", w.Code, w.Body.String())
+		}
+		if w := serve(s, http.MethodPut, "/bucket/new.txt", "new"); w.Code != http.StatusOK {
+			t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+		}
+		if body, _ := f.file("/bucket/new.txt"); body != "new" {
+			t.Errorf("stored %q, want new", body)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpSession is one FTP control connection. A session is used by a single
+// operation at a time, which owns it between acquire and release.
+type ftpSession struct {
+	conn     *ftp.ServerConn
+	pool     *connPool
+	lastUsed time.Time
+
+	// operation names the current use and acquired when it began, for -metrics
+	operation string
+	acquired  time.Time
+
+	// retries is what is left of the operation's -ftp-retry-budget
+	retries int
+}
+
+// close logs out and marks the session for a fresh login on its next use
+func (s *ftpSession) close() {
+	if s.conn != nil {
+		s.conn.Quit()
+		s.conn = nil
+		s.pool.live.Add(-1)
+	}
+}
+
+// connPool hands out FTP sessions to concurrent operations, at most size at
+// once. Released sessions are kept for reuse until idle for longer than
+// idleTTL.
+type connPool struct {
+	slots   chan struct{}
+	idleTTL time.Duration
+	// live counts the pool's logged-in sessions, idle or in use
+	live atomic.Int64
+
+	mu   sync.Mutex
+	idle []*ftpSession
+}
+
+func newConnPool(size int, idleTTL time.Duration) *connPool {
+	if size < 1 {
+		size = 1
+	}
+	p := &connPool{
+		slots:   make(chan struct{}, size),
+		idleTTL: idleTTL,
+	}
+	if idleTTL > 0 {
+		go p.reapIdle()
+	}
+	return p
+}
+
+// get blocks until a session is available. The most recently used idle
+// session is preferred, it is the least likely to have been dropped by the
+// server; the returned session may still need to log in.
+func (p *connPool) get() *ftpSession {
+	p.slots <- struct{}{}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n := len(p.idle); n > 0 {
+		session := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		return session
+	}
+	return &ftpSession{pool: p}
+}
+
+// put returns a session obtained from get. Sessions without a connection are
+// dropped.
+func (p *connPool) put(session *ftpSession) {
+	if session.conn != nil {
+		session.lastUsed = time.Now()
+		p.mu.Lock()
+		p.idle = append(p.idle, session)
+		p.mu.Unlock()
+	}
+	<-p.slots
+}
+
+// partitionPool returns a pool of its own for one kind of operation when size
+// is set, and the shared pool otherwise
+func partitionPool(shared *connPool, size int, idleTTL time.Duration) *connPool {
+	if size <= 0 {
+		return shared
+	}
+	return newConnPool(size, idleTTL)
+}
+
+// reapIdle closes sessions idle for longer than the TTL, so the FTP server
+// doesn't hold logins for a quiet gateway
+func (p *connPool) reapIdle() {
+	ticker := time.NewTicker(p.idleTTL / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expired []*ftpSession
+		p.mu.Lock()
+		kept := p.idle[:0]
+		for _, session := range p.idle {
+			if time.Since(session.lastUsed) > p.idleTTL {
+				expired = append(expired, session)
+			} else {
+				kept = append(kept, session)
+			}
+		}
+		p.idle = kept
+		p.mu.Unlock()
+
+		for _, session := range expired {
+			session.close()
+		}
+		if len(expired) > 0 {
+			slog.Debug("closed idle FTP connections", "count", len(expired))
+		}
+	}
+}
+
+// closeIdle logs out of all idle sessions and returns how many there were.
+// Sessions in use are left to their operations.
+func (p *connPool) closeIdle() int {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	for _, session := range idle {
+		session.close()
+	}
+	return len(idle)
+}
+
+// pooledResponse is a download holding its session until it is closed
+type pooledResponse struct {
+	*ftp.Response
+	// release hands the session back, complete tells whether the download
+	// was read to its end
+	release func(err error, complete bool)
+	eof     bool
+	closed  bool
+}
+
+func (r *pooledResponse) Read(p []byte) (int, error) {
+	n, err := r.Response.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+func (r *pooledResponse) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if !r.eof {
+		// The session is discarded, so don't wait for the reply to an
+		// interrupted download, a stalled server may hold it back for long
+		r.release(nil, false)
+		return r.Response.Close()
+	}
+	err := r.Response.Close()
+	r.release(err, true)
+	return err
+}
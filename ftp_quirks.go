@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// Quirk names accepted by -ftp-quirks
+const (
+	QuirkMLSD      = "mlsd"
+	QuirkMDTMWrite = "mdtm-write"
+	QuirkUTF8      = "utf8"
+	QuirkREST      = "rest"
+)
+
+// ftpQuirks are the compatibility switches applied when dialing the FTP server
+type ftpQuirks struct {
+	// MLSD listings are used when the server advertises MLST
+	MLSD bool
+	// MDTMWrite sets modification times with the two-argument MDTM form
+	MDTMWrite bool
+	// UTF8 enables OPTS UTF8 ON when the server advertises it
+	UTF8 bool
+	// REST resumes downloads at an offset for ranged GETs. It is switched
+	// off when the server rejects REST.
+	REST bool
+}
+
+// defaultQuirks trusts whatever the server advertises in FEAT
+var defaultQuirks = ftpQuirks{MLSD: true, UTF8: true, REST: true}
+
+// detectQuirks derives the quirks of known server software from its welcome
+// banner. Unknown servers keep the defaults.
+func detectQuirks(banner string) (string, ftpQuirks) {
+	quirks := defaultQuirks
+	lower := strings.ToLower(banner)
+	switch {
+	case strings.Contains(lower, "vsftpd"):
+		// vsftpd sets times via "MDTM <time> <path>" rather than MFMT
+		quirks.MDTMWrite = true
+		return "vsftpd", quirks
+	case strings.Contains(lower, "proftpd"):
+		return "proftpd", quirks
+	case strings.Contains(lower, "pure-ftpd"):
+		return "pure-ftpd", quirks
+	case strings.Contains(lower, "filezilla server"):
+		return "filezilla", quirks
+	case strings.Contains(lower, "microsoft ftp service"):
+		// IIS mangles non-ASCII names after OPTS UTF8 ON when the site
+		// isn't configured for UTF-8, its default code page is safer
+		quirks.UTF8 = false
+		return "iis", quirks
+	}
+	return "unknown", quirks
+}
+
+// ParseQuirkOverrides parses a comma-separated list of quirk=on|off pairs,
+// e.g. "mlsd=off,utf8=on"
+func ParseQuirkOverrides(spec string) (map[string]bool, error) {
+	overrides := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid quirk entry %q, expected name=on|off", entry)
+		}
+		switch name {
+		case QuirkMLSD, QuirkMDTMWrite, QuirkUTF8, QuirkREST:
+		default:
+			return nil, fmt.Errorf("unknown FTP quirk %q", name)
+		}
+		switch value {
+		case "on":
+			overrides[name] = true
+		case "off":
+			overrides[name] = false
+		default:
+			return nil, fmt.Errorf("invalid value %q for quirk %s, expected on or off", value, name)
+		}
+	}
+	return overrides, nil
+}
+
+// withOverrides applies manual overrides for servers that misreport
+func (q ftpQuirks) withOverrides(overrides map[string]bool) ftpQuirks {
+	if v, ok := overrides[QuirkMLSD]; ok {
+		q.MLSD = v
+	}
+	if v, ok := overrides[QuirkMDTMWrite]; ok {
+		q.MDTMWrite = v
+	}
+	if v, ok := overrides[QuirkUTF8]; ok {
+		q.UTF8 = v
+	}
+	if v, ok := overrides[QuirkREST]; ok {
+		q.REST = v
+	}
+	return q
+}
+
+func (q ftpQuirks) dialOptions() []ftp.DialOption {
+	return []ftp.DialOption{
+		ftp.DialWithDisabledMLSD(!q.MLSD),
+		ftp.DialWithWritingMDTM(q.MDTMWrite),
+		ftp.DialWithDisabledUTF8(!q.UTF8),
+	}
+}
+
+// maxBannerSize bounds how much of the welcome message is kept
+const maxBannerSize = 4096
+
+// bannerRecorder captures the server's welcome message from the control
+// connection's debug stream. It stops recording at the end of the 220 reply,
+// before any command (and thus the password) is sent.
+type bannerRecorder struct {
+	mu     sync.Mutex
+	banner strings.Builder
+	done   bool
+}
+
+func (b *bannerRecorder) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.done {
+		return len(p), nil
+	}
+	b.banner.Write(p)
+	if b.banner.Len() >= maxBannerSize {
+		b.done = true
+		return len(p), nil
+	}
+	// The reply ends with a complete "ddd text" line, continuation lines
+	// use "ddd-text"
+	lines := strings.Split(b.banner.String(), "\n")
+	for _, line := range lines[:len(lines)-1] {
+		if len(line) >= 4 && line[3] == ' ' {
+			b.done = true
+			break
+		}
+	}
+	return len(p), nil
+}
+
+func (b *bannerRecorder) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return strings.TrimSpace(b.banner.String())
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDetectQuirks(t *testing.T) {
+	// Welcome messages as sent by the respective servers
+	tests := []struct {
+		banner string
+		server string
+		want   ftpQuirks
+	}{
+		{"220 (vsFTPd 3.0.5)", "vsftpd", ftpQuirks{MLSD: true, MDTMWrite: true, UTF8: true, REST: true}},
+		{"220 ProFTPD Server (Debian) [::ffff:192.0.2.10]", "proftpd", defaultQuirks},
+		{"220---------- Welcome to Pure-FTPd [privsep] [TLS] ----------\n220-You are user number 1 of 50 allowed.\n220 This is a private system - No anonymous login", "pure-ftpd", defaultQuirks},
+		{"220-FileZilla Server 1.8.0\n220 Please visit https://filezilla-project.org/", "filezilla", defaultQuirks},
+		{"220 Microsoft FTP Service", "iis", ftpQuirks{MLSD: true, UTF8: false, REST: true}},
+		{"220 Welcome to the archive", "unknown", defaultQuirks},
+	}
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			server, quirks := detectQuirks(tt.banner)
+			if server != tt.server || quirks != tt.want {
+				t.Errorf("detectQuirks = %s %+v, want %s %+v", server, quirks, tt.server, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuirkOverrides(t *testing.T) {
+	overrides, err := ParseQuirkOverrides("mlsd=off, mdtm-write=on,utf8=off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ftpQuirks{MLSD: false, MDTMWrite: true, UTF8: false, REST: true}
+	if got := defaultQuirks.withOverrides(overrides); got != want {
+		t.Errorf("withOverrides = %+v, want %+v", got, want)
+	}
+
+	for _, spec := range []string{"mlsd", "mlsd=yes", "passive=on"} {
+		if _, err := ParseQuirkOverrides(spec); err == nil {
+			t.Errorf("ParseQuirkOverrides(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestBannerRecorderStopsAtReply(t *testing.T) {
+	var b bannerRecorder
+	for _, chunk := range []string{"220-FileZilla Server 1.8.0\r\n", "220 Please visit", " https://filezilla-project.org/\r\n", "USER admin\r\n", "PASS secret\r\n"} {
+		b.Write([]byte(chunk))
+	}
+	if got := b.String(); strings.Contains(got, "USER") || strings.Contains(got, "secret") || !strings.HasSuffix(got, "filezilla-project.org/") {
+		t.Errorf("banner = %q, want the 220 reply only", got)
+	}
+}
+
+func TestQuirksDetectedOnConnect(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "content"})
+	f.mu.Lock()
+	f.banner = "220 Microsoft FTP Service"
+	f.mu.Unlock()
+
+	tests := []struct {
+		name string
+		args []string
+		utf8 bool
+	}{
+		{"detected", nil, false},
+		{"overridden", []string{"-ftp-quirks", "utf8=on"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, f, append([]string{"-subdir-buckets"}, tt.args...)...)
+			if w := serve(s, http.MethodGet, "/bucket/file.txt", ""); w.Code != http.StatusOK {
+				t.Fatalf("GET: status = %d: %s", w.Code, w.Body.String())
+			}
+			s.ftp.quirksMu.Lock()
+			defer s.ftp.quirksMu.Unlock()
+			if !s.ftp.quirksDetected || s.ftp.quirks.UTF8 != tt.utf8 {
+				t.Errorf("quirks = %+v (detected %v), want UTF8 %v", s.ftp.quirks, s.ftp.quirksDetected, tt.utf8)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+// maxRetryBackoff caps the exponential backoff between retries
+const maxRetryBackoff = 10 * time.Second
+
+// retry runs step, an FTP command on session, again when it fails
+// transiently: on a dropped, reset or refused connection, a timeout or a 421
+// from a busy server. Each retry waits out an exponential backoff starting at
+// -ftp-retry-backoff and reconnects, up to -ftp-max-retries times and within
+// the operation's retry budget. Other errors, such as a 550 for a missing
+// file, are returned at once.
+func (c *FTPClient) retry(session *ftpSession, step func() error) error {
+	err := step()
+	for attempt := 0; err != nil && attempt < c.config.FTPMaxRetries; attempt++ {
+		category := connectionErrorCategory(err)
+		if category == "" {
+			return err
+		}
+		delay := c.retryBackoff(attempt)
+		slog.Debug("retrying FTP command after transient error",
+			"attempt", attempt+1,
+			"delay", delay,
+			"category", category,
+			"error", err,
+		)
+		time.Sleep(delay)
+
+		reconnErr := c.handleConnectionError(session, err)
+		if errors.Is(reconnErr, err) {
+			// The operation used up its retry budget
+			return err
+		}
+		if reconnErr != nil {
+			// The server may still be refusing connections, the next
+			// attempt reconnects again
+			err = reconnErr
+			continue
+		}
+		err = step()
+	}
+	return err
+}
+
+// retryBackoff returns how long to wait before the given retry, counted from
+// 0: -ftp-retry-backoff doubled per attempt, with jitter so clients turned
+// away together don't come back together
+func (c *FTPClient) retryBackoff(attempt int) time.Duration {
+	base := c.config.FTPRetryBackoff
+	if base <= 0 {
+		return 0
+	}
+	delay := base << attempt
+	if delay <= 0 || delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errSiteUnsupported is returned once the server rejected SITE commands
+var errSiteUnsupported = errors.New("SITE is not supported by the FTP server")
+
+// siteSession is a bare FTP control connection for SITE commands, which the
+// ftp library doesn't expose. It needs no data connections, so it is a plain
+// textproto session logged in with the gateway's FTP account.
+type siteSession struct {
+	config *Config
+
+	mu          sync.Mutex
+	conn        *textproto.Conn
+	unsupported bool
+}
+
+func newSiteSession(config *Config) *siteSession {
+	return &siteSession{config: config}
+}
+
+func (s *siteSession) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	if s.config.FTPLocalAddr != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(s.config.FTPLocalAddr)}
+	}
+	addr := net.JoinHostPort(s.config.FTPHost, strconv.Itoa(s.config.FTPPort))
+	release := dialLimiterFor(s.config).acquire()
+	defer release()
+	netConn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to FTP server: %v", err)
+	}
+	if s.config.FTPTLS == FTPTLSImplicit {
+		netConn = tls.Client(netConn, newFTPTLSConfig(s.config))
+	}
+	conn := textproto.NewConn(netConn)
+
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		conn.Close()
+		warnConnectionLimit(err)
+		return fmt.Errorf("unexpected FTP greeting: %v", err)
+	}
+	if s.config.FTPTLS == FTPTLSExplicit {
+		// Upgrade before the credentials are sent, as the ftp library does
+		code, msg, err := s.command(conn, "AUTH TLS")
+		if err != nil || code != 234 {
+			conn.Close()
+			return fmt.Errorf("failed to start TLS: %d %s %v", code, msg, err)
+		}
+		conn = textproto.NewConn(tls.Client(netConn, newFTPTLSConfig(s.config)))
+	}
+	code, _, err := s.command(conn, "USER %s", s.config.FTPUser)
+	if err == nil && code == 331 {
+		code, _, err = s.command(conn, "PASS %s", s.config.FTPPassword)
+	}
+	if err != nil || code != 230 {
+		conn.Close()
+		return fmt.Errorf("failed to login to FTP server: %d %v", code, err)
+	}
+
+	s.conn = conn
+	return nil
+}
+
+// command sends a command and reads its reply, whatever its code
+func (s *siteSession) command(conn *textproto.Conn, format string, args ...interface{}) (int, string, error) {
+	id, err := conn.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	conn.StartResponse(id)
+	defer conn.EndResponse(id)
+
+	// Any reply code is accepted here, callers interpret it
+	return conn.ReadResponse(0)
+}
+
+// close logs out of the SITE session if it is open
+func (s *siteSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return
+	}
+	s.command(s.conn, "QUIT")
+	s.conn.Close()
+	s.conn = nil
+}
+
+// Site runs "SITE <args>" and returns the server's reply text. Arguments must
+// not contain line breaks, which would inject further commands.
+func (s *siteSession) Site(args string) (string, error) {
+	if strings.ContainsAny(args, "\r\n") {
+		return "", fmt.Errorf("SITE arguments must not contain line breaks")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.unsupported {
+		return "", errSiteUnsupported
+	}
+	if err := s.connect(); err != nil {
+		return "", err
+	}
+
+	code, msg, err := s.command(s.conn, "SITE %s", args)
+	if err != nil {
+		// The session is broken, start over on the next command
+		s.conn.Close()
+		s.conn = nil
+		return "", err
+	}
+	switch {
+	case code == 500 || code == 502 || code == 504:
+		slog.Info("FTP server doesn't support SITE commands", "code", code, "reply", msg)
+		s.unsupported = true
+		return "", errSiteUnsupported
+	case code < 200 || code >= 300:
+		return "", &textproto.Error{Code: code, Msg: msg}
+	}
+	return msg, nil
+}
+
+// RawSite runs "SITE <args>" on the FTP server and returns its reply. It is
+// meant for operator-configured commands only: arguments must never come
+// from S3 clients.
+func (c *FTPClient) RawSite(args string) (string, error) {
+	return c.site.Site(args)
+}
+
+// chmodHeader lets a PUT choose the mode applied when -upload-chmod is set
+const chmodHeader = "x-ftp-s3-chmod"
+
+// chmodModePattern matches octal file modes such as 644 or 0640
+var chmodModePattern = regexp.MustCompile(`^[0-7]{3,4}$`)
+
+// chmodUpload sets the permissions of an uploaded file with SITE CHMOD. The
+// upload already succeeded, so failures are only logged.
+func (s *S3Server) chmodUpload(r *http.Request, ftpPath string) {
+	if s.config.UploadChmod == "" {
+		return
+	}
+	mode := s.config.UploadChmod
+	if requested := r.Header.Get(chmodHeader); requested != "" {
+		if !chmodModePattern.MatchString(requested) {
+			slog.Warn("ignoring invalid requested file mode", "path", ftpPath, "mode", requested)
+		} else {
+			mode = requested
+		}
+	}
+
+	if _, err := s.ftp.RawSite("CHMOD " + mode + " " + ftpPath); err != nil {
+		if errors.Is(err, errSiteUnsupported) {
+			slog.Debug("skipping SITE CHMOD", "path", ftpPath, "error", err)
+			return
+		}
+		slog.Warn("failed to set file mode", "path", ftpPath, "mode", mode, "error", err)
+		return
+	}
+	slog.Debug("set file mode", "path", ftpPath, "mode", mode)
+}
+
+// sitePathPlaceholder is replaced with the object's FTP path in
+// -post-upload-site templates
+const sitePathPlaceholder = "{path}"
+
+// parseSiteTemplates splits the ;-separated -post-upload-site templates
+func parseSiteTemplates(spec string) ([]string, error) {
+	var templates []string
+	for _, template := range strings.Split(spec, ";") {
+		template = strings.TrimSpace(template)
+		if template == "" {
+			continue
+		}
+		if strings.ContainsAny(template, "\r\n") {
+			return nil, fmt.Errorf("SITE template %q contains a line break", template)
+		}
+		templates = append(templates, template)
+	}
+	return templates, nil
+}
+
+// siteAfterUpload issues the configured SITE commands for an uploaded file.
+// Only the object path comes from the request, and Site refuses line breaks,
+// so clients can't smuggle in commands of their own. The upload already
+// succeeded, so failures are only logged.
+func (s *S3Server) siteAfterUpload(ftpPath string) {
+	for _, template := range s.siteTemplates {
+		args := strings.ReplaceAll(template, sitePathPlaceholder, ftpPath)
+		reply, err := s.ftp.RawSite(args)
+		if errors.Is(err, errSiteUnsupported) {
+			slog.Debug("skipping post-upload SITE commands", "path", ftpPath, "error", err)
+			return
+		}
+		if err != nil {
+			slog.Warn("post-upload SITE command failed", "path", ftpPath, "command", args, "error", err)
+			continue
+		}
+		slog.Debug("ran post-upload SITE command", "path", ftpPath, "command", args, "reply", reply)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploadChmod(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+	s := newTestServer(t, f, "-subdir-buckets", "-upload-chmod", "640")
+	sites := func() []string {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return append([]string(nil), f.sites...)
+	}
+	put := func(key, mode string) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPut, "/bucket/"+key, strings.NewReader("body"))
+		if mode != "" {
+			r.Header.Set(chmodHeader, mode)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: status = %d: %s", key, w.Code, w.Body.String())
+		}
+	}
+
+	put("configured.txt", "")
+	put("requested.txt", "0600")
+	put("invalid.txt", "999; DELE x")
+	want := []string{"CHMOD 640 bucket/configured.txt", "CHMOD 0600 bucket/requested.txt", "CHMOD 640 bucket/invalid.txt"}
+	if got := sites(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("SITE commands = %q, want %q", got, want)
+	}
+
+	// Servers without SITE are asked only once and uploads still succeed
+	f.mu.Lock()
+	f.siteUnsupported = true
+	f.mu.Unlock()
+	put("unsupported.txt", "")
+	put("again.txt", "")
+	if _, ok := f.file("/bucket/again.txt"); !ok {
+		t.Error("upload failed without SITE support")
+	}
+	if got := sites(); len(got) != len(want)+1 {
+		t.Errorf("SITE commands = %q, want a single attempt after the first 502", got)
+	}
+}
+
+func TestPostUploadSite(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": "", "/bucket/victim.txt": "victim"})
+	s := newTestServer(t, f, "-subdir-buckets", "-post-upload-site", "CHMOD 640 {path}; QUOTA")
+
+	if w := serve(s, http.MethodPut, "/bucket/file.txt", "body"); w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+	// A key can't smuggle in a command of its own
+	serve(s, http.MethodPut, "/bucket/evil%0D%0ADELE%20bucket/victim.txt", "body")
+
+	f.mu.Lock()
+	sites := strings.Join(f.sites, "\n")
+	f.mu.Unlock()
+	if want := "CHMOD 640 bucket/file.txt\nQUOTA"; sites != want {
+		t.Errorf("SITE commands = %q, want %q", sites, want)
+	}
+	if _, ok := f.file("/bucket/victim.txt"); !ok {
+		t.Error("a key injected a DELE")
+	}
+
+	if reply, err := s.ftp.RawSite("HELP"); err != nil || reply == "" {
+		t.Errorf("RawSite = %q, %v", reply, err)
+	}
+	if _, err := parseSiteTemplates("CHMOD 640 {path}\r\nDELE x"); err == nil {
+		t.Error("template with a line break accepted")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// deadlineConn fails a read or write on an FTP connection that doesn't
+// complete within the timeout, so a server that stops responding mid-command
+// or mid-transfer can't hang the request. The deadline is pushed forward by
+// every call, a slow but moving transfer keeps going.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// sessionDialFunc returns the dial function for one FTP session. The ftp
+// library hands every connection of the session, the control connection
+// first and then each data connection, to it and no longer wraps them in TLS
+// itself, so that is done here. Connections stall out after -ftp-data-timeout
+// and, with -ftp-ignore-pasv-ip, data connections go to the control
+// connection's host rather than the address the server advertised.
+func (c *FTPClient) sessionDialFunc(dialer net.Dialer) func(network, address string) (net.Conn, error) {
+	controlHost := ""
+	return func(network, address string) (net.Conn, error) {
+		isControl := controlHost == ""
+		if !isControl {
+			address = c.dataAddress(controlHost, address)
+		}
+
+		conn, err := dialer.Dial(network, address)
+		if err != nil {
+			if !isControl {
+				c.logUnreachableDataAddress(controlHost, address, err)
+			}
+			return nil, err
+		}
+		if isControl {
+			controlHost = conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		}
+		if c.config.FTPDataTimeout > 0 {
+			conn = &deadlineConn{Conn: conn, timeout: c.config.FTPDataTimeout}
+		}
+
+		// The explicit TLS control connection is upgraded after AUTH TLS
+		// by the library
+		if isControl && c.config.FTPTLS != FTPTLSImplicit {
+			return conn, nil
+		}
+		if c.config.FTPTLS == FTPTLSNone {
+			return conn, nil
+		}
+		return tls.Client(conn, c.tls), nil
+	}
+}
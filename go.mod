@@ -4,11 +4,11 @@ go 1.21
 
 require (
 	github.com/aws/aws-sdk-go-v2 v1.24.1
+	github.com/aws/smithy-go v1.19.0
 	github.com/jlaffaye/ftp v0.2.0
 )
 
 require (
-	github.com/aws/smithy-go v1.19.0 // indirect
 	github.com/hashicorp/errwrap v1.0.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 )
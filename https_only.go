@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// What plaintext HTTP requests get from -http-listen when serving HTTPS
+const (
+	// HTTPSOnlyOff serves plaintext requests like HTTPS ones
+	HTTPSOnlyOff = "off"
+	// HTTPSOnlyRedirect redirects GET and HEAD to HTTPS. SDKs don't replay
+	// other methods on a redirect, so they are rejected instead.
+	HTTPSOnlyRedirect = "redirect"
+	// HTTPSOnlyReject rejects every plaintext request
+	HTTPSOnlyReject = "reject"
+)
+
+// HTTPSOnly keeps plaintext requests from reaching the gateway, redirecting
+// or rejecting them depending on -https-only
+type HTTPSOnly struct {
+	mode      string
+	httpsPort string
+	next      http.Handler
+}
+
+// NewHTTPSOnly wraps next for the HTTPS server listening on listenAddr
+func NewHTTPSOnly(mode, listenAddr string, next http.Handler) *HTTPSOnly {
+	_, port, _ := net.SplitHostPort(listenAddr)
+	if port == "443" {
+		port = ""
+	}
+	return &HTTPSOnly{mode: mode, httpsPort: port, next: next}
+}
+
+func (h *HTTPSOnly) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS != nil || h.mode == HTTPSOnlyOff {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	if h.mode == HTTPSOnlyRedirect && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		if h.httpsPort != "" {
+			host = net.JoinHostPort(host, h.httpsPort)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		slog.Debug("redirecting plaintext request to HTTPS", "method", r.Method, "target", target)
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	slog.Debug("rejecting plaintext request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+	writeS3Error(w, http.StatusForbidden, "AccessDenied",
+		"Requests must use HTTPS", r.URL.Path)
+}
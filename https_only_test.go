@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSOnly(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("served"))
+	})
+
+	tests := []struct {
+		name     string
+		mode     string
+		listen   string
+		method   string
+		status   int
+		location string
+	}{
+		{"off GET", HTTPSOnlyOff, ":8443", http.MethodGet, http.StatusOK, ""},
+		{"off PUT", HTTPSOnlyOff, ":8443", http.MethodPut, http.StatusOK, ""},
+		{"redirect GET", HTTPSOnlyRedirect, ":8443", http.MethodGet, http.StatusMovedPermanently, "https://s3.example.com:8443/bucket/file.txt?versionId=null"},
+		{"redirect HEAD to the default port", HTTPSOnlyRedirect, "0.0.0.0:443", http.MethodHead, http.StatusMovedPermanently, "https://s3.example.com/bucket/file.txt?versionId=null"},
+		// SDKs don't replay an upload on a redirect
+		{"redirect PUT", HTTPSOnlyRedirect, ":8443", http.MethodPut, http.StatusForbidden, ""},
+		{"redirect DELETE", HTTPSOnlyRedirect, ":8443", http.MethodDelete, http.StatusForbidden, ""},
+		{"reject GET", HTTPSOnlyReject, ":8443", http.MethodGet, http.StatusForbidden, ""},
+		{"reject PUT", HTTPSOnlyReject, ":8443", http.MethodPut, http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHTTPSOnly(tt.mode, tt.listen, next)
+			r := httptest.NewRequest(tt.method, "http://s3.example.com:8080/bucket/file.txt?versionId=null", nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if got := w.Header().Get("Location"); got != tt.location {
+				t.Errorf("Location = %q, want %q", got, tt.location)
+			}
+			if tt.status == http.StatusForbidden {
+				var doc S3Error
+				if err := xml.Unmarshal(w.Body.Bytes(), &doc); err != nil || doc.Code != "AccessDenied" {
+					t.Errorf("error = %+v (%v), want AccessDenied", doc, err)
+				}
+			}
+		})
+	}
+
+	t.Run("HTTPS passes", func(t *testing.T) {
+		for _, mode := range []string{HTTPSOnlyRedirect, HTTPSOnlyReject} {
+			r := httptest.NewRequest(http.MethodPut, "https://s3.example.com/bucket/file.txt", nil)
+			r.TLS = &tls.ConnectionState{}
+			w := httptest.NewRecorder()
+			NewHTTPSOnly(mode, ":443", next).ServeHTTP(w, r)
+			if w.Code != http.StatusOK || w.Body.String() != "served" {
+				t.Errorf("%s: status = %d: %s", mode, w.Code, w.Body.String())
+			}
+		}
+	})
+}
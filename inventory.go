@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output formats of /admin/inventory
+const (
+	InventoryJSONLines = "jsonl"
+	InventoryCSV       = "csv"
+)
+
+// inventoryColumns heads the CSV inventory, in the order of InventoryEntry
+var inventoryColumns = []string{"bucket", "key", "size", "last_modified", "etag", "storage_class"}
+
+// InventoryEntry is one object of the report served by /admin/inventory
+type InventoryEntry struct {
+	Bucket       string `json:"bucket"`
+	Key          string `json:"key"`
+	Size         int64  `json:"size"`
+	LastModified string `json:"last_modified"`
+	ETag         string `json:"etag"`
+	StorageClass string `json:"storage_class"`
+}
+
+// inventoryWriter encodes entries in one of the inventory formats
+type inventoryWriter interface {
+	write(entry InventoryEntry) error
+	flush() error
+}
+
+type jsonLinesInventory struct {
+	encoder *json.Encoder
+}
+
+func (j *jsonLinesInventory) write(entry InventoryEntry) error {
+	return j.encoder.Encode(entry)
+}
+
+func (j *jsonLinesInventory) flush() error {
+	return nil
+}
+
+type csvInventory struct {
+	writer *csv.Writer
+}
+
+func (c *csvInventory) write(entry InventoryEntry) error {
+	return c.writer.Write([]string{
+		entry.Bucket,
+		entry.Key,
+		strconv.FormatInt(entry.Size, 10),
+		entry.LastModified,
+		entry.ETag,
+		entry.StorageClass,
+	})
+}
+
+func (c *csvInventory) flush() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+// handleInventory serves GET /admin/inventory, a report of every object of
+// a bucket below an optional prefix with its size, time, ETag and storage
+// class, like a basic S3 Inventory. The bucket, prefix and format (jsonl or
+// csv) query parameters select it. The report is streamed while the backend
+// is walked, one directory listing at a time, and a report that left out
+// unreadable subtrees or broke off ends with the listIncompleteHeader
+// trailer.
+func (s *S3Server) handleInventory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	bucket := query.Get("bucket")
+	if bucket == "" {
+		bucket = defaultBucket
+	}
+	root, ok := s.bucketRoot(bucket)
+	if !ok {
+		http.Error(w, "no such bucket \""+bucket+"\"", http.StatusNotFound)
+		return
+	}
+	prefix := query.Get("prefix")
+	if escapesBucket(prefix) {
+		http.Error(w, "prefix must not contain \"..\" segments", http.StatusBadRequest)
+		return
+	}
+
+	var report inventoryWriter
+	switch format := query.Get("format"); format {
+	case "", InventoryJSONLines:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		report = &jsonLinesInventory{encoder: json.NewEncoder(w)}
+	case InventoryCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		report = &csvInventory{writer: csv.NewWriter(w)}
+	default:
+		http.Error(w, "unknown format \""+format+"\", expected "+InventoryJSONLines+" or "+InventoryCSV, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Trailer", listIncompleteHeader)
+
+	slog.Info("exporting object inventory", "bucket", bucket, "prefix", prefix)
+	if csvReport, ok := report.(*csvInventory); ok {
+		csvReport.writer.Write(inventoryColumns)
+	}
+
+	keyDir := prefixDir(prefix)
+	count := 0
+	incomplete, err := s.walkKeys(root, keyDir, prefix, s.config.MaxListDepth, func(file FileInfo) error {
+		key := keyDir + file.Name
+		if file.IsDir || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		count++
+		return report.write(InventoryEntry{
+			Bucket:       bucket,
+			Key:          key,
+			Size:         file.Size,
+			LastModified: file.ModTime.UTC().Format(time.RFC3339),
+			ETag:         s.listedETag(root, key, file),
+			StorageClass: s.storageClass(bucket, key),
+		})
+	})
+	if err != nil && count == 0 {
+		// Nothing was sent yet, the CSV header is still buffered
+		if !strings.Contains(err.Error(), "550") {
+			slog.Error("failed to export object inventory", "bucket", bucket, "prefix", prefix, "error", err)
+			http.Error(w, "failed to list objects: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// A prefix without a directory behind it has no objects
+		err = nil
+	}
+	if flushErr := report.flush(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		slog.Error("object inventory broke off", "bucket", bucket, "prefix", prefix, "objects", count, "error", err)
+		incomplete = true
+	} else {
+		slog.Info("exported object inventory", "bucket", bucket, "prefix", prefix, "objects", count)
+	}
+	markIncomplete(w, incomplete)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestInventory(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/bucket/a.txt":           "a",
+		"/bucket/dir/b.txt":       "bb",
+		"/bucket/dir/sub/c.txt":   "ccc",
+		"/bucket/secret/file.txt": "secret",
+		"/bucket/.hidden":         "x",
+	})
+	f.mu.Lock()
+	f.listDenied = map[string]bool{"/bucket/secret": true}
+	f.mu.Unlock()
+	s := newTestServer(t, f, "-subdir-buckets", "-list-on-error", ListOnErrorPartial)
+
+	// jsonLines decodes a JSON lines inventory
+	jsonLines := func(t *testing.T, body string) []InventoryEntry {
+		t.Helper()
+		var entries []InventoryEntry
+		decoder := json.NewDecoder(strings.NewReader(body))
+		for decoder.More() {
+			var entry InventoryEntry
+			if err := decoder.Decode(&entry); err != nil {
+				t.Fatalf("%v: %s", err, body)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	t.Run("jsonl", func(t *testing.T) {
+		w := serve(s, http.MethodGet, adminPrefix+"inventory?bucket=bucket", "")
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Fatalf("status = %d, Content-Type %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+		var keys []string
+		for _, entry := range jsonLines(t, w.Body.String()) {
+			keys = append(keys, entry.Key)
+			if entry.Bucket != "bucket" || entry.ETag == "" || entry.StorageClass != "STANDARD" || entry.LastModified != "2024-01-01T00:00:00Z" {
+				t.Errorf("entry = %+v", entry)
+			}
+		}
+		if got := strings.Join(keys, ","); got != "a.txt,dir/b.txt,dir/sub/c.txt" {
+			t.Errorf("keys = %s", got)
+		}
+		// The unreadable directory was left out
+		if got := w.Result().Trailer.Get(listIncompleteHeader); got != "true" {
+			t.Errorf("%s trailer = %q, want true", listIncompleteHeader, got)
+		}
+	})
+
+	t.Run("csv with prefix", func(t *testing.T) {
+		w := serve(s, http.MethodGet, adminPrefix+"inventory?bucket=bucket&prefix=dir/s&format=csv", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		records, err := csv.NewReader(w.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) != 2 || strings.Join(records[0], ",") != strings.Join(inventoryColumns, ",") {
+			t.Fatalf("records = %v", records)
+		}
+		if got := records[1]; got[0] != "bucket" || got[1] != "dir/sub/c.txt" || got[2] != "3" {
+			t.Errorf("record = %v", got)
+		}
+		if got := w.Result().Trailer.Get(listIncompleteHeader); got != "" {
+			t.Errorf("%s trailer = %q for a complete report", listIncompleteHeader, got)
+		}
+	})
+
+	t.Run("missing prefix directory", func(t *testing.T) {
+		w := serve(s, http.MethodGet, adminPrefix+"inventory?bucket=bucket&prefix=nothing/", "")
+		if w.Code != http.StatusOK || w.Body.Len() != 0 {
+			t.Errorf("status = %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		want   int
+	}{
+		{"unknown bucket", http.MethodGet, adminPrefix + "inventory?bucket=nobucket", http.StatusNotFound},
+		{"unknown format", http.MethodGet, adminPrefix + "inventory?bucket=bucket&format=xml", http.StatusBadRequest},
+		{"POST", http.MethodPost, adminPrefix + "inventory?bucket=bucket", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(s, tt.method, tt.target, ""); w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
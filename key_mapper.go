@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+)
+
+// KeyMapper translates object keys to FTP paths relative to the bucket root
+// and back. Keys ending in "/" denote directories.
+type KeyMapper interface {
+	ToFTPPath(key string) string
+	FromFTPPath(ftpPath string) string
+}
+
+// NewKeyMapper returns the key mapper registered under name
+func NewKeyMapper(name string) (KeyMapper, error) {
+	switch name {
+	case "", "identity":
+		return identityKeyMapper{}, nil
+	case "hash-prefix":
+		return hashPrefixKeyMapper{}, nil
+	default:
+		return nil, fmt.Errorf("unknown key mapper %q, expected identity or hash-prefix", name)
+	}
+}
+
+// identityKeyMapper stores every key at the FTP path of the same name
+type identityKeyMapper struct{}
+
+func (identityKeyMapper) ToFTPPath(key string) string {
+	return key
+}
+
+func (identityKeyMapper) FromFTPPath(ftpPath string) string {
+	return ftpPath
+}
+
+// hashPrefixShard is the prefix of the shard directories created by
+// hashPrefixKeyMapper
+const hashPrefixShard = "_h"
+
+// hashPrefixKeyMapper spreads the files of each directory over up to 256
+// shard directories named after the first byte of the MD5 of the file name,
+// so "a/b/c.txt" is stored as "a/b/_h4a/c.txt". This keeps FTP directories
+// small when a single prefix holds a huge number of objects.
+type hashPrefixKeyMapper struct{}
+
+func (hashPrefixKeyMapper) ToFTPPath(key string) string {
+	dir, file := path.Split(key)
+	if file == "" {
+		return key
+	}
+	sum := md5.Sum([]byte(file))
+	return dir + hashPrefixShard + hex.EncodeToString(sum[:1]) + "/" + file
+}
+
+func (hashPrefixKeyMapper) FromFTPPath(ftpPath string) string {
+	parts := strings.Split(ftpPath, "/")
+	kept := parts[:0]
+	for _, part := range parts {
+		if !isHashShard(part) {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, "/")
+}
+
+// isHashShard reports whether name is a shard directory name such as "_h4a"
+func isHashShard(name string) bool {
+	if len(name) != len(hashPrefixShard)+2 || !strings.HasPrefix(name, hashPrefixShard) {
+		return false
+	}
+	_, err := hex.DecodeString(name[len(hashPrefixShard):])
+	return err == nil && strings.ToLower(name) == name
+}
+
+// suffixKeyMapper hides a suffix every stored file carries, such as ".enc",
+// from keys: the key "a/b" is stored as "a/b.enc" by the wrapped mapper.
+// Directories keep their names.
+type suffixKeyMapper struct {
+	base   KeyMapper
+	suffix string
+}
+
+func (m suffixKeyMapper) ToFTPPath(key string) string {
+	if key == "" || strings.HasSuffix(key, "/") {
+		return m.base.ToFTPPath(key)
+	}
+	return m.base.ToFTPPath(key) + m.suffix
+}
+
+func (m suffixKeyMapper) FromFTPPath(ftpPath string) string {
+	return m.base.FromFTPPath(strings.TrimSuffix(ftpPath, m.suffix))
+}
+
+// stripListedSuffix turns the listed files of a directory into the names of
+// their keys under -key-strip-suffix. Files without the suffix can't be
+// addressed by any key and are left out; one that has the name another
+// file's key is stripped to collides with it and is reported.
+func stripListedSuffix(dir string, files []FileInfo, suffix string) []FileInfo {
+	stripped := make(map[string]bool)
+	var unaddressable []string
+	kept := files[:0]
+	for _, file := range files {
+		switch {
+		case file.IsDir:
+			kept = append(kept, file)
+		case strings.HasSuffix(file.Name, suffix) && len(file.Name) > len(suffix):
+			file.Name = strings.TrimSuffix(file.Name, suffix)
+			stripped[file.Name] = true
+			kept = append(kept, file)
+		default:
+			unaddressable = append(unaddressable, file.Name)
+		}
+	}
+	for _, name := range unaddressable {
+		if stripped[name] {
+			slog.Warn("file collides with a key stripped of -key-strip-suffix, only the suffixed file is served",
+				"dir", dir,
+				"file", name,
+				"served", name+suffix,
+			)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestHashPrefixKeyMapperRoundTrip(t *testing.T) {
+	mapper, err := NewKeyMapper("hash-prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{
+		"file.txt",
+		"a/b/c.txt",
+		"dir/",
+		"deep/nested/dir/",
+		"unicode/ファイル.txt",
+	}
+	for _, key := range keys {
+		t.Run(key, func(t *testing.T) {
+			ftpPath := mapper.ToFTPPath(key)
+			if strings.HasSuffix(key, "/") {
+				if ftpPath != key {
+					t.Errorf("directory %q mapped to %q", key, ftpPath)
+				}
+			} else if !isHashShard(path.Base(path.Dir(ftpPath))) {
+				t.Errorf("%q mapped to %q, not into a shard directory", key, ftpPath)
+			}
+			if got := mapper.FromFTPPath(ftpPath); got != key {
+				t.Errorf("FromFTPPath(%q) = %q, want %q", ftpPath, got, key)
+			}
+		})
+	}
+	if _, err := NewKeyMapper("unknown"); err == nil {
+		t.Error("NewKeyMapper accepted an unknown name")
+	}
+}
+
+func TestHashPrefixKeyMapperObjects(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+	s := newTestServer(t, f, "-subdir-buckets", "-key-mapper", "hash-prefix")
+
+	if w := serve(s, http.MethodPut, "/bucket/a/b/c.txt", "content"); w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+	if _, ok := f.file("/bucket/" + hashPrefixKeyMapper{}.ToFTPPath("a/b/c.txt")); !ok {
+		t.Fatal("object wasn't stored in its shard directory")
+	}
+	if w := serve(s, http.MethodGet, "/bucket/a/b/c.txt", ""); w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Fatalf("GET: status = %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSuffixKeyMapperRoundTrip(t *testing.T) {
+	mapper := suffixKeyMapper{base: identityKeyMapper{}, suffix: ".enc"}
+
+	tests := []struct {
+		key     string
+		ftpPath string
+	}{
+		{"file.txt", "file.txt.enc"},
+		{"a/b", "a/b.enc"},
+		{"dir/", "dir/"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := mapper.ToFTPPath(tt.key); got != tt.ftpPath {
+			t.Errorf("ToFTPPath(%q) = %q, want %q", tt.key, got, tt.ftpPath)
+		}
+		if got := mapper.FromFTPPath(tt.ftpPath); got != tt.key {
+			t.Errorf("FromFTPPath(%q) = %q, want %q", tt.ftpPath, got, tt.key)
+		}
+	}
+}
+
+func TestSuffixKeyMapperObjects(t *testing.T) {
+	var logs bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+
+	f := startFakeFTP(t, map[string]string{
+		"/bucket/old.csv.enc": "old",
+		"/bucket/plain.txt":   "plain",
+		"/bucket/twin":        "unsuffixed",
+		"/bucket/twin.enc":    "suffixed",
+		"/bucket/dir/x.enc":   "x",
+	})
+	s := newTestServer(t, f, "-subdir-buckets", "-key-strip-suffix", ".enc")
+
+	if w := serve(s, http.MethodPut, "/bucket/a/b", "content"); w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+	if body, ok := f.file("/bucket/a/b.enc"); !ok || body != "content" {
+		t.Fatalf("object stored as %q, want a/b.enc", body)
+	}
+	for key, want := range map[string]string{"a/b": "content", "old.csv": "old", "twin": "suffixed", "dir/x": "x"} {
+		if w := serve(s, http.MethodGet, "/bucket/"+key, ""); w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("GET %s: status = %d: %q, want %q", key, w.Code, w.Body.String(), want)
+		}
+	}
+	if w := serve(s, http.MethodHead, "/bucket/plain.txt", ""); w.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a file without the suffix: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	w := serve(s, http.MethodGet, "/bucket?list-type=2", "")
+	var result ListBucketV2Result
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	var keys []string
+	for _, object := range result.Contents {
+		keys = append(keys, object.Key)
+	}
+	if got, want := strings.Join(keys, ","), "a/,a/b,dir/,dir/x,old.csv,twin"; got != want {
+		t.Errorf("keys = %s, want %s", got, want)
+	}
+	if !strings.Contains(logs.String(), "file collides with a key") || !strings.Contains(logs.String(), "file=twin") {
+		t.Errorf("collision of twin and twin.enc wasn't reported: %s", logs.String())
+	}
+	if strings.Contains(logs.String(), "file=plain.txt") {
+		t.Errorf("plain.txt was reported as a collision: %s", logs.String())
+	}
+}
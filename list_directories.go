@@ -0,0 +1,51 @@
+package main
+
+import "strings"
+
+// How FTP directories appear in listings
+const (
+	// ListDirectoriesKeys rolls directories into CommonPrefixes when a
+	// delimiter applies and lists them as empty "dir/" objects otherwise
+	ListDirectoriesKeys = "keys"
+	// ListDirectoriesPrefixes only shows directories as CommonPrefixes
+	ListDirectoriesPrefixes = "prefixes"
+	// ListDirectoriesOmit leaves directories out, listing files only
+	ListDirectoriesOmit = "omit"
+)
+
+// classifyEntry decides how the listed entry with key name appears in a
+// listing of prefix: rolled up into a common prefix, as an object, or, when
+// neither is returned, not at all. ListObjects and ListObjectsV2 share it so
+// both show directories the same way.
+func (s *S3Server) classifyEntry(name, prefix, delimiter string, isDir bool) (commonPrefix string, object bool) {
+	if delimiter != "" {
+		rest := name[len(prefix):]
+		if i := strings.Index(rest, delimiter); i >= 0 {
+			if isDir && s.config.ListDirectories == ListDirectoriesOmit {
+				return "", false
+			}
+			return prefix + rest[:i+len(delimiter)], false
+		}
+	}
+	if isDir && s.config.ListDirectories != ListDirectoriesKeys {
+		return "", false
+	}
+	return "", true
+}
+
+// listedObject returns the listing entry of a file or directory of bucket.
+// A directory is an empty object, whatever size LIST reports for it.
+func (s *S3Server) listedObject(bucket, root, name string, file FileInfo) S3Object {
+	size := file.Size
+	if file.IsDir {
+		size = 0
+	}
+	return S3Object{
+		Key:          name,
+		LastModified: file.ModTime,
+		Size:         size,
+		ETag:         s.listedETag(root, name, file),
+		StorageClass: s.storageClass(bucket, name),
+		ContentType:  s.contentTypeHint(bucket, s.objectPath(root, name), file),
+	}
+}
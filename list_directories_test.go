@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestListDirectories(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/bucket/dir/file.txt": "file",
+		"/bucket/top.txt":      "top",
+	})
+	f.mu.Lock()
+	f.dirs["/bucket/empty"] = true
+	f.mu.Unlock()
+
+	// list answers the keys and common prefixes of a V1 or V2 listing
+	list := func(t *testing.T, s *S3Server, target string) (string, string) {
+		t.Helper()
+		w := serve(s, http.MethodGet, target, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		var result ListBucketV2Result
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		var contents, prefixes []string
+		for _, object := range result.Contents {
+			contents = append(contents, object.Key)
+			if strings.HasSuffix(object.Key, "/") && object.Size != 0 {
+				t.Errorf("directory %s listed with size %d", object.Key, object.Size)
+			}
+		}
+		for _, prefix := range result.CommonPrefixes {
+			prefixes = append(prefixes, prefix.Prefix)
+		}
+		return strings.Join(contents, ","), strings.Join(prefixes, ",")
+	}
+
+	tests := []struct {
+		mode     string
+		flat     string
+		contents string
+		prefixes string
+	}{
+		{ListDirectoriesKeys, "dir/,dir/file.txt,empty/,top.txt", "top.txt", "dir/,empty/"},
+		{ListDirectoriesPrefixes, "dir/file.txt,top.txt", "top.txt", "dir/,empty/"},
+		{ListDirectoriesOmit, "dir/file.txt,top.txt", "top.txt", ""},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t, f, "-subdir-buckets", "-list-directories", tt.mode)
+		// ListObjects and ListObjectsV2 show directories the same way
+		for _, query := range []string{"list-type=2&", ""} {
+			t.Run(tt.mode+" "+query, func(t *testing.T) {
+				if contents, _ := list(t, s, "/bucket?"+query); contents != tt.flat {
+					t.Errorf("Contents without delimiter = %s, want %s", contents, tt.flat)
+				}
+				contents, prefixes := list(t, s, "/bucket?"+query+"delimiter=/")
+				if contents != tt.contents {
+					t.Errorf("Contents = %s, want %s", contents, tt.contents)
+				}
+				if prefixes != tt.prefixes {
+					t.Errorf("CommonPrefixes = %s, want %s", prefixes, tt.prefixes)
+				}
+			})
+		}
+
+		t.Run(tt.mode+" HEAD", func(t *testing.T) {
+			// A directory is never an object without the slash
+			if w := serve(s, http.MethodHead, "/bucket/dir", ""); w.Code != http.StatusNotFound {
+				t.Errorf("HEAD dir status = %d, want %d", w.Code, http.StatusNotFound)
+			}
+			marker := newTestServer(t, f, "-subdir-buckets", "-list-directories", tt.mode,
+				"-trailing-slash", TrailingSlashFolderMarker)
+			want := http.StatusNotFound
+			if tt.mode == ListDirectoriesKeys {
+				want = http.StatusOK
+			}
+			if w := serve(marker, http.MethodHead, "/bucket/dir/", ""); w.Code != want {
+				t.Errorf("HEAD dir/ status = %d, want %d", w.Code, want)
+			}
+		})
+	}
+}
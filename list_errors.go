@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// How listings treat subdirectories they descend into but can't read
+const (
+	ListOnErrorFail    = "fail"    // the listing fails
+	ListOnErrorSkip    = "skip"    // the subtree is left out
+	ListOnErrorPartial = "partial" // the subtree is left out and the listing flagged
+)
+
+// listIncompleteHeader flags listings that left out unreadable subtrees
+const listIncompleteHeader = "x-ftp-s3-list-incomplete"
+
+// skipUnreadable decides whether a listing goes on without the subdirectory
+// dir, which failed to list with err. It reports whether the listing must be
+// flagged as incomplete.
+func (s *S3Server) skipUnreadable(dir string, err error) (skip, incomplete bool) {
+	switch s.config.ListOnError {
+	case ListOnErrorSkip:
+		slog.Debug("skipping unreadable subdirectory", "path", dir, "error", err)
+		return true, false
+	case ListOnErrorPartial:
+		slog.Debug("leaving unreadable subdirectory out of partial listing", "path", dir, "error", err)
+		return true, true
+	}
+	return false, false
+}
+
+// markIncomplete sets listIncompleteHeader on a listing response that left
+// out unreadable subtrees
+func markIncomplete(w http.ResponseWriter, incomplete bool) {
+	if incomplete {
+		w.Header().Set(listIncompleteHeader, "true")
+	}
+}
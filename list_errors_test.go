@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestListOnError(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/bucket/a/file.txt":      "a",
+		"/bucket/secret/file.txt": "secret",
+		"/bucket/z/file.txt":      "z",
+	})
+	f.mu.Lock()
+	f.listDenied = map[string]bool{"/bucket/secret": true}
+	f.mu.Unlock()
+
+	tests := []struct {
+		mode       string
+		status     int
+		incomplete string
+	}{
+		{ListOnErrorFail, http.StatusForbidden, ""},
+		{ListOnErrorSkip, http.StatusOK, ""},
+		{ListOnErrorPartial, http.StatusOK, "true"},
+	}
+	for _, walk := range []struct {
+		name string
+		args []string
+	}{
+		{"serial", nil},
+		{"concurrent", []string{"-list-concurrency", "4", "-max-ftp-conns", "4"}},
+	} {
+		for _, tt := range tests {
+			t.Run(walk.name+" "+tt.mode, func(t *testing.T) {
+				s := newTestServer(t, f, append([]string{"-subdir-buckets", "-list-on-error", tt.mode}, walk.args...)...)
+				w := serve(s, http.MethodGet, "/bucket?list-type=2", "")
+				if w.Code != tt.status {
+					t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+				}
+				if got := w.Header().Get(listIncompleteHeader); got != tt.incomplete {
+					t.Errorf("%s = %q, want %q", listIncompleteHeader, got, tt.incomplete)
+				}
+				if tt.status != http.StatusOK {
+					return
+				}
+				body := w.Body.String()
+				for _, key := range []string{"a/file.txt", "z/file.txt"} {
+					if !strings.Contains(body, "<Key>"+key+"</Key>") {
+						t.Errorf("readable %s missing: %s", key, body)
+					}
+				}
+				if strings.Contains(body, "secret/file.txt") {
+					t.Errorf("unreadable subtree listed: %s", body)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+)
+
+// maxListConcurrency caps -list-concurrency, so one listing can't flood the
+// FTP server with logins
+const maxListConcurrency = 32
+
+// listHintHeader tells a client why a listing of a whole bucket stopped early
+const listHintHeader = "x-ftp-s3-list-hint"
+
+// unscopedListHint is sent in listHintHeader when -unscoped-list-depth cut a
+// listing short
+const unscopedListHint = "Listing without a prefix or delimiter stopped at -unscoped-list-depth, narrow it with a prefix or use the / delimiter"
+
+// listKeys lists the entries a listing of prefix is built from, starting at
+// keyDir, the key directory holding the prefix. With "/" as delimiter deeper
+// keys roll up into their directory's common prefix, so keyDir alone is
+// listed. Otherwise S3 returns every key below the prefix, collected with
+// walkKeys, down to listDepth.
+func (s *S3Server) listKeys(root, keyDir, prefix, delimiter string) ([]FileInfo, bool, error) {
+	if delimiter == "/" {
+		return s.listKeyDir(root, keyDir)
+	}
+	maxDepth, _ := s.listDepth(prefix)
+	if s.config.ListConcurrency > 1 {
+		return s.walkKeysConcurrent(root, keyDir, prefix, maxDepth, s.config.ListConcurrency)
+	}
+
+	var listed []FileInfo
+	incomplete, err := s.walkKeys(root, keyDir, prefix, maxDepth, func(file FileInfo) error {
+		listed = append(listed, file)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return listed, incomplete, nil
+}
+
+// walkKeys calls visit with every entry below keyDir, one directory listing
+// at a time so huge trees aren't held in memory. Subdirectories that can hold
+// keys of the prefix are walked down to maxDepth levels, which also stops
+// symlink loops. Entries are named relative to keyDir, such as
+// "b/c.txt", and hidden ones are skipped. An error returned by visit stops
+// the walk.
+func (s *S3Server) walkKeys(root, keyDir, prefix string, maxDepth int, visit func(FileInfo) error) (bool, error) {
+	files, incomplete, err := s.listKeyDir(root, keyDir)
+	if err != nil {
+		return false, err
+	}
+
+	var walk func(rel string, files []FileInfo, depth int) error
+	walk = func(rel string, files []FileInfo, depth int) error {
+		for _, file := range files {
+			if strings.HasPrefix(file.Name, ".") {
+				continue
+			}
+			file.Name = rel + file.Name
+			if err := visit(file); err != nil {
+				return err
+			}
+			if !file.IsDir {
+				continue
+			}
+
+			dirKey := keyDir + file.Name + "/"
+			descend, limited := s.descendInto(root, dirKey, prefix, depth, maxDepth)
+			incomplete = incomplete || limited
+			if !descend {
+				continue
+			}
+			subFiles, partial, err := s.listKeyDir(root, dirKey)
+			if err != nil {
+				skip, partial := s.skipUnreadable(path.Join(root, s.keyMapper.ToFTPPath(dirKey)), err)
+				if !skip {
+					return err
+				}
+				incomplete = incomplete || partial
+				continue
+			}
+			incomplete = incomplete || partial
+			if err := walk(file.Name+"/", subFiles, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk("", files, 0); err != nil {
+		return false, err
+	}
+	return incomplete, nil
+}
+
+// descendInto reports whether a walk lists the subdirectory dirKey found at
+// depth. Only directories that can hold keys of the prefix are walked, down to
+// maxDepth; limited reports a directory left out for its depth.
+func (s *S3Server) descendInto(root, dirKey, prefix string, depth, maxDepth int) (descend, limited bool) {
+	if !strings.HasPrefix(dirKey, prefix) && !strings.HasPrefix(prefix, dirKey) {
+		return false, false
+	}
+	if depth >= maxDepth {
+		slog.Warn("not listing directory beyond the maximum listing depth",
+			"path", path.Join(root, s.keyMapper.ToFTPPath(dirKey)),
+			"max_depth", maxDepth,
+		)
+		return false, true
+	}
+	return true, false
+}
+
+// listDepth returns how many directory levels a listing of prefix without the
+// / delimiter walks: -max-list-depth, or -unscoped-list-depth when that is
+// lower and the listing covers the whole bucket, reported as capped
+func (s *S3Server) listDepth(prefix string) (depth int, capped bool) {
+	unscoped := s.config.UnscopedListDepth
+	if prefix == "" && unscoped > 0 && unscoped < s.config.MaxListDepth {
+		return unscoped, true
+	}
+	return s.config.MaxListDepth, false
+}
+
+// depthCapped reports whether a walk down to depth left out directories, that
+// is listed one whose name is depth levels deep
+func depthCapped(files []FileInfo, depth int) bool {
+	for _, file := range files {
+		if file.IsDir && strings.Count(file.Name, "/") == depth {
+			return true
+		}
+	}
+	return false
+}
+
+// walkKeysConcurrent collects the entries walkKeys would visit, listing up to
+// workers directories at once, each over a pooled connection of its own.
+// Directories finish in any order, so the entries are returned sorted by key.
+func (s *S3Server) walkKeysConcurrent(root, keyDir, prefix string, maxDepth, workers int) ([]FileInfo, bool, error) {
+	files, incomplete, err := s.listKeyDir(root, keyDir)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var (
+		mu       sync.Mutex
+		listed   []FileInfo
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	slots := make(chan struct{}, workers)
+
+	var collect func(rel string, files []FileInfo, depth int)
+	collect = func(rel string, files []FileInfo, depth int) {
+		for _, file := range files {
+			if strings.HasPrefix(file.Name, ".") {
+				continue
+			}
+			file.Name = rel + file.Name
+			mu.Lock()
+			listed = append(listed, file)
+			mu.Unlock()
+			if !file.IsDir {
+				continue
+			}
+
+			dirKey := keyDir + file.Name + "/"
+			descend, limited := s.descendInto(root, dirKey, prefix, depth, maxDepth)
+			if limited {
+				mu.Lock()
+				incomplete = true
+				mu.Unlock()
+			}
+			if !descend {
+				continue
+			}
+
+			wg.Add(1)
+			go func(name, dirKey string) {
+				defer wg.Done()
+				slots <- struct{}{}
+				mu.Lock()
+				failed := firstErr != nil
+				mu.Unlock()
+				if failed {
+					<-slots
+					return
+				}
+				subFiles, partial, err := s.listKeyDir(root, dirKey)
+				<-slots
+
+				mu.Lock()
+				if err != nil {
+					var skip bool
+					skip, partial = s.skipUnreadable(path.Join(root, s.keyMapper.ToFTPPath(dirKey)), err)
+					if !skip && firstErr == nil {
+						firstErr = err
+					}
+				}
+				incomplete = incomplete || partial
+				mu.Unlock()
+				if err == nil {
+					collect(name+"/", subFiles, depth+1)
+				}
+			}(file.Name, dirKey)
+		}
+	}
+	collect("", files, 0)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, false, firstErr
+	}
+	sortFiles(listed)
+	return listed, incomplete, nil
+}
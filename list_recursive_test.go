@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deepTree returns files spread over width directories per level, depth
+// levels deep
+func deepTree(base string, width, depth int) map[string]string {
+	files := make(map[string]string)
+	var fill func(dir string, level int)
+	fill = func(dir string, level int) {
+		files[dir+"/file.txt"] = "x"
+		if level == depth {
+			return
+		}
+		for i := 0; i < width; i++ {
+			fill(fmt.Sprintf("%s/d%d", dir, i), level+1)
+		}
+	}
+	fill(base, 0)
+	return files
+}
+
+func TestConcurrentWalkSorted(t *testing.T) {
+	files := deepTree("/bucket", 3, 3)
+	// Names that sort differently from a depth-first walk
+	for _, name := range []string{"/bucket/a-b.txt", "/bucket/a.txt", "/bucket/a/b.txt", "/bucket/a/c/d.txt", "/bucket/a0.txt", "/bucket/d1-x.txt"} {
+		files[name] = "x"
+	}
+	f := startFakeFTP(t, files)
+
+	serial := newTestServer(t, f, "-subdir-buckets", "-list-order", "ftp")
+	want, _, err := serial.listKeys("bucket", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortFiles(want)
+
+	tests := []struct {
+		name   string
+		prefix string
+		args   []string
+	}{
+		{"whole bucket", "", []string{"-list-concurrency", "4", "-max-ftp-conns", "4"}},
+		{"more workers than connections", "", []string{"-list-concurrency", "8", "-max-ftp-conns", "2"}},
+		{"prefix", "d1", []string{"-list-concurrency", "4", "-max-ftp-conns", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, f, append([]string{"-subdir-buckets", "-list-order", "ftp"}, tt.args...)...)
+			got, incomplete, err := s.listKeys("bucket", "", tt.prefix, "")
+			if err != nil || incomplete {
+				t.Fatalf("listing failed: %v, incomplete %v", err, incomplete)
+			}
+			keys := make([]string, len(got))
+			for i, file := range got {
+				keys[i] = file.Name
+				if file.IsDir {
+					keys[i] += "/"
+				}
+			}
+			if !sort.StringsAreSorted(keys) {
+				t.Errorf("keys aren't sorted: %v", keys)
+			}
+			if tt.prefix == "" && len(got) != len(want) {
+				t.Errorf("listed %d entries, the serial walk %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func BenchmarkListingWalk(b *testing.B) {
+	f := startFakeFTP(b, deepTree("/bucket", 4, 3))
+	f.mu.Lock()
+	f.listDelay = 2 * time.Millisecond
+	f.mu.Unlock()
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			s := newTestServer(b, f, "-subdir-buckets", "-max-ftp-conns", "16", "-list-concurrency", fmt.Sprint(workers))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := s.listKeys("bucket", "", "", ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnscopedListingTruncated(t *testing.T) {
+	f := startFakeFTP(t, deepTree("/bucket", 2, 6))
+
+	tests := []struct {
+		name      string
+		args      []string
+		query     string
+		truncated bool
+		deepest   int
+	}{
+		{"default cap", nil, "list-type=2", true, 3},
+		{"lower cap", []string{"-unscoped-list-depth", "1"}, "list-type=2", true, 1},
+		{"prefix walks the full depth", nil, "list-type=2&prefix=d0/", false, 6},
+		{"delimiter lists one level", nil, "list-type=2&delimiter=/", false, 0},
+		{"cap disabled", []string{"-unscoped-list-depth", "0"}, "list-type=2", false, 6},
+		{"concurrent walk", []string{"-list-concurrency", "4"}, "list-type=2", true, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, f, append([]string{"-subdir-buckets"}, tt.args...)...)
+			w := serve(s, http.MethodGet, "/bucket?"+tt.query, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+			}
+			var result ListBucketV2Result
+			if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.IsTruncated != tt.truncated {
+				t.Errorf("truncated = %v, want %v", result.IsTruncated, tt.truncated)
+			}
+			if hint := w.Header().Get(listHintHeader); (hint != "") != tt.truncated {
+				t.Errorf("hint = %q with truncated %v", hint, tt.truncated)
+			}
+			deepest := 0
+			for _, object := range result.Contents {
+				if depth := strings.Count(object.Key, "/"); !strings.HasSuffix(object.Key, "/") && depth > deepest {
+					deepest = depth
+				}
+			}
+			if deepest != tt.deepest {
+				t.Errorf("deepest object is %d levels down, want %d", deepest, tt.deepest)
+			}
+			if !tt.truncated {
+				return
+			}
+
+			// The continuation ends the listing instead of repeating it
+			next := serve(s, http.MethodGet, "/bucket?"+tt.query+"&continuation-token="+url.QueryEscape(result.NextContinuationToken), "")
+			var rest ListBucketV2Result
+			if err := xml.Unmarshal(next.Body.Bytes(), &rest); err != nil {
+				t.Fatal(err)
+			}
+			if rest.IsTruncated || len(rest.Contents) != 0 {
+				t.Errorf("continuation returned %d keys, truncated %v", len(rest.Contents), rest.IsTruncated)
+			}
+		})
+	}
+}
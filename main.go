@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log/slog"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 type Config struct {
@@ -17,6 +25,137 @@ type Config struct {
 	AccessKeyID string
 	SecretKey   string
 	LogLevel    string
+
+	FTPServerTimezone string
+	FTPLocalAddr      string
+	FTPDisableEPSV    bool
+	FTPIgnorePasvIP   bool
+	AuthPolicy        string
+	SubdirBuckets     bool
+
+	MaxPathLength          int
+	MaxPathComponentLength int
+
+	OverwriteProtection time.Duration
+	ListTimeout         time.Duration
+	ListCacheTTL        time.Duration
+	BrowserIndex        bool
+
+	CaseInsensitiveBackend bool
+	KeyMapper              string
+	ListOrder              string
+	TrailingSlash          string
+	FTPDegradedAfter       int
+	FTPQuirks              string
+	DeleteResponseStatus   int
+	TransferIdleTimeout    time.Duration
+	BucketMapFile          string
+	ContentMD5             bool
+
+	UpstreamEndpoint    string
+	UpstreamAccessKeyID string
+	UpstreamSecretKey   string
+	UpstreamRegion      string
+	UpstreamPrefixes    string
+	UpstreamOperations  string
+	// UpstreamSignAnonymous signs anonymous requests with the upstream
+	// credentials too, instead of forwarding them unsigned
+	UpstreamSignAnonymous bool
+
+	WORMBuckets         string
+	StorageClasses      string
+	SimulateGlacier     bool
+	AsyncETagWorkers    int
+	ForceContentLength  bool
+	SidecarMetadata     bool
+	CheckTypeCollisions bool
+	UploadChmod         string
+	PostUploadSite      string
+
+	WriteBufferDir     string
+	WriteBufferMaxSize int64
+	WriteBufferWorkers int
+	WriteBufferSync    bool
+
+	HTTPKeepAlive   bool
+	HTTPIdleTimeout time.Duration
+	ListContentType bool
+
+	FTPDialConcurrency int
+
+	RangeCacheSize int64
+	RangeCacheTTL  time.Duration
+
+	MaxFTPConns    int
+	FTPConnIdleTTL time.Duration
+
+	VerifyUploads      bool
+	VerifyRetries      int
+	VerifyRetryMaxSize int64
+
+	AccessLog       string
+	AccessLogFormat string
+
+	FTPTLS                   string
+	FTPTLSInsecureSkipVerify bool
+
+	ListOnError string
+
+	MaxObjectSize   int64
+	ListSizeRecheck bool
+
+	FlushCacheOnSIGHUP bool
+
+	TimeDriftInterval time.Duration
+	TimeDriftWarn     time.Duration
+
+	DefaultContentType string
+
+	UseMDTM bool
+
+	WeakETags bool
+
+	ShutdownTimeout time.Duration
+
+	FetchSourceHosts   string
+	FetchSourceMaxSize int64
+
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion string
+
+	FTPRetryBudget  int
+	FTPMaxRetries   int
+	FTPRetryBackoff time.Duration
+
+	ReadOnly bool
+
+	ListDirectories string
+
+	CredentialsFile string
+
+	KeyStripSuffix string
+
+	HTTPListenAddr string
+	HTTPSOnly      string
+
+	MaxListDepth      int
+	UnscopedListDepth int
+	ListConcurrency   int
+
+	FTPDialTimeout time.Duration
+	FTPDataTimeout time.Duration
+
+	NotFoundDocument string
+
+	FTPReadConns  int
+	FTPWriteConns int
+	FTPMetaConns  int
+
+	MetricsEnabled  bool
+	UsageAccounting bool
+
+	DebugBackendPath bool
 }
 
 func main() {
@@ -54,20 +193,166 @@ func main() {
 
 	// Initialize credentials store
 	credStore := NewCredentialsStore()
-	if config.AccessKeyID != "" && config.SecretKey != "" {
-		credStore.AddCredentials(config.AccessKeyID, config.SecretKey)
+	if err := credStore.Load(config); err != nil {
+		slog.Error("failed to load credentials", "file", config.CredentialsFile, "error", err)
+		os.Exit(1)
 	}
+	slog.Info("loaded S3 credentials", "count", credStore.Count())
 
 	// Create S3 server
-	s3Server := NewS3Server(config)
+	s3Server, err := NewS3Server(config)
+	if err != nil {
+		slog.Error("failed to set up the S3 server", "error", err)
+		os.Exit(1)
+	}
+
+	// Surface unlistable bucket roots early without delaying startup
+	go s3Server.CheckListable()
+	go s3Server.MonitorTimeDrift()
 
 	// Wrap with auth middleware
-	httpHandler := NewAuthMiddleware(credStore, s3Server)
+	authPolicy, err := ParseAuthPolicy(config.AuthPolicy)
+	if err != nil {
+		slog.Error("invalid auth policy", "error", err)
+		os.Exit(1)
+	}
+	var httpHandler http.Handler = NewAuthMiddleware(credStore, authPolicy, s3Server)
+	if config.MetricsEnabled {
+		httpHandler = s3Server.MetricsHandler(httpHandler)
+	}
+	if config.HTTPListenAddr != "" {
+		httpHandler = NewHTTPSOnly(config.HTTPSOnly, config.ListenAddr, httpHandler)
+	}
+
+	// The access log sees every request, including rejected ones
+	var accessLog *AccessLog
+	if config.AccessLog != "" {
+		var err error
+		accessLog, err = NewAccessLog(config.AccessLog, config.AccessLogFormat, httpHandler)
+		if err != nil {
+			slog.Error("failed to open access log", "path", config.AccessLog, "error", err)
+			os.Exit(1)
+		}
+		httpHandler = accessLog
+	}
+
+	// Reload bucket mappings and credentials, reopen the access log and
+	// optionally flush caches on SIGHUP without a restart
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	go func() {
+		for range reloadSignals {
+			if accessLog != nil {
+				if err := accessLog.Reopen(); err != nil {
+					slog.Error("failed to reopen access log", "path", config.AccessLog, "error", err)
+				}
+			}
+			if config.FlushCacheOnSIGHUP {
+				s3Server.FlushCaches(nil)
+			}
+			if config.CredentialsFile != "" {
+				if err := credStore.Load(config); err != nil {
+					slog.Error("failed to reload credentials, keeping current ones", "file", config.CredentialsFile, "error", err)
+				} else {
+					slog.Info("reloaded S3 credentials", "count", credStore.Count())
+				}
+			}
+			if config.BucketMapFile == "" {
+				if config.CredentialsFile == "" {
+					slog.Info("received SIGHUP, nothing to reload")
+				}
+				continue
+			}
+			slog.Info("received SIGHUP, reloading bucket mappings", "file", config.BucketMapFile)
+			if err := s3Server.ReloadBucketMap(); err != nil {
+				slog.Error("failed to reload bucket mappings, keeping current ones", "error", err)
+			}
+		}
+	}()
+
+	// Enter draining mode on SIGUSR1 ahead of a rolling restart
+	drainSignals := make(chan os.Signal, 1)
+	signal.Notify(drainSignals, syscall.SIGUSR1)
+	go func() {
+		for range drainSignals {
+			slog.Info("received SIGUSR1, draining: /ready now reports unavailable")
+			s3Server.SetDraining(true)
+		}
+	}()
+
+	server := newHTTPServer(config, config.ListenAddr, httpHandler)
+	if config.TLSCertFile != "" {
+		tlsConfig, err := newServerTLSConfig(config)
+		if err != nil {
+			slog.Error("invalid TLS configuration", "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	// Plaintext requests next to HTTPS are redirected or rejected by
+	// HTTPSOnly as -https-only asks
+	var plainServer *http.Server
+	if config.HTTPListenAddr != "" {
+		plainServer = newHTTPServer(config, config.HTTPListenAddr, httpHandler)
+		go func() {
+			slog.Info("serving plaintext HTTP", "address", config.HTTPListenAddr, "https_only", config.HTTPSOnly)
+			if err := plainServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("plaintext server failed", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// Stop accepting requests on SIGINT/SIGTERM and let in-flight ones
+	// finish, so uploads aren't cut off leaving partial files behind
+	stopSignals := make(chan os.Signal, 1)
+	signal.Notify(stopSignals, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		sig := <-stopSignals
+		slog.Info("shutting down, waiting for in-flight requests", "signal", sig.String(), "timeout", config.ShutdownTimeout)
+		s3Server.SetDraining(true)
 
-	if err := http.ListenAndServe(config.ListenAddr, httpHandler); err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		if plainServer != nil {
+			go plainServer.Shutdown(ctx)
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("in-flight requests didn't finish in time, closing their connections", "error", err)
+			server.Close()
+		}
+	}()
+
+	if config.TLSCertFile != "" {
+		slog.Info("serving HTTPS", "cert_file", config.TLSCertFile, "min_version", config.TLSMinVersion)
+		err = server.ListenAndServeTLS(config.TLSCertFile, config.TLSKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
 		slog.Error("server failed", "error", err)
 		os.Exit(1)
 	}
+	<-stopped
+	s3Server.ftp.Close()
+	slog.Info("server stopped")
+}
+
+// newHTTPServer returns a server with the configured keep-alive settings.
+// Streamed transfers have no overall deadline, only idle keep-alive
+// connections are reaped. A client's "Connection: close" lets the response
+// finish before the connection is closed.
+func newHTTPServer(config *Config, addr string, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     handler,
+		IdleTimeout: config.HTTPIdleTimeout,
+	}
+	server.SetKeepAlivesEnabled(config.HTTPKeepAlive)
+	return server
 }
 
 func parseConfig() *Config {
@@ -81,6 +366,99 @@ func parseConfig() *Config {
 	flag.StringVar(&config.AccessKeyID, "access-key-id", "", "S3 access key ID")
 	flag.StringVar(&config.SecretKey, "secret-key", "", "S3 secret access key")
 	flag.StringVar(&config.LogLevel, "log-level", "INFO", "Log level (DEBUG, INFO, WARN, ERROR)")
+	flag.StringVar(&config.AuthPolicy, "auth-policy", "", "Per-operation auth requirements, e.g. ListBuckets=anonymous,Put=required")
+	flag.BoolVar(&config.SubdirBuckets, "subdir-buckets", false, "Expose top-level FTP directories as separate buckets")
+	flag.IntVar(&config.MaxPathLength, "max-path-length", 1024, "Maximum total FTP path length, 0 to disable")
+	flag.IntVar(&config.MaxPathComponentLength, "max-path-component-length", 255, "Maximum length of a single FTP path component, 0 to disable")
+	flag.DurationVar(&config.OverwriteProtection, "overwrite-protection", 0, "Reject overwriting objects written within this window (e.g. 30s), 0 to disable")
+	flag.DurationVar(&config.ListTimeout, "list-timeout", 0, "Time budget for a ListObjectsV2 request before returning a truncated result, 0 to disable")
+	flag.DurationVar(&config.ListCacheTTL, "list-cache-ttl", 0, "Cache directory listings for this long and answer HEAD from them, 0 to disable")
+	flag.BoolVar(&config.BrowserIndex, "browser-index", false, "Serve an HTML landing page at / for web browsers")
+	flag.StringVar(&config.FTPServerTimezone, "ftp-server-timezone", "UTC", "Timezone used to interpret FTP LIST times without zone info (e.g. Europe/Berlin)")
+	flag.BoolVar(&config.FTPDisableEPSV, "ftp-disable-epsv", false, "Use PASV instead of EPSV for data transfers, for servers that accept EPSV but refuse its data connections")
+	flag.BoolVar(&config.FTPIgnorePasvIP, "ftp-ignore-pasv-ip", false, "Open passive-mode data connections to the control connection's host, ignoring the address the server advertises")
+	flag.StringVar(&config.FTPLocalAddr, "ftp-local-addr", "", "Local IP address to bind FTP control and data connections to")
+	flag.BoolVar(&config.CaseInsensitiveBackend, "case-insensitive-backend", false, "The FTP server's filesystem is case-insensitive")
+	flag.StringVar(&config.KeyMapper, "key-mapper", "identity", "Key to FTP path mapping: identity or hash-prefix")
+	flag.StringVar(&config.ListOrder, "list-order", "sorted", "Listing order: sorted (S3 key order) or ftp (raw FTP LIST order)")
+	flag.StringVar(&config.TrailingSlash, "trailing-slash", "passthrough", "Handling of keys ending in /: passthrough, folder-marker or error")
+	flag.IntVar(&config.FTPDegradedAfter, "ftp-degraded-after", 3, "Report /ready unavailable after this many consecutive failed FTP connection attempts, 0 to disable")
+	flag.StringVar(&config.FTPQuirks, "ftp-quirks", "", "Override detected FTP server quirks, e.g. mlsd=off,mdtm-write=on,utf8=off")
+	flag.IntVar(&config.DeleteResponseStatus, "delete-response-status", 204, "HTTP status for successful DELETE: 204 or 200 (for clients that mishandle 204)")
+	flag.DurationVar(&config.TransferIdleTimeout, "transfer-idle-timeout", 0, "Abort GET and PUT transfers when no bytes move for this long, 0 to disable")
+	flag.StringVar(&config.BucketMapFile, "bucket-map", "", "File mapping bucket names to FTP directories (bucket = path per line), reloaded on SIGHUP")
+	flag.BoolVar(&config.ContentMD5, "content-md5", false, "Send Content-MD5 on GET and HEAD for objects whose real MD5 is known")
+	flag.StringVar(&config.UpstreamEndpoint, "upstream-endpoint", "", "Upstream S3 endpoint URL for proxied requests")
+	flag.StringVar(&config.UpstreamAccessKeyID, "upstream-access-key-id", "", "Access key ID used to sign upstream S3 requests")
+	flag.StringVar(&config.UpstreamSecretKey, "upstream-secret-key", "", "Secret key used to sign upstream S3 requests")
+	flag.StringVar(&config.UpstreamRegion, "upstream-region", "us-east-1", "Region used to sign upstream S3 requests")
+	flag.StringVar(&config.UpstreamPrefixes, "upstream-prefixes", "", "Comma-separated bucket/key prefixes proxied to the upstream endpoint")
+	flag.StringVar(&config.UpstreamOperations, "upstream-operations", "", "Comma-separated operations proxied to the upstream endpoint, e.g. Multipart,Delete")
+	flag.BoolVar(&config.UpstreamSignAnonymous, "upstream-sign-anonymous", false, "Sign anonymous requests with the upstream credentials too, instead of forwarding them unsigned")
+	flag.StringVar(&config.WORMBuckets, "worm-buckets", "", "Write-once buckets as bucket=retention pairs, * for all buckets")
+	flag.StringVar(&config.StorageClasses, "storage-classes", "", "Storage class per bucket/key prefix, e.g. default/archive/=GLACIER")
+	flag.BoolVar(&config.SimulateGlacier, "simulate-glacier", false, "Reject GET of GLACIER and DEEP_ARCHIVE objects with InvalidObjectState")
+	flag.IntVar(&config.AsyncETagWorkers, "async-etag-workers", 0, "Hash uploads in the background with this many workers instead of while streaming, 0 to disable")
+	flag.BoolVar(&config.ForceContentLength, "force-content-length", false, "Always determine the object size before a GET and send Content-Length instead of chunked encoding")
+	flag.BoolVar(&config.SidecarMetadata, "sidecar-metadata", false, "Store S3 object metadata in hidden sidecar files next to objects")
+	flag.BoolVar(&config.CheckTypeCollisions, "check-type-collisions", false, "Reject PUTs whose key collides with an FTP directory, or whose parent is a file")
+	flag.StringVar(&config.UploadChmod, "upload-chmod", "", "Octal mode set with SITE CHMOD after each upload, e.g. 644")
+	flag.StringVar(&config.PostUploadSite, "post-upload-site", "", "SITE commands run after each upload, separated by ;, with {path} replaced by the file path")
+	flag.StringVar(&config.WriteBufferDir, "write-buffer-dir", "", "Stage small uploads in this local directory and flush them to FTP asynchronously")
+	flag.Int64Var(&config.WriteBufferMaxSize, "write-buffer-max-size", 1048576, "Largest upload in bytes that goes through the write buffer")
+	flag.IntVar(&config.WriteBufferWorkers, "write-buffer-workers", 4, "Workers flushing the write buffer through the shared FTP connection pool")
+	flag.BoolVar(&config.WriteBufferSync, "write-buffer-sync", true, "fsync staged uploads before acknowledging them")
+	flag.BoolVar(&config.HTTPKeepAlive, "http-keepalive", true, "Keep client connections open between requests")
+	flag.DurationVar(&config.HTTPIdleTimeout, "http-idle-timeout", 2*time.Minute, "Close keep-alive client connections idle for this long, 0 for no limit")
+	flag.BoolVar(&config.ListContentType, "list-content-type", false, "Add a namespaced ContentType element to each object in listings")
+	flag.IntVar(&config.FTPDialConcurrency, "ftp-dial-concurrency", 2, "Maximum FTP connections being established at once, 0 for no limit")
+	flag.Int64Var(&config.RangeCacheSize, "range-cache-size", 0, "Bytes of temporary files caching whole objects for ranged GETs when the FTP server lacks REST, 0 to disable")
+	flag.DurationVar(&config.RangeCacheTTL, "range-cache-ttl", time.Minute, "How long an object stays in the range cache")
+	flag.IntVar(&config.MaxFTPConns, "max-ftp-conns", 4, "Maximum concurrent FTP connections serving requests")
+	flag.DurationVar(&config.FTPConnIdleTTL, "ftp-conn-idle-ttl", 5*time.Minute, "Close pooled FTP connections idle for this long, 0 to keep them")
+	flag.BoolVar(&config.VerifyUploads, "verify-uploads", false, "Check the stored size of every upload and remove objects that don't match")
+	flag.IntVar(&config.VerifyRetries, "verify-retries", 2, "Store an upload again this often when its verification fails, for bodies kept in memory")
+	flag.Int64Var(&config.VerifyRetryMaxSize, "verify-retry-max-size", 8388608, "Largest upload in bytes kept in memory for verification retries")
+	flag.StringVar(&config.AccessLog, "access-log", "", "Write an access log line per request to this file, - for stdout")
+	flag.StringVar(&config.AccessLogFormat, "access-log-format", "combined", "Access log format (combined, json)")
+	flag.StringVar(&config.FTPTLS, "ftp-tls", "none", "FTP TLS mode (none, explicit, implicit)")
+	flag.BoolVar(&config.FTPTLSInsecureSkipVerify, "ftp-tls-insecure-skip-verify", false, "Accept any FTP server certificate, for self-signed certificates")
+	flag.StringVar(&config.ListOnError, "list-on-error", "fail", "How listings treat unreadable subdirectories they descend into (fail, skip, partial)")
+	flag.Int64Var(&config.MaxObjectSize, "max-object-size", 5497558138880, "Largest plausible object size in bytes, larger or negative listed sizes are treated as bogus")
+	flag.BoolVar(&config.ListSizeRecheck, "list-size-recheck", true, "Confirm bogus listed sizes with SIZE before reporting them as 0")
+	flag.BoolVar(&config.FlushCacheOnSIGHUP, "flush-cache-on-sighup", false, "Flush the in-memory caches on SIGHUP")
+	flag.DurationVar(&config.TimeDriftInterval, "time-drift-interval", 0, "Measure the FTP server's clock drift at startup and at this interval by storing a probe file, 0 to disable")
+	flag.DurationVar(&config.TimeDriftWarn, "time-drift-warn", 30*time.Second, "Warn when the FTP server's clock drifts further than this")
+	flag.StringVar(&config.DefaultContentType, "default-content-type", "application/octet-stream", "Content-Type served for objects of unknown type, e.g. text/plain; charset=utf-8")
+	flag.BoolVar(&config.UseMDTM, "use-mdtm", true, "Read object modification times with MDTM, which is precise and UTC, instead of from LIST")
+	flag.BoolVar(&config.WeakETags, "weak-etags", false, "Advertise synthetic ETags as weak validators (W/) in GET and HEAD responses")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for in-flight requests on SIGINT/SIGTERM before closing their connections")
+	flag.StringVar(&config.FetchSourceHosts, "fetch-source-hosts", "", "Comma-separated hosts a PUT with x-ftp-s3-fetch-source may fetch from, *.example.com allows subdomains; empty disables fetching")
+	flag.Int64Var(&config.FetchSourceMaxSize, "fetch-source-max-size", 5368709120, "Maximum size in bytes of an object fetched from a URL")
+	flag.StringVar(&config.TLSCertFile, "tls-cert-file", "", "Certificate file (PEM) to serve HTTPS with, together with -tls-key-file")
+	flag.StringVar(&config.TLSKeyFile, "tls-key-file", "", "Private key file (PEM) of -tls-cert-file")
+	flag.StringVar(&config.TLSMinVersion, "tls-min-version", "1.2", "Minimum TLS version served (1.0, 1.1, 1.2, 1.3)")
+	flag.IntVar(&config.FTPRetryBudget, "ftp-retry-budget", 3, "Reconnects allowed within one FTP operation, e.g. creating an upload's directories and storing it")
+	flag.IntVar(&config.FTPMaxRetries, "ftp-max-retries", 3, "Retries of an FTP command failing on a dropped connection, a timeout or a 421, 0 to fail at once")
+	flag.DurationVar(&config.FTPRetryBackoff, "ftp-retry-backoff", 100*time.Millisecond, "Backoff before the first retry of an FTP command, doubled for each further one")
+	flag.BoolVar(&config.ReadOnly, "read-only", false, "Reject PUT, POST and DELETE requests with 403 AccessDenied, serving only reads and listings")
+	flag.StringVar(&config.ListDirectories, "list-directories", "keys", "FTP directories in listings: keys (prefixes with a delimiter, empty dir/ objects without), prefixes or omit")
+	flag.StringVar(&config.CredentialsFile, "credentials-file", "", "JSON or CSV file of S3 access key ID and secret key pairs, reloaded on SIGHUP")
+	flag.StringVar(&config.KeyStripSuffix, "key-strip-suffix", "", "Suffix every stored file carries that keys leave out, e.g. .enc stores the key a/b as a/b.enc")
+	flag.StringVar(&config.HTTPListenAddr, "http-listen", "", "Additional plaintext HTTP address to listen on next to HTTPS, see -https-only")
+	flag.StringVar(&config.HTTPSOnly, "https-only", "off", "Plaintext HTTP requests when serving HTTPS: off, redirect (GET and HEAD to HTTPS, other methods rejected) or reject")
+	flag.IntVar(&config.MaxListDepth, "max-list-depth", 16, "Directory levels below the prefix walked by listings without a / delimiter, 0 to list the prefix's directory only")
+	flag.IntVar(&config.UnscopedListDepth, "unscoped-list-depth", 3, "Directory levels walked by listings without a prefix or / delimiter, which end truncated when deeper ones exist, 0 to walk -max-list-depth levels")
+	flag.IntVar(&config.ListConcurrency, "list-concurrency", 1, "Directories listed at once by listings without a / delimiter")
+	flag.DurationVar(&config.FTPDialTimeout, "ftp-dial-timeout", 30*time.Second, "Timeout for opening FTP control and data connections")
+	flag.DurationVar(&config.FTPDataTimeout, "ftp-data-timeout", 5*time.Minute, "Fail an FTP command or transfer when the server sends or accepts no bytes for this long, 0 to wait forever")
+	flag.StringVar(&config.NotFoundDocument, "not-found-document", "", "HTML file served to web browsers instead of NoSuchKey XML for missing objects")
+	flag.IntVar(&config.FTPReadConns, "ftp-read-conns", 0, "FTP connections reserved for downloads, 0 to share -max-ftp-conns")
+	flag.IntVar(&config.FTPWriteConns, "ftp-write-conns", 0, "FTP connections reserved for uploads, 0 to share -max-ftp-conns")
+	flag.IntVar(&config.FTPMetaConns, "ftp-meta-conns", 0, "FTP connections reserved for listings and other quick commands, 0 to share -max-ftp-conns")
+	flag.BoolVar(&config.MetricsEnabled, "metrics", false, "Serve Prometheus metrics on /metrics, without authentication")
+	flag.BoolVar(&config.UsageAccounting, "usage-accounting", false, "Account requests and bytes per access key ID, served as JSON or Prometheus metrics on /admin/usage")
+	flag.BoolVar(&config.DebugBackendPath, "debug-backend-path", false, "Report the FTP path of objects in an x-ftp-s3-backend-path header to authenticated clients")
 
 	flag.Parse()
 
@@ -108,11 +486,572 @@ func parseConfig() *Config {
 	if envLogLevel := os.Getenv("LOG_LEVEL"); envLogLevel != "" {
 		config.LogLevel = envLogLevel
 	}
+	if envTimezone := os.Getenv("FTP_SERVER_TIMEZONE"); envTimezone != "" {
+		config.FTPServerTimezone = envTimezone
+	}
+	if envLocalAddr := os.Getenv("FTP_LOCAL_ADDR"); envLocalAddr != "" {
+		config.FTPLocalAddr = envLocalAddr
+	}
+	if envDisableEPSV := os.Getenv("FTP_DISABLE_EPSV"); envDisableEPSV != "" {
+		if disableEPSV, err := strconv.ParseBool(envDisableEPSV); err == nil {
+			config.FTPDisableEPSV = disableEPSV
+		}
+	}
+	if envIgnorePasvIP := os.Getenv("FTP_IGNORE_PASV_IP"); envIgnorePasvIP != "" {
+		if ignorePasvIP, err := strconv.ParseBool(envIgnorePasvIP); err == nil {
+			config.FTPIgnorePasvIP = ignorePasvIP
+		}
+	}
+	if envAuthPolicy := os.Getenv("S3_AUTH_POLICY"); envAuthPolicy != "" {
+		config.AuthPolicy = envAuthPolicy
+	}
+	if envMaxPath := os.Getenv("MAX_PATH_LENGTH"); envMaxPath != "" {
+		if maxPath, err := strconv.Atoi(envMaxPath); err == nil {
+			config.MaxPathLength = maxPath
+		}
+	}
+	if envMaxComponent := os.Getenv("MAX_PATH_COMPONENT_LENGTH"); envMaxComponent != "" {
+		if maxComponent, err := strconv.Atoi(envMaxComponent); err == nil {
+			config.MaxPathComponentLength = maxComponent
+		}
+	}
+	if envProtection := os.Getenv("OVERWRITE_PROTECTION"); envProtection != "" {
+		if protection, err := time.ParseDuration(envProtection); err == nil {
+			config.OverwriteProtection = protection
+		}
+	}
+	if envListTimeout := os.Getenv("LIST_TIMEOUT"); envListTimeout != "" {
+		if listTimeout, err := time.ParseDuration(envListTimeout); err == nil {
+			config.ListTimeout = listTimeout
+		}
+	}
+	if envListCacheTTL := os.Getenv("LIST_CACHE_TTL"); envListCacheTTL != "" {
+		if listCacheTTL, err := time.ParseDuration(envListCacheTTL); err == nil {
+			config.ListCacheTTL = listCacheTTL
+		}
+	}
+	if envBrowserIndex := os.Getenv("BROWSER_INDEX"); envBrowserIndex != "" {
+		if browserIndex, err := strconv.ParseBool(envBrowserIndex); err == nil {
+			config.BrowserIndex = browserIndex
+		}
+	}
+	if envSubdirBuckets := os.Getenv("SUBDIR_BUCKETS"); envSubdirBuckets != "" {
+		if subdirBuckets, err := strconv.ParseBool(envSubdirBuckets); err == nil {
+			config.SubdirBuckets = subdirBuckets
+		}
+	}
+	if envCaseInsensitiveBackend := os.Getenv("CASE_INSENSITIVE_BACKEND"); envCaseInsensitiveBackend != "" {
+		if caseInsensitiveBackend, err := strconv.ParseBool(envCaseInsensitiveBackend); err == nil {
+			config.CaseInsensitiveBackend = caseInsensitiveBackend
+		}
+	}
+	if envKeyMapper := os.Getenv("KEY_MAPPER"); envKeyMapper != "" {
+		config.KeyMapper = envKeyMapper
+	}
+	if envListOrder := os.Getenv("LIST_ORDER"); envListOrder != "" {
+		config.ListOrder = envListOrder
+	}
+	if envTrailingSlash := os.Getenv("TRAILING_SLASH"); envTrailingSlash != "" {
+		config.TrailingSlash = envTrailingSlash
+	}
+	if envFTPDegradedAfter := os.Getenv("FTP_DEGRADED_AFTER"); envFTPDegradedAfter != "" {
+		if degradedAfter, err := strconv.Atoi(envFTPDegradedAfter); err == nil {
+			config.FTPDegradedAfter = degradedAfter
+		}
+	}
+	if envFTPQuirks := os.Getenv("FTP_QUIRKS"); envFTPQuirks != "" {
+		config.FTPQuirks = envFTPQuirks
+	}
+	if envDeleteResponseStatus := os.Getenv("DELETE_RESPONSE_STATUS"); envDeleteResponseStatus != "" {
+		if deleteResponseStatus, err := strconv.Atoi(envDeleteResponseStatus); err == nil {
+			config.DeleteResponseStatus = deleteResponseStatus
+		}
+	}
+	if envTransferIdleTimeout := os.Getenv("TRANSFER_IDLE_TIMEOUT"); envTransferIdleTimeout != "" {
+		if transferIdleTimeout, err := time.ParseDuration(envTransferIdleTimeout); err == nil {
+			config.TransferIdleTimeout = transferIdleTimeout
+		}
+	}
+	if envBucketMapFile := os.Getenv("BUCKET_MAP"); envBucketMapFile != "" {
+		config.BucketMapFile = envBucketMapFile
+	}
+	if envContentMD5 := os.Getenv("CONTENT_MD5"); envContentMD5 != "" {
+		if contentMD5, err := strconv.ParseBool(envContentMD5); err == nil {
+			config.ContentMD5 = contentMD5
+		}
+	}
+	if envUpstreamEndpoint := os.Getenv("UPSTREAM_S3_ENDPOINT"); envUpstreamEndpoint != "" {
+		config.UpstreamEndpoint = envUpstreamEndpoint
+	}
+	if envUpstreamAccessKeyID := os.Getenv("UPSTREAM_S3_ACCESS_KEY_ID"); envUpstreamAccessKeyID != "" {
+		config.UpstreamAccessKeyID = envUpstreamAccessKeyID
+	}
+	if envUpstreamSecretKey := os.Getenv("UPSTREAM_S3_SECRET_KEY"); envUpstreamSecretKey != "" {
+		config.UpstreamSecretKey = envUpstreamSecretKey
+	}
+	if envUpstreamRegion := os.Getenv("UPSTREAM_S3_REGION"); envUpstreamRegion != "" {
+		config.UpstreamRegion = envUpstreamRegion
+	}
+	if envUpstreamPrefixes := os.Getenv("UPSTREAM_S3_PREFIXES"); envUpstreamPrefixes != "" {
+		config.UpstreamPrefixes = envUpstreamPrefixes
+	}
+	if envUpstreamOperations := os.Getenv("UPSTREAM_S3_OPERATIONS"); envUpstreamOperations != "" {
+		config.UpstreamOperations = envUpstreamOperations
+	}
+	if envUpstreamSignAnonymous := os.Getenv("UPSTREAM_S3_SIGN_ANONYMOUS"); envUpstreamSignAnonymous != "" {
+		if signAnonymous, err := strconv.ParseBool(envUpstreamSignAnonymous); err == nil {
+			config.UpstreamSignAnonymous = signAnonymous
+		}
+	}
+	if envWORMBuckets := os.Getenv("WORM_BUCKETS"); envWORMBuckets != "" {
+		config.WORMBuckets = envWORMBuckets
+	}
+	if envStorageClasses := os.Getenv("STORAGE_CLASSES"); envStorageClasses != "" {
+		config.StorageClasses = envStorageClasses
+	}
+	if envSimulateGlacier := os.Getenv("SIMULATE_GLACIER"); envSimulateGlacier != "" {
+		if simulateGlacier, err := strconv.ParseBool(envSimulateGlacier); err == nil {
+			config.SimulateGlacier = simulateGlacier
+		}
+	}
+	if envAsyncETagWorkers := os.Getenv("ASYNC_ETAG_WORKERS"); envAsyncETagWorkers != "" {
+		if asyncETagWorkers, err := strconv.Atoi(envAsyncETagWorkers); err == nil {
+			config.AsyncETagWorkers = asyncETagWorkers
+		}
+	}
+	if envForceContentLength := os.Getenv("FORCE_CONTENT_LENGTH"); envForceContentLength != "" {
+		if forceContentLength, err := strconv.ParseBool(envForceContentLength); err == nil {
+			config.ForceContentLength = forceContentLength
+		}
+	}
+	if envSidecarMetadata := os.Getenv("SIDECAR_METADATA"); envSidecarMetadata != "" {
+		if sidecarMetadata, err := strconv.ParseBool(envSidecarMetadata); err == nil {
+			config.SidecarMetadata = sidecarMetadata
+		}
+	}
+	if envCheckTypeCollisions := os.Getenv("CHECK_TYPE_COLLISIONS"); envCheckTypeCollisions != "" {
+		if checkTypeCollisions, err := strconv.ParseBool(envCheckTypeCollisions); err == nil {
+			config.CheckTypeCollisions = checkTypeCollisions
+		}
+	}
+	if envUploadChmod := os.Getenv("UPLOAD_CHMOD"); envUploadChmod != "" {
+		config.UploadChmod = envUploadChmod
+	}
+	if envPostUploadSite := os.Getenv("POST_UPLOAD_SITE"); envPostUploadSite != "" {
+		config.PostUploadSite = envPostUploadSite
+	}
+	if envWriteBufferDir := os.Getenv("WRITE_BUFFER_DIR"); envWriteBufferDir != "" {
+		config.WriteBufferDir = envWriteBufferDir
+	}
+	if envWriteBufferMaxSize := os.Getenv("WRITE_BUFFER_MAX_SIZE"); envWriteBufferMaxSize != "" {
+		if writeBufferMaxSize, err := strconv.ParseInt(envWriteBufferMaxSize, 10, 64); err == nil {
+			config.WriteBufferMaxSize = writeBufferMaxSize
+		}
+	}
+	if envWriteBufferWorkers := os.Getenv("WRITE_BUFFER_WORKERS"); envWriteBufferWorkers != "" {
+		if writeBufferWorkers, err := strconv.Atoi(envWriteBufferWorkers); err == nil {
+			config.WriteBufferWorkers = writeBufferWorkers
+		}
+	}
+	if envWriteBufferSync := os.Getenv("WRITE_BUFFER_SYNC"); envWriteBufferSync != "" {
+		if writeBufferSync, err := strconv.ParseBool(envWriteBufferSync); err == nil {
+			config.WriteBufferSync = writeBufferSync
+		}
+	}
+	if envKeepAlive := os.Getenv("HTTP_KEEPALIVE"); envKeepAlive != "" {
+		if keepAlive, err := strconv.ParseBool(envKeepAlive); err == nil {
+			config.HTTPKeepAlive = keepAlive
+		}
+	}
+	if envIdleTimeout := os.Getenv("HTTP_IDLE_TIMEOUT"); envIdleTimeout != "" {
+		if idleTimeout, err := time.ParseDuration(envIdleTimeout); err == nil {
+			config.HTTPIdleTimeout = idleTimeout
+		}
+	}
+	if envListContentType := os.Getenv("LIST_CONTENT_TYPE"); envListContentType != "" {
+		if listContentType, err := strconv.ParseBool(envListContentType); err == nil {
+			config.ListContentType = listContentType
+		}
+	}
+	if envFTPDialConcurrency := os.Getenv("FTP_DIAL_CONCURRENCY"); envFTPDialConcurrency != "" {
+		if dialConcurrency, err := strconv.Atoi(envFTPDialConcurrency); err == nil {
+			config.FTPDialConcurrency = dialConcurrency
+		}
+	}
+	if envRangeCacheSize := os.Getenv("RANGE_CACHE_SIZE"); envRangeCacheSize != "" {
+		if rangeCacheSize, err := strconv.ParseInt(envRangeCacheSize, 10, 64); err == nil {
+			config.RangeCacheSize = rangeCacheSize
+		}
+	}
+	if envRangeCacheTTL := os.Getenv("RANGE_CACHE_TTL"); envRangeCacheTTL != "" {
+		if rangeCacheTTL, err := time.ParseDuration(envRangeCacheTTL); err == nil {
+			config.RangeCacheTTL = rangeCacheTTL
+		}
+	}
+	if envMaxFTPConns := os.Getenv("MAX_FTP_CONNS"); envMaxFTPConns != "" {
+		if maxFTPConns, err := strconv.Atoi(envMaxFTPConns); err == nil {
+			config.MaxFTPConns = maxFTPConns
+		}
+	}
+	if envFTPConnIdleTTL := os.Getenv("FTP_CONN_IDLE_TTL"); envFTPConnIdleTTL != "" {
+		if connIdleTTL, err := time.ParseDuration(envFTPConnIdleTTL); err == nil {
+			config.FTPConnIdleTTL = connIdleTTL
+		}
+	}
+	if envVerifyUploads := os.Getenv("VERIFY_UPLOADS"); envVerifyUploads != "" {
+		if verifyUploads, err := strconv.ParseBool(envVerifyUploads); err == nil {
+			config.VerifyUploads = verifyUploads
+		}
+	}
+	if envVerifyRetries := os.Getenv("VERIFY_RETRIES"); envVerifyRetries != "" {
+		if verifyRetries, err := strconv.Atoi(envVerifyRetries); err == nil {
+			config.VerifyRetries = verifyRetries
+		}
+	}
+	if envVerifyRetryMaxSize := os.Getenv("VERIFY_RETRY_MAX_SIZE"); envVerifyRetryMaxSize != "" {
+		if verifyRetryMaxSize, err := strconv.ParseInt(envVerifyRetryMaxSize, 10, 64); err == nil {
+			config.VerifyRetryMaxSize = verifyRetryMaxSize
+		}
+	}
+	if envAccessLog := os.Getenv("ACCESS_LOG"); envAccessLog != "" {
+		config.AccessLog = envAccessLog
+	}
+	if envAccessLogFormat := os.Getenv("ACCESS_LOG_FORMAT"); envAccessLogFormat != "" {
+		config.AccessLogFormat = envAccessLogFormat
+	}
+	if envFTPTLS := os.Getenv("FTP_TLS"); envFTPTLS != "" {
+		config.FTPTLS = envFTPTLS
+	}
+	if envFTPTLSInsecureSkipVerify := os.Getenv("FTP_TLS_INSECURE_SKIP_VERIFY"); envFTPTLSInsecureSkipVerify != "" {
+		if insecureSkipVerify, err := strconv.ParseBool(envFTPTLSInsecureSkipVerify); err == nil {
+			config.FTPTLSInsecureSkipVerify = insecureSkipVerify
+		}
+	}
+	if envListOnError := os.Getenv("LIST_ON_ERROR"); envListOnError != "" {
+		config.ListOnError = envListOnError
+	}
+	if envMaxObjectSize := os.Getenv("MAX_OBJECT_SIZE"); envMaxObjectSize != "" {
+		if maxObjectSize, err := strconv.ParseInt(envMaxObjectSize, 10, 64); err == nil {
+			config.MaxObjectSize = maxObjectSize
+		}
+	}
+	if envListSizeRecheck := os.Getenv("LIST_SIZE_RECHECK"); envListSizeRecheck != "" {
+		if listSizeRecheck, err := strconv.ParseBool(envListSizeRecheck); err == nil {
+			config.ListSizeRecheck = listSizeRecheck
+		}
+	}
+	if envFlushCacheOnSIGHUP := os.Getenv("FLUSH_CACHE_ON_SIGHUP"); envFlushCacheOnSIGHUP != "" {
+		if flushOnSIGHUP, err := strconv.ParseBool(envFlushCacheOnSIGHUP); err == nil {
+			config.FlushCacheOnSIGHUP = flushOnSIGHUP
+		}
+	}
+	if envTimeDriftInterval := os.Getenv("TIME_DRIFT_INTERVAL"); envTimeDriftInterval != "" {
+		if timeDriftInterval, err := time.ParseDuration(envTimeDriftInterval); err == nil {
+			config.TimeDriftInterval = timeDriftInterval
+		}
+	}
+	if envTimeDriftWarn := os.Getenv("TIME_DRIFT_WARN"); envTimeDriftWarn != "" {
+		if timeDriftWarn, err := time.ParseDuration(envTimeDriftWarn); err == nil {
+			config.TimeDriftWarn = timeDriftWarn
+		}
+	}
+	if envDefaultContentType := os.Getenv("DEFAULT_CONTENT_TYPE"); envDefaultContentType != "" {
+		config.DefaultContentType = envDefaultContentType
+	}
+	if envUseMDTM := os.Getenv("USE_MDTM"); envUseMDTM != "" {
+		if useMDTM, err := strconv.ParseBool(envUseMDTM); err == nil {
+			config.UseMDTM = useMDTM
+		}
+	}
+	if envWeakETags := os.Getenv("WEAK_ETAGS"); envWeakETags != "" {
+		if weakETags, err := strconv.ParseBool(envWeakETags); err == nil {
+			config.WeakETags = weakETags
+		}
+	}
+	if envShutdownTimeout := os.Getenv("SHUTDOWN_TIMEOUT"); envShutdownTimeout != "" {
+		if shutdownTimeout, err := time.ParseDuration(envShutdownTimeout); err == nil {
+			config.ShutdownTimeout = shutdownTimeout
+		}
+	}
+	if envFetchSourceHosts := os.Getenv("FETCH_SOURCE_HOSTS"); envFetchSourceHosts != "" {
+		config.FetchSourceHosts = envFetchSourceHosts
+	}
+	if envFetchSourceMaxSize := os.Getenv("FETCH_SOURCE_MAX_SIZE"); envFetchSourceMaxSize != "" {
+		if fetchSourceMaxSize, err := strconv.ParseInt(envFetchSourceMaxSize, 10, 64); err == nil {
+			config.FetchSourceMaxSize = fetchSourceMaxSize
+		}
+	}
+	if envTLSCertFile := os.Getenv("TLS_CERT_FILE"); envTLSCertFile != "" {
+		config.TLSCertFile = envTLSCertFile
+	}
+	if envTLSKeyFile := os.Getenv("TLS_KEY_FILE"); envTLSKeyFile != "" {
+		config.TLSKeyFile = envTLSKeyFile
+	}
+	if envTLSMinVersion := os.Getenv("TLS_MIN_VERSION"); envTLSMinVersion != "" {
+		config.TLSMinVersion = envTLSMinVersion
+	}
+	if envFTPRetryBudget := os.Getenv("FTP_RETRY_BUDGET"); envFTPRetryBudget != "" {
+		if retryBudget, err := strconv.Atoi(envFTPRetryBudget); err == nil {
+			config.FTPRetryBudget = retryBudget
+		}
+	}
+	if envFTPMaxRetries := os.Getenv("FTP_MAX_RETRIES"); envFTPMaxRetries != "" {
+		if maxRetries, err := strconv.Atoi(envFTPMaxRetries); err == nil {
+			config.FTPMaxRetries = maxRetries
+		}
+	}
+	if envFTPRetryBackoff := os.Getenv("FTP_RETRY_BACKOFF"); envFTPRetryBackoff != "" {
+		if retryBackoff, err := time.ParseDuration(envFTPRetryBackoff); err == nil {
+			config.FTPRetryBackoff = retryBackoff
+		}
+	}
+	if envReadOnly := os.Getenv("READ_ONLY"); envReadOnly != "" {
+		if readOnly, err := strconv.ParseBool(envReadOnly); err == nil {
+			config.ReadOnly = readOnly
+		}
+	}
+	if envListDirectories := os.Getenv("LIST_DIRECTORIES"); envListDirectories != "" {
+		config.ListDirectories = envListDirectories
+	}
+	if envCredentialsFile := os.Getenv("CREDENTIALS_FILE"); envCredentialsFile != "" {
+		config.CredentialsFile = envCredentialsFile
+	}
+	if envKeyStripSuffix := os.Getenv("KEY_STRIP_SUFFIX"); envKeyStripSuffix != "" {
+		config.KeyStripSuffix = envKeyStripSuffix
+	}
+	if envHTTPListenAddr := os.Getenv("HTTP_LISTEN_ADDR"); envHTTPListenAddr != "" {
+		config.HTTPListenAddr = envHTTPListenAddr
+	}
+	if envHTTPSOnly := os.Getenv("HTTPS_ONLY"); envHTTPSOnly != "" {
+		config.HTTPSOnly = envHTTPSOnly
+	}
+	if envMaxListDepth := os.Getenv("MAX_LIST_DEPTH"); envMaxListDepth != "" {
+		if maxListDepth, err := strconv.Atoi(envMaxListDepth); err == nil {
+			config.MaxListDepth = maxListDepth
+		}
+	}
+	if envUnscopedListDepth := os.Getenv("UNSCOPED_LIST_DEPTH"); envUnscopedListDepth != "" {
+		if unscopedListDepth, err := strconv.Atoi(envUnscopedListDepth); err == nil {
+			config.UnscopedListDepth = unscopedListDepth
+		}
+	}
+	if envListConcurrency := os.Getenv("LIST_CONCURRENCY"); envListConcurrency != "" {
+		if listConcurrency, err := strconv.Atoi(envListConcurrency); err == nil {
+			config.ListConcurrency = listConcurrency
+		}
+	}
+	if envFTPDialTimeout := os.Getenv("FTP_DIAL_TIMEOUT"); envFTPDialTimeout != "" {
+		if dialTimeout, err := time.ParseDuration(envFTPDialTimeout); err == nil {
+			config.FTPDialTimeout = dialTimeout
+		}
+	}
+	if envFTPDataTimeout := os.Getenv("FTP_DATA_TIMEOUT"); envFTPDataTimeout != "" {
+		if dataTimeout, err := time.ParseDuration(envFTPDataTimeout); err == nil {
+			config.FTPDataTimeout = dataTimeout
+		}
+	}
+	if envNotFoundDocument := os.Getenv("NOT_FOUND_DOCUMENT"); envNotFoundDocument != "" {
+		config.NotFoundDocument = envNotFoundDocument
+	}
+	if envFTPReadConns := os.Getenv("FTP_READ_CONNS"); envFTPReadConns != "" {
+		if readConns, err := strconv.Atoi(envFTPReadConns); err == nil {
+			config.FTPReadConns = readConns
+		}
+	}
+	if envFTPWriteConns := os.Getenv("FTP_WRITE_CONNS"); envFTPWriteConns != "" {
+		if writeConns, err := strconv.Atoi(envFTPWriteConns); err == nil {
+			config.FTPWriteConns = writeConns
+		}
+	}
+	if envFTPMetaConns := os.Getenv("FTP_META_CONNS"); envFTPMetaConns != "" {
+		if metaConns, err := strconv.Atoi(envFTPMetaConns); err == nil {
+			config.FTPMetaConns = metaConns
+		}
+	}
+	if envMetricsEnabled := os.Getenv("METRICS_ENABLED"); envMetricsEnabled != "" {
+		if metricsEnabled, err := strconv.ParseBool(envMetricsEnabled); err == nil {
+			config.MetricsEnabled = metricsEnabled
+		}
+	}
+	if envUsageAccounting := os.Getenv("USAGE_ACCOUNTING"); envUsageAccounting != "" {
+		if usageAccounting, err := strconv.ParseBool(envUsageAccounting); err == nil {
+			config.UsageAccounting = usageAccounting
+		}
+	}
+	if envDebugBackendPath := os.Getenv("DEBUG_BACKEND_PATH"); envDebugBackendPath != "" {
+		if debugBackendPath, err := strconv.ParseBool(envDebugBackendPath); err == nil {
+			config.DebugBackendPath = debugBackendPath
+		}
+	}
 
 	if config.FTPUser == "" || config.FTPPassword == "" {
 		slog.Error("FTP credentials must be provided via flags or environment variables")
 		os.Exit(1)
 	}
 
+	if _, err := time.LoadLocation(config.FTPServerTimezone); err != nil {
+		slog.Error("invalid FTP server timezone", "timezone", config.FTPServerTimezone, "error", err)
+		os.Exit(1)
+	}
+
+	if config.FTPLocalAddr != "" && net.ParseIP(config.FTPLocalAddr) == nil {
+		slog.Error("invalid FTP local address, expected an IP address", "address", config.FTPLocalAddr)
+		os.Exit(1)
+	}
+
+	if config.ListOrder != "sorted" && config.ListOrder != "ftp" {
+		slog.Error("invalid list order, expected sorted or ftp", "order", config.ListOrder)
+		os.Exit(1)
+	}
+
+	switch config.TrailingSlash {
+	case TrailingSlashPassthrough, TrailingSlashFolderMarker, TrailingSlashError:
+	default:
+		slog.Error("invalid trailing slash policy, expected passthrough, folder-marker or error", "policy", config.TrailingSlash)
+		os.Exit(1)
+	}
+
+	if strings.Contains(config.KeyStripSuffix, "/") {
+		slog.Error("invalid key suffix, it must not contain /", "suffix", config.KeyStripSuffix)
+		os.Exit(1)
+	}
+
+	switch config.ListDirectories {
+	case ListDirectoriesKeys, ListDirectoriesPrefixes, ListDirectoriesOmit:
+	default:
+		slog.Error("invalid directory listing mode, expected keys, prefixes or omit", "mode", config.ListDirectories)
+		os.Exit(1)
+	}
+
+	if config.DeleteResponseStatus != http.StatusNoContent && config.DeleteResponseStatus != http.StatusOK {
+		slog.Error("invalid delete response status, expected 204 or 200", "status", config.DeleteResponseStatus)
+		os.Exit(1)
+	}
+
+	if config.BucketMapFile != "" {
+		if _, err := LoadBucketMap(config.BucketMapFile); err != nil {
+			slog.Error("invalid bucket map", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if _, err := NewUpstreamProxy(config); err != nil {
+		slog.Error("invalid upstream S3 configuration", "error", err)
+		os.Exit(1)
+	}
+
+	if _, err := ParseWORMPolicy(config.WORMBuckets); err != nil {
+		slog.Error("invalid WORM policy", "error", err)
+		os.Exit(1)
+	}
+
+	if _, err := ParseStorageClasses(config.StorageClasses); err != nil {
+		slog.Error("invalid storage classes", "error", err)
+		os.Exit(1)
+	}
+
+	if _, err := parseFetchHosts(config.FetchSourceHosts); err != nil {
+		slog.Error("invalid fetch source hosts", "error", err)
+		os.Exit(1)
+	}
+
+	if _, _, err := mime.ParseMediaType(config.DefaultContentType); err != nil {
+		slog.Error("invalid default content type", "content_type", config.DefaultContentType, "error", err)
+		os.Exit(1)
+	}
+
+	if config.UploadChmod != "" && !chmodModePattern.MatchString(config.UploadChmod) {
+		slog.Error("invalid upload file mode, expected octal digits such as 644", "mode", config.UploadChmod)
+		os.Exit(1)
+	}
+
+	if config.WriteBufferDir != "" && config.WriteBufferWorkers < 1 {
+		slog.Error("the write buffer needs at least one worker", "workers", config.WriteBufferWorkers)
+		os.Exit(1)
+	}
+
+	if config.MaxFTPConns < 1 {
+		slog.Error("at least one FTP connection is needed", "max_ftp_conns", config.MaxFTPConns)
+		os.Exit(1)
+	}
+	if config.FTPReadConns < 0 || config.FTPWriteConns < 0 || config.FTPMetaConns < 0 {
+		slog.Error("FTP connection partitions can't be negative",
+			"ftp_read_conns", config.FTPReadConns,
+			"ftp_write_conns", config.FTPWriteConns,
+			"ftp_meta_conns", config.FTPMetaConns,
+		)
+		os.Exit(1)
+	}
+	if config.MaxListDepth < 0 || config.UnscopedListDepth < 0 {
+		slog.Error("invalid maximum listing depth",
+			"max_list_depth", config.MaxListDepth,
+			"unscoped_list_depth", config.UnscopedListDepth,
+		)
+		os.Exit(1)
+	}
+	if config.ListConcurrency < 1 || config.ListConcurrency > maxListConcurrency {
+		slog.Error("listing concurrency must be between 1 and the cap",
+			"list_concurrency", config.ListConcurrency,
+			"max", maxListConcurrency,
+		)
+		os.Exit(1)
+	}
+	if config.FTPMaxRetries < 0 || config.FTPRetryBackoff < 0 {
+		slog.Error("FTP retries and their backoff can't be negative",
+			"ftp_max_retries", config.FTPMaxRetries,
+			"ftp_retry_backoff", config.FTPRetryBackoff,
+		)
+		os.Exit(1)
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		slog.Error("serving HTTPS needs both -tls-cert-file and -tls-key-file")
+		os.Exit(1)
+	}
+	if _, err := newServerTLSConfig(config); err != nil {
+		slog.Error("invalid TLS minimum version", "error", err)
+		os.Exit(1)
+	}
+	if config.HTTPListenAddr != "" && config.TLSCertFile == "" {
+		slog.Error("-http-listen adds a plaintext listener next to HTTPS and needs -tls-cert-file")
+		os.Exit(1)
+	}
+	if config.HTTPSOnly != HTTPSOnlyOff && config.HTTPListenAddr == "" {
+		slog.Warn("-https-only only applies to the -http-listen listener, which isn't configured")
+	}
+	switch config.HTTPSOnly {
+	case HTTPSOnlyOff, HTTPSOnlyRedirect, HTTPSOnlyReject:
+	default:
+		slog.Error("invalid HTTPS-only mode, expected off, redirect or reject", "mode", config.HTTPSOnly)
+		os.Exit(1)
+	}
+
+	if config.FTPTLS != FTPTLSNone && config.FTPTLS != FTPTLSExplicit && config.FTPTLS != FTPTLSImplicit {
+		slog.Error("invalid FTP TLS mode", "mode", config.FTPTLS)
+		os.Exit(1)
+	}
+	if config.ListOnError != ListOnErrorFail && config.ListOnError != ListOnErrorSkip && config.ListOnError != ListOnErrorPartial {
+		slog.Error("invalid list error mode", "mode", config.ListOnError)
+		os.Exit(1)
+	}
+	if config.AccessLogFormat != AccessLogCombined && config.AccessLogFormat != AccessLogJSON {
+		slog.Error("invalid access log format", "format", config.AccessLogFormat)
+		os.Exit(1)
+	}
+
+	if _, err := ParseQuirkOverrides(config.FTPQuirks); err != nil {
+		slog.Error("invalid FTP quirk overrides", "error", err)
+		os.Exit(1)
+	}
+
+	if _, err := NewKeyMapper(config.KeyMapper); err != nil {
+		slog.Error("invalid key mapper", "error", err)
+		os.Exit(1)
+	}
+
+	if _, err := ParseAuthPolicy(config.AuthPolicy); err != nil {
+		slog.Error("invalid auth policy", "policy", config.AuthPolicy, "error", err)
+		os.Exit(1)
+	}
+
 	return config
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestKeepAliveReusesFTPSessions(t *testing.T) {
+	body := strings.Repeat("x", 256<<10)
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "data", "/bucket/big.txt": body})
+	config := testConfig(t, f, "-subdir-buckets")
+	s, err := NewS3Server(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.ftp.Close)
+
+	server := httptest.NewUnstartedServer(nil)
+	server.Config = newHTTPServer(config, "", s)
+	var accepted atomic.Int32
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			accepted.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	client := server.Client()
+
+	get := func(key string, close bool) string {
+		t.Helper()
+		r, err := http.NewRequest(http.MethodGet, server.URL+"/bucket/"+key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close = close
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: status = %d, error %v", key, resp.StatusCode, err)
+		}
+		return string(data)
+	}
+
+	get("file.txt", false)
+	logins := f.loginCount()
+	for i := 0; i < 5; i++ {
+		get("file.txt", false)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("%d client connections for keep-alive requests, want 1", n)
+	}
+	if got := f.loginCount(); got != logins {
+		t.Errorf("FTP logins grew from %d to %d, want the pooled sessions reused", logins, got)
+	}
+
+	// "Connection: close" still gets the whole streamed object
+	if got := get("big.txt", true); got != body {
+		t.Errorf("GET with Connection: close read %d of %d bytes", len(got), len(body))
+	}
+	get("file.txt", false)
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("%d client connections, want a new one after Connection: close", n)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metricsPath serves the Prometheus metrics with -metrics
+const metricsPath = "/metrics"
+
+// ftpLatencyBuckets are the upper bounds in seconds of the FTP operation
+// latency histogram
+var ftpLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// requestKey labels the HTTP request counter
+type requestKey struct {
+	method string
+	status int
+}
+
+// latencyHistogram is a Prometheus histogram of one FTP operation
+type latencyHistogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// metrics collects the counters published on /metrics. A nil *metrics, with
+// -metrics disabled, ignores everything recorded on it.
+type metrics struct {
+	mu         sync.Mutex
+	requests   map[requestKey]uint64
+	ftpLatency map[string]*latencyHistogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:   make(map[requestKey]uint64),
+		ftpLatency: make(map[string]*latencyHistogram),
+	}
+}
+
+// countRequest records a served request by method and response status
+func (m *metrics) countRequest(method string, status int) {
+	if m == nil {
+		return
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{method: method, status: status}]++
+}
+
+// observeFTP records how long an FTP operation held its connection
+func (m *metrics) observeFTP(operation string, elapsed time.Duration) {
+	if m == nil || operation == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	histogram, ok := m.ftpLatency[operation]
+	if !ok {
+		histogram = &latencyHistogram{buckets: make([]uint64, len(ftpLatencyBuckets))}
+		m.ftpLatency[operation] = histogram
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range ftpLatencyBuckets {
+		if seconds <= bound {
+			histogram.buckets[i]++
+		}
+	}
+	histogram.sum += seconds
+	histogram.count++
+}
+
+// write renders the metrics in the Prometheus text exposition format
+func (m *metrics) write(w io.Writer, ftp *FTPClient) {
+	m.mu.Lock()
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].method != requests[j].method {
+			return requests[i].method < requests[j].method
+		}
+		return requests[i].status < requests[j].status
+	})
+	fmt.Fprintln(w, "# HELP ftp_over_s3_http_requests_total HTTP requests served by method and status.")
+	fmt.Fprintln(w, "# TYPE ftp_over_s3_http_requests_total counter")
+	for _, key := range requests {
+		fmt.Fprintf(w, "ftp_over_s3_http_requests_total{method=%q,status=\"%d\"} %d\n", key.method, key.status, m.requests[key])
+	}
+
+	operations := make([]string, 0, len(m.ftpLatency))
+	for operation := range m.ftpLatency {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	fmt.Fprintln(w, "# HELP ftp_over_s3_ftp_operation_duration_seconds Time FTP operations held their connection, downloads until the response was sent.")
+	fmt.Fprintln(w, "# TYPE ftp_over_s3_ftp_operation_duration_seconds histogram")
+	for _, operation := range operations {
+		histogram := m.ftpLatency[operation]
+		for i, bound := range ftpLatencyBuckets {
+			fmt.Fprintf(w, "ftp_over_s3_ftp_operation_duration_seconds_bucket{operation=%q,le=%q} %d\n",
+				operation, strconv.FormatFloat(bound, 'g', -1, 64), histogram.buckets[i])
+		}
+		fmt.Fprintf(w, "ftp_over_s3_ftp_operation_duration_seconds_bucket{operation=%q,le=\"+Inf\"} %d\n", operation, histogram.count)
+		fmt.Fprintf(w, "ftp_over_s3_ftp_operation_duration_seconds_sum{operation=%q} %g\n", operation, histogram.sum)
+		fmt.Fprintf(w, "ftp_over_s3_ftp_operation_duration_seconds_count{operation=%q} %d\n", operation, histogram.count)
+	}
+	m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP ftp_over_s3_ftp_connections Logged-in pooled FTP connections.")
+	fmt.Fprintln(w, "# TYPE ftp_over_s3_ftp_connections gauge")
+	fmt.Fprintf(w, "ftp_over_s3_ftp_connections %d\n", ftp.LiveConnections())
+
+	reconnects := ftp.ReconnectCounts()
+	categories := make([]string, 0, len(reconnects))
+	for category := range reconnects {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	fmt.Fprintln(w, "# HELP ftp_over_s3_ftp_reconnects_total FTP reconnects by the connection error that caused them.")
+	fmt.Fprintln(w, "# TYPE ftp_over_s3_ftp_reconnects_total counter")
+	for _, category := range categories {
+		fmt.Fprintf(w, "ftp_over_s3_ftp_reconnects_total{category=%q} %d\n", category, reconnects[category])
+	}
+}
+
+// MetricsHandler serves /metrics ahead of next, which is wired behind it so
+// scrapers don't need S3 credentials
+func (s *S3Server) MetricsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != metricsPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		slog.Debug("handling metrics request")
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		// Per-credential usage is served by the authenticated /admin/usage,
+		// access key IDs aren't for unauthenticated scrapers
+		s.metrics.write(w, s.ftp)
+	})
+}
+
+// statusWriter remembers the status and body size of a response for the
+// request counter and usage accounting
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// multipartDir is the hidden directory below a bucket root holding the
+	// parts of unfinished multipart uploads, one subdirectory per upload
+	multipartDir = ".uploads"
+	// uploadManifestName is the file in an upload's directory describing it
+	uploadManifestName = "upload.json"
+	// maxPartNumber is the highest part number S3 accepts
+	maxPartNumber = 10000
+	// maxCompleteRequestSize bounds a CompleteMultipartUpload body, enough
+	// for maxPartNumber parts
+	maxCompleteRequestSize = 2 << 20
+)
+
+// multipartUpload is the manifest of an unfinished multipart upload. It is
+// kept on the FTP server, so uploads survive a gateway restart.
+type multipartUpload struct {
+	Key       string         `json:"key"`
+	Path      string         `json:"path"`
+	Metadata  objectMetadata `json:"metadata"`
+	Initiated time.Time      `json:"initiated"`
+}
+
+// S3 multipart upload XML structures
+type InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+type CompleteMultipartUpload struct {
+	Parts []CompletedPart `xml:"Part"`
+}
+
+type CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+var (
+	errNoSuchUpload     = errors.New("no such upload")
+	errPartETagMismatch = errors.New("part doesn't match its ETag")
+)
+
+func uploadDir(root, uploadID string) string {
+	return path.Join(root, multipartDir, uploadID)
+}
+
+func partPath(root, uploadID string, partNumber int) string {
+	return path.Join(uploadDir(root, uploadID), strconv.Itoa(partNumber))
+}
+
+func newUploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// validUploadID reports whether id could have been issued by newUploadID, so
+// it is safe to use as a directory name
+func validUploadID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return len(id) == 32 && err == nil
+}
+
+// loadUpload reads the manifest of the upload uploadID of ftpPath. Unknown
+// uploads and uploads of another key are errNoSuchUpload.
+func (s *S3Server) loadUpload(root, uploadID, ftpPath string) (*multipartUpload, error) {
+	if !validUploadID(uploadID) {
+		return nil, errNoSuchUpload
+	}
+	reader, err := s.ftp.Get(path.Join(uploadDir(root, uploadID), uploadManifestName))
+	if err != nil {
+		if strings.Contains(err.Error(), "550") {
+			return nil, errNoSuchUpload
+		}
+		return nil, err
+	}
+	defer reader.Close()
+
+	var upload multipartUpload
+	if err := json.NewDecoder(io.LimitReader(reader, maxSidecarSize)).Decode(&upload); err != nil {
+		return nil, fmt.Errorf("unreadable upload manifest: %v", err)
+	}
+	if upload.Path != ftpPath {
+		return nil, errNoSuchUpload
+	}
+	return &upload, nil
+}
+
+// removeUpload deletes the parts and manifest of an upload
+func (s *S3Server) removeUpload(root, uploadID string) error {
+	dir := uploadDir(root, uploadID)
+	files, err := s.ftp.List(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := s.ftp.Delete(path.Join(dir, file.Name)); err != nil {
+			return err
+		}
+	}
+	return s.ftp.RemoveDir(dir)
+}
+
+// resolveUpload resolves the object and upload of an UploadPart, Complete or
+// Abort request, writing the error response when either doesn't exist
+func (s *S3Server) resolveUpload(w http.ResponseWriter, r *http.Request) (root, ftpPath string, upload *multipartUpload, ok bool) {
+	ftpPath, ok = s.resolveObject(w, r)
+	if !ok {
+		return "", "", nil, false
+	}
+	bucket, _ := splitBucketKey(r.URL.Path)
+	root, _ = s.bucketRoot(bucket)
+
+	uploadID := r.URL.Query().Get("uploadId")
+	upload, err := s.loadUpload(root, uploadID, ftpPath)
+	if errors.Is(err, errNoSuchUpload) {
+		slog.Debug("multipart upload not found", "path", ftpPath, "upload_id", uploadID)
+		writeS3Error(w, http.StatusNotFound, "NoSuchUpload",
+			"The specified upload does not exist. The upload ID may be invalid, or the upload may have been aborted or completed.", r.URL.Path)
+		return "", "", nil, false
+	}
+	if err != nil {
+		slog.Error("failed to load multipart upload", "path", ftpPath, "upload_id", uploadID, "error", err)
+		writeInternalError(w, r, err)
+		return "", "", nil, false
+	}
+	return root, ftpPath, upload, true
+}
+
+func (s *S3Server) handleCreateMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	ftpPath, ok := s.resolveObject(w, r)
+	if !ok {
+		return
+	}
+	if !checkSSE(w, r) {
+		return
+	}
+	bucket, key := splitBucketKey(r.URL.Path)
+	root, _ := s.bucketRoot(bucket)
+
+	meta := metadataFromRequest(r)
+	if meta.userMetadataSize() > maxUserMetadataSize {
+		writeS3Error(w, http.StatusBadRequest, "MetadataTooLarge",
+			"Your metadata headers exceed the maximum allowed metadata size", r.URL.Path)
+		return
+	}
+	if !validWebsiteRedirect(meta.WebsiteRedirectLocation) {
+		writeS3Error(w, http.StatusBadRequest, "InvalidRedirectLocation",
+			"The website redirect location must be a path starting with / or an http(s) URL", r.URL.Path)
+		return
+	}
+
+	uploadID, err := newUploadID()
+	if err != nil {
+		slog.Error("failed to generate upload ID", "error", err)
+		writeInternalError(w, r, err)
+		return
+	}
+	manifest, err := json.Marshal(multipartUpload{
+		Key:       key,
+		Path:      ftpPath,
+		Metadata:  meta,
+		Initiated: time.Now().UTC(),
+	})
+	if err == nil {
+		err = s.ftp.Put(path.Join(uploadDir(root, uploadID), uploadManifestName), bytes.NewReader(manifest))
+	}
+	if err != nil {
+		slog.Error("failed to create multipart upload", "path", ftpPath, "error", err)
+		writeInternalError(w, r, err)
+		return
+	}
+	slog.Debug("created multipart upload", "path", ftpPath, "upload_id", uploadID)
+
+	w.Header().Set("Content-Type", "application/xml")
+	if err := xml.NewEncoder(w).Encode(InitiateMultipartUploadResult{
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: uploadID,
+	}); err != nil {
+		slog.Error("failed to encode XML response", "error", err)
+	}
+}
+
+func (s *S3Server) handleUploadPart(w http.ResponseWriter, r *http.Request) {
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument",
+			fmt.Sprintf("Part number must be an integer between 1 and %d, inclusive", maxPartNumber), r.URL.Path)
+		return
+	}
+	root, ftpPath, _, ok := s.resolveUpload(w, r)
+	if !ok {
+		return
+	}
+	uploadID := r.URL.Query().Get("uploadId")
+	part := partPath(root, uploadID, partNumber)
+	slog.Debug("uploading part", "path", ftpPath, "upload_id", uploadID, "part", partNumber)
+
+	watchdog := s.startTransferWatchdog(w, part, nil)
+	digest := newDigestReader(watchdog.Reader(r.Body))
+	err = s.ftp.Put(part, digest)
+	expired := watchdog.Expired()
+	watchdog.Stop()
+	incomplete := !expired && r.ContentLength >= 0 && digest.size != r.ContentLength
+	if err != nil || incomplete {
+		// Never keep a part that may be damaged
+		if delErr := s.ftp.Delete(part); delErr != nil {
+			slog.Debug("failed to remove rejected part", "path", part, "error", delErr)
+		}
+	}
+	switch {
+	case err != nil && expired:
+		writeS3Error(w, http.StatusBadRequest, "RequestTimeout",
+			"Your socket connection to the server was not read from or written to within the timeout period", r.URL.Path)
+		return
+	case err != nil && payloadMismatch(r):
+		writePayloadMismatch(w, r)
+		return
+	case incomplete:
+		writeS3Error(w, http.StatusBadRequest, "IncompleteBody",
+			"You did not provide the number of bytes specified by the Content-Length HTTP header", r.URL.Path)
+		return
+	case err != nil:
+		slog.Error("failed to store part", "path", part, "error", err)
+		if isQuotaError(err) {
+			writeS3Error(w, http.StatusInsufficientStorage, "QuotaExceeded",
+				"The FTP server has no storage space left for this object", r.URL.Path)
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", digestETag(digest.digest().md5))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *S3Server) handleCompleteMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	root, ftpPath, upload, ok := s.resolveUpload(w, r)
+	if !ok {
+		return
+	}
+	bucket, key := splitBucketKey(r.URL.Path)
+	uploadID := r.URL.Query().Get("uploadId")
+
+	var request CompleteMultipartUpload
+	if err := xml.NewDecoder(io.LimitReader(r.Body, maxCompleteRequestSize)).Decode(&request); err != nil || len(request.Parts) == 0 {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML",
+			"The XML you provided was not well-formed or did not validate against our published schema", r.URL.Path)
+		return
+	}
+	for i, part := range request.Parts {
+		if i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber {
+			writeS3Error(w, http.StatusBadRequest, "InvalidPartOrder",
+				"The list of parts was not in ascending order. The parts list must be specified in order by part number.", r.URL.Path)
+			return
+		}
+	}
+
+	// Every part must have been uploaded before the object is touched
+	files, err := s.ftp.List(uploadDir(root, uploadID))
+	if err != nil {
+		slog.Error("failed to list upload parts", "path", ftpPath, "upload_id", uploadID, "error", err)
+		writeInternalError(w, r, err)
+		return
+	}
+	uploaded := make(map[string]bool, len(files))
+	for _, file := range files {
+		uploaded[file.Name] = true
+	}
+	for _, part := range request.Parts {
+		if !uploaded[strconv.Itoa(part.PartNumber)] {
+			writeS3Error(w, http.StatusBadRequest, "InvalidPart",
+				fmt.Sprintf("Part %d could not be found", part.PartNumber), r.URL.Path)
+			return
+		}
+	}
+
+	unlock := s.lockWrite(r, ftpPath)
+	defer unlock()
+	if !s.checkWORMOverwrite(w, r, ftpPath) {
+		return
+	}
+	s.writeBuffer.Cancel(ftpPath)
+	s.rangeCache.invalidate(ftpPath)
+
+	parts := newPartsReader(s.ftp, root, uploadID, request.Parts)
+	digest := newDigestReader(parts)
+	body, cleanup, err := s.streamBetween(digest, parts)
+	if err == nil {
+		err = s.ftp.Put(ftpPath, body)
+		cleanup()
+	}
+	parts.Close()
+	if err == nil && s.config.VerifyUploads {
+		err = s.ftp.VerifyUpload(ftpPath, digest.size)
+	}
+	if err != nil {
+		if errors.Is(err, errPartETagMismatch) {
+			if delErr := s.ftp.Delete(ftpPath); delErr != nil {
+				slog.Debug("failed to remove partial object", "path", ftpPath, "error", delErr)
+			}
+		}
+		s.digests.remove(ftpPath)
+		s.writeCompleteError(w, r, ftpPath, err)
+		return
+	}
+	// HEAD and GET answer with the ETag the completion returns
+	sum := digest.digest()
+	sum.etag = parts.etag()
+	s.digests.put(ftpPath, sum)
+
+	if err := s.writeMetadata(ftpPath, upload.Metadata); err != nil {
+		slog.Error("failed to store object metadata", "path", ftpPath, "error", err)
+		writeInternalError(w, r, err)
+		return
+	}
+	s.chmodUpload(r, ftpPath)
+	s.siteAfterUpload(ftpPath)
+
+	if err := s.removeUpload(root, uploadID); err != nil {
+		slog.Warn("failed to clean up completed multipart upload", "path", ftpPath, "upload_id", uploadID, "error", err)
+	}
+	slog.Debug("completed multipart upload", "path", ftpPath, "upload_id", uploadID, "parts", len(request.Parts), "size", digest.size)
+
+	w.Header().Set("Content-Type", "application/xml")
+	if err := xml.NewEncoder(w).Encode(CompleteMultipartUploadResult{
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     sum.etag,
+	}); err != nil {
+		slog.Error("failed to encode XML response", "error", err)
+	}
+}
+
+// writeCompleteError reports a failure to assemble a multipart upload
+func (s *S3Server) writeCompleteError(w http.ResponseWriter, r *http.Request, ftpPath string, err error) {
+	switch {
+	case errors.Is(err, errPartETagMismatch):
+		writeS3Error(w, http.StatusBadRequest, "InvalidPart", err.Error(), r.URL.Path)
+	case errors.Is(err, errUploadUnverified):
+		writeUploadUnverified(w, r)
+	case isQuotaError(err):
+		writeS3Error(w, http.StatusInsufficientStorage, "QuotaExceeded",
+			"The FTP server has no storage space left for this object", r.URL.Path)
+	default:
+		slog.Error("failed to assemble multipart upload", "path", ftpPath, "error", err)
+		writeInternalError(w, r, err)
+	}
+}
+
+func (s *S3Server) handleAbortMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	root, ftpPath, _, ok := s.resolveUpload(w, r)
+	if !ok {
+		return
+	}
+	uploadID := r.URL.Query().Get("uploadId")
+
+	if err := s.removeUpload(root, uploadID); err != nil {
+		slog.Error("failed to abort multipart upload", "path", ftpPath, "upload_id", uploadID, "error", err)
+		writeInternalError(w, r, err)
+		return
+	}
+	slog.Debug("aborted multipart upload", "path", ftpPath, "upload_id", uploadID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// partsReader reads the parts of an upload one after the other, checking
+// each against the ETag the client listed for it
+type partsReader struct {
+	ftp      *FTPClient
+	root     string
+	uploadID string
+	parts    []CompletedPart
+
+	current io.ReadCloser
+	hash    hash.Hash
+	// sums collects the part MD5s the multipart ETag is derived from
+	sums []byte
+}
+
+func newPartsReader(ftp *FTPClient, root, uploadID string, parts []CompletedPart) *partsReader {
+	return &partsReader{ftp: ftp, root: root, uploadID: uploadID, parts: parts}
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.current == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+			reader, err := p.ftp.Get(partPath(p.root, p.uploadID, p.parts[0].PartNumber))
+			if err != nil {
+				return 0, err
+			}
+			p.current, p.hash = reader, md5.New()
+		}
+
+		n, err := p.current.Read(b)
+		p.hash.Write(b[:n])
+		if err == io.EOF {
+			p.current.Close()
+			p.current = nil
+			sum := p.hash.Sum(nil)
+			part := p.parts[0]
+			p.parts = p.parts[1:]
+			if hex.EncodeToString(sum) != strings.Trim(part.ETag, `"`) {
+				return n, fmt.Errorf("%w: part %d", errPartETagMismatch, part.PartNumber)
+			}
+			p.sums = append(p.sums, sum...)
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close releases the download of a part that wasn't read to the end
+func (p *partsReader) Close() error {
+	if p.current == nil {
+		return nil
+	}
+	err := p.current.Close()
+	p.current = nil
+	return err
+}
+
+// etag is the ETag S3 gives multipart objects, the MD5 of the part MD5s
+// followed by the part count
+func (p *partsReader) etag() string {
+	sum := md5.Sum(p.sums)
+	return fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(p.sums)/md5.Size)
+}
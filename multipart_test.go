@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// uploadMultipart runs a multipart upload of parts to target and returns the
+// response of CompleteMultipartUpload, or of the step that failed
+// uploadMultipart uploads parts to target, creating the upload with header
+func uploadMultipart(t *testing.T, s *S3Server, target string, parts []string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target+"?uploads", nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	var initiated InitiateMultipartUploadResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &initiated); err != nil || initiated.UploadID == "" {
+		t.Errorf("create multipart upload of %s failed with %d: %s", target, w.Code, w.Body.String())
+		return w
+	}
+
+	var complete strings.Builder
+	complete.WriteString("<CompleteMultipartUpload>")
+	for i, part := range parts {
+		w := serve(s, http.MethodPut, fmt.Sprintf("%s?partNumber=%d&uploadId=%s", target, i+1, initiated.UploadID), part)
+		if w.Code != http.StatusOK {
+			t.Errorf("upload of part %d of %s failed with %d: %s", i+1, target, w.Code, w.Body.String())
+			return w
+		}
+		fmt.Fprintf(&complete, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, w.Header().Get("ETag"))
+	}
+	complete.WriteString("</CompleteMultipartUpload>")
+
+	return serve(s, http.MethodPost, target+"?uploadId="+initiated.UploadID, complete.String())
+}
+
+func TestMultipartUpload(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/existing.txt": "existing"})
+
+	tests := []struct {
+		name  string
+		args  []string
+		parts []string
+	}{
+		{"streamed", []string{"-max-ftp-conns", "4"}, []string{"first ", "second ", "third"}},
+		{"spooled with one connection", []string{"-max-ftp-conns", "1"}, []string{"first ", "second ", "third"}},
+		{"single part", []string{"-max-ftp-conns", "4"}, []string{"only"}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, f, append([]string{"-subdir-buckets"}, tt.args...)...)
+			target := fmt.Sprintf("/bucket/object-%d.txt", i)
+			if w := uploadMultipart(t, s, target, tt.parts, nil); w.Code != http.StatusOK {
+				t.Fatalf("complete failed with %d: %s", w.Code, w.Body.String())
+			}
+			if body, _ := f.file(target); body != strings.Join(tt.parts, "") {
+				t.Errorf("assembled object is %q", body)
+			}
+		})
+	}
+}
+
+func TestConcurrentMultipartCompletesSmallPool(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/existing.txt": "existing"})
+	s := newTestServer(t, f, "-subdir-buckets", "-max-ftp-conns", "2")
+
+	const uploads = 6
+	var wg sync.WaitGroup
+	codes := make(chan int, uploads)
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes <- uploadMultipart(t, s, fmt.Sprintf("/bucket/object-%d.txt", i), []string{"first ", "second"}, nil).Code
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("concurrent multipart completions deadlocked on the connection pool")
+	}
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("complete failed with status %d", code)
+		}
+	}
+}
+
+func TestMultipartETagAfterComplete(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	w := uploadMultipart(t, s, "/bucket/object.txt", []string{"first ", "second ", "third"}, nil)
+	var result CompleteMultipartUploadResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("complete failed with %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.HasSuffix(result.ETag, `-3"`) {
+		t.Fatalf("completion ETag %s isn't a multipart ETag of 3 parts", result.ETag)
+	}
+
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		w := serve(s, method, "/bucket/object.txt", "")
+		if got := w.Header().Get("ETag"); got != result.ETag {
+			t.Errorf("%s ETag = %s, want the completion's %s", method, got, result.ETag)
+		}
+	}
+	var listing ListBucketV2Result
+	w = serve(s, http.MethodGet, "/bucket?list-type=2", "")
+	if err := xml.Unmarshal(w.Body.Bytes(), &listing); err != nil || len(listing.Contents) != 1 {
+		t.Fatalf("unexpected listing %d: %s", w.Code, w.Body.String())
+	}
+	if got := listing.Contents[0].ETag; got != result.ETag {
+		t.Errorf("listed ETag = %s, want the completion's %s", got, result.ETag)
+	}
+}
+
+func TestMultipartMetadataMatchesPut(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+	s := newTestServer(t, f, "-subdir-buckets", "-sidecar-metadata", "-storage-classes", "bucket/=STANDARD_IA")
+	header := http.Header{
+		"Content-Type":        {"text/csv"},
+		"Content-Disposition": {`attachment; filename="report.csv"`},
+		"Cache-Control":       {"max-age=60"},
+		"X-Amz-Meta-Owner":    {"reports"},
+		"X-Amz-Meta-Run":      {"42"},
+	}
+
+	r := httptest.NewRequest(http.MethodPut, "/bucket/put.csv", strings.NewReader("a,b\n1,2\n"))
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := uploadMultipart(t, s, "/bucket/multipart.csv", []string{"a,b\n", "1,2\n"}, header); w.Code != http.StatusOK {
+		t.Fatalf("multipart upload: status = %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		put := serve(s, method, "/bucket/put.csv", "").Header()
+		multipart := serve(s, method, "/bucket/multipart.csv", "").Header()
+		for _, name := range []string{"Content-Type", "Content-Disposition", "Cache-Control",
+			"X-Amz-Meta-Owner", "X-Amz-Meta-Run", "X-Amz-Storage-Class", "Content-Length"} {
+			if put.Get(name) == "" || multipart.Get(name) != put.Get(name) {
+				t.Errorf("%s %s: multipart %q, single PUT %q", method, name, multipart.Get(name), put.Get(name))
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/xml"
+	"log/slog"
+	"net/http"
+)
+
+// S3 XML error response structure
+type S3Error struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource,omitempty"`
+	RequestID string   `xml:"RequestId"`
+}
+
+const placeholderRequestID = "00000000-0000-0000-0000-000000000000"
+
+// writeS3Error answers with an S3 <Error> document, which every S3 handler
+// and the auth middleware use so clients can parse the error code
+func writeS3Error(w http.ResponseWriter, statusCode int, code, message, resource string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(S3Error{
+		Code:      code,
+		Message:   message,
+		Resource:  resource,
+		RequestID: placeholderRequestID,
+	}); err != nil {
+		slog.Error("failed to encode XML error response", "error", err)
+	}
+}
+
+// writeInternalError reports an unexpected failure, typically of the FTP
+// backend, as InternalError. The cause is kept in the message to help
+// diagnose it. A broken FTP connection, left once an operation used up its
+// -ftp-retry-budget, is reported as ServiceUnavailable and an FTP server that
+// stopped responding as GatewayTimeout, both of which clients retry.
+func writeInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	switch connectionErrorCategory(err) {
+	case "":
+		writeS3Error(w, http.StatusInternalServerError, "InternalError",
+			"We encountered an internal error: "+err.Error(), r.URL.Path)
+	case "timeout":
+		writeS3Error(w, http.StatusGatewayTimeout, "GatewayTimeout",
+			"The FTP server didn't respond in time, please retry: "+err.Error(), r.URL.Path)
+	default:
+		writeS3Error(w, http.StatusServiceUnavailable, "ServiceUnavailable",
+			"The FTP backend connection failed, please retry: "+err.Error(), r.URL.Path)
+	}
+}
+
+// writeNoSuchKey answers a request for a missing object with NoSuchKey, or
+// with the -not-found-document page when a web browser asks
+func (s *S3Server) writeNoSuchKey(w http.ResponseWriter, r *http.Request) {
+	if s.notFoundPage != nil && wantsHTML(r) {
+		s.notFoundPage.write(w)
+		return
+	}
+	writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.", r.URL.Path)
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed",
+		"The specified method is not allowed against this resource.", r.URL.Path)
+}
+
+// headWriter drops the body of responses to HEAD requests. S3 signals a
+// failed HEAD by its status alone, and the Content-Length of an XML body
+// that is never sent confuses some clients.
+type headWriter struct {
+	http.ResponseWriter
+}
+
+func (h headWriter) WriteHeader(code int) {
+	if code >= http.StatusBadRequest {
+		h.Header().Del("Content-Type")
+	}
+	h.ResponseWriter.WriteHeader(code)
+}
+
+func (h headWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (h headWriter) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
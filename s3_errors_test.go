@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestS3ErrorResponses(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "x"})
+	s := newTestServer(t, f, "-subdir-buckets", "-access-key-id", "AKIDEXAMPLE", "-secret-key", "secret")
+	store := NewCredentialsStore()
+	if err := store.Load(s.config); err != nil {
+		t.Fatal(err)
+	}
+	handler := NewAuthMiddleware(store, nil, s)
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		method  string
+		target  string
+		status  int
+		code    string
+	}{
+		{"missing key", s, http.MethodGet, "/bucket/missing.txt", http.StatusNotFound, "NoSuchKey"},
+		{"unsupported POST", s, http.MethodPost, "/bucket/file.txt", http.StatusMethodNotAllowed, "MethodNotAllowed"},
+		{"key escaping its bucket", s, http.MethodGet, "/bucket/../other", http.StatusBadRequest, "InvalidArgument"},
+		{"unsigned request", handler, http.MethodGet, "/bucket/file.txt", http.StatusForbidden, "AccessDenied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(tt.handler, tt.method, tt.target, "")
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/xml" {
+				t.Errorf("Content-Type = %q, want application/xml", ct)
+			}
+			var doc S3Error
+			if err := xml.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+				t.Fatalf("error body isn't an S3 error document: %v: %s", err, w.Body.String())
+			}
+			if doc.Code != tt.code || doc.Resource != tt.target || doc.Message == "" {
+				t.Errorf("error = %+v, want code %s for %s", doc, tt.code, tt.target)
+			}
+		})
+	}
+
+	t.Run("internal error", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		writeInternalError(w, httptest.NewRequest(http.MethodGet, "/bucket/file.txt", nil), errors.New("backend exploded"))
+		var doc S3Error
+		if err := xml.Unmarshal(w.Body.Bytes(), &doc); err != nil || w.Code != http.StatusInternalServerError || doc.Code != "InternalError" {
+			t.Errorf("status %d, error %+v (%v)", w.Code, doc, err)
+		}
+	})
+}
+
+func TestHeadErrorsHaveNoBody(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/bucket/file.txt":        "x",
+		"/bucket/secret/file.txt": "x",
+	})
+	f.mu.Lock()
+	f.listDenied = map[string]bool{"/bucket/secret": true}
+	f.mu.Unlock()
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"missing key", "/bucket/missing.txt", http.StatusNotFound},
+		{"missing bucket", "/nobucket/file.txt", http.StatusNotFound},
+		// SIZE fails, and so does the listing HEAD falls back to
+		{"permission denied", "/bucket/secret/other.txt", http.StatusForbidden},
+		{"key escaping its bucket", "/bucket/../other", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s, http.MethodHead, tt.target, "")
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("HEAD error has a body: %q", w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "" {
+				t.Errorf("Content-Type = %q for a response without a body", ct)
+			}
+		})
+	}
+
+	t.Run("found", func(t *testing.T) {
+		w := serve(s, http.MethodHead, "/bucket/file.txt", "")
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") == "" {
+			t.Errorf("status = %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+		}
+	})
+}
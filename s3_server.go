@@ -1,26 +1,140 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type S3Server struct {
-	config *Config
-	ftp    *FTPClient
+	config    *Config
+	ftp       *FTPClient
+	keyMapper KeyMapper
+	draining  atomic.Bool
+	bucketMap atomic.Pointer[map[string]bucketConfig]
+	upstream  *UpstreamProxy
+
+	worm           map[string]time.Duration
+	writeLocks     pathLocks
+	storageClasses []storageClassRule
+	siteTemplates  []string
+	fetchHosts     []string
+	fetchClient    *http.Client
+	notFoundPage   *notFoundPage
+	metrics        *metrics
+	usage          *usageTracker
+
+	digests     *digestStore
+	hasher      *etagHasher
+	writeBuffer *writeBuffer
+	rangeCache  *rangeCache
+
+	timeDrift timeDrift
 }
 
-func NewS3Server(config *Config) *S3Server {
-	return &S3Server{
-		config: config,
-		ftp:    NewFTPClient(config),
+// NewS3Server sets up the gateway for config. An error means part of the
+// configuration can't be used, the server then doesn't start rather than
+// silently run without it.
+func NewS3Server(config *Config) (*S3Server, error) {
+	keyMapper, err := NewKeyMapper(config.KeyMapper)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key mapper: %w", err)
+	}
+	if config.KeyStripSuffix != "" {
+		keyMapper = suffixKeyMapper{base: keyMapper, suffix: config.KeyStripSuffix}
+	}
+	s := &S3Server{
+		config:    config,
+		ftp:       NewFTPClient(config),
+		keyMapper: keyMapper,
+		digests:   newDigestStore(),
+	}
+	// Don't leave the FTP client's connections behind on failure
+	fail := func(err error) (*S3Server, error) {
+		s.ftp.Close()
+		return nil, err
+	}
+	if config.MetricsEnabled {
+		s.metrics = newMetrics()
+		s.ftp.metrics = s.metrics
+	}
+	if config.UsageAccounting {
+		s.usage = newUsageTracker()
+	}
+	upstream, err := NewUpstreamProxy(config)
+	if err != nil {
+		return fail(fmt.Errorf("invalid upstream S3 configuration: %w", err))
+	}
+	s.upstream = upstream
+	worm, err := ParseWORMPolicy(config.WORMBuckets)
+	if err != nil {
+		return fail(fmt.Errorf("invalid WORM policy: %w", err))
+	}
+	s.worm = worm
+	siteTemplates, err := parseSiteTemplates(config.PostUploadSite)
+	if err != nil {
+		return fail(fmt.Errorf("invalid post-upload SITE commands: %w", err))
+	}
+	s.siteTemplates = siteTemplates
+	fetchHosts, err := parseFetchHosts(config.FetchSourceHosts)
+	if err != nil {
+		return fail(fmt.Errorf("invalid fetch source hosts: %w", err))
+	}
+	if len(fetchHosts) > 0 {
+		s.fetchHosts = fetchHosts
+		s.fetchClient = newFetchClient(fetchHosts)
 	}
+	storageClasses, err := ParseStorageClasses(config.StorageClasses)
+	if err != nil {
+		return fail(fmt.Errorf("invalid storage classes: %w", err))
+	}
+	s.storageClasses = storageClasses
+	if config.NotFoundDocument != "" {
+		page, err := loadNotFoundPage(config.NotFoundDocument)
+		if err != nil {
+			return fail(fmt.Errorf("failed to load not found document: %w", err))
+		}
+		s.notFoundPage = page
+	}
+	if config.BucketMapFile != "" {
+		if err := s.ReloadBucketMap(); err != nil {
+			return fail(fmt.Errorf("failed to load bucket mappings: %w", err))
+		}
+	}
+	if config.RangeCacheSize > 0 {
+		s.rangeCache = newRangeCache(config.RangeCacheSize, config.RangeCacheTTL)
+	}
+	if config.AsyncETagWorkers > 0 {
+		s.hasher = newETagHasher(config, s.digests, config.AsyncETagWorkers)
+	}
+	// The write buffer starts flushing at once, so it is set up last
+	if config.WriteBufferDir != "" {
+		buffer, err := newWriteBuffer(config, s.ftp, func(ftpPath string) { s.rangeCache.invalidate(ftpPath) })
+		if err != nil {
+			return fail(fmt.Errorf("failed to set up write buffer in %s: %w", config.WriteBufferDir, err))
+		}
+		s.writeBuffer = buffer
+	}
+	return s, nil
+}
+
+// SetDraining toggles draining mode, in which /ready reports 503 so load
+// balancers stop routing new traffic while requests keep being served
+func (s *S3Server) SetDraining(draining bool) {
+	s.draining.Store(draining)
 }
 
 func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -30,18 +144,52 @@ func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"query", r.URL.Query(),
 	)
 
+	if s.metrics != nil || s.usage != nil {
+		recorder := &statusWriter{ResponseWriter: w}
+		body := &countingBody{ReadCloser: r.Body}
+		w, r.Body = recorder, body
+		defer func() {
+			s.metrics.countRequest(r.Method, recorder.status)
+			s.usage.record(authenticatedAs(r), r.Method, body.read, recorder.written)
+		}()
+	}
+
+	if r.URL.Path == adminPrefix+"selftest" {
+		s.handleSelfTest(w, r)
+		return
+	}
+	if r.URL.Path == adminPrefix+"flush-cache" {
+		s.handleFlushCache(w, r)
+		return
+	}
+	if r.URL.Path == adminPrefix+"time-drift" {
+		s.handleTimeDrift(w, r)
+		return
+	}
+	if r.URL.Path == adminPrefix+"inventory" {
+		s.handleInventory(w, r)
+		return
+	}
+	if r.URL.Path == adminPrefix+"usage" {
+		s.handleUsage(w, r)
+		return
+	}
+
+	// Only reads, listings and health checks get through in read-only mode
+	if s.config.ReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		slog.Debug("rejecting request in read-only mode", "method", r.Method, "path", r.URL.Path)
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", "The gateway is read-only", r.URL.Path)
+		return
+	}
+
+	if s.upstream != nil && s.upstream.Matches(r) {
+		s.upstream.ServeHTTP(w, r)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
-		// Check if this is a bucket listing request
-		if strings.Count(r.URL.Path, "/") == 1 && r.URL.Query().Get("list-type") == "2" {
-			bucket := strings.Trim(r.URL.Path, "/")
-			if bucket == "default" {
-				slog.Debug("handling ListObjectsV2 request for bucket", "bucket", bucket)
-				s.handleListObjectsV2(w, r)
-				return
-			}
-		}
-
+		bucket, key := splitBucketKey(r.URL.Path)
 		if r.URL.Path == "/" {
 			if r.URL.Query().Get("list-type") == "2" {
 				slog.Debug("handling ListObjectsV2 request")
@@ -49,6 +197,9 @@ func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			} else if r.URL.Query().Get("list-type") != "" || r.URL.Query().Get("prefix") != "" {
 				slog.Debug("handling ListObjects request")
 				s.handleListObjects(w, r)
+			} else if s.config.BrowserIndex && wantsHTML(r) {
+				slog.Debug("handling browser index request")
+				s.handleBrowserIndex(w, r)
 			} else {
 				slog.Debug("handling ListBuckets request")
 				s.handleListBuckets(w, r)
@@ -58,26 +209,56 @@ func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("ok"))
 			w.WriteHeader(http.StatusOK)
 			return
+		} else if r.URL.Path == "/ready" {
+			slog.Debug("handling readiness request", "draining", s.draining.Load())
+			if s.draining.Load() {
+				http.Error(w, "draining", http.StatusServiceUnavailable)
+				return
+			}
+			if s.ftp.Degraded() {
+				http.Error(w, "FTP backend degraded", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok"))
+			return
+		} else if r.URL.Path == "/favicon.ico" {
+			// There is no icon, but answering avoids routing it to GetObject
+			w.WriteHeader(http.StatusNoContent)
+			return
+		} else if key == "" {
+			// Bucket listing request
+			if r.URL.Query().Get("list-type") == "2" {
+				slog.Debug("handling ListObjectsV2 request for bucket", "bucket", bucket)
+				s.handleListObjectsV2(w, r)
+			} else {
+				slog.Debug("handling ListObjects request for bucket", "bucket", bucket)
+				s.handleListObjects(w, r)
+			}
 		} else {
 			slog.Debug("handling GetObject request", "path", r.URL.Path)
 			s.handleGet(w, r)
 		}
 	case http.MethodHead:
 		slog.Debug("handling HeadObject request", "path", r.URL.Path)
-		s.handleHead(w, r)
+		s.handleHead(headWriter{w}, r)
 	case http.MethodPost:
+		if r.URL.Query().Has("delete") {
+			slog.Debug("handling DeleteObjects request", "path", r.URL.Path)
+			s.handleDeleteObjects(w, r)
+			return
+		}
 		// Handle multipart upload operations
-		if r.URL.Query().Get("uploads") != "" {
+		if r.URL.Query().Has("uploads") {
 			slog.Debug("handling CreateMultipartUpload request", "path", r.URL.Path)
 			s.handleCreateMultipartUpload(w, r)
 			return
 		}
-		if strings.Contains(r.URL.Query().Get("uploadId"), "") {
+		if r.URL.Query().Has("uploadId") {
 			slog.Debug("handling CompleteMultipartUpload request", "path", r.URL.Path)
 			s.handleCompleteMultipartUpload(w, r)
 			return
 		}
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r)
 	case http.MethodPut:
 		if uploadID := r.URL.Query().Get("uploadId"); uploadID != "" {
 			slog.Debug("handling UploadPart request", "path", r.URL.Path)
@@ -96,8 +277,240 @@ func (s *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.handleDelete(w, r)
 	default:
 		slog.Debug("method not allowed", "method", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// overwriteHeader lets a PUT bypass the overwrite protection window
+const overwriteHeader = "x-ftp-s3-allow-overwrite"
+
+// defaultBucket is the single bucket exposed when subdirectory buckets are disabled
+const defaultBucket = "default"
+
+// splitBucketKey splits a path-style request path into bucket and object key
+func splitBucketKey(urlPath string) (bucket, key string) {
+	bucket, key, _ = strings.Cut(strings.TrimPrefix(urlPath, "/"), "/")
+	return bucket, key
+}
+
+// escapesBucket reports whether a key or prefix has a ".." segment. net/http
+// doesn't clean request paths without a ServeMux, and joined to the bucket
+// root such a key would resolve to another bucket or anywhere on the FTP
+// server. Backslashes count as separators for Windows servers.
+func escapesBucket(key string) bool {
+	for _, segment := range strings.FieldsFunc(key, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// writeInvalidKey rejects a request whose key or prefix escapes its bucket
+func writeInvalidKey(w http.ResponseWriter, r *http.Request) {
+	writeS3Error(w, http.StatusBadRequest, "InvalidArgument",
+		"Keys and prefixes must not contain \"..\" segments", r.URL.Path)
+}
+
+// bucketRoot returns the FTP directory backing bucket. With subdirectory
+// buckets enabled every top-level FTP directory is a bucket; otherwise the FTP
+// root is exposed as the default bucket.
+func (s *S3Server) bucketRoot(bucket string) (string, bool) {
+	if s.config.BucketMapFile != "" {
+		mapped, ok := s.mappedBuckets()[bucket]
+		return mapped.root, ok
+	}
+	if !s.config.SubdirBuckets {
+		return "", bucket == defaultBucket
+	}
+	if bucket == "" || bucket == "." || bucket == ".." || strings.HasPrefix(bucket, ".") {
+		return "", false
+	}
+	// Only directories are buckets, files at the root are not
+	isDir, err := s.ftp.IsDir(bucket)
+	if err != nil {
+		slog.Error("failed to check bucket directory", "bucket", bucket, "error", err)
+		return "", false
+	}
+	return bucket, isDir
+}
+
+// resolveObject maps the request path to its FTP path, writing a NoSuchBucket
+// error when the bucket doesn't exist
+func (s *S3Server) resolveObject(w http.ResponseWriter, r *http.Request) (string, bool) {
+	bucket, key := splitBucketKey(r.URL.Path)
+	if escapesBucket(key) {
+		slog.Warn("rejecting key escaping its bucket", "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		writeInvalidKey(w, r)
+		return "", false
+	}
+	root, ok := s.bucketRoot(bucket)
+	if !ok {
+		slog.Debug("bucket not found", "bucket", bucket)
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist", "/"+bucket)
+		return "", false
+	}
+	ftpPath := s.objectPath(root, key)
+	if !withinRoot(root, ftpPath) {
+		slog.Warn("rejecting key mapped outside its bucket", "path", r.URL.Path, "ftp_path", ftpPath, "root", root)
+		writeInvalidKey(w, r)
+		return "", false
+	}
+	if err := s.checkPathLength(ftpPath); err != nil {
+		slog.Debug("rejecting key exceeding FTP path limits", "path", ftpPath, "error", err)
+		writeS3Error(w, http.StatusBadRequest, "KeyTooLongError", err.Error(), r.URL.Path)
+		return "", false
+	}
+	// Backend paths are only revealed to authenticated callers
+	if s.config.DebugBackendPath && authenticatedAs(r) != "" {
+		w.Header().Set(backendPathHeader, ftpPath)
+	}
+	return ftpPath, true
+}
+
+// backendPathHeader reports the FTP path of an object with -debug-backend-path
+const backendPathHeader = "x-ftp-s3-backend-path"
+
+// objectPath maps an object key to its FTP path below the bucket root
+func (s *S3Server) objectPath(root, key string) string {
+	return path.Join(root, s.keyMapper.ToFTPPath(key))
+}
+
+// withinRoot reports whether ftpPath, as returned by objectPath, lies below
+// the bucket root, which keeps buckets of -bucket-map and -subdir-buckets
+// apart whatever the key mapper makes of a key. The root "" or "." is the
+// FTP login directory.
+func withinRoot(root, ftpPath string) bool {
+	root = path.Clean(root)
+	if root == "." {
+		return ftpPath != ".." && !strings.HasPrefix(ftpPath, "../") && !strings.HasPrefix(ftpPath, "/")
+	}
+	return ftpPath == root || strings.HasPrefix(ftpPath, root+"/")
+}
+
+// listKeyDir lists the FTP directory backing keyDir, a key prefix ending in
+// "/" or "" for the bucket root. Directories the key mapper treats as
+// transparent, such as hash shards, are expanded in place; -list-on-error
+// decides what happens when one of them can't be listed, the second result
+// reports whether the listing must be flagged incomplete.
+func (s *S3Server) listKeyDir(root, keyDir string) ([]FileInfo, bool, error) {
+	ftpDir := s.keyMapper.ToFTPPath(keyDir)
+	files, err := s.ftp.List(path.Join(root, ftpDir))
+	if err != nil {
+		return nil, false, err
+	}
+
+	var expanded []FileInfo
+	incomplete := false
+	for _, file := range files {
+		if !file.IsDir || s.keyMapper.FromFTPPath(ftpDir+file.Name+"/") != keyDir {
+			expanded = append(expanded, file)
+			continue
+		}
+		shardDir := path.Join(root, ftpDir, file.Name)
+		shardFiles, err := s.ftp.List(shardDir)
+		if err != nil {
+			skip, partial := s.skipUnreadable(shardDir, err)
+			if !skip {
+				return nil, false, err
+			}
+			incomplete = incomplete || partial
+			continue
+		}
+		expanded = append(expanded, shardFiles...)
+	}
+
+	if s.config.SidecarMetadata {
+		sidecars := make(map[string]bool)
+		objects := expanded[:0]
+		for _, file := range expanded {
+			if file.IsDir || !isSidecarName(file.Name) {
+				objects = append(objects, file)
+			} else {
+				sidecars[file.Name] = true
+			}
+		}
+		for i := range objects {
+			objects[i].HasSidecar = sidecars[path.Base(sidecarPath(objects[i].Name))]
+		}
+		expanded = objects
 	}
+	if s.config.KeyStripSuffix != "" {
+		expanded = stripListedSuffix(path.Join(root, ftpDir), expanded, s.config.KeyStripSuffix)
+	}
+	return expanded, incomplete, nil
+}
+
+// writeListAccessDenied reports a LIST the FTP server refused, which points
+// at the FTP account's permissions rather than at the request
+func writeListAccessDenied(w http.ResponseWriter, r *http.Request, ftpPath string) {
+	writeS3Error(w, http.StatusForbidden, "AccessDenied",
+		"The FTP account is not permitted to list \""+ftpPath+"\", check its permissions on the FTP server", r.URL.Path)
+}
+
+// CheckListable lists the bucket roots once at startup and warns when the FTP
+// login works but a root can't be listed, a common account misconfiguration
+func (s *S3Server) CheckListable() {
+	roots := []string{"."}
+	if buckets := s.mappedBuckets(); buckets != nil {
+		roots = roots[:0]
+		for _, bucket := range buckets {
+			roots = append(roots, bucket.root)
+		}
+	}
+	for _, root := range roots {
+		_, err := s.ftp.List(root)
+		if err == nil {
+			continue
+		}
+		if isPermissionError(err) {
+			slog.Warn("FTP login succeeded but listing is denied, check the FTP account's permissions",
+				"path", root,
+				"error", err,
+			)
+		} else {
+			slog.Warn("failed to list FTP directory at startup", "path", root, "error", err)
+		}
+	}
+}
+
+// checkPathLength validates an FTP path against the configured total and
+// per-component length limits, so overly long keys fail before reaching FTP
+func (s *S3Server) checkPathLength(ftpPath string) error {
+	if s.config.MaxPathLength > 0 && len(ftpPath) > s.config.MaxPathLength {
+		return fmt.Errorf("key is too long: the FTP path is %d bytes, the limit is %d", len(ftpPath), s.config.MaxPathLength)
+	}
+	if s.config.MaxPathComponentLength > 0 {
+		for _, component := range strings.Split(ftpPath, "/") {
+			if len(component) > s.config.MaxPathComponentLength {
+				return fmt.Errorf("key is too long: path component %q is %d bytes, the limit is %d",
+					component, len(component), s.config.MaxPathComponentLength)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveBucket determines the bucket name and its FTP root for a bucket-level
+// request, falling back to the default bucket for requests on "/"
+func (s *S3Server) resolveBucket(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	bucket, _ := splitBucketKey(r.URL.Path)
+	if bucket == "" {
+		bucket = defaultBucket
+	}
+	// Listing prefixes are joined to the root like keys
+	if escapesBucket(r.URL.Query().Get("prefix")) {
+		slog.Warn("rejecting prefix escaping its bucket", "path", r.URL.Path, "prefix", r.URL.Query().Get("prefix"), "remote_addr", r.RemoteAddr)
+		writeInvalidKey(w, r)
+		return "", "", false
+	}
+	root, ok := s.bucketRoot(bucket)
+	if !ok {
+		slog.Debug("bucket not found", "bucket", bucket)
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist", "/"+bucket)
+		return "", "", false
+	}
+	return bucket, root, true
 }
 
 // S3 XML response structures
@@ -122,11 +535,13 @@ type Bucket struct {
 }
 
 type ListBucketResult struct {
-	XMLName  xml.Name   `xml:"ListBucketResult"`
-	Name     string     `xml:"Name"`
-	Prefix   string     `xml:"Prefix"`
-	Marker   string     `xml:"Marker"`
-	Contents []S3Object `xml:"Contents"`
+	XMLName        xml.Name       `xml:"ListBucketResult"`
+	Name           string         `xml:"Name"`
+	Prefix         string         `xml:"Prefix"`
+	Marker         string         `xml:"Marker"`
+	Delimiter      string         `xml:"Delimiter,omitempty"`
+	Contents       []S3Object     `xml:"Contents"`
+	CommonPrefixes []CommonPrefix `xml:"CommonPrefixes"`
 }
 
 type ListBucketV2Result struct {
@@ -139,6 +554,7 @@ type ListBucketV2Result struct {
 	IsTruncated           bool           `xml:"IsTruncated"`
 	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
 	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
 	Contents              []S3Object     `xml:"Contents"`
 	CommonPrefixes        []CommonPrefix `xml:"CommonPrefixes,omitempty"`
 }
@@ -153,21 +569,31 @@ type S3Object struct {
 	ETag         string    `xml:"ETag"`
 	Size         int64     `xml:"Size"`
 	StorageClass string    `xml:"StorageClass"`
+
+	// ContentType is the -list-content-type extension, in its own namespace
+	// so strict S3 clients can tell it apart
+	ContentType string `xml:"https://github.com/aiexz/ftp-over-s3 ContentType,omitempty"`
 }
 
 func (s *S3Server) handleListBuckets(w http.ResponseWriter, r *http.Request) {
+	buckets, err := s.listBuckets()
+	if err != nil {
+		slog.Error("failed to list buckets", "error", err)
+		if isPermissionError(err) {
+			writeListAccessDenied(w, r, ".")
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+
 	result := ListAllMyBucketsResult{
 		Owner: Owner{
 			ID:          "ftp-over-s3",
 			DisplayName: "ftp-over-s3",
 		},
 		Buckets: Buckets{
-			Bucket: []Bucket{
-				{
-					Name:         "default",
-					CreationDate: time.Now(),
-				},
-			},
+			Bucket: buckets,
 		},
 	}
 
@@ -178,48 +604,116 @@ func (s *S3Server) handleListBuckets(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// listBuckets returns the buckets exposed by the gateway
+func (s *S3Server) listBuckets() ([]Bucket, error) {
+	if s.config.BucketMapFile != "" {
+		mapped := s.mappedBuckets()
+		names := make([]string, 0, len(mapped))
+		for name := range mapped {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		buckets := make([]Bucket, 0, len(names))
+		for _, name := range names {
+			buckets = append(buckets, Bucket{Name: name, CreationDate: time.Now()})
+		}
+		return buckets, nil
+	}
+	if !s.config.SubdirBuckets {
+		return []Bucket{
+			{
+				Name:         defaultBucket,
+				CreationDate: time.Now(),
+			},
+		}, nil
+	}
+
+	files, err := s.ftp.List(".")
+	if err != nil {
+		return nil, err
+	}
+	var buckets []Bucket
+	for _, file := range files {
+		// Files at the root and hidden directories are not buckets
+		if !file.IsDir || strings.HasPrefix(file.Name, ".") {
+			continue
+		}
+		buckets = append(buckets, Bucket{
+			Name:         file.Name,
+			CreationDate: file.ModTime,
+		})
+	}
+	return buckets, nil
+}
+
 func (s *S3Server) handleListObjectsV2(w http.ResponseWriter, r *http.Request) {
 	prefix := r.URL.Query().Get("prefix")
 	delimiter := r.URL.Query().Get("delimiter")
-	bucket := strings.Trim(r.URL.Path, "/")
-	if bucket == "" {
-		bucket = "default"
+	bucket, root, ok := s.resolveBucket(w, r)
+	if !ok {
+		return
+	}
+
+	// The time budget covers the whole enumeration, including the FTP LIST
+	deadline := time.Now().Add(s.config.ListTimeout)
+
+	continuationToken := r.URL.Query().Get("continuation-token")
+	start, err := decodeContinuationToken(continuationToken)
+	if err != nil {
+		slog.Debug("invalid continuation token", "token", continuationToken, "error", err)
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect", r.URL.Path)
+		return
+	}
+	// A continuation token already points past start-after
+	startAfter := r.URL.Query().Get("start-after")
+	afterKey := startAfter
+	if continuationToken != "" {
+		afterKey = ""
+	}
+	maxKeys, err := parseMaxKeys(r.URL.Query().Get("max-keys"))
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "Provided max-keys not an integer or within integer range", r.URL.Path)
+		return
 	}
 
 	slog.Debug("listing objects v2",
 		"bucket", bucket,
 		"prefix", prefix,
 		"delimiter", delimiter,
+		"start", start,
+		"max_keys", maxKeys,
 	)
 
 	result := ListBucketV2Result{
-		Name:        bucket,
-		Prefix:      prefix,
-		Delimiter:   delimiter,
-		MaxKeys:     1000,
-		IsTruncated: false,
+		Name:              bucket,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		IsTruncated:       false,
+		ContinuationToken: continuationToken,
+		StartAfter:        startAfter,
 	}
 
 	// Keep track of common prefixes to avoid duplicates
 	commonPrefixes := make(map[string]bool)
 
-	// Determine the FTP directory path from the prefix
-	ftpPath := "."
-	if prefix != "" {
-		// Remove trailing slash if present for directory lookup
-		ftpPath = strings.TrimSuffix(prefix, "/")
-		if ftpPath == "" {
-			ftpPath = "."
-		}
-	}
+	// The prefix may end mid-name, so list the directory holding its last
+	// component and filter the entries by the full prefix
+	keyDir := prefixDir(prefix)
+	ftpPath := path.Join(root, keyDir)
 
 	slog.Debug("listing contents of FTP directory", "path", ftpPath)
-	files, err := s.ftp.List(ftpPath)
+	files, incomplete, err := s.listKeys(root, keyDir, prefix, delimiter)
+	markIncomplete(w, incomplete)
 	if err != nil {
 		slog.Error("failed to list FTP directory",
 			"path", ftpPath,
 			"error", err,
 		)
+		if isPermissionError(err) {
+			writeListAccessDenied(w, r, ftpPath)
+			return
+		}
 		// If the path doesn't exist, return empty list instead of error
 		if strings.Contains(err.Error(), "550") {
 			result.KeyCount = 0
@@ -229,7 +723,7 @@ func (s *S3Server) handleListObjectsV2(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, r, err)
 		return
 	}
 
@@ -238,7 +732,32 @@ func (s *S3Server) handleListObjectsV2(w http.ResponseWriter, r *http.Request) {
 		"count", len(files),
 	)
 
-	for _, file := range files {
+	// Continuation tokens are offsets, so keep the order stable between requests
+	if s.sortListings() {
+		sortFiles(files)
+	}
+
+	// truncate ends the page before the entry at offset next
+	truncate := func(next int) {
+		result.IsTruncated = true
+		result.NextContinuationToken = encodeContinuationToken(next)
+	}
+
+entries:
+	for i := start; i < len(files); i++ {
+		// Return what we have so far once the time budget is spent, always
+		// making progress so the client can resume
+		if s.config.ListTimeout > 0 && i > start && time.Now().After(deadline) {
+			slog.Debug("listing time budget exceeded, truncating",
+				"path", ftpPath,
+				"budget", s.config.ListTimeout,
+				"next", i,
+			)
+			truncate(i)
+			break
+		}
+
+		file := files[i]
 		slog.Debug("processing file",
 			"name", file.Name,
 			"size", file.Size,
@@ -257,43 +776,57 @@ func (s *S3Server) handleListObjectsV2(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Construct the full key path
-		var name string
-		if ftpPath == "." {
-			name = file.Name
-		} else {
-			// If we're in a subdirectory, include the path
-			name = ftpPath + "/" + file.Name
-		}
+		name := keyDir + file.Name
 		if file.IsDir {
 			name = name + "/"
 		}
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
 
 		// Handle delimiter (usually "/" for directory-like listing)
-		if delimiter != "" {
-			// If there's a delimiter after the prefix, this is a CommonPrefix
-			rest := strings.TrimPrefix(name, prefix)
-			if i := strings.Index(rest, delimiter); i >= 0 {
-				commonPrefix := prefix + rest[:i+1]
-				if !commonPrefixes[commonPrefix] {
-					commonPrefixes[commonPrefix] = true
-					result.CommonPrefixes = append(result.CommonPrefixes, CommonPrefix{
-						Prefix: commonPrefix,
-					})
-					slog.Debug("found common prefix", "prefix", commonPrefix)
-				}
+		commonPrefix, object := s.classifyEntry(name, prefix, delimiter, file.IsDir)
+		if commonPrefix != "" {
+			// A common prefix stays while keys below it may follow start-after
+			if afterKey != "" && commonPrefix <= afterKey && !strings.HasPrefix(afterKey, commonPrefix) {
 				continue
 			}
+			if !commonPrefixes[commonPrefix] {
+				if len(result.Contents)+len(result.CommonPrefixes) == maxKeys {
+					truncate(i)
+					break entries
+				}
+				commonPrefixes[commonPrefix] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, CommonPrefix{
+					Prefix: commonPrefix,
+				})
+				slog.Debug("found common prefix", "prefix", commonPrefix)
+			}
+			continue
+		}
+		if !object || (afterKey != "" && name <= afterKey) {
+			continue
 		}
 
-		result.Contents = append(result.Contents, S3Object{
-			Key:          name,
-			LastModified: file.ModTime,
-			Size:         file.Size,
-			ETag:         `"d41d8cd98f00b204e9800998ecf8427e"`, // Empty file MD5
-			StorageClass: "STANDARD",
-		})
+		if len(result.Contents)+len(result.CommonPrefixes) == maxKeys {
+			truncate(i)
+			break
+		}
+		result.Contents = append(result.Contents, s.listedObject(bucket, root, name, file))
+	}
+
+	// A whole-bucket walk cut short by -unscoped-list-depth ends truncated,
+	// its continuation returns nothing more
+	if depth, capped := s.listDepth(prefix); capped && delimiter != "/" && !result.IsTruncated &&
+		start < len(files) && depthCapped(files, depth) {
+		slog.Info("truncating listing at the unscoped listing depth", "bucket", bucket, "depth", depth)
+		w.Header().Set(listHintHeader, unscopedListHint)
+		truncate(len(files))
 	}
 
+	if s.sortListings() {
+		sortListing(result.Contents, result.CommonPrefixes)
+	}
 	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
 
 	w.Header().Set("Content-Type", "application/xml")
@@ -303,38 +836,120 @@ func (s *S3Server) handleListObjectsV2(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// sortListings reports whether listings are returned in S3 key order rather
+// than the order of the FTP server's LIST output
+func (s *S3Server) sortListings() bool {
+	return s.config.ListOrder != "ftp"
+}
+
+// sortFiles orders directory entries by the key they produce, so directories
+// sort with their trailing slash exactly like S3 keys
+func sortFiles(files []FileInfo) {
+	entryKey := func(file FileInfo) string {
+		if file.IsDir {
+			return file.Name + "/"
+		}
+		return file.Name
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return entryKey(files[i]) < entryKey(files[j])
+	})
+}
+
+// sortListing orders listing results by key in UTF-8 byte order, as S3 does
+func sortListing(contents []S3Object, commonPrefixes []CommonPrefix) {
+	sort.Slice(contents, func(i, j int) bool {
+		return contents[i].Key < contents[j].Key
+	})
+	sort.Slice(commonPrefixes, func(i, j int) bool {
+		return commonPrefixes[i].Prefix < commonPrefixes[j].Prefix
+	})
+}
+
+// prefixDir returns the key directory containing prefix, including the
+// trailing slash, or "" for the bucket root. "a/b/" lists "a/b/" while "a/b"
+// lists "a/" and matches both "a/b/..." and "a/bc".
+func prefixDir(prefix string) string {
+	return prefix[:strings.LastIndex(prefix, "/")+1]
+}
+
+// maxListKeys is the most keys S3 returns in one listing page
+const maxListKeys = 1000
+
+// parseMaxKeys reads the max-keys query parameter. Like S3, larger values
+// are capped at maxListKeys.
+func parseMaxKeys(value string) (int, error) {
+	if value == "" {
+		return maxListKeys, nil
+	}
+	maxKeys, err := strconv.Atoi(value)
+	if err != nil || maxKeys < 0 {
+		return 0, fmt.Errorf("invalid max-keys %q", value)
+	}
+	return min(maxKeys, maxListKeys), nil
+}
+
+// encodeContinuationToken encodes the offset at which a truncated listing resumes
+func encodeContinuationToken(offset int) string {
+	return base64.URLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodeContinuationToken(token string) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+	decoded, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := strconv.Atoi(string(decoded))
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	return offset, nil
+}
+
 func (s *S3Server) handleListObjects(w http.ResponseWriter, r *http.Request) {
 	prefix := r.URL.Query().Get("prefix")
 	delimiter := r.URL.Query().Get("delimiter")
+	bucket, root, ok := s.resolveBucket(w, r)
+	if !ok {
+		return
+	}
 	slog.Debug("listing objects",
+		"bucket", bucket,
 		"prefix", prefix,
 		"delimiter", delimiter,
 	)
 
-	// For simplicity, we'll treat the FTP root as a single bucket
 	result := ListBucketResult{
-		Name:   "default",
-		Prefix: prefix,
-		Marker: "",
+		Name:      bucket,
+		Prefix:    prefix,
+		Marker:    "",
+		Delimiter: delimiter,
 	}
+	commonPrefixes := make(map[string]bool)
 
-	// Determine the FTP directory path from the prefix
-	ftpPath := "."
-	if prefix != "" {
-		// Remove trailing slash if present for directory lookup
-		ftpPath = strings.TrimSuffix(prefix, "/")
-		if ftpPath == "" {
-			ftpPath = "."
-		}
-	}
+	// The prefix may end mid-name, so list the directory holding its last
+	// component and filter the entries by the full prefix
+	keyDir := prefixDir(prefix)
+	ftpPath := path.Join(root, keyDir)
 
 	slog.Debug("listing contents of FTP directory", "path", ftpPath)
-	files, err := s.ftp.List(ftpPath)
+	files, incomplete, err := s.listKeys(root, keyDir, prefix, delimiter)
+	markIncomplete(w, incomplete)
 	if err != nil {
 		slog.Error("failed to list FTP directory",
 			"path", ftpPath,
 			"error", err,
 		)
+		if isPermissionError(err) {
+			writeListAccessDenied(w, r, ftpPath)
+			return
+		}
 		// If the path doesn't exist, return empty list instead of error
 		if strings.Contains(err.Error(), "550") {
 			w.Header().Set("Content-Type", "application/xml")
@@ -343,7 +958,7 @@ func (s *S3Server) handleListObjects(w http.ResponseWriter, r *http.Request) {
 			}
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, r, err)
 		return
 	}
 
@@ -352,6 +967,10 @@ func (s *S3Server) handleListObjects(w http.ResponseWriter, r *http.Request) {
 		"count", len(files),
 	)
 
+	if s.sortListings() {
+		sortFiles(files)
+	}
+
 	for _, file := range files {
 		slog.Debug("processing file",
 			"name", file.Name,
@@ -371,24 +990,27 @@ func (s *S3Server) handleListObjects(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Construct the full key path
-		var name string
-		if ftpPath == "." {
-			name = file.Name
-		} else {
-			// If we're in a subdirectory, include the path
-			name = ftpPath + "/" + file.Name
-		}
+		name := keyDir + file.Name
 		if file.IsDir {
 			name = name + "/"
 		}
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
 
-		result.Contents = append(result.Contents, S3Object{
-			Key:          name,
-			LastModified: file.ModTime,
-			Size:         file.Size,
-			ETag:         `"d41d8cd98f00b204e9800998ecf8427e"`, // Empty file MD5
-			StorageClass: "STANDARD",
-		})
+		commonPrefix, object := s.classifyEntry(name, prefix, delimiter, file.IsDir)
+		if commonPrefix != "" {
+			if !commonPrefixes[commonPrefix] {
+				commonPrefixes[commonPrefix] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, CommonPrefix{
+					Prefix: commonPrefix,
+				})
+			}
+			continue
+		}
+		if object {
+			result.Contents = append(result.Contents, s.listedObject(bucket, root, name, file))
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/xml")
@@ -399,37 +1021,192 @@ func (s *S3Server) handleListObjects(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *S3Server) handleGet(w http.ResponseWriter, r *http.Request) {
-	// Remove bucket prefix and leading slash
-	path := strings.TrimPrefix(r.URL.Path, "/default/")
+	if s.handleFolderKey(w, r) {
+		return
+	}
+
+	path, ok := s.resolveObject(w, r)
+	if !ok {
+		return
+	}
 	slog.Debug("getting file from FTP", "path", path)
 
+	if s.config.SimulateGlacier {
+		bucket, key := splitBucketKey(r.URL.Path)
+		if class := s.storageClass(bucket, key); isArchivedClass(class) {
+			slog.Debug("rejecting GET of archived object", "path", path, "storage_class", class)
+			writeS3Error(w, http.StatusForbidden, "InvalidObjectState",
+				"The operation is not valid for the object's storage class", r.URL.Path)
+			return
+		}
+	}
+
+	if s.serveStaged(w, r, path) {
+		return
+	}
+
 	// Convert empty path or "." to empty string for FTP
 	if path == "." || path == "" {
 		path = ""
 	}
 
-	reader, err := s.ftp.Get(path)
+	// The ETag, conditional requests and ranges need the object's size and
+	// time, looked up before the download starts
+	file := s.objectInfo(path)
+	if file != nil && file.IsDir {
+		// RETR of a directory fails oddly or sends nothing, and
+		// directories are only objects as "dir/"
+		slog.Debug("not getting directory as an object", "path", path)
+		s.writeNoSuchKey(w, r)
+		return
+	}
+	etag, weak := "", false
+	if file != nil {
+		etag, weak = s.entityTag(path, file.Size, file.ModTime)
+	}
+
+	switch evaluatePreconditions(r, file, etag) {
+	case http.StatusNotModified:
+		slog.Debug("object not modified", "path", path, "modified", file.ModTime)
+		w.Header().Set("Last-Modified", file.ModTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", s.advertisedETag(etag, weak))
+		w.Header().Set("x-amz-version-id", "null") // Buckets are unversioned
+		w.WriteHeader(http.StatusNotModified)
+		return
+	case http.StatusPreconditionFailed:
+		slog.Debug("object precondition failed", "path", path, "etag", etag)
+		writePreconditionFailed(w, r)
+		return
+	}
+
+	meta := s.readMetadata(path)
+	if meta.WebsiteRedirectLocation != "" {
+		slog.Debug("redirecting object", "path", path, "location", meta.WebsiteRedirectLocation)
+		w.Header().Set("x-amz-website-redirect-location", meta.WebsiteRedirectLocation)
+		http.Redirect(w, r, meta.WebsiteRedirectLocation, http.StatusMovedPermanently)
+		return
+	}
+
+	var rng *byteRange
+	size := int64(-1)
+	if file != nil {
+		size = file.Size
+	}
+	// A Range whose If-Range validator changed is ignored, sending it all
+	if header := r.Header.Get("Range"); header != "" && file != nil && !ifRangeMatches(r, etag, weak, file.ModTime) {
+		slog.Debug("If-Range doesn't match, ignoring Range", "path", path, "etag", etag)
+	} else if header != "" {
+		if size < 0 {
+			size = s.objectSize(path)
+		}
+		var err error
+		rng, err = parseRange(header, size)
+		if err != nil {
+			slog.Debug("unsatisfiable range", "path", path, "range", header, "size", size)
+			w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+			writeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange",
+				"The requested range is not satisfiable", r.URL.Path)
+			return
+		}
+	}
+
+	// Clients that can't take a chunked response need the size up front
+	needsLength := s.needsContentLength(r)
+	contentLength := int64(-1)
+	switch {
+	case rng != nil:
+		contentLength = rng.length()
+	case size >= 0:
+		contentLength = size
+	case needsLength:
+		contentLength = s.objectSize(path)
+	}
+
+	var reader io.ReadCloser
+	var err error
+	if rng != nil {
+		reader, err = s.getRange(path, rng, size)
+	} else {
+		reader, err = s.ftp.Get(path)
+	}
 	if err != nil {
 		slog.Error("failed to get file from FTP",
 			"path", path,
 			"error", err,
 		)
 		if strings.Contains(err.Error(), "550") {
-			http.Error(w, "Key \""+path+"\" does not exist", http.StatusNotFound)
+			s.writeNoSuchKey(w, r)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, r, err)
 		return
 	}
 	defer reader.Close()
 
+	// Wait for the first bytes before answering, so a transfer the FTP server
+	// never starts fails with an error rather than an empty 200
+	buffered := bufio.NewReader(reader)
+	if _, err := buffered.Peek(1); err != nil && !errors.Is(err, io.EOF) {
+		slog.Error("failed to read file from FTP", "path", path, "error", err)
+		writeInternalError(w, r, err)
+		return
+	}
+
+	var body io.Reader = buffered
+	if needsLength && contentLength < 0 {
+		spool, size, err := spoolToTempFile(body)
+		if err != nil {
+			slog.Error("failed to buffer file for a fixed Content-Length", "path", path, "error", err)
+			writeInternalError(w, r, err)
+			return
+		}
+		defer spool.Close()
+		body, contentLength = spool, size
+	}
+
 	// Set response headers
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`) // Empty file MD5
+	s.setObjectHeaders(w, r, meta)
+	w.Header().Set("Accept-Ranges", "bytes")
+	if contentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+	if rng != nil {
+		w.Header().Set("Content-Range", rng.contentRange(size))
+	}
+	if file != nil {
+		w.Header().Set("Last-Modified", file.ModTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", s.advertisedETag(etag, weak))
+		// A range has no digest of its own
+		if rng == nil {
+			s.setContentMD5(w, path, file.Size)
+		}
+	}
+	w.Header().Set("x-amz-version-id", "null") // Buckets are unversioned
+
+	// On an idle timeout the FTP data connection is unblocked through its
+	// deadline, racing a Close against the in-flight read isn't safe
+	var abort func()
+	if conn, ok := reader.(interface{ SetDeadline(time.Time) error }); ok {
+		abort = func() { conn.SetDeadline(time.Now()) }
+	}
+	watchdog := s.startTransferWatchdog(w, path, abort)
+	defer watchdog.Stop()
+
+	if rng != nil {
+		w.WriteHeader(http.StatusPartialContent)
+	}
 
 	slog.Debug("streaming file contents to client", "path", path)
-	written, err := io.Copy(w, reader)
+	written, err := io.Copy(watchdog.Writer(w), watchdog.Reader(body))
 	if err != nil {
+		if watchdog.Expired() {
+			slog.Warn("aborted idle download",
+				"path", path,
+				"idle", s.config.TransferIdleTimeout,
+				"bytes", written,
+			)
+			return
+		}
 		slog.Error("failed to stream file contents",
 			"path", path,
 			"error", err,
@@ -443,8 +1220,18 @@ func (s *S3Server) handleGet(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *S3Server) handlePut(w http.ResponseWriter, r *http.Request) {
-	// Remove bucket prefix and leading slash
-	path := strings.TrimPrefix(r.URL.Path, "/default/")
+	if r.Header.Get(copySourceHeader) != "" {
+		s.handleCopyObject(w, r)
+		return
+	}
+	if s.handleFolderKey(w, r) {
+		return
+	}
+
+	path, ok := s.resolveObject(w, r)
+	if !ok {
+		return
+	}
 	slog.Debug("putting file to FTP", "path", path)
 
 	// Convert empty path or "." to empty string for FTP
@@ -452,56 +1239,338 @@ func (s *S3Server) handlePut(w http.ResponseWriter, r *http.Request) {
 		path = ""
 	}
 
-	err := s.ftp.Put(path, r.Body)
+	if !checkSSE(w, r) {
+		return
+	}
+
+	if s.config.CaseInsensitiveBackend {
+		existing, err := s.caseCollision(path)
+		if err != nil {
+			slog.Debug("failed to check for case collisions", "path", path, "error", err)
+		} else if existing != "" {
+			slog.Debug("rejecting PUT colliding with differently-cased key", "path", path, "existing", existing)
+			writeS3Error(w, http.StatusConflict, "OperationAborted",
+				"The key collides with existing object \""+existing+"\" on the case-insensitive backend", r.URL.Path)
+			return
+		}
+	}
+
+	meta := metadataFromRequest(r)
+	if !validWebsiteRedirect(meta.WebsiteRedirectLocation) {
+		writeS3Error(w, http.StatusBadRequest, "InvalidRedirectLocation",
+			"The website redirect location must be a path starting with / or an http(s) URL", r.URL.Path)
+		return
+	}
+	if meta.userMetadataSize() > maxUserMetadataSize {
+		writeS3Error(w, http.StatusBadRequest, "MetadataTooLarge",
+			"Your metadata headers exceed the maximum allowed metadata size", r.URL.Path)
+		return
+	}
+	if meta.WebsiteRedirectLocation != "" && !s.config.SidecarMetadata {
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented",
+			"Storing website redirects requires -sidecar-metadata", r.URL.Path)
+		return
+	}
+
+	unlock := s.lockWrite(r, path)
+	defer unlock()
+	if !s.checkWORMOverwrite(w, r, path) {
+		return
+	}
+	if !s.checkPutPreconditions(w, r, path) {
+		return
+	}
+
+	if s.config.CheckTypeCollisions {
+		collision, err := s.typeCollision(path)
+		if err != nil {
+			slog.Debug("failed to check for file/directory collisions", "path", path, "error", err)
+		} else if collision != "" {
+			slog.Debug("rejecting PUT colliding with a file or directory", "path", path, "collision", collision)
+			writeS3Error(w, http.StatusConflict, "InvalidRequest", collision, r.URL.Path)
+			return
+		}
+	}
+
+	if s.config.OverwriteProtection > 0 && r.Header.Get(overwriteHeader) != "true" && s.recentlyWritten(path) {
+		writeS3Error(w, http.StatusConflict, "OperationAborted",
+			"The object was written too recently to be overwritten, set "+overwriteHeader+": true to override", r.URL.Path)
+		return
+	}
+
+	if r.Header.Get(fetchSourceHeader) != "" {
+		contentType, ok := s.openFetchSource(w, r)
+		if !ok {
+			return
+		}
+		defer r.Body.Close()
+		if meta.ContentType == "" {
+			meta.ContentType = contentType
+		}
+	}
+
+	if s.bufferable(r, meta) && s.handleBufferedPut(w, r, path) {
+		return
+	}
+	// A direct write replaces whatever is still waiting in the buffer
+	s.writeBuffer.Cancel(path)
+	s.rangeCache.invalidate(path)
+
+	watchdog := s.startTransferWatchdog(w, path, nil)
+	counted := &countingReader{r: watchdog.Reader(r.Body)}
+	var body io.Reader = counted
+	// Without background hashing the digest is computed while streaming
+	var digest *digestReader
+	if s.hasher == nil {
+		digest = newDigestReader(body)
+		body = digest
+	}
+	// Small bodies are kept so a failed verification can store them again
+	var sent *bytes.Buffer
+	if s.retainForRetry(r) {
+		sent = bytes.NewBuffer(make([]byte, 0, r.ContentLength))
+		body = io.TeeReader(body, sent)
+	}
+	err := s.ftp.Put(path, body)
+	expired := watchdog.Expired()
+	watchdog.Stop()
+	// A body cut short usually fails the read, but never trust a stored
+	// object whose size differs from the declared Content-Length. A body
+	// the FTP server stopped reading, e.g. on a full disk, isn't short.
+	incomplete := !expired && r.ContentLength >= 0 && counted.ended && counted.n != r.ContentLength
+	if incomplete && err == nil {
+		err = fmt.Errorf("read %d of %d declared bytes", counted.n, r.ContentLength)
+	}
+	if err == nil && s.config.VerifyUploads {
+		err = s.verifyUpload(path, counted.n, sent)
+	}
+	// The ETag is the real MD5 unless hashing happens in the background
+	etag := syntheticETag(counted.n, time.Now())
+	switch {
+	case err != nil:
+		s.digests.remove(path)
+	case s.hasher != nil:
+		s.hasher.enqueue(path)
+	default:
+		sum := digest.digest()
+		s.digests.put(path, sum)
+		etag = digestETag(sum.md5)
+	}
+	if err != nil && expired {
+		slog.Warn("aborted idle upload",
+			"path", path,
+			"idle", s.config.TransferIdleTimeout,
+			"error", err,
+		)
+		if delErr := s.ftp.Delete(path); delErr != nil {
+			slog.Debug("failed to remove partial file", "path", path, "error", delErr)
+		}
+		writeS3Error(w, http.StatusBadRequest, "RequestTimeout",
+			"Your socket connection to the server was not read from or written to within the timeout period", r.URL.Path)
+		return
+	}
+	if err != nil && payloadMismatch(r) {
+		slog.Warn("upload body doesn't match its signed SHA-256, removing it", "path", path)
+		if delErr := s.ftp.Delete(path); delErr != nil {
+			slog.Debug("failed to remove rejected file", "path", path, "error", delErr)
+		}
+		writePayloadMismatch(w, r)
+		return
+	}
+	if incomplete {
+		slog.Warn("upload body doesn't match Content-Length, removing partial file",
+			"path", path,
+			"declared", r.ContentLength,
+			"received", counted.n,
+			"error", err,
+		)
+		if delErr := s.ftp.Delete(path); delErr != nil {
+			slog.Debug("failed to remove partial file", "path", path, "error", delErr)
+		}
+		writeS3Error(w, http.StatusBadRequest, "IncompleteBody",
+			"You did not provide the number of bytes specified by the Content-Length HTTP header", r.URL.Path)
+		return
+	}
+	if errors.Is(err, errUploadUnverified) {
+		writeUploadUnverified(w, r)
+		return
+	}
+	if errors.Is(err, errFetchTooLarge) {
+		slog.Warn("fetched object exceeds the maximum size, removing partial file", "path", path)
+		if delErr := s.ftp.Delete(path); delErr != nil {
+			slog.Debug("failed to remove partial file", "path", path, "error", delErr)
+		}
+		writeS3Error(w, http.StatusBadRequest, "EntityTooLarge",
+			"The fetched object exceeds the maximum allowed size", r.URL.Path)
+		return
+	}
 	if err != nil {
 		slog.Error("failed to put file to FTP",
 			"path", path,
 			"error", err,
 		)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if isQuotaError(err) {
+			writeS3Error(w, http.StatusInsufficientStorage, "QuotaExceeded",
+				"The FTP server has no storage space left for this object", r.URL.Path)
+			return
+		}
+		writeInternalError(w, r, err)
 		return
 	}
 
+	if err := s.writeMetadata(path, meta); err != nil {
+		slog.Error("failed to store object metadata", "path", path, "error", err)
+		writeInternalError(w, r, err)
+		return
+	}
+
+	s.chmodUpload(r, path)
+	s.siteAfterUpload(path)
+
 	// Set response headers
-	w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`) // Empty file MD5
+	w.Header().Set("ETag", etag)
+	w.Header().Set("x-amz-version-id", "null") // Buckets are unversioned
 	slog.Debug("successfully uploaded file", "path", path)
 	w.WriteHeader(http.StatusOK)
 }
 
+// recentlyWritten reports whether the object at ftpPath was written within the
+// -overwrite-protection window. A staged upload was just written. The time
+// comes from MDTM, or an uncached listing, as a cached one may predate the
+// last write.
+func (s *S3Server) recentlyWritten(ftpPath string) bool {
+	if s.writeBuffer.Staged(ftpPath) {
+		slog.Debug("rejecting overwrite of staged object within protection window", "path", ftpPath)
+		return true
+	}
+	written, err := s.ftp.ModTime(ftpPath)
+	if err != nil {
+		file, statErr := s.statObjectUncached(ftpPath)
+		if statErr != nil {
+			slog.Debug("failed to stat file for overwrite protection", "path", ftpPath, "error", statErr)
+			return false
+		}
+		if file == nil || file.IsDir {
+			return false
+		}
+		written = file.ModTime
+	}
+	if time.Since(written) >= s.config.OverwriteProtection {
+		return false
+	}
+	slog.Debug("rejecting overwrite within protection window",
+		"path", ftpPath,
+		"modified", written,
+		"window", s.config.OverwriteProtection,
+	)
+	return true
+}
+
 func (s *S3Server) handleDelete(w http.ResponseWriter, r *http.Request) {
-	// Remove bucket prefix and leading slash
-	path := strings.TrimPrefix(r.URL.Path, "/default/")
+	if s.handleFolderKey(w, r) {
+		return
+	}
+
+	path, ok := s.resolveObject(w, r)
+	if !ok {
+		return
+	}
 	slog.Debug("deleting file from FTP", "path", path)
 
+	bucket, _ := splitBucketKey(r.URL.Path)
+	if reason := s.wormDeleteError(bucket, path); reason != "" {
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", reason, r.URL.Path)
+		return
+	}
+
 	// Convert empty path or "." to empty string for FTP
 	if path == "." || path == "" {
 		path = ""
 	}
 
-	err := s.ftp.Delete(path)
+	err := s.deleteObject(path)
 	if err != nil {
 		slog.Error("failed to delete file from FTP",
 			"path", path,
 			"error", err,
 		)
 		if strings.Contains(err.Error(), "550") {
-			http.Error(w, "Key \""+path+"\" does not exist", http.StatusNotFound)
+			s.writeNoSuchKey(w, r)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeInternalError(w, r, err)
 		return
 	}
 
+	s.digests.remove(path)
+	s.removeMetadata(path)
 	slog.Debug("successfully deleted file", "path", path)
-	w.WriteHeader(http.StatusNoContent)
+	// Some clients choke on 204, 200 is sent without a body as well
+	w.WriteHeader(s.config.DeleteResponseStatus)
 }
 
 func (s *S3Server) handleHead(w http.ResponseWriter, r *http.Request) {
-	// Remove bucket prefix and leading slash
-	path := strings.TrimPrefix(r.URL.Path, "/default/")
+	if s.handleFolderKey(w, r) {
+		return
+	}
+
+	path, ok := s.resolveObject(w, r)
+	if !ok {
+		return
+	}
 	slog.Debug("checking file on FTP", "path", path)
+	if s.serveStaged(w, r, path) {
+		return
+	}
 
-	// First, try to list the file to get its metadata
+	file, err := s.statObjectExact(path)
+	if err != nil {
+		slog.Error("failed to list FTP directory",
+			"path", path,
+			"error", err,
+		)
+		if isPermissionError(err) {
+			writeS3Error(w, http.StatusForbidden, "AccessDenied", "Access Denied", r.URL.Path)
+			return
+		}
+		if strings.Contains(err.Error(), "550") {
+			s.writeNoSuchKey(w, r)
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+	if file == nil || file.IsDir {
+		// File not found, directories are only objects as "dir/"
+		s.writeNoSuchKey(w, r)
+		return
+	}
+
+	etag, weak := s.entityTag(path, file.Size, file.ModTime)
+	status := evaluatePreconditions(r, file, etag)
+	if status == http.StatusPreconditionFailed {
+		writePreconditionFailed(w, r)
+		return
+	}
+
+	// File found, set headers
+	w.Header().Set("Last-Modified", file.ModTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", s.advertisedETag(etag, weak))
+	w.Header().Set("x-amz-version-id", "null") // Buckets are unversioned
+	w.Header().Set("Accept-Ranges", "bytes")
+	s.setContentMD5(w, path, file.Size)
+	s.setObjectHeaders(w, r, s.readMetadata(path))
+	if status == http.StatusNotModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", file.Size))
+	w.WriteHeader(http.StatusOK)
+}
+
+// statObject looks up the metadata of the object at path by listing its parent
+// directory. It returns nil when the object doesn't exist.
+func (s *S3Server) statObject(path string) (*FileInfo, error) {
 	dir := filepath.Dir(path)
 	base := filepath.Base(path)
 
@@ -510,23 +1579,36 @@ func (s *S3Server) handleHead(w http.ResponseWriter, r *http.Request) {
 		dir = ""
 	}
 
-	slog.Debug("listing directory for HEAD",
+	// A recent listing of the parent answers without any FTP round-trip
+	if files, ok := s.ftp.CachedList(dir); ok {
+		slog.Debug("using cached listing for object metadata", "dir", dir, "base", base)
+		for _, file := range files {
+			if s.sameName(file.Name, base) {
+				return &file, nil
+			}
+		}
+		return nil, nil
+	}
+	return s.statObjectUncached(path)
+}
+
+// statObjectUncached is statObject always asking the FTP server, for checks
+// that must not act on a stale listing
+func (s *S3Server) statObjectUncached(path string) (*FileInfo, error) {
+	dir := filepath.Dir(path)
+	base := filepath.Base(path)
+	if dir == "." {
+		dir = ""
+	}
+
+	slog.Debug("listing directory for object metadata",
 		"dir", dir,
 		"base", base,
 	)
 
-	files, err := s.ftp.List(dir)
+	files, err := s.ftp.ListUncached(dir)
 	if err != nil {
-		slog.Error("failed to list FTP directory",
-			"path", dir,
-			"error", err,
-		)
-		if strings.Contains(err.Error(), "550") {
-			http.Error(w, "Key \""+path+"\" does not exist", http.StatusNotFound)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	// Look for the file in the directory listing
@@ -537,63 +1619,86 @@ func (s *S3Server) handleHead(w http.ResponseWriter, r *http.Request) {
 			"size", file.Size,
 			"is_dir", file.IsDir,
 		)
-		if file.Name == base {
-			// File found, set headers
-			w.Header().Set("Content-Length", fmt.Sprintf("%d", file.Size))
-			w.Header().Set("Last-Modified", file.ModTime.UTC().Format(http.TimeFormat))
-			w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`) // Empty file MD5
-			w.Header().Set("Accept-Ranges", "bytes")
-			w.Header().Set("Content-Type", "application/octet-stream")
-			w.WriteHeader(http.StatusOK)
-			return
+		if s.sameName(file.Name, base) {
+			// Prefer MDTM, which is UTC per spec, over the LIST time
+			if mdtm, err := s.ftp.ModTime(path); err == nil {
+				file.ModTime = mdtm
+			} else {
+				slog.Debug("MDTM unavailable, using LIST time", "path", path, "error", err)
+			}
+			return &file, nil
 		}
 	}
+	return nil, nil
+}
 
-	// File not found
-	http.Error(w, "Key \""+path+"\" does not exist", http.StatusNotFound)
+// sameName compares FTP file names according to the backend's case sensitivity
+func (s *S3Server) sameName(a, b string) bool {
+	if s.config.CaseInsensitiveBackend {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
 }
 
-func (s *S3Server) handleCreateMultipartUpload(w http.ResponseWriter, r *http.Request) {
-	// For now, just return a simple response that indicates we don't support multipart uploads
-	w.Header().Set("Content-Type", "application/xml")
-	w.WriteHeader(http.StatusMethodNotAllowed)
-	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
-<Error>
-    <Code>NotImplemented</Code>
-    <Message>Multipart upload is not supported. Please use single-part upload instead.</Message>
-    <RequestId>00000000-0000-0000-0000-000000000000</RequestId>
-</Error>`))
+// caseCollision returns the name of an existing entry next to path that differs
+// from it only by case. On a case-insensitive backend writing path would
+// silently replace that entry.
+func (s *S3Server) caseCollision(path string) (string, error) {
+	dir := filepath.Dir(path)
+	base := filepath.Base(path)
+	if dir == "." {
+		dir = ""
+	}
+
+	files, err := s.ftp.List(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if file.Name != base && strings.EqualFold(file.Name, base) {
+			return file.Name, nil
+		}
+	}
+	return "", nil
 }
 
-func (s *S3Server) handleUploadPart(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/xml")
-	w.WriteHeader(http.StatusMethodNotAllowed)
-	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
-<Error>
-    <Code>NotImplemented</Code>
-    <Message>Multipart upload is not supported. Please use single-part upload instead.</Message>
-    <RequestId>00000000-0000-0000-0000-000000000000</RequestId>
-</Error>`))
+// notModifiedSince evaluates the If-Modified-Since condition. Per RFC 7232 a
+// malformed date or one in the future is ignored. HTTP dates have one second
+// precision, so the object mtime is truncated before comparing.
+func notModifiedSince(r *http.Request, modTime time.Time) bool {
+	header := r.Header.Get("If-Modified-Since")
+	if header == "" {
+		return false
+	}
+	since, err := http.ParseTime(header)
+	if err != nil {
+		slog.Debug("ignoring malformed If-Modified-Since", "value", header)
+		return false
+	}
+	if since.After(time.Now()) {
+		slog.Debug("ignoring future If-Modified-Since", "value", header)
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
 }
 
-func (s *S3Server) handleCompleteMultipartUpload(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/xml")
-	w.WriteHeader(http.StatusMethodNotAllowed)
-	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
-<Error>
-    <Code>NotImplemented</Code>
-    <Message>Multipart upload is not supported. Please use single-part upload instead.</Message>
-    <RequestId>00000000-0000-0000-0000-000000000000</RequestId>
-</Error>`))
+// isSupportedSSE reports whether a requested server-side encryption algorithm
+// passes request validation. This only validates the request: objects are
+// stored as sent, and the response header waits for at-rest encryption.
+func isSupportedSSE(algorithm string) bool {
+	return algorithm == "AES256"
 }
 
-func (s *S3Server) handleAbortMultipartUpload(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/xml")
-	w.WriteHeader(http.StatusMethodNotAllowed)
-	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
-<Error>
-    <Code>NotImplemented</Code>
-    <Message>Multipart upload is not supported. Please use single-part upload instead.</Message>
-    <RequestId>00000000-0000-0000-0000-000000000000</RequestId>
-</Error>`))
+// checkSSE validates the x-amz-server-side-encryption header of a request
+// that writes an object, writing InvalidArgument and returning false for an
+// algorithm that isn't accepted
+func checkSSE(w http.ResponseWriter, r *http.Request) bool {
+	sse := r.Header.Get("x-amz-server-side-encryption")
+	if sse == "" || isSupportedSSE(sse) {
+		return true
+	}
+	slog.Debug("rejecting unsupported server-side encryption", "path", r.URL.Path, "algorithm", sse)
+	writeS3Error(w, http.StatusBadRequest, "InvalidArgument",
+		"Server-side encryption algorithm \""+sse+"\" is not supported", r.URL.Path)
+	return false
 }
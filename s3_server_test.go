@@ -0,0 +1,832 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscapesBucket(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"file.txt", false},
+		{"dir/file.txt", false},
+		{"dir/..file", false},
+		{"dir/file..", false},
+		{"./file.txt", false},
+		{"", false},
+		{"..", true},
+		{"../other/secret", true},
+		{"dir/../../secret", true},
+		{"dir/..", true},
+		{`dir\..\..\secret`, true},
+	}
+	for _, tt := range tests {
+		if got := escapesBucket(tt.key); got != tt.want {
+			t.Errorf("escapesBucket(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestPathTraversalRejected(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/public/readme.txt": "public",
+		"/private/secret":    "classified",
+		"/outside.txt":       "outside",
+	})
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		want   int
+	}{
+		{http.MethodGet, "/public/readme.txt", "", http.StatusOK},
+		{http.MethodGet, "/public/../private/secret", "", http.StatusBadRequest},
+		{http.MethodGet, "/public/%2e%2e/private/secret", "", http.StatusBadRequest},
+		{http.MethodGet, "/public/dir/../../outside.txt", "", http.StatusBadRequest},
+		{http.MethodHead, "/public/../private/secret", "", http.StatusBadRequest},
+		{http.MethodPut, "/public/../private/secret", "overwritten", http.StatusBadRequest},
+		{http.MethodDelete, "/public/../private/secret", "", http.StatusBadRequest},
+		{http.MethodGet, "/public?prefix=../private/", "", http.StatusBadRequest},
+		{http.MethodGet, "/public?list-type=2&prefix=../", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			w := serve(s, tt.method, tt.target, tt.body)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			// HEAD responses carry no error document
+			if tt.want == http.StatusBadRequest && tt.method != http.MethodHead && !strings.Contains(w.Body.String(), "<Code>InvalidArgument</Code>") {
+				t.Errorf("error is not InvalidArgument: %s", w.Body.String())
+			}
+		})
+	}
+
+	if body, _ := f.file("/private/secret"); body != "classified" {
+		t.Errorf("other bucket's file was changed to %q", body)
+	}
+}
+
+func TestListTimesInServerTimezone(t *testing.T) {
+	// The fake server lists every file as "Jan 01 2024", without a zone
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "x"})
+
+	tests := []struct {
+		timezone string
+		want     string
+	}{
+		{"UTC", "2024-01-01T00:00:00Z"},
+		{"Europe/Berlin", "2023-12-31T23:00:00Z"},
+		{"America/New_York", "2024-01-01T05:00:00Z"},
+		{"Asia/Kolkata", "2023-12-31T18:30:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.timezone, func(t *testing.T) {
+			s := newTestServer(t, f, "-subdir-buckets", "-ftp-server-timezone", tt.timezone)
+			w := serve(s, http.MethodGet, "/bucket?list-type=2", "")
+			var result ListBucketV2Result
+			if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || len(result.Contents) != 1 {
+				t.Fatalf("unexpected listing %d: %s", w.Code, w.Body.String())
+			}
+			if got := result.Contents[0].LastModified.UTC().Format(time.RFC3339); got != tt.want {
+				t.Errorf("LastModified = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerSideEncryptionHeader(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/source.txt": "source"})
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	requests := []struct {
+		name   string
+		method string
+		target string
+		copy   bool
+		want   int
+	}{
+		{"put", http.MethodPut, "/bucket/put.txt", false, http.StatusOK},
+		{"copy", http.MethodPut, "/bucket/copy.txt", true, http.StatusOK},
+		{"multipart", http.MethodPost, "/bucket/multipart.txt?uploads", false, http.StatusOK},
+	}
+	algorithms := []struct {
+		sse     string
+		invalid bool
+	}{
+		{"", false},
+		{"AES256", false},
+		{"aws:kms", true},
+		{"aws:kms:dsse", true},
+	}
+	for _, req := range requests {
+		for _, alg := range algorithms {
+			t.Run(req.name+" "+alg.sse, func(t *testing.T) {
+				r := httptest.NewRequest(req.method, req.target, strings.NewReader("body"))
+				if req.copy {
+					r.Header.Set(copySourceHeader, "/bucket/source.txt")
+				}
+				if alg.sse != "" {
+					r.Header.Set("x-amz-server-side-encryption", alg.sse)
+				}
+				w := httptest.NewRecorder()
+				s.ServeHTTP(w, r)
+
+				want := req.want
+				if alg.invalid {
+					want = http.StatusBadRequest
+				}
+				if w.Code != want {
+					t.Fatalf("status = %d, want %d: %s", w.Code, want, w.Body.String())
+				}
+				if alg.invalid && !strings.Contains(w.Body.String(), "<Code>InvalidArgument</Code>") {
+					t.Errorf("error is not InvalidArgument: %s", w.Body.String())
+				}
+				// Nothing is encrypted, so no response may claim it was
+				if got := w.Header().Get("x-amz-server-side-encryption"); got != "" {
+					t.Errorf("response claims server-side encryption %q", got)
+				}
+			})
+		}
+	}
+	if _, ok := f.file("/bucket/copy.txt"); !ok {
+		t.Error("copy with AES256 wasn't stored")
+	}
+}
+
+func TestOverwriteProtection(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/old.txt": "old"})
+	s := newTestServer(t, f, "-subdir-buckets", "-overwrite-protection", "1m", "-list-cache-ttl", "1m")
+
+	put := func(target, body string, override bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, target, strings.NewReader(body))
+		if override {
+			r.Header.Set(overwriteHeader, "true")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := put("/bucket/old.txt", "replaced", false); w.Code != http.StatusOK {
+		t.Fatalf("overwriting an old object: status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := put("/bucket/file.txt", "first", false); w.Code != http.StatusOK {
+		t.Fatalf("first PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+	// A cached listing only has the minute-precision LIST time
+	serve(s, http.MethodGet, "/bucket?list-type=2", "")
+	w := put("/bucket/file.txt", "second", false)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "<Code>OperationAborted</Code>") {
+		t.Fatalf("quick second PUT: status = %d, want 409 OperationAborted: %s", w.Code, w.Body.String())
+	}
+	if body, _ := f.file("/bucket/file.txt"); body != "first" {
+		t.Fatalf("rejected PUT stored %q", body)
+	}
+	if w := put("/bucket/file.txt", "third", true); w.Code != http.StatusOK {
+		t.Fatalf("PUT with %s: status = %d: %s", overwriteHeader, w.Code, w.Body.String())
+	}
+	if body, _ := f.file("/bucket/file.txt"); body != "third" {
+		t.Errorf("overriding PUT stored %q", body)
+	}
+
+	// Of two simultaneous uploads of a new key only one gets through, even
+	// when both are checked before either is stored
+	f.setStorHook(func(string) error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	codes := make(chan int, 2)
+	for _, body := range []string{"a", "b"} {
+		go func(body string) { codes <- put("/bucket/race.txt", body, false).Code }(body)
+	}
+	got := map[int]int{}
+	for i := 0; i < 2; i++ {
+		got[<-codes]++
+	}
+	if got[http.StatusOK] != 1 || got[http.StatusConflict] != 1 {
+		t.Errorf("simultaneous PUTs answered %v, want one 200 and one 409", got)
+	}
+}
+
+func TestNewS3ServerSetupErrors(t *testing.T) {
+	f := startFakeFTP(t, nil)
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"write buffer dir is a file", []string{"-write-buffer-dir", notDir}},
+		{"missing not found document", []string{"-not-found-document", filepath.Join(t.TempDir(), "404.html")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if s, err := NewS3Server(testConfig(t, f, tt.args...)); err == nil {
+				s.ftp.Close()
+				t.Fatal("NewS3Server succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestKeyLengthLimits(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+	s := newTestServer(t, f, "-subdir-buckets", "-max-path-length", "31", "-max-path-component-length", "8")
+
+	// The FTP path of a key is bucket/key
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"12345678", http.StatusOK},
+		{"123456789", http.StatusBadRequest},
+		{"aaaaaaaa/bbbbbbbb/cccccc", http.StatusOK},
+		{"aaaaaaaa/bbbbbbbb/ccccccc", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			for _, method := range []string{http.MethodPut, http.MethodGet} {
+				w := serve(s, method, "/bucket/"+tt.key, "body")
+				if w.Code != tt.want {
+					t.Fatalf("%s: status = %d, want %d: %s", method, w.Code, tt.want, w.Body.String())
+				}
+				if tt.want == http.StatusBadRequest && !strings.Contains(w.Body.String(), "<Code>KeyTooLongError</Code>") {
+					t.Errorf("%s: error is not KeyTooLongError: %s", method, w.Body.String())
+				}
+			}
+			if _, ok := f.file("/bucket/" + tt.key); ok != (tt.want == http.StatusOK) {
+				t.Errorf("stored = %v", ok)
+			}
+		})
+	}
+}
+
+func TestDraining(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "content"})
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	if w := serve(s, http.MethodGet, "/ready", ""); w.Code != http.StatusOK {
+		t.Fatalf("ready before draining: status = %d", w.Code)
+	}
+	s.SetDraining(true)
+	if w := serve(s, http.MethodGet, "/ready", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("ready while draining: status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	// Requests are still served while the load balancer drains the instance
+	if w := serve(s, http.MethodGet, "/bucket/file.txt", ""); w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Fatalf("GET while draining: status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve(s, http.MethodPut, "/bucket/new.txt", "new"); w.Code != http.StatusOK {
+		t.Fatalf("PUT while draining: status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve(s, http.MethodGet, "/health", ""); w.Code != http.StatusOK {
+		t.Errorf("health while draining: status = %d", w.Code)
+	}
+	s.SetDraining(false)
+	if w := serve(s, http.MethodGet, "/ready", ""); w.Code != http.StatusOK {
+		t.Errorf("ready after draining: status = %d", w.Code)
+	}
+}
+
+func TestContentLengthMismatch(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	tests := []struct {
+		name     string
+		body     string
+		declared int64
+		want     int
+	}{
+		{"exact", "12345678", 8, http.StatusOK},
+		{"short body", "1234", 8, http.StatusBadRequest},
+		{"long body", "123456789012", 8, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/bucket/file.bin", strings.NewReader(tt.body))
+			r.ContentLength = tt.declared
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			body, stored := f.file("/bucket/file.bin")
+			if tt.want == http.StatusOK {
+				if body != tt.body {
+					t.Errorf("stored %q, want %q", body, tt.body)
+				}
+				return
+			}
+			if !strings.Contains(w.Body.String(), "<Code>IncompleteBody</Code>") {
+				t.Errorf("error is not IncompleteBody: %s", w.Body.String())
+			}
+			if stored {
+				t.Errorf("mismatched upload left %q behind", body)
+			}
+		})
+	}
+
+	// A body the FTP server refused before reading it isn't short
+	f.setStorHook(func(string) error { return errors.New("permission denied") })
+	t.Cleanup(func() { f.setStorHook(nil) })
+	w := serve(s, http.MethodPut, "/bucket/refused.bin", "content")
+	if strings.Contains(w.Body.String(), "<Code>IncompleteBody</Code>") {
+		t.Errorf("refused upload reported as IncompleteBody: %s", w.Body.String())
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	tests := []struct {
+		name  string
+		quota int
+		hook  func(string) error
+	}{
+		{"552 during the transfer", 4, nil},
+		{"452 before the transfer", 0, func(string) error { return errors.New("452 Insufficient storage space") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f.mu.Lock()
+			f.quota = tt.quota
+			f.mu.Unlock()
+			f.setStorHook(tt.hook)
+
+			w := serve(s, http.MethodPut, "/bucket/big.bin", "more than four bytes")
+			if w.Code != http.StatusInsufficientStorage || !strings.Contains(w.Body.String(), "<Code>QuotaExceeded</Code>") {
+				t.Fatalf("status = %d, want 507 QuotaExceeded: %s", w.Code, w.Body.String())
+			}
+			if body, ok := f.file("/bucket/big.bin"); ok {
+				t.Errorf("partial file %q left behind", body)
+			}
+		})
+	}
+}
+
+func TestListTimeoutTruncates(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/bucket/a.txt": "a",
+		"/bucket/b.txt": "b",
+		"/bucket/c.txt": "c",
+	})
+	// Every LIST alone takes longer than the budget
+	f.mu.Lock()
+	f.listDelay = 30 * time.Millisecond
+	f.mu.Unlock()
+	s := newTestServer(t, f, "-subdir-buckets", "-list-timeout", "10ms")
+
+	var keys []string
+	token := ""
+	for page := 0; ; page++ {
+		if page == 5 {
+			t.Fatalf("listing doesn't finish, got %v", keys)
+		}
+		target := "/bucket?list-type=2"
+		if token != "" {
+			target += "&continuation-token=" + token
+		}
+		w := serve(s, http.MethodGet, target, "")
+		var result ListBucketV2Result
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("page %d: status = %d: %s", page, w.Code, w.Body.String())
+		}
+		// Each page makes progress despite the spent budget
+		if len(result.Contents) != 1 {
+			t.Fatalf("page %d has %d keys, want 1", page, len(result.Contents))
+		}
+		keys = append(keys, result.Contents[0].Key)
+		if !result.IsTruncated {
+			break
+		}
+		if result.NextContinuationToken == "" {
+			t.Fatalf("page %d is truncated without a continuation token", page)
+		}
+		token = result.NextContinuationToken
+	}
+	if got := strings.Join(keys, ","); got != "a.txt,b.txt,c.txt" {
+		t.Errorf("keys = %s, want a.txt,b.txt,c.txt", got)
+	}
+}
+
+func TestHeadFromCachedListing(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "content"})
+	s := newTestServer(t, f, "-subdir-buckets", "-list-cache-ttl", "1m")
+
+	if w := serve(s, http.MethodGet, "/bucket?list-type=2", ""); w.Code != http.StatusOK {
+		t.Fatalf("listing: status = %d: %s", w.Code, w.Body.String())
+	}
+	before := f.commandCount()
+	w := serve(s, http.MethodHead, "/bucket/file.txt", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "7" {
+		t.Fatalf("HEAD: status = %d, Content-Length %q", w.Code, w.Header().Get("Content-Length"))
+	}
+	if w := serve(s, http.MethodHead, "/bucket/missing.txt", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("HEAD of a missing key: status = %d", w.Code)
+	}
+	if n := f.commandCount() - before; n != 0 {
+		t.Errorf("HEADs after a cached listing sent %d FTP commands", n)
+	}
+
+	// A write through the gateway invalidates the cached listing
+	if w := serve(s, http.MethodPut, "/bucket/file.txt", "longer content"); w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve(s, http.MethodHead, "/bucket/file.txt", ""); w.Header().Get("Content-Length") != "14" {
+		t.Errorf("HEAD after PUT: Content-Length = %q, want 14", w.Header().Get("Content-Length"))
+	}
+}
+
+func TestVersionIDHeader(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	requests := []struct {
+		method string
+		body   string
+	}{
+		{http.MethodPut, "content"},
+		{http.MethodGet, ""},
+		{http.MethodHead, ""},
+	}
+	for _, req := range requests {
+		w := serve(s, req.method, "/bucket/file.txt", req.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d: %s", req.method, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("x-amz-version-id"); got != "null" {
+			t.Errorf("%s: x-amz-version-id = %q, want null", req.method, got)
+		}
+	}
+}
+
+func TestCaseInsensitiveBackend(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/Foo.txt": "original"})
+
+	t.Run("insensitive", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets", "-case-insensitive-backend")
+		w := serve(s, http.MethodPut, "/bucket/foo.txt", "other")
+		if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "Foo.txt") {
+			t.Fatalf("colliding PUT: status = %d, want 409 naming Foo.txt: %s", w.Code, w.Body.String())
+		}
+		if _, ok := f.file("/bucket/foo.txt"); ok {
+			t.Error("colliding PUT was stored")
+		}
+		if w := serve(s, http.MethodPut, "/bucket/Foo.txt", "replaced"); w.Code != http.StatusOK {
+			t.Errorf("PUT of the same key: status = %d: %s", w.Code, w.Body.String())
+		}
+		// The backend would serve Foo.txt for foo.txt
+		if w := serve(s, http.MethodHead, "/bucket/FOO.TXT", ""); w.Code != http.StatusOK {
+			t.Errorf("HEAD in other case: status = %d", w.Code)
+		}
+	})
+
+	t.Run("sensitive", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets")
+		if w := serve(s, http.MethodPut, "/bucket/foo.txt", "other"); w.Code != http.StatusOK {
+			t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+		}
+		if w := serve(s, http.MethodHead, "/bucket/FOO.TXT", ""); w.Code != http.StatusNotFound {
+			t.Errorf("HEAD in other case: status = %d, want 404", w.Code)
+		}
+	})
+}
+
+func TestListNestedPrefixes(t *testing.T) {
+	files := map[string]string{
+		"/bucket/a/b/c/1.txt":   "1",
+		"/bucket/a/b/d.txt":     "d",
+		"/bucket/a/b/e/f/2.txt": "2",
+		"/bucket/a/bc.txt":      "bc",
+		"/bucket/top.txt":       "top",
+	}
+
+	// The expectations are what S3 answers for the same keys
+	tests := []struct {
+		prefix   string
+		contents string
+		prefixes string
+	}{
+		{"", "top.txt", "a/"},
+		{"a/", "a/bc.txt", "a/b/"},
+		{"a/b", "a/bc.txt", "a/b/"},
+		{"a/b/", "a/b/d.txt", "a/b/c/,a/b/e/"},
+		{"a/b/c", "", "a/b/c/"},
+		{"a/b/e/", "", "a/b/e/f/"},
+		{"a/b/e/f/", "a/b/e/f/2.txt", ""},
+		{"a/x", "", ""},
+	}
+	// Servers listing full names, slash-marked directories and dot entries
+	// must list the same keys
+	for _, fullNames := range []bool{false, true} {
+		f := startFakeFTP(t, files)
+		f.mu.Lock()
+		f.listFullNames = fullNames
+		f.mu.Unlock()
+		s := newTestServer(t, f, "-subdir-buckets")
+		quirk := ""
+		if fullNames {
+			quirk = "full names "
+		}
+
+		t.Run(quirk+"buckets", func(t *testing.T) {
+			w := serve(s, http.MethodGet, "/", "")
+			var result ListAllMyBucketsResult
+			if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+			}
+			var names []string
+			for _, bucket := range result.Buckets.Bucket {
+				names = append(names, bucket.Name)
+			}
+			if got := strings.Join(names, ","); got != "bucket" {
+				t.Errorf("buckets = %s, want bucket", got)
+			}
+		})
+		for _, tt := range tests {
+			t.Run(quirk+"prefix "+tt.prefix, func(t *testing.T) {
+				w := serve(s, http.MethodGet, "/bucket?list-type=2&delimiter=/&prefix="+tt.prefix, "")
+				var result ListBucketV2Result
+				if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+				}
+				var contents, prefixes []string
+				for _, object := range result.Contents {
+					contents = append(contents, object.Key)
+				}
+				for _, prefix := range result.CommonPrefixes {
+					prefixes = append(prefixes, prefix.Prefix)
+				}
+				if got := strings.Join(contents, ","); got != tt.contents {
+					t.Errorf("Contents = %s, want %s", got, tt.contents)
+				}
+				if got := strings.Join(prefixes, ","); got != tt.prefixes {
+					t.Errorf("CommonPrefixes = %s, want %s", got, tt.prefixes)
+				}
+			})
+		}
+	}
+}
+
+func TestListSortedRegardlessOfFTPOrder(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/bucket/b.txt":     "b",
+		"/bucket/a.txt":     "a",
+		"/bucket/a b.txt":   "a b",
+		"/bucket/a-b.txt":   "a-b",
+		"/bucket/Z.txt":     "Z",
+		"/bucket/é.txt":     "é",
+		"/bucket/a/x.txt":   "x",
+		"/bucket/a0/y.txt":  "y",
+		"/bucket/A/z.txt":   "z",
+		"/bucket/ab/w.txt":  "w",
+		"/bucket/a.d/v.txt": "v",
+	})
+	f.mu.Lock()
+	f.listReversed = true
+	f.mu.Unlock()
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	wantContents := "Z.txt,a b.txt,a-b.txt,a.txt,b.txt,é.txt"
+	wantPrefixes := "A/,a.d/,a/,a0/,ab/"
+
+	list := func(target string) ListBucketV2Result {
+		t.Helper()
+		w := serve(s, http.MethodGet, target, "")
+		var result ListBucketV2Result
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		return result
+	}
+	join := func(result ListBucketV2Result) (string, string) {
+		var contents, prefixes []string
+		for _, object := range result.Contents {
+			contents = append(contents, object.Key)
+		}
+		for _, prefix := range result.CommonPrefixes {
+			prefixes = append(prefixes, prefix.Prefix)
+		}
+		return strings.Join(contents, ","), strings.Join(prefixes, ",")
+	}
+
+	contents, prefixes := join(list("/bucket?list-type=2&delimiter=/"))
+	if contents != wantContents || prefixes != wantPrefixes {
+		t.Errorf("listing = %s and %s, want %s and %s", contents, prefixes, wantContents, wantPrefixes)
+	}
+
+	// Pages resume at the right place only in a stable order
+	var keys []string
+	token := ""
+	for pages := 0; pages < 10; pages++ {
+		target := "/bucket?list-type=2&delimiter=/&max-keys=2"
+		if token != "" {
+			target += "&continuation-token=" + token
+		}
+		result := list(target)
+		var page []string
+		for _, object := range result.Contents {
+			page = append(page, object.Key)
+		}
+		for _, prefix := range result.CommonPrefixes {
+			page = append(page, prefix.Prefix)
+		}
+		// Contents and CommonPrefixes are separate, each page covers a range
+		sort.Strings(page)
+		keys = append(keys, page...)
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sortedKeys := append([]string(nil), keys...)
+	sort.Strings(sortedKeys)
+	if got, want := strings.Join(keys, ","), strings.Join(sortedKeys, ","); got != want || len(keys) != 11 {
+		t.Errorf("paged keys = %s, want all 11 in order %s", got, want)
+	}
+
+	t.Run("ftp order", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets", "-list-order", "ftp")
+		w := serve(s, http.MethodGet, "/bucket?list-type=2&delimiter=/", "")
+		var result ListBucketV2Result
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || len(result.Contents) == 0 {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		if first := result.Contents[0].Key; first != "é.txt" {
+			t.Errorf("first key = %s, want é.txt as the FTP server listed it", first)
+		}
+	})
+}
+
+func TestDeleteResponseStatus(t *testing.T) {
+	f := startFakeFTP(t, nil)
+
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{nil, http.StatusNoContent},
+		{[]string{"-delete-response-status", "200"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.want), func(t *testing.T) {
+			f.put("/bucket/file.txt", "content")
+			s := newTestServer(t, f, append([]string{"-subdir-buckets"}, tt.args...)...)
+			w := serve(s, http.MethodDelete, "/bucket/file.txt", "")
+			if w.Code != tt.want || w.Body.Len() != 0 {
+				t.Errorf("status = %d with %d bytes, want %d without a body", w.Code, w.Body.Len(), tt.want)
+			}
+			if _, ok := f.file("/bucket/file.txt"); ok {
+				t.Error("file wasn't deleted")
+			}
+		})
+	}
+}
+
+func TestUnlistableRoot(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/file.txt": "data"})
+	f.mu.Lock()
+	f.listDenied = map[string]bool{"/": true, "/bucket": true}
+	f.mu.Unlock()
+	s := newTestServer(t, f, "-subdir-buckets")
+
+	var logs bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+	s.CheckListable()
+	if !strings.Contains(logs.String(), "listing is denied") {
+		t.Errorf("no startup warning about the unlistable root: %s", logs.String())
+	}
+
+	for _, target := range []string{"/", "/bucket?list-type=2", "/bucket"} {
+		w := serve(s, http.MethodGet, target, "")
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "<Code>AccessDenied</Code>") ||
+			!strings.Contains(w.Body.String(), "FTP account") {
+			t.Errorf("GET %s: status = %d: %s", target, w.Code, w.Body.String())
+		}
+	}
+	// Objects are still reachable without listing
+	if w := serve(s, http.MethodGet, "/bucket/file.txt", ""); w.Code != http.StatusOK || w.Body.String() != "data" {
+		t.Errorf("GET object: status = %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestImplausibleListedSizes(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/bucket/overflowed.txt": "overflowed",
+		"/bucket/huge.txt":       "huge",
+		"/bucket/fine.txt":       "fine",
+	})
+	f.mu.Lock()
+	f.listedSize = map[string]string{
+		// 2^64 - 10, negative once stored in an int64
+		"/bucket/overflowed.txt": "18446744073709551606",
+		"/bucket/huge.txt":       "9000000000000000000",
+	}
+	f.mu.Unlock()
+
+	tests := []struct {
+		name string
+		args []string
+		want map[string]string
+	}{
+		{"recheck", nil, map[string]string{"overflowed.txt": "10", "huge.txt": "4", "fine.txt": "4"}},
+		{"no recheck", []string{"-list-size-recheck=false"}, map[string]string{"overflowed.txt": "0", "huge.txt": "0", "fine.txt": "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, f, append([]string{"-subdir-buckets"}, tt.args...)...)
+			body := serve(s, http.MethodGet, "/bucket?list-type=2", "").Body.String()
+			for key, size := range tt.want {
+				if !strings.Contains(body, "<Key>"+key+"</Key>") {
+					t.Fatalf("listing misses %s: %s", key, body)
+				}
+				entry := body[strings.Index(body, "<Key>"+key+"</Key>"):]
+				entry = entry[:strings.Index(entry, "</Contents>")]
+				if !strings.Contains(entry, "<Size>"+size+"</Size>") {
+					t.Errorf("%s listed as %s, want size %s", key, entry, size)
+				}
+			}
+			// HEAD takes SIZE, which the server reports correctly
+			if got := serve(s, http.MethodHead, "/bucket/overflowed.txt", "").Header().Get("Content-Length"); got != "10" {
+				t.Errorf("HEAD Content-Length = %s, want 10", got)
+			}
+		})
+	}
+}
+
+func TestDebugBackendPath(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/dir/file.txt": "content"})
+
+	tests := []struct {
+		name      string
+		debug     bool
+		anonymous bool
+		signed    bool
+		want      string
+	}{
+		{"authenticated", true, false, true, "bucket/dir/file.txt"},
+		{"anonymous", true, true, false, ""},
+		// A signature on an operation the policy leaves anonymous isn't
+		// verified, so it doesn't count
+		{"unverified signature", true, true, true, ""},
+		{"disabled", false, false, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{"-subdir-buckets", "-access-key-id", "AKIDEXAMPLE", "-secret-key", "secret"}
+			if tt.debug {
+				args = append(args, "-debug-backend-path")
+			}
+			s := newTestServer(t, f, args...)
+			store := NewCredentialsStore()
+			if err := store.Load(s.config); err != nil {
+				t.Fatal(err)
+			}
+			var policy AuthPolicy
+			if tt.anonymous {
+				var err error
+				if policy, err = ParseAuthPolicy("Get=anonymous"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			handler := NewAuthMiddleware(store, policy, s)
+
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				r := httptest.NewRequest(method, "/bucket/dir/file.txt", nil)
+				if tt.signed {
+					signRequest(t, r, "AKIDEXAMPLE", "secret")
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					t.Fatalf("%s: status = %d: %s", method, w.Code, w.Body.String())
+				}
+				if got := w.Header().Get(backendPathHeader); got != tt.want {
+					t.Errorf("%s: %s = %q, want %q", method, backendPathHeader, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"time"
+)
+
+// adminPrefix is the path prefix of the administrative endpoints. It shadows
+// a bucket named "admin" in path-style requests.
+const adminPrefix = "/admin/"
+
+// selfTestDirPrefix names the temporary directory created by the self-test
+const selfTestDirPrefix = ".ftp-over-s3-selftest-"
+
+// SelfTestStep is the outcome of one backend operation of the self-test
+type SelfTestStep struct {
+	Name      string  `json:"name"`
+	OK        bool    `json:"ok"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// SelfTestReport is the JSON document returned by /admin/selftest
+type SelfTestReport struct {
+	OK    bool           `json:"ok"`
+	Path  string         `json:"path"`
+	Steps []SelfTestStep `json:"steps"`
+}
+
+func (r *SelfTestReport) run(name string, step func() error) bool {
+	start := time.Now()
+	err := step()
+	result := SelfTestStep{
+		Name:      name,
+		OK:        err == nil,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Error = err.Error()
+		r.OK = false
+	}
+	r.Steps = append(r.Steps, result)
+	return err == nil
+}
+
+// runSelfTest exercises a full round-trip against the FTP backend inside a
+// temporary directory at the FTP root. The directory and object are removed
+// even when a step fails halfway.
+func (s *S3Server) runSelfTest() SelfTestReport {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	dir := selfTestDirPrefix + hex.EncodeToString(suffix)
+	object := path.Join(dir, "object")
+	payload := []byte("ftp-over-s3 self-test " + time.Now().UTC().Format(time.RFC3339Nano))
+
+	report := SelfTestReport{OK: true, Path: dir}
+	var dirCreated, objectStored bool
+	defer func() {
+		// Best-effort cleanup of whatever the failed steps left behind
+		if objectStored {
+			if err := s.ftp.Delete(object); err != nil {
+				slog.Warn("failed to clean up self-test object", "path", object, "error", err)
+			}
+		}
+		if dirCreated {
+			if err := s.ftp.RemoveDir(dir); err != nil {
+				slog.Warn("failed to clean up self-test directory", "path", dir, "error", err)
+			}
+		}
+	}()
+
+	if !report.run("connect", s.ftp.Ping) {
+		return report
+	}
+	if !report.run("mkdir", func() error { return s.ftp.MakeDir(dir) }) {
+		return report
+	}
+	dirCreated = true
+	// A failed STOR may still leave a partial file behind
+	objectStored = true
+	if !report.run("put", func() error { return s.ftp.Put(object, bytes.NewReader(payload)) }) {
+		return report
+	}
+	if !report.run("list", func() error {
+		files, err := s.ftp.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if path.Base(file.Name) == "object" {
+				if file.Size != int64(len(payload)) {
+					return fmt.Errorf("listed size %d, expected %d", file.Size, len(payload))
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("object missing from listing of %d entries", len(files))
+	}) {
+		return report
+	}
+	if !report.run("get", func() error {
+		reader, err := s.ftp.Get(object)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, payload) {
+			return fmt.Errorf("read %d bytes that don't match the %d bytes written", len(data), len(payload))
+		}
+		return nil
+	}) {
+		return report
+	}
+	if !report.run("delete", func() error { return s.ftp.Delete(object) }) {
+		return report
+	}
+	objectStored = false
+	if !report.run("rmdir", func() error { return s.ftp.RemoveDir(dir) }) {
+		return report
+	}
+	dirCreated = false
+	return report
+}
+
+func (s *S3Server) handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	slog.Info("running backend self-test")
+	report := s.runSelfTest()
+	slog.Info("backend self-test finished", "ok", report.OK, "steps", len(report.Steps))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Error("failed to encode self-test report", "error", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	// leftovers lists the self-test files and directories still on the server
+	leftovers := func(f *fakeFTP) []string {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		var names []string
+		for name := range f.files {
+			if strings.Contains(name, selfTestDirPrefix) {
+				names = append(names, name)
+			}
+		}
+		for name := range f.dirs {
+			if strings.Contains(name, selfTestDirPrefix) {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	run := func(t *testing.T, f *fakeFTP) (int, SelfTestReport) {
+		t.Helper()
+		s := newTestServer(t, f)
+		w := serve(s, http.MethodPost, adminPrefix+"selftest", "")
+		var report SelfTestReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("status = %d: %v: %s", w.Code, err, w.Body.String())
+		}
+		return w.Code, report
+	}
+
+	t.Run("pass", func(t *testing.T) {
+		f := startFakeFTP(t, nil)
+		code, report := run(t, f)
+		if code != http.StatusOK || !report.OK {
+			t.Fatalf("status = %d, report %+v", code, report)
+		}
+		var steps []string
+		for _, step := range report.Steps {
+			if !step.OK {
+				t.Errorf("step %s failed: %s", step.Name, step.Error)
+			}
+			steps = append(steps, step.Name)
+		}
+		if got := strings.Join(steps, ","); got != "connect,mkdir,put,list,get,delete,rmdir" {
+			t.Errorf("steps = %s", got)
+		}
+		if left := leftovers(f); len(left) > 0 {
+			t.Errorf("self-test left %v behind", left)
+		}
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		f := startFakeFTP(t, nil)
+		// The upload fails halfway, leaving a partial object to clean up
+		f.mu.Lock()
+		f.quota = 5
+		f.mu.Unlock()
+		code, report := run(t, f)
+		if code != http.StatusServiceUnavailable || report.OK {
+			t.Fatalf("status = %d, report %+v", code, report)
+		}
+		last := report.Steps[len(report.Steps)-1]
+		if last.Name != "put" || last.OK || last.Error == "" {
+			t.Errorf("last step = %+v, want the failed put", last)
+		}
+		if left := leftovers(f); len(left) > 0 {
+			t.Errorf("self-test left %v behind", left)
+		}
+	})
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// tlsVersions maps -tls-min-version values to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newServerTLSConfig returns the TLS settings the gateway serves HTTPS with.
+// The certificate is loaded by ListenAndServeTLS.
+func newServerTLSConfig(config *Config) (*tls.Config, error) {
+	version, ok := tlsVersions[config.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", config.TLSMinVersion)
+	}
+	return &tls.Config{MinVersion: version}, nil
+}
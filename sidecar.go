@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sidecarSuffix ends the name of the hidden file holding an object's
+// metadata, "dir/.name.s3meta.json" for the object "dir/name"
+const sidecarSuffix = ".s3meta.json"
+
+// maxSidecarSize bounds how much of a sidecar file is read
+const maxSidecarSize = 64 << 10
+
+// userMetadataPrefix starts the headers carrying user-defined metadata
+const userMetadataPrefix = "x-amz-meta-"
+
+// maxUserMetadataSize is S3's limit on the combined size of the user-defined
+// metadata names and values
+const maxUserMetadataSize = 2 << 10
+
+// objectMetadata is the S3 metadata FTP can't store, kept in a sidecar file
+// next to the object
+type objectMetadata struct {
+	ContentType             string            `json:"content_type,omitempty"`
+	ContentDisposition      string            `json:"content_disposition,omitempty"`
+	CacheControl            string            `json:"cache_control,omitempty"`
+	WebsiteRedirectLocation string            `json:"website_redirect_location,omitempty"`
+	UserMetadata            map[string]string `json:"user_metadata,omitempty"`
+}
+
+func (m objectMetadata) empty() bool {
+	return m.ContentType == "" && m.ContentDisposition == "" && m.CacheControl == "" &&
+		m.WebsiteRedirectLocation == "" && len(m.UserMetadata) == 0
+}
+
+// userMetadataSize is the size S3 counts against maxUserMetadataSize
+func (m objectMetadata) userMetadataSize() int {
+	size := 0
+	for name, value := range m.UserMetadata {
+		size += len(name) + len(value)
+	}
+	return size
+}
+
+// sidecarPath returns the FTP path of the sidecar of the object at ftpPath
+func sidecarPath(ftpPath string) string {
+	dir, name := path.Split(ftpPath)
+	return dir + "." + name + sidecarSuffix
+}
+
+// isSidecarName reports whether a listed file name is a sidecar, which is
+// never exposed as an object
+func isSidecarName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, sidecarSuffix)
+}
+
+// metadataFromRequest collects the metadata a PUT or CreateMultipartUpload
+// asks to store. User-defined metadata names are kept lowercase, as S3
+// returns them.
+func metadataFromRequest(r *http.Request) objectMetadata {
+	meta := objectMetadata{
+		ContentType:             r.Header.Get("Content-Type"),
+		ContentDisposition:      r.Header.Get("Content-Disposition"),
+		CacheControl:            r.Header.Get("Cache-Control"),
+		WebsiteRedirectLocation: r.Header.Get("x-amz-website-redirect-location"),
+	}
+	for header, values := range r.Header {
+		name := strings.ToLower(header)
+		if !strings.HasPrefix(name, userMetadataPrefix) || len(values) == 0 {
+			continue
+		}
+		if meta.UserMetadata == nil {
+			meta.UserMetadata = make(map[string]string)
+		}
+		meta.UserMetadata[strings.TrimPrefix(name, userMetadataPrefix)] = strings.Join(values, ",")
+	}
+	return meta
+}
+
+// setObjectHeaders sets the metadata headers of a GET or HEAD response. The
+// object's own metadata wins over the defaults of its bucket.
+func (s *S3Server) setObjectHeaders(w http.ResponseWriter, r *http.Request, meta objectMetadata) {
+	bucket, key := splitBucketKey(r.URL.Path)
+	defaults := s.bucketDefaults(bucket)
+
+	w.Header().Set("Content-Type", s.contentType(bucket, key, meta))
+
+	cacheControl := meta.CacheControl
+	if cacheControl == "" {
+		cacheControl = defaults.CacheControl
+	}
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	if meta.ContentDisposition != "" {
+		w.Header().Set("Content-Disposition", meta.ContentDisposition)
+	}
+	for name, value := range meta.UserMetadata {
+		w.Header().Set(userMetadataPrefix+name, value)
+	}
+
+	// S3 omits the header for STANDARD
+	if class := s.storageClass(bucket, key); class != storageClassStandard {
+		w.Header().Set("x-amz-storage-class", class)
+	}
+	if meta.WebsiteRedirectLocation != "" {
+		w.Header().Set("x-amz-website-redirect-location", meta.WebsiteRedirectLocation)
+	}
+}
+
+// contentType returns the Content-Type served for the object key of bucket
+// with the given metadata. The type stored on PUT wins, then the one known for
+// the key's extension, the bucket's default and finally -default-content-type.
+func (s *S3Server) contentType(bucket, key string, meta objectMetadata) string {
+	if meta.ContentType != "" {
+		return meta.ContentType
+	}
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		return contentType
+	}
+	if contentType := s.bucketDefaults(bucket).ContentType; contentType != "" {
+		return contentType
+	}
+	return s.config.DefaultContentType
+}
+
+// contentTypeHint returns the Content-Type a HEAD of the listed file would
+// report, or "" when -list-content-type is off. Only objects whose sidecar
+// showed up in the listing cost an extra read.
+func (s *S3Server) contentTypeHint(bucket, ftpPath string, file FileInfo) string {
+	if !s.config.ListContentType || file.IsDir {
+		return ""
+	}
+	var meta objectMetadata
+	if file.HasSidecar {
+		meta = s.readMetadata(ftpPath)
+	}
+	return s.contentType(bucket, ftpPath, meta)
+}
+
+// validWebsiteRedirect follows S3, which only accepts paths within the
+// bucket and absolute http(s) URLs
+func validWebsiteRedirect(location string) bool {
+	return location == "" || strings.HasPrefix(location, "/") ||
+		strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// readMetadata loads the sidecar of the object at ftpPath. Objects without a
+// sidecar, or with -sidecar-metadata disabled, have empty metadata.
+func (s *S3Server) readMetadata(ftpPath string) objectMetadata {
+	var meta objectMetadata
+	if !s.config.SidecarMetadata {
+		return meta
+	}
+
+	reader, err := s.ftp.Get(sidecarPath(ftpPath))
+	if err != nil {
+		if !strings.Contains(err.Error(), "550") {
+			slog.Warn("failed to read object metadata", "path", ftpPath, "error", err)
+		}
+		return meta
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, maxSidecarSize))
+	reader.Close()
+	if err != nil {
+		slog.Warn("failed to read object metadata", "path", ftpPath, "error", err)
+		return meta
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		slog.Warn("ignoring malformed object metadata", "path", ftpPath, "error", err)
+		return objectMetadata{}
+	}
+	return meta
+}
+
+// writeMetadata stores the sidecar of the object at ftpPath, removing a stale
+// one when the object has no metadata
+func (s *S3Server) writeMetadata(ftpPath string, meta objectMetadata) error {
+	if !s.config.SidecarMetadata {
+		return nil
+	}
+	if meta.empty() {
+		s.removeMetadata(ftpPath)
+		return nil
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.ftp.Put(sidecarPath(ftpPath), bytes.NewReader(data))
+}
+
+// removeMetadata deletes the sidecar of the object at ftpPath, if any
+func (s *S3Server) removeMetadata(ftpPath string) {
+	if !s.config.SidecarMetadata {
+		return
+	}
+	if err := s.ftp.Delete(sidecarPath(ftpPath)); err != nil && !strings.Contains(err.Error(), "550") {
+		slog.Warn("failed to remove object metadata", "path", ftpPath, "error", err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebsiteRedirect(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+	s := newTestServer(t, f, "-subdir-buckets", "-sidecar-metadata")
+
+	put := func(s *S3Server, key, location string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/bucket/"+key, strings.NewReader("page"))
+		if location != "" {
+			r.Header.Set("x-amz-website-redirect-location", location)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := put(s, "old.html", "/bucket/new.html"); w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+	w := serve(s, http.MethodGet, "/bucket/old.html", "")
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/bucket/new.html" {
+		t.Errorf("GET: status = %d, Location %q", w.Code, w.Header().Get("Location"))
+	}
+	w = serve(s, http.MethodHead, "/bucket/old.html", "")
+	if w.Code != http.StatusOK || w.Header().Get("x-amz-website-redirect-location") != "/bucket/new.html" {
+		t.Errorf("HEAD: status = %d, x-amz-website-redirect-location %q", w.Code, w.Header().Get("x-amz-website-redirect-location"))
+	}
+	if _, ok := f.file("/bucket/.old.html" + sidecarSuffix); !ok {
+		t.Error("no sidecar stored next to the object")
+	}
+	if body := serve(s, http.MethodGet, "/bucket?list-type=2", "").Body.String(); strings.Contains(body, sidecarSuffix) {
+		t.Errorf("listing exposes the sidecar: %s", body)
+	}
+
+	// Overwriting without the header drops the redirect
+	if w := put(s, "old.html", ""); w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve(s, http.MethodGet, "/bucket/old.html", ""); w.Code != http.StatusOK || w.Body.String() != "page" {
+		t.Errorf("GET after overwrite: status = %d: %s", w.Code, w.Body.String())
+	}
+	if _, ok := f.file("/bucket/.old.html" + sidecarSuffix); ok {
+		t.Error("stale sidecar left behind")
+	}
+
+	if w := put(s, "bad.html", "ftp://elsewhere/"); w.Code != http.StatusBadRequest ||
+		!strings.Contains(w.Body.String(), "InvalidRedirectLocation") {
+		t.Errorf("invalid location: status = %d: %s", w.Code, w.Body.String())
+	}
+	disabled := newTestServer(t, f, "-subdir-buckets")
+	if w := put(disabled, "other.html", "https://example.com/"); w.Code != http.StatusNotImplemented {
+		t.Errorf("without -sidecar-metadata: status = %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestListContentTypeHint(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/page.html": "<p>", "/bucket/data": "data"})
+	listed := func(s *S3Server) map[string]string {
+		t.Helper()
+		body := serve(s, http.MethodGet, "/bucket?list-type=2", "").Body.String()
+		hints := make(map[string]string)
+		for _, entry := range strings.Split(body, "<Contents>")[1:] {
+			key := entry[strings.Index(entry, "<Key>")+5 : strings.Index(entry, "</Key>")]
+			if start := strings.Index(entry, `<ContentType xmlns="https://github.com/aiexz/ftp-over-s3">`); start >= 0 {
+				rest := entry[start:]
+				hints[key] = rest[strings.Index(rest, ">")+1 : strings.Index(rest, "</ContentType>")]
+			} else if strings.Contains(entry, "ContentType") {
+				t.Errorf("unnamespaced content type for %s: %s", key, entry)
+			} else {
+				hints[key] = ""
+			}
+		}
+		return hints
+	}
+
+	s := newTestServer(t, f, "-subdir-buckets", "-sidecar-metadata", "-list-content-type")
+	r := httptest.NewRequest(http.MethodPut, "/bucket/report", strings.NewReader("a,b"))
+	r.Header.Set("Content-Type", "text/csv")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT: status = %d: %s", w.Code, w.Body.String())
+	}
+
+	hints := listed(s)
+	if len(hints) != 3 {
+		t.Fatalf("listed %v, want 3 objects without sidecars", hints)
+	}
+	for key, hint := range hints {
+		// The hint saves the HEAD, so it must agree with it
+		if want := serve(s, http.MethodHead, "/bucket/"+key, "").Header().Get("Content-Type"); hint != want {
+			t.Errorf("%s: hint %q, HEAD reports %q", key, hint, want)
+		}
+	}
+	if hints["report"] != "text/csv" {
+		t.Errorf("report: hint %q, want the stored text/csv", hints["report"])
+	}
+
+	disabled := newTestServer(t, f, "-subdir-buckets", "-sidecar-metadata")
+	for key, hint := range listed(disabled) {
+		if hint != "" {
+			t.Errorf("%s: hint %q without -list-content-type", key, hint)
+		}
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/README": "read me", "/bucket/page.html": "<p>"})
+	tests := []struct {
+		args []string
+		key  string
+		want string
+	}{
+		{[]string{"-default-content-type", "text/plain; charset=utf-8"}, "README", "text/plain; charset=utf-8"},
+		{[]string{"-default-content-type", "text/plain; charset=utf-8"}, "page.html", "text/html; charset=utf-8"},
+		{nil, "README", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		s := newTestServer(t, f, append([]string{"-subdir-buckets"}, tt.args...)...)
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			if got := serve(s, method, "/bucket/"+tt.key, "").Header().Get("Content-Type"); got != tt.want {
+				t.Errorf("%s %s with %v: Content-Type = %q, want %q", method, tt.key, tt.args, got, tt.want)
+			}
+		}
+	}
+}
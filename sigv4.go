@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	// sigV4TimeFormat is the format of X-Amz-Date
+	sigV4TimeFormat = "20060102T150405Z"
+	// maxRequestSkew is how far a request's date may be off, as on S3
+	maxRequestSkew = 15 * time.Minute
+	// maxPresignedExpiry is the longest X-Amz-Expires S3 accepts, 7 days
+	maxPresignedExpiry = 7 * 24 * time.Hour
+)
+
+var (
+	errSignatureMismatch = errors.New("signature does not match")
+	errRequestTimeSkewed = errors.New("request time too skewed")
+	errRequestExpired    = errors.New("presigned request expired")
+)
+
+// sigV4Auth is a parsed "AWS4-HMAC-SHA256 Credential=..., SignedHeaders=...,
+// Signature=..." Authorization header
+type sigV4Auth struct {
+	accessKeyID   string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+
+	// Presigned URLs carry the date and their lifetime in the query
+	presigned bool
+	amzDate   string
+	expires   time.Duration
+}
+
+// scope is the credential scope the signing key is derived for
+func (a *sigV4Auth) scope() string {
+	return a.date + "/" + a.region + "/" + a.service + "/aws4_request"
+}
+
+func parseAuthorization(header string) (*sigV4Auth, error) {
+	algorithm, fields, ok := strings.Cut(header, " ")
+	if !ok || algorithm != sigV4Algorithm {
+		return nil, fmt.Errorf("unsupported authorization algorithm")
+	}
+
+	auth := &sigV4Auth{}
+	for _, field := range strings.Split(fields, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed authorization field %q", field)
+		}
+		switch name {
+		case "Credential":
+			parts := strings.Split(value, "/")
+			if len(parts) != 5 || parts[4] != "aws4_request" {
+				return nil, fmt.Errorf("malformed credential %q", value)
+			}
+			auth.accessKeyID, auth.date, auth.region, auth.service = parts[0], parts[1], parts[2], parts[3]
+		case "SignedHeaders":
+			auth.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			auth.signature = value
+		}
+	}
+	if auth.accessKeyID == "" || len(auth.signedHeaders) == 0 || auth.signature == "" {
+		return nil, fmt.Errorf("incomplete authorization header")
+	}
+	if !signsHost(auth.signedHeaders) {
+		return nil, fmt.Errorf("SignedHeaders must include host")
+	}
+	return auth, nil
+}
+
+// parsePresigned parses the X-Amz-* query parameters of a presigned URL
+func parsePresigned(query url.Values) (*sigV4Auth, error) {
+	if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, fmt.Errorf("unsupported X-Amz-Algorithm")
+	}
+	auth := &sigV4Auth{
+		presigned: true,
+		amzDate:   query.Get("X-Amz-Date"),
+		signature: query.Get("X-Amz-Signature"),
+	}
+	credential := query.Get("X-Amz-Credential")
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return nil, fmt.Errorf("malformed X-Amz-Credential %q", credential)
+	}
+	auth.accessKeyID, auth.date, auth.region, auth.service = parts[0], parts[1], parts[2], parts[3]
+	if signedHeaders := query.Get("X-Amz-SignedHeaders"); signedHeaders != "" {
+		auth.signedHeaders = strings.Split(signedHeaders, ";")
+	}
+
+	seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || seconds <= 0 {
+		return nil, fmt.Errorf("X-Amz-Expires must be a positive number of seconds")
+	}
+	auth.expires = time.Duration(seconds) * time.Second
+	if auth.expires > maxPresignedExpiry {
+		return nil, fmt.Errorf("X-Amz-Expires must be less than a week (in seconds); that is, the given X-Amz-Expires must be less than 604800 seconds")
+	}
+	if auth.accessKeyID == "" || auth.amzDate == "" || len(auth.signedHeaders) == 0 || auth.signature == "" {
+		return nil, fmt.Errorf("incomplete presigned URL parameters")
+	}
+	if !signsHost(auth.signedHeaders) {
+		return nil, fmt.Errorf("X-Amz-SignedHeaders must include host")
+	}
+	return auth, nil
+}
+
+// signsHost reports whether the signed headers cover host, which SigV4
+// requires so a signature can't be replayed against another endpoint
+func signsHost(signedHeaders []string) bool {
+	for _, name := range signedHeaders {
+		if name == "host" {
+			return true
+		}
+	}
+	return false
+}
+
+// verify recomputes the signature of r with secretKey and compares it with
+// the one the client sent. The body is not read, its hash is the one the
+// client declared.
+func (a *sigV4Auth) verify(r *http.Request, secretKey string, now time.Time) error {
+	amzDate := a.amzDate
+	if !a.presigned {
+		amzDate = r.Header.Get("X-Amz-Date")
+	}
+	var signedAt time.Time
+	var err error
+	if amzDate != "" {
+		signedAt, err = time.Parse(sigV4TimeFormat, amzDate)
+	} else {
+		// Without X-Amz-Date the HTTP Date header dates the request, the
+		// string to sign still carries it in the X-Amz-Date format
+		signedAt, err = http.ParseTime(r.Header.Get("Date"))
+		amzDate = signedAt.UTC().Format(sigV4TimeFormat)
+	}
+	if err != nil || !strings.HasPrefix(amzDate, a.date) {
+		return errSignatureMismatch
+	}
+	// A presigned URL is valid from its date for its lifetime, other
+	// requests only close to their date
+	skew := now.Sub(signedAt)
+	switch {
+	case skew < -maxRequestSkew:
+		return errRequestTimeSkewed
+	case a.presigned && skew > a.expires:
+		return errRequestExpired
+	case !a.presigned && skew > maxRequestSkew:
+		return errRequestTimeSkewed
+	}
+
+	canonical := canonicalRequest(r, a.signedHeaders, payloadHash(r))
+	stringToSign := sigV4Algorithm + "\n" + amzDate + "\n" + a.scope() + "\n" + hexSHA256(canonical)
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), a.date)
+	key = hmacSHA256(key, a.region)
+	key = hmacSHA256(key, a.service)
+	key = hmacSHA256(key, "aws4_request")
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	if !hmac.Equal([]byte(expected), []byte(a.signature)) {
+		return errSignatureMismatch
+	}
+	return nil
+}
+
+// canonicalRequest builds the SigV4 canonical request of r over the given
+// signed headers
+func canonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+	var b strings.Builder
+	b.WriteString(r.Method + "\n")
+
+	uri := awsURIEncode(r.URL.Path, false)
+	if uri == "" {
+		uri = "/"
+	}
+	b.WriteString(uri + "\n")
+
+	query := r.URL.Query()
+	var params []string
+	for name, values := range query {
+		if name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			params = append(params, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	b.WriteString(strings.Join(params, "&") + "\n")
+
+	for _, name := range signedHeaders {
+		b.WriteString(name + ":" + canonicalHeaderValue(r, name) + "\n")
+	}
+	b.WriteString("\n")
+	b.WriteString(strings.Join(signedHeaders, ";") + "\n")
+	b.WriteString(payloadHash)
+	return b.String()
+}
+
+// canonicalHeaderValue returns the trimmed value of a signed header, with
+// repeated headers joined by commas and inner runs of spaces collapsed
+func canonicalHeaderValue(r *http.Request, name string) string {
+	var values []string
+	switch name {
+	case "host":
+		values = []string{r.Host}
+	case "content-length":
+		values = r.Header.Values(name)
+		if len(values) == 0 && r.ContentLength >= 0 {
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		}
+	default:
+		values = r.Header.Values(name)
+	}
+	for i, value := range values {
+		values[i] = strings.Join(strings.Fields(value), " ")
+	}
+	return strings.Join(values, ",")
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters, and
+// "/" unless encodeSlash is set, as SigV4 requires
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// payloadVerifier hashes a request body while it is read and fails the final
+// read when it doesn't match the declared x-amz-content-sha256, so signed
+// bodies are checked without buffering them
+type payloadVerifier struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected string
+	mismatch bool
+}
+
+func newPayloadVerifier(body io.ReadCloser, expected string) *payloadVerifier {
+	return &payloadVerifier{body: body, hash: sha256.New(), expected: strings.ToLower(expected)}
+}
+
+func (p *payloadVerifier) Read(b []byte) (int, error) {
+	n, err := p.body.Read(b)
+	p.hash.Write(b[:n])
+	if err == io.EOF && hex.EncodeToString(p.hash.Sum(nil)) != p.expected {
+		p.mismatch = true
+		return n, fmt.Errorf("body doesn't match x-amz-content-sha256")
+	}
+	return n, err
+}
+
+func (p *payloadVerifier) Close() error {
+	return p.body.Close()
+}
+
+// payloadMismatch reports whether the body of r failed its SHA-256 check
+func payloadMismatch(r *http.Request) bool {
+	body := r.Body
+	if counted, ok := body.(*countingBody); ok {
+		// Usage accounting wraps the verified body
+		body = counted.ReadCloser
+	}
+	verifier, ok := body.(*payloadVerifier)
+	return ok && verifier.mismatch
+}
+
+// writePayloadMismatch rejects an upload whose body failed its SHA-256 check
+func writePayloadMismatch(w http.ResponseWriter, r *http.Request) {
+	writeS3Error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch",
+		"The provided 'x-amz-content-sha256' header does not match what was computed", r.URL.Path)
+}
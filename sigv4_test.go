@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// signWithDate signs r over the HTTP Date header instead of X-Amz-Date, as
+// some older clients do
+func signWithDate(r *http.Request, auth *sigV4Auth, secretKey string, signedAt time.Time) {
+	r.Header.Set("Date", signedAt.UTC().Format(http.TimeFormat))
+	r.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	canonical := canonicalRequest(r, auth.signedHeaders, unsignedPayload)
+	stringToSign := sigV4Algorithm + "\n" + signedAt.UTC().Format(sigV4TimeFormat) + "\n" + auth.scope() + "\n" + hexSHA256(canonical)
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), auth.date)
+	key = hmacSHA256(key, auth.region)
+	key = hmacSHA256(key, auth.service)
+	key = hmacSHA256(key, "aws4_request")
+	auth.signature = hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func TestVerifyDateHeader(t *testing.T) {
+	now := time.Date(2024, 3, 9, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		signedAt time.Time
+		want     error
+	}{
+		{"current", now, nil},
+		{"slightly behind", now.Add(-5 * time.Minute), nil},
+		{"stale", now.Add(-time.Hour), errRequestTimeSkewed},
+		{"future", now.Add(time.Hour), errRequestTimeSkewed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/bucket/file.txt", nil)
+			auth := &sigV4Auth{
+				accessKeyID:   "AKIDEXAMPLE",
+				date:          tt.signedAt.Format("20060102"),
+				region:        "us-east-1",
+				service:       "s3",
+				signedHeaders: []string{"date", "host", "x-amz-content-sha256"},
+			}
+			signWithDate(r, auth, "secret", tt.signedAt)
+			if err := auth.verify(r, "secret", now); !errors.Is(err, tt.want) {
+				t.Fatalf("verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("wrong secret", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/bucket/file.txt", nil)
+		auth := &sigV4Auth{accessKeyID: "AKIDEXAMPLE", date: "20240309", region: "us-east-1", service: "s3",
+			signedHeaders: []string{"date", "host", "x-amz-content-sha256"}}
+		signWithDate(r, auth, "secret", now)
+		if err := auth.verify(r, "other", now); !errors.Is(err, errSignatureMismatch) {
+			t.Fatalf("verify = %v, want %v", err, errSignatureMismatch)
+		}
+	})
+}
+
+func TestSignedHeadersRequireHost(t *testing.T) {
+	credential := "AKIDEXAMPLE/20240309/us-east-1/s3/aws4_request"
+
+	headers := []struct {
+		signedHeaders string
+		valid         bool
+	}{
+		{"host;x-amz-content-sha256;x-amz-date", true},
+		{"host", true},
+		{"x-amz-content-sha256;x-amz-date", false},
+		{"hostname;x-amz-date", false},
+	}
+	for _, tt := range headers {
+		t.Run("header "+tt.signedHeaders, func(t *testing.T) {
+			_, err := parseAuthorization(sigV4Algorithm + " Credential=" + credential +
+				", SignedHeaders=" + tt.signedHeaders + ", Signature=abcdef")
+			if (err == nil) != tt.valid {
+				t.Fatalf("parseAuthorization error = %v, want valid %v", err, tt.valid)
+			}
+		})
+		t.Run("presigned "+tt.signedHeaders, func(t *testing.T) {
+			query := url.Values{
+				"X-Amz-Algorithm":     {sigV4Algorithm},
+				"X-Amz-Credential":    {credential},
+				"X-Amz-Date":          {"20240309T123000Z"},
+				"X-Amz-Expires":       {"300"},
+				"X-Amz-SignedHeaders": {tt.signedHeaders},
+				"X-Amz-Signature":     {"abcdef"},
+			}
+			if _, err := parsePresigned(query); (err == nil) != tt.valid {
+				t.Fatalf("parsePresigned error = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// storageClassStandard is reported for objects without a configured class
+const storageClassStandard = "STANDARD"
+
+// validStorageClasses are the S3 storage classes an operator can assign
+var validStorageClasses = map[string]bool{
+	"STANDARD":            true,
+	"REDUCED_REDUNDANCY":  true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+	"GLACIER":             true,
+	"GLACIER_IR":          true,
+	"DEEP_ARCHIVE":        true,
+}
+
+// storageClassRule assigns a storage class to the objects below a prefix
+type storageClassRule struct {
+	prefix string
+	class  string
+}
+
+// ParseStorageClasses parses a comma-separated list of prefix=CLASS pairs,
+// where prefixes are matched against "bucket/key", e.g.
+// "default/archive/=GLACIER,logs/=STANDARD_IA"
+func ParseStorageClasses(spec string) ([]storageClassRule, error) {
+	var rules []storageClassRule
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, class, ok := strings.Cut(entry, "=")
+		if !ok || prefix == "" {
+			return nil, fmt.Errorf("invalid storage class entry %q, expected prefix=CLASS", entry)
+		}
+		class = strings.ToUpper(class)
+		if !validStorageClasses[class] {
+			return nil, fmt.Errorf("unknown storage class %q", class)
+		}
+		rules = append(rules, storageClassRule{prefix: strings.TrimPrefix(prefix, "/"), class: class})
+	}
+	return rules, nil
+}
+
+// storageClass returns the configured class of an object, the longest
+// matching prefix wins over the bucket's default
+func (s *S3Server) storageClass(bucket, key string) string {
+	target := bucket + "/" + key
+	class, matched := s.bucketDefaults(bucket).StorageClass, -1
+	if class == "" {
+		class = storageClassStandard
+	}
+	for _, rule := range s.storageClasses {
+		if len(rule.prefix) > matched && strings.HasPrefix(target, rule.prefix) {
+			class, matched = rule.class, len(rule.prefix)
+		}
+	}
+	return class
+}
+
+// isArchivedClass reports whether objects of class need a restore before
+// they can be read
+func isArchivedClass(class string) bool {
+	return class == "GLACIER" || class == "DEEP_ARCHIVE"
+}
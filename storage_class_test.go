@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseStorageClasses(t *testing.T) {
+	rules, err := ParseStorageClasses(" default/archive/=glacier, logs/=STANDARD_IA,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []storageClassRule{{"default/archive/", "GLACIER"}, {"logs/", "STANDARD_IA"}}
+	if len(rules) != len(want) || rules[0] != want[0] || rules[1] != want[1] {
+		t.Errorf("rules = %+v, want %+v", rules, want)
+	}
+	for _, spec := range []string{"archive/", "=GLACIER", "archive/=COLD"} {
+		if _, err := ParseStorageClasses(spec); err == nil {
+			t.Errorf("ParseStorageClasses(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestStorageClasses(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/bucket/archive/old.txt":      "old",
+		"/bucket/archive/deep/old.txt": "deeper",
+		"/bucket/logs/today.txt":       "today",
+		"/bucket/file.txt":             "file",
+	})
+	classes := "bucket/archive/=GLACIER,bucket/archive/deep/=DEEP_ARCHIVE,bucket/logs/=STANDARD_IA"
+
+	t.Run("reported", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets", "-storage-classes", classes)
+		tests := []struct {
+			key, class string
+		}{
+			{"archive/old.txt", "GLACIER"},
+			{"archive/deep/old.txt", "DEEP_ARCHIVE"},
+			{"logs/today.txt", "STANDARD_IA"},
+			{"file.txt", "STANDARD"},
+		}
+		for _, tt := range tests {
+			w := serve(s, http.MethodHead, "/bucket/"+tt.key, "")
+			// S3 omits the header for STANDARD
+			want := tt.class
+			if want == storageClassStandard {
+				want = ""
+			}
+			if got := w.Header().Get("x-amz-storage-class"); w.Code != http.StatusOK || got != want {
+				t.Errorf("HEAD %s: status = %d, x-amz-storage-class = %q, want %q", tt.key, w.Code, got, want)
+			}
+
+			prefix := tt.key[:strings.LastIndex(tt.key, "/")+1]
+			w = serve(s, http.MethodGet, "/bucket?list-type=2&delimiter=/&prefix="+prefix, "")
+			entry := "<Key>" + tt.key + "</Key>"
+			body := w.Body.String()
+			i := strings.Index(body, entry)
+			if i < 0 {
+				t.Fatalf("listing of %q misses %s: %s", prefix, tt.key, body)
+			}
+			if !strings.Contains(body[i:], "<StorageClass>"+tt.class+"</StorageClass>") {
+				t.Errorf("listing reports %s with the wrong class: %s", tt.key, body)
+			}
+		}
+		// Without the simulation, archived objects are readable
+		if w := serve(s, http.MethodGet, "/bucket/archive/old.txt", ""); w.Code != http.StatusOK {
+			t.Errorf("GET archived: status = %d", w.Code)
+		}
+	})
+
+	t.Run("simulated glacier", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets", "-storage-classes", classes, "-simulate-glacier")
+		for _, key := range []string{"archive/old.txt", "archive/deep/old.txt"} {
+			w := serve(s, http.MethodGet, "/bucket/"+key, "")
+			if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "<Code>InvalidObjectState</Code>") {
+				t.Errorf("GET %s: status = %d: %s", key, w.Code, w.Body.String())
+			}
+		}
+		for _, key := range []string{"logs/today.txt", "file.txt"} {
+			if w := serve(s, http.MethodGet, "/bucket/"+key, ""); w.Code != http.StatusOK {
+				t.Errorf("GET %s: status = %d: %s", key, w.Code, w.Body.String())
+			}
+		}
+		// HEAD still reports the object, as S3 does before a restore
+		if w := serve(s, http.MethodHead, "/bucket/archive/old.txt", ""); w.Code != http.StatusOK {
+			t.Errorf("HEAD archived: status = %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockProbeName is the empty file stored at the FTP root to read the
+// server's clock from its modification time
+const clockProbeName = ".ftp-over-s3-clock"
+
+// timeDrift is the latest measurement of the FTP server's clock
+type timeDrift struct {
+	mu       sync.Mutex
+	drift    time.Duration
+	measured time.Time
+	err      error
+}
+
+// TimeDriftReport is the JSON document returned by /admin/time-drift
+type TimeDriftReport struct {
+	DriftSeconds float64   `json:"drift_seconds"`
+	MeasuredAt   time.Time `json:"measured_at"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// measureTimeDrift stores a probe file and compares its MDTM time with the
+// local time the upload happened at. A positive drift means the FTP server's
+// clock is ahead. MDTM has a resolution of one second, so is the result.
+func (s *S3Server) measureTimeDrift() (time.Duration, error) {
+	before := time.Now()
+	if err := s.ftp.Put(clockProbeName, strings.NewReader("")); err != nil {
+		return 0, fmt.Errorf("failed to store clock probe: %v", err)
+	}
+	after := time.Now()
+	defer func() {
+		if err := s.ftp.Delete(clockProbeName); err != nil {
+			slog.Debug("failed to remove clock probe", "error", err)
+		}
+	}()
+
+	modTime, err := s.ftp.ModTime(clockProbeName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read clock probe time: %v", err)
+	}
+	// The file was written at some point during the upload
+	local := before.Add(after.Sub(before) / 2).Truncate(time.Second)
+	return modTime.Sub(local), nil
+}
+
+// MonitorTimeDrift measures the FTP server's clock at startup and then every
+// -time-drift-interval, warning when it is further off than
+// -time-drift-warn. Object times come from the FTP server while conditional
+// requests are compared against client clocks, so drift skews them.
+func (s *S3Server) MonitorTimeDrift() {
+	if s.config.TimeDriftInterval <= 0 {
+		return
+	}
+	for {
+		drift, err := s.measureTimeDrift()
+		s.timeDrift.mu.Lock()
+		s.timeDrift.drift, s.timeDrift.measured, s.timeDrift.err = drift, time.Now(), err
+		s.timeDrift.mu.Unlock()
+
+		switch {
+		case err != nil:
+			slog.Warn("failed to measure FTP server time drift", "error", err)
+		case drift.Abs() > s.config.TimeDriftWarn:
+			slog.Warn("FTP server clock drifts from local time, conditional requests and listing times may be off",
+				"drift", drift,
+				"threshold", s.config.TimeDriftWarn,
+			)
+		default:
+			slog.Info("measured FTP server time drift", "drift", drift)
+		}
+		time.Sleep(s.config.TimeDriftInterval)
+	}
+}
+
+// TimeDrift returns the latest drift measurement
+func (s *S3Server) TimeDrift() TimeDriftReport {
+	s.timeDrift.mu.Lock()
+	defer s.timeDrift.mu.Unlock()
+
+	report := TimeDriftReport{
+		DriftSeconds: s.timeDrift.drift.Seconds(),
+		MeasuredAt:   s.timeDrift.measured,
+	}
+	if s.timeDrift.err != nil {
+		report.Error = s.timeDrift.err.Error()
+	}
+	return report
+}
+
+// handleTimeDrift serves GET /admin/time-drift
+func (s *S3Server) handleTimeDrift(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.config.TimeDriftInterval <= 0 {
+		http.Error(w, "time drift monitoring is disabled, set -time-drift-interval", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(s.TimeDrift()); err != nil {
+		slog.Error("failed to encode time drift report", "error", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMeasureTimeDrift(t *testing.T) {
+	for _, offset := range []time.Duration{0, 90 * time.Second, -time.Hour} {
+		f := startFakeFTP(t, nil)
+		f.mu.Lock()
+		f.clockOffset = offset
+		f.mu.Unlock()
+		s := newTestServer(t, f, "-time-drift-interval", "1h")
+
+		drift, err := s.measureTimeDrift()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// MDTM has a resolution of one second
+		if diff := (drift - offset).Abs(); diff > time.Second {
+			t.Errorf("drift = %v, want %v", drift, offset)
+		}
+		if _, ok := f.file("/" + clockProbeName); ok {
+			t.Error("clock probe left behind")
+		}
+	}
+}
+
+func TestTimeDriftEndpoint(t *testing.T) {
+	f := startFakeFTP(t, nil)
+	if w := serve(newTestServer(t, f), http.MethodGet, adminPrefix+"time-drift", ""); w.Code != http.StatusNotFound {
+		t.Errorf("disabled: status = %d", w.Code)
+	}
+
+	s := newTestServer(t, f, "-time-drift-interval", "1h")
+	measured := time.Date(2024, 3, 9, 12, 30, 0, 0, time.UTC)
+	s.timeDrift.drift, s.timeDrift.measured = -90*time.Second, measured
+	w := serve(s, http.MethodGet, adminPrefix+"time-drift", "")
+	var report TimeDriftReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+	}
+	if report.DriftSeconds != -90 || !report.MeasuredAt.Equal(measured) || report.Error != "" {
+		t.Errorf("report = %+v", report)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idleWatchdog aborts a transfer once no bytes have moved for the idle
+// timeout. Every read or write pushes the client connection's deadlines
+// forward, so a slow but progressing transfer never times out.
+type idleWatchdog struct {
+	rc    *http.ResponseController
+	idle  time.Duration
+	abort func()
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired bool
+}
+
+// newIdleWatchdog starts a watchdog for the request served by w. abort, if
+// non-nil, is called on expiry to unblock the FTP side of the transfer.
+func newIdleWatchdog(w http.ResponseWriter, idle time.Duration, abort func()) *idleWatchdog {
+	d := &idleWatchdog{
+		rc:    http.NewResponseController(w),
+		idle:  idle,
+		abort: abort,
+	}
+	d.timer = time.AfterFunc(idle, d.expire)
+	d.progress()
+	return d
+}
+
+// progress records that bytes moved and extends the deadlines
+func (d *idleWatchdog) progress() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.expired {
+		return
+	}
+	d.timer.Reset(d.idle)
+	deadline := time.Now().Add(d.idle)
+	// Not every ResponseWriter supports deadlines, the timer still fires
+	d.rc.SetReadDeadline(deadline)
+	d.rc.SetWriteDeadline(deadline)
+}
+
+func (d *idleWatchdog) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.expired {
+		return
+	}
+	d.expired = true
+	now := time.Now()
+	d.rc.SetReadDeadline(now)
+	d.rc.SetWriteDeadline(now)
+	if d.abort != nil {
+		d.abort()
+	}
+}
+
+// Expired reports whether the transfer was aborted for being idle
+func (d *idleWatchdog) Expired() bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.expired
+}
+
+// Stop disarms the watchdog and clears the deadlines so they don't carry over
+// to the next request on a keep-alive connection
+func (d *idleWatchdog) Stop() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.timer.Stop()
+	if !d.expired {
+		d.rc.SetReadDeadline(time.Time{})
+		d.rc.SetWriteDeadline(time.Time{})
+	}
+}
+
+// Reader wraps r so that every successful read counts as progress
+func (d *idleWatchdog) Reader(r io.Reader) io.Reader {
+	if d == nil {
+		return r
+	}
+	return &progressReader{r: r, watchdog: d}
+}
+
+// Writer wraps w so that every successful write counts as progress
+func (d *idleWatchdog) Writer(w io.Writer) io.Writer {
+	if d == nil {
+		return w
+	}
+	return &progressWriter{w: w, watchdog: d}
+}
+
+type progressReader struct {
+	r        io.Reader
+	watchdog *idleWatchdog
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.watchdog.progress()
+	}
+	return n, err
+}
+
+type progressWriter struct {
+	w        io.Writer
+	watchdog *idleWatchdog
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	if n > 0 {
+		p.watchdog.progress()
+	}
+	return n, err
+}
+
+// startTransferWatchdog arms an idle watchdog when -transfer-idle-timeout is
+// set. It returns nil otherwise; a nil watchdog passes readers and writers
+// through untouched.
+func (s *S3Server) startTransferWatchdog(w http.ResponseWriter, path string, abort func()) *idleWatchdog {
+	if s.config.TransferIdleTimeout <= 0 {
+		return nil
+	}
+	slog.Debug("arming transfer idle watchdog", "path", path, "idle", s.config.TransferIdleTimeout)
+	return newIdleWatchdog(w, s.config.TransferIdleTimeout, abort)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trickle writes body to w one byte at a time, pausing between bytes
+func trickle(w *io.PipeWriter, body string, pause time.Duration) {
+	for i := 0; i < len(body); i++ {
+		time.Sleep(pause)
+		if _, err := w.Write([]byte{body[i]}); err != nil {
+			return
+		}
+	}
+	w.Close()
+}
+
+func TestTransferIdleTimeout(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+	s := newTestServer(t, f, "-subdir-buckets", "-transfer-idle-timeout", "100ms")
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	put := func(key string, body io.Reader, size int64) (int, error) {
+		r, err := http.NewRequest(http.MethodPut, server.URL+"/bucket/"+key, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.ContentLength = size
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	t.Run("slow upload completes", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		// Takes longer than the idle timeout overall, but never idles
+		go trickle(pw, "0123456789", 30*time.Millisecond)
+		if code, err := put("slow.txt", pr, 10); err != nil || code != http.StatusOK {
+			t.Fatalf("PUT: status = %d, error %v", code, err)
+		}
+		if body, _ := f.file("/bucket/slow.txt"); body != "0123456789" {
+			t.Errorf("stored %q", body)
+		}
+	})
+
+	t.Run("stalled upload is aborted", func(t *testing.T) {
+		// A raw connection, the HTTP client would wait for its body
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "PUT /bucket/stalled.txt HTTP/1.1\r\nHost: gateway\r\nContent-Length: 10\r\n\r\n01234")
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		// The gateway hangs up once the upload idles
+		if _, err := io.Copy(io.Discard, conn); err != nil {
+			t.Fatalf("connection wasn't closed: %v", err)
+		}
+		if body, ok := f.file("/bucket/stalled.txt"); ok && body != "" {
+			t.Errorf("stalled PUT stored %q", body)
+		}
+	})
+
+	t.Run("stalled download is aborted", func(t *testing.T) {
+		f.put("/bucket/big.txt", strings.Repeat("x", 1<<20))
+		f.mu.Lock()
+		f.retrStall = 2 * time.Second
+		f.mu.Unlock()
+		defer func() {
+			f.mu.Lock()
+			f.retrStall = 0
+			f.mu.Unlock()
+		}()
+
+		start := time.Now()
+		resp, err := http.Get(server.URL + "/bucket/big.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		n, err := io.Copy(io.Discard, resp.Body)
+		if err == nil && n == 1<<20 {
+			t.Fatal("stalled GET delivered the whole object")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("stalled GET took %v, want it cut after the idle timeout", elapsed)
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// OpMultipart selects the multipart upload operations for -upstream-operations,
+// which the FTP backend can't serve
+const OpMultipart = "Multipart"
+
+// resignedHeaders carry the client's signature and are replaced when signing
+// for the upstream endpoint
+var resignedHeaders = map[string]bool{
+	"Authorization":        true,
+	"X-Amz-Date":           true,
+	"X-Amz-Content-Sha256": true,
+	"X-Amz-Security-Token": true,
+}
+
+// hopHeaders are connection-specific and never forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// UpstreamProxy forwards selected requests to a real S3 endpoint, re-signed
+// with the upstream credentials. Anonymous requests are forwarded unsigned
+// unless signAnonymous is set, so they get no more access upstream than an
+// anonymous client would.
+type UpstreamProxy struct {
+	endpoint      *url.URL
+	region        string
+	creds         aws.Credentials
+	signAnonymous bool
+	prefixes      []string
+	operations    map[string]bool
+	client        *http.Client
+}
+
+// NewUpstreamProxy returns the proxy configured by the -upstream-* flags, or
+// nil when no upstream endpoint is set
+func NewUpstreamProxy(config *Config) (*UpstreamProxy, error) {
+	if config.UpstreamEndpoint == "" {
+		return nil, nil
+	}
+	endpoint, err := url.Parse(config.UpstreamEndpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid upstream endpoint %q, expected an http or https URL", config.UpstreamEndpoint)
+	}
+
+	p := &UpstreamProxy{
+		endpoint: endpoint,
+		region:   config.UpstreamRegion,
+		creds: aws.Credentials{
+			AccessKeyID:     config.UpstreamAccessKeyID,
+			SecretAccessKey: config.UpstreamSecretKey,
+		},
+		signAnonymous: config.UpstreamSignAnonymous,
+		operations:    make(map[string]bool),
+		client:        &http.Client{},
+	}
+	for _, prefix := range strings.Split(config.UpstreamPrefixes, ",") {
+		prefix = strings.TrimLeft(strings.TrimSpace(prefix), "/")
+		if prefix != "" {
+			p.prefixes = append(p.prefixes, prefix)
+		}
+	}
+	for _, op := range strings.Split(config.UpstreamOperations, ",") {
+		op = strings.TrimSpace(op)
+		switch op {
+		case "":
+			continue
+		case OpListBuckets, OpListObjects, OpGet, OpPut, OpDelete, OpMultipart:
+			p.operations[op] = true
+		default:
+			return nil, fmt.Errorf("unknown upstream operation %q", op)
+		}
+	}
+	if len(p.prefixes) == 0 && len(p.operations) == 0 {
+		return nil, fmt.Errorf("an upstream endpoint needs -upstream-prefixes or -upstream-operations")
+	}
+	return p, nil
+}
+
+// Matches reports whether r is served by the upstream endpoint. Prefixes
+// match the cleaned "bucket/key", listings match on the bucket and their
+// prefix parameter.
+func (p *UpstreamProxy) Matches(r *http.Request) bool {
+	query := r.URL.Query()
+	if p.operations[OpMultipart] && (query.Has("uploads") || query.Has("uploadId")) {
+		return true
+	}
+	if p.operations[classifyOperation(r)] {
+		return true
+	}
+
+	target := strings.TrimPrefix(r.URL.Path, "/")
+	if bucket, key := splitBucketKey(r.URL.Path); key == "" && bucket != "" {
+		target = bucket + "/" + query.Get("prefix")
+	}
+	target = cleanTarget(target)
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(target, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanTarget resolves "." and ".." segments and repeated slashes in a
+// "bucket/key" target, keeping a trailing slash, so a prefix can't be
+// reached or dodged by spelling the path differently
+func cleanTarget(target string) string {
+	cleaned := strings.TrimPrefix(path.Clean("/"+target), "/")
+	if cleaned != "" && strings.HasSuffix(target, "/") {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func (p *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := *p.endpoint
+	target.Path = strings.TrimSuffix(p.endpoint.Path, "/") + r.URL.Path
+	// Presigned query parameters belong to the client's signature
+	query := r.URL.Query()
+	for name := range query {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			query.Del(name)
+		}
+	}
+	target.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target.String(), r.Body)
+	if err != nil {
+		slog.Error("failed to build upstream request", "error", err)
+		writeS3Error(w, http.StatusBadGateway, "InternalError", "Failed to forward the request upstream", r.URL.Path)
+		return
+	}
+	req.ContentLength = r.ContentLength
+	if r.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+	for name, values := range r.Header {
+		if !resignedHeaders[name] {
+			req.Header[name] = values
+		}
+	}
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+
+	if authenticatedAs(r) == "" && !p.signAnonymous {
+		slog.Debug("forwarding anonymous request upstream unsigned", "method", r.Method, "url", target.String())
+		p.forward(w, r, req, target.String())
+		return
+	}
+
+	// The body is streamed, so it can't be hashed up front
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	if err := v4.NewSigner().SignHTTP(r.Context(), p.creds, req, unsignedPayload, "s3", p.region, time.Now()); err != nil {
+		slog.Error("failed to sign upstream request", "error", err)
+		writeS3Error(w, http.StatusBadGateway, "InternalError", "Failed to sign the upstream request", r.URL.Path)
+		return
+	}
+
+	slog.Debug("forwarding request upstream", "method", r.Method, "url", target.String())
+	p.forward(w, r, req, target.String())
+}
+
+// forward sends the upstream request req for r and streams the response back
+func (p *UpstreamProxy) forward(w http.ResponseWriter, r *http.Request, req *http.Request, target string) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		slog.Error("upstream request failed", "url", target, "error", err)
+		writeS3Error(w, http.StatusBadGateway, "InternalError", "The upstream S3 endpoint is unavailable", r.URL.Path)
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	for _, name := range hopHeaders {
+		w.Header().Del(name)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		slog.Error("failed to stream upstream response", "url", target, "error", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUpstreamMatchesCleanedPath(t *testing.T) {
+	p, err := NewUpstreamProxy(&Config{UpstreamEndpoint: "https://s3.example.com", UpstreamPrefixes: "archive/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		want   bool
+	}{
+		{"/archive/file.txt", true},
+		{"/archive//file.txt", true},
+		{"/./archive/file.txt", true},
+		{"/other/../archive/file.txt", true},
+		{"/archive/../other/file.txt", false},
+		{"/archive/dir/../../other/file.txt", false},
+		{"/other/file.txt", false},
+		{"/archive?prefix=old/", true},
+		{"/archive", true},
+		{"/archived/file.txt", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if got := p.Matches(r); got != tt.want {
+			t.Errorf("Matches(%q) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamSignsAnonymousOnlyWhenEnabled(t *testing.T) {
+	var mu sync.Mutex
+	var authorization string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		authorization = r.Header.Get("Authorization")
+		mu.Unlock()
+		w.Write([]byte("upstream"))
+	}))
+	t.Cleanup(upstream.Close)
+	f := startFakeFTP(t, nil)
+
+	tests := []struct {
+		name          string
+		method        string
+		signAnonymous bool
+		signed        bool
+		want          string
+	}{
+		{"anonymous", http.MethodGet, false, false, ""},
+		{"anonymous signed with opt-in", http.MethodGet, true, false, "Credential=AKIDUPSTREAM/"},
+		// A signature on an operation the policy leaves anonymous isn't
+		// verified, so it doesn't count
+		{"unverified signature", http.MethodGet, false, true, ""},
+		{"authenticated", http.MethodPut, false, true, "Credential=AKIDUPSTREAM/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{"-subdir-buckets", "-access-key-id", "AKIDCLIENT", "-secret-key", "client-secret",
+				"-upstream-endpoint", upstream.URL, "-upstream-prefixes", "archive/",
+				"-upstream-access-key-id", "AKIDUPSTREAM", "-upstream-secret-key", "upstream-secret"}
+			if tt.signAnonymous {
+				args = append(args, "-upstream-sign-anonymous")
+			}
+			s := newTestServer(t, f, args...)
+			store := NewCredentialsStore()
+			if err := store.Load(s.config); err != nil {
+				t.Fatal(err)
+			}
+			policy, err := ParseAuthPolicy("Get=anonymous")
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := NewAuthMiddleware(store, policy, s)
+
+			r := httptest.NewRequest(tt.method, "/archive/file.txt", nil)
+			if tt.signed {
+				signRequest(t, r, "AKIDCLIENT", "client-secret")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != http.StatusOK || w.Body.String() != "upstream" {
+				t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.want == "" && authorization != "" {
+				t.Errorf("anonymous request was signed upstream: %s", authorization)
+			}
+			if tt.want != "" && !strings.Contains(authorization, tt.want) {
+				t.Errorf("upstream Authorization = %q, want it to contain %q", authorization, tt.want)
+			}
+		})
+	}
+}
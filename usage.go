@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// anonymousUsage accounts requests that weren't signed with a credential
+const anonymousUsage = "anonymous"
+
+// Output formats of /admin/usage
+const (
+	UsageJSON       = "json"
+	UsagePrometheus = "prometheus"
+)
+
+// CredentialUsage is the traffic of one access key ID, cumulative since the
+// gateway started
+type CredentialUsage struct {
+	Requests        map[string]uint64 `json:"requests"`
+	BytesUploaded   int64             `json:"bytes_uploaded"`
+	BytesDownloaded int64             `json:"bytes_downloaded"`
+}
+
+// UsageReport is the JSON document returned by /admin/usage
+type UsageReport struct {
+	Since       time.Time                  `json:"since"`
+	Credentials map[string]CredentialUsage `json:"credentials"`
+}
+
+// usageTracker accounts requests and bytes per access key ID with
+// -usage-accounting. A nil *usageTracker ignores everything recorded on it.
+type usageTracker struct {
+	mu          sync.Mutex
+	since       time.Time
+	credentials map[string]*CredentialUsage
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{
+		since:       time.Now().UTC(),
+		credentials: make(map[string]*CredentialUsage),
+	}
+}
+
+// record accounts one request by accessKeyID, "" for an anonymous one, with
+// the body bytes it sent and received
+func (u *usageTracker) record(accessKeyID, method string, uploaded, downloaded int64) {
+	if u == nil {
+		return
+	}
+	if accessKeyID == "" {
+		accessKeyID = anonymousUsage
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	usage, ok := u.credentials[accessKeyID]
+	if !ok {
+		usage = &CredentialUsage{Requests: make(map[string]uint64)}
+		u.credentials[accessKeyID] = usage
+	}
+	usage.Requests[method]++
+	usage.BytesUploaded += uploaded
+	usage.BytesDownloaded += downloaded
+}
+
+// report copies the counters so they can be encoded without the lock
+func (u *usageTracker) report() UsageReport {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	report := UsageReport{Since: u.since, Credentials: make(map[string]CredentialUsage, len(u.credentials))}
+	for accessKeyID, usage := range u.credentials {
+		requests := make(map[string]uint64, len(usage.Requests))
+		for method, count := range usage.Requests {
+			requests[method] = count
+		}
+		report.Credentials[accessKeyID] = CredentialUsage{
+			Requests:        requests,
+			BytesUploaded:   usage.BytesUploaded,
+			BytesDownloaded: usage.BytesDownloaded,
+		}
+	}
+	return report
+}
+
+// writeMetrics renders the counters in the Prometheus text exposition format,
+// labeled by access key ID. It is only served on the authenticated
+// /admin/usage, never on /metrics.
+func (u *usageTracker) writeMetrics(w io.Writer) {
+	report := u.report()
+	accessKeyIDs := make([]string, 0, len(report.Credentials))
+	for accessKeyID := range report.Credentials {
+		accessKeyIDs = append(accessKeyIDs, accessKeyID)
+	}
+	sort.Strings(accessKeyIDs)
+
+	fmt.Fprintln(w, "# HELP ftp_over_s3_credential_requests_total HTTP requests by access key ID and method.")
+	fmt.Fprintln(w, "# TYPE ftp_over_s3_credential_requests_total counter")
+	for _, accessKeyID := range accessKeyIDs {
+		requests := report.Credentials[accessKeyID].Requests
+		methods := make([]string, 0, len(requests))
+		for method := range requests {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		for _, method := range methods {
+			fmt.Fprintf(w, "ftp_over_s3_credential_requests_total{access_key_id=%q,method=%q} %d\n", accessKeyID, method, requests[method])
+		}
+	}
+	fmt.Fprintln(w, "# HELP ftp_over_s3_credential_uploaded_bytes_total Request body bytes received by access key ID.")
+	fmt.Fprintln(w, "# TYPE ftp_over_s3_credential_uploaded_bytes_total counter")
+	for _, accessKeyID := range accessKeyIDs {
+		fmt.Fprintf(w, "ftp_over_s3_credential_uploaded_bytes_total{access_key_id=%q} %d\n", accessKeyID, report.Credentials[accessKeyID].BytesUploaded)
+	}
+	fmt.Fprintln(w, "# HELP ftp_over_s3_credential_downloaded_bytes_total Response body bytes sent by access key ID.")
+	fmt.Fprintln(w, "# TYPE ftp_over_s3_credential_downloaded_bytes_total counter")
+	for _, accessKeyID := range accessKeyIDs {
+		fmt.Fprintf(w, "ftp_over_s3_credential_downloaded_bytes_total{access_key_id=%q} %d\n", accessKeyID, report.Credentials[accessKeyID].BytesDownloaded)
+	}
+}
+
+// countingBody counts the request body bytes a handler read
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+// handleUsage serves GET /admin/usage, as JSON or, with format=prometheus,
+// as Prometheus metrics labeled by access key ID
+func (s *S3Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.usage == nil {
+		http.Error(w, "usage accounting is disabled, set -usage-accounting", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	switch format := r.URL.Query().Get("format"); format {
+	case "", UsageJSON:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.usage.report()); err != nil {
+			slog.Error("failed to encode usage report", "error", err)
+		}
+	case UsagePrometheus:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.usage.writeMetrics(w)
+	default:
+		http.Error(w, "unknown format \""+format+"\", expected "+UsageJSON+" or "+UsagePrometheus, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsOmitAccessKeyIDs(t *testing.T) {
+	f := startFakeFTP(t, nil)
+	s := newTestServer(t, f, "-metrics", "-usage-accounting")
+	s.usage.record("AKIAEXAMPLE", http.MethodGet, 10, 20)
+
+	w := serve(s.MetricsHandler(http.NotFoundHandler()), http.MethodGet, metricsPath, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	for _, leak := range []string{"AKIAEXAMPLE", "access_key_id"} {
+		if strings.Contains(w.Body.String(), leak) {
+			t.Errorf("unauthenticated metrics expose %q", leak)
+		}
+	}
+
+	if report := s.usage.report(); report.Credentials["AKIAEXAMPLE"].BytesDownloaded != 20 {
+		t.Errorf("usage report lost the credential's counters: %+v", report)
+	}
+}
+
+func TestUsageCounters(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/public.txt": "public"})
+	s := newTestServer(t, f, "-subdir-buckets", "-usage-accounting", "-access-key-id", "AKIDUSAGE", "-secret-key", "usage-secret")
+	store := NewCredentialsStore()
+	if err := store.Load(s.config); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := ParseAuthPolicy("Get=anonymous")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := NewAuthMiddleware(store, policy, s)
+	send := func(method, target, body string, signed bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if signed {
+			signRequest(t, r, "AKIDUSAGE", "usage-secret")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: status = %d: %s", method, target, w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	send(http.MethodPut, "/bucket/a.txt", "hello", true)
+	send(http.MethodPut, "/bucket/b.txt", "world!", true)
+	listing := send(http.MethodGet, "/bucket?list-type=2", "", true)
+	send(http.MethodGet, "/bucket/public.txt", "", false)
+	send(http.MethodGet, "/bucket/public.txt", "", false)
+
+	report := s.usage.report()
+	signed := report.Credentials["AKIDUSAGE"]
+	if signed.Requests[http.MethodPut] != 2 || signed.Requests[http.MethodGet] != 1 {
+		t.Errorf("signed requests = %v, want 2 PUT and 1 GET", signed.Requests)
+	}
+	if signed.BytesUploaded != int64(len("hello")+len("world!")) {
+		t.Errorf("signed bytes uploaded = %d, want %d", signed.BytesUploaded, len("hello")+len("world!"))
+	}
+	if signed.BytesDownloaded != int64(listing.Body.Len()) {
+		t.Errorf("signed bytes downloaded = %d, want the listing's %d", signed.BytesDownloaded, listing.Body.Len())
+	}
+	anonymous := report.Credentials[anonymousUsage]
+	if anonymous.Requests[http.MethodGet] != 2 || anonymous.BytesDownloaded != int64(2*len("public")) || anonymous.BytesUploaded != 0 {
+		t.Errorf("anonymous usage = %+v, want 2 GETs downloading %d bytes", anonymous, 2*len("public"))
+	}
+
+	metrics := send(http.MethodGet, "/admin/usage?format=prometheus", "", true).Body.String()
+	for _, series := range []string{
+		`ftp_over_s3_credential_requests_total{access_key_id="AKIDUSAGE",method="PUT"} 2`,
+		`ftp_over_s3_credential_requests_total{access_key_id="anonymous",method="GET"} 2`,
+		`ftp_over_s3_credential_uploaded_bytes_total{access_key_id="AKIDUSAGE"} 11`,
+		`ftp_over_s3_credential_downloaded_bytes_total{access_key_id="anonymous"} 12`,
+	} {
+		if !strings.Contains(metrics, series) {
+			t.Errorf("usage metrics lack %s:\n%s", series, metrics)
+		}
+	}
+
+	// The labeled series need a signed request like the JSON report
+	w := serve(handler, http.MethodGet, "/admin/usage?format=prometheus", "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("anonymous usage metrics: status = %d, want 403", w.Code)
+	}
+}
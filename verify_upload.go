@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// errUploadUnverified is returned when a stored object's size still differs
+// from the bytes sent once the retries are used up
+var errUploadUnverified = errors.New("stored object size doesn't match the upload")
+
+// StoredSize returns the size of the file at path by SIZE, or from a listing
+// of its directory when the server doesn't support SIZE
+func (c *FTPClient) StoredSize(path string) (int64, error) {
+	size, err := c.FileSize(path)
+	if err == nil || !isCommandUnsupported(err) {
+		return size, err
+	}
+
+	path = strings.TrimPrefix(filepath.Clean(path), "/")
+	dir := filepath.Dir(path)
+	if dir == "." {
+		dir = ""
+	}
+	files, err := c.List(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range files {
+		if file.Name == filepath.Base(path) && !file.IsDir {
+			return file.Size, nil
+		}
+	}
+	return 0, fmt.Errorf("stored file %q is missing from its directory listing", path)
+}
+
+// VerifyUpload checks that the file at path has the size that was sent. A
+// mismatching file is deleted, so a truncated object is never served.
+func (c *FTPClient) VerifyUpload(path string, size int64) error {
+	stored, err := c.StoredSize(path)
+	if err != nil {
+		return fmt.Errorf("failed to verify upload: %w", err)
+	}
+	if stored == size {
+		return nil
+	}
+	slog.Warn("stored object size doesn't match the upload, removing it",
+		"path", path,
+		"sent", size,
+		"stored", stored,
+	)
+	if err := c.Delete(path); err != nil {
+		slog.Debug("failed to remove unverified file", "path", path, "error", err)
+	}
+	return errUploadUnverified
+}
+
+// verifyUpload verifies a direct PUT. When the sent bytes were kept, a failed
+// verification stores them again up to VerifyRetries times; otherwise the
+// upload fails and the client has to send it again.
+func (s *S3Server) verifyUpload(ftpPath string, size int64, sent *bytes.Buffer) error {
+	err := s.ftp.VerifyUpload(ftpPath, size)
+	for attempt := 1; errors.Is(err, errUploadUnverified) && sent != nil && attempt <= s.config.VerifyRetries; attempt++ {
+		slog.Info("retrying unverified upload", "path", ftpPath, "attempt", attempt)
+		if err = s.ftp.Put(ftpPath, bytes.NewReader(sent.Bytes())); err != nil {
+			return err
+		}
+		err = s.ftp.VerifyUpload(ftpPath, size)
+	}
+	return err
+}
+
+// retainForRetry reports whether a PUT body is small enough to be kept in
+// memory for verification retries
+func (s *S3Server) retainForRetry(r *http.Request) bool {
+	return s.config.VerifyUploads && s.config.VerifyRetries > 0 &&
+		r.ContentLength >= 0 && r.ContentLength <= s.config.VerifyRetryMaxSize
+}
+
+// writeUploadUnverified fails an upload that didn't verify with a status
+// S3 clients retry
+func writeUploadUnverified(w http.ResponseWriter, r *http.Request) {
+	writeS3Error(w, http.StatusServiceUnavailable, "SlowDown",
+		"The stored object didn't match the upload and was removed, please retry", r.URL.Path)
+}
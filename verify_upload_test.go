@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestVerifyUploadRetry(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/.keep": ""})
+	var stors atomic.Int32
+	f.setStorHook(func(string) error {
+		stors.Add(1)
+		return nil
+	})
+	truncate := func(n int) {
+		f.mu.Lock()
+		f.truncate = n
+		f.mu.Unlock()
+		stors.Store(0)
+	}
+
+	t.Run("retry succeeds", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets", "-verify-uploads")
+		truncate(1)
+		if w := serve(s, http.MethodPut, "/bucket/retried.txt", "0123456789"); w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		if body, _ := f.file("/bucket/retried.txt"); body != "0123456789" {
+			t.Errorf("stored %q", body)
+		}
+		if n := stors.Load(); n != 2 {
+			t.Errorf("%d STORs, want the truncated one retried once", n)
+		}
+	})
+
+	t.Run("retries used up", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets", "-verify-uploads", "-verify-retries", "1")
+		truncate(2)
+		w := serve(s, http.MethodPut, "/bucket/truncated.txt", "0123456789")
+		if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "<Code>SlowDown</Code>") {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		if _, ok := f.file("/bucket/truncated.txt"); ok {
+			t.Error("unverified object left behind")
+		}
+	})
+
+	t.Run("too large to retry", func(t *testing.T) {
+		s := newTestServer(t, f, "-subdir-buckets", "-verify-uploads", "-verify-retry-max-size", "4")
+		truncate(1)
+		w := serve(s, http.MethodPut, "/bucket/large.txt", "0123456789")
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d: %s", w.Code, w.Body.String())
+		}
+		if n := stors.Load(); n != 1 {
+			t.Errorf("%d STORs, want no retry of a body that wasn't kept", n)
+		}
+		if _, ok := f.file("/bucket/large.txt"); ok {
+			t.Error("unverified object left behind")
+		}
+	})
+}
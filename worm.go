@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wormAllBuckets applies a write-once policy to every bucket without one of
+// its own
+const wormAllBuckets = "*"
+
+// ParseWORMPolicy parses a comma-separated list of bucket=retention pairs,
+// e.g. "archive=8760h,logs=0s". Objects in listed buckets can't be
+// overwritten, and can't be deleted until they are older than the retention.
+func ParseWORMPolicy(spec string) (map[string]time.Duration, error) {
+	policy := make(map[string]time.Duration)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		bucket, value, ok := strings.Cut(entry, "=")
+		if !ok || bucket == "" {
+			return nil, fmt.Errorf("invalid WORM entry %q, expected bucket=retention", entry)
+		}
+		retention, err := time.ParseDuration(value)
+		if err != nil || retention < 0 {
+			return nil, fmt.Errorf("invalid retention %q for bucket %s", value, bucket)
+		}
+		policy[bucket] = retention
+	}
+	return policy, nil
+}
+
+// wormRetention returns the retention of the write-once bucket, false when
+// the bucket isn't write-once
+func (s *S3Server) wormRetention(bucket string) (time.Duration, bool) {
+	if retention, ok := s.worm[bucket]; ok {
+		return retention, true
+	}
+	retention, ok := s.worm[wormAllBuckets]
+	return retention, ok
+}
+
+// lockWrite serializes the writes of a path whose checks look at the object
+// already there, in write-once buckets and with -overwrite-protection, so two
+// uploads can't both pass them. It returns the function releasing the path,
+// other writes don't wait.
+func (s *S3Server) lockWrite(r *http.Request, ftpPath string) func() {
+	bucket, _ := splitBucketKey(r.URL.Path)
+	if _, ok := s.wormRetention(bucket); !ok && s.config.OverwriteProtection <= 0 {
+		return func() {}
+	}
+	return s.writeLocks.lock(ftpPath)
+}
+
+// checkWORMOverwrite refuses to replace an existing object in a write-once
+// bucket. It fails closed when existence can't be determined. The caller holds
+// lockWrite for the path until the write is done.
+func (s *S3Server) checkWORMOverwrite(w http.ResponseWriter, r *http.Request, ftpPath string) bool {
+	bucket, _ := splitBucketKey(r.URL.Path)
+	if _, ok := s.wormRetention(bucket); !ok {
+		return true
+	}
+
+	// A staged upload isn't on the FTP server yet but already exists
+	if s.writeBuffer.Staged(ftpPath) {
+		slog.Debug("rejecting overwrite of staged object in write-once bucket", "bucket", bucket, "path", ftpPath)
+		writeS3Error(w, http.StatusForbidden, "AccessDenied",
+			"Objects in this bucket are write-once and can't be overwritten", r.URL.Path)
+		return false
+	}
+	file, err := s.statObjectUncached(ftpPath)
+	if err != nil && !strings.Contains(err.Error(), "550") {
+		slog.Error("failed to check write-once object", "path", ftpPath, "error", err)
+		writeS3Error(w, http.StatusServiceUnavailable, "ServiceUnavailable",
+			"Could not verify that the write-once object doesn't exist yet", r.URL.Path)
+		return false
+	}
+	if file != nil && !file.IsDir {
+		slog.Debug("rejecting overwrite in write-once bucket", "bucket", bucket, "path", ftpPath)
+		writeS3Error(w, http.StatusForbidden, "AccessDenied",
+			"Objects in this bucket are write-once and can't be overwritten", r.URL.Path)
+		return false
+	}
+	return true
+}
+
+// wormDeleteError returns why the object can't be deleted yet from its
+// write-once bucket, or "" when deleting is allowed. The write time comes from
+// MDTM, falling back to the listing.
+func (s *S3Server) wormDeleteError(bucket, ftpPath string) string {
+	retention, ok := s.wormRetention(bucket)
+	if !ok {
+		return ""
+	}
+
+	// A staged upload was just written
+	if s.writeBuffer.Staged(ftpPath) {
+		if retention > 0 {
+			return fmt.Sprintf("The object is retained until %s", time.Now().Add(retention).UTC().Format(time.RFC3339))
+		}
+		return ""
+	}
+
+	written, err := s.ftp.ModTime(ftpPath)
+	if err != nil {
+		file, statErr := s.statObjectUncached(ftpPath)
+		if statErr != nil {
+			slog.Error("failed to determine write time of write-once object", "path", ftpPath, "error", statErr)
+			return "Could not determine when the write-once object was written"
+		}
+		if file == nil {
+			// Nothing to protect, the delete reports the missing key
+			return ""
+		}
+		written = file.ModTime
+	}
+
+	if age := time.Since(written); age < retention {
+		slog.Debug("rejecting delete within retention", "path", ftpPath, "written", written, "retention", retention)
+		return fmt.Sprintf("The object is retained until %s", written.Add(retention).UTC().Format(time.RFC3339))
+	}
+	return ""
+}
+
+// pathLocks hands out a mutex per FTP path, dropping it once nobody holds or
+// waits for it
+type pathLocks struct {
+	mu    sync.Mutex
+	paths map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock blocks until the path is free and returns the function releasing it
+func (l *pathLocks) lock(ftpPath string) func() {
+	l.mu.Lock()
+	if l.paths == nil {
+		l.paths = make(map[string]*pathLock)
+	}
+	entry, ok := l.paths[ftpPath]
+	if !ok {
+		entry = &pathLock{}
+		l.paths[ftpPath] = entry
+	}
+	entry.refs++
+	l.mu.Unlock()
+
+	entry.Lock()
+	return func() {
+		entry.Unlock()
+		l.mu.Lock()
+		if entry.refs--; entry.refs == 0 {
+			delete(l.paths, ftpPath)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestWORMBuckets(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{
+		"/archive/existing.txt": "kept",
+		"/logs/old.log":         "old",
+		"/scratch/file.txt":     "scratch",
+	})
+	s := newTestServer(t, f, "-subdir-buckets",
+		"-worm-buckets", "archive=876000h,logs=0s",
+		"-list-cache-ttl", "1m",
+		"-write-buffer-dir", t.TempDir(),
+	)
+
+	// A cached listing of the bucket must not hide objects written since
+	if w := serve(s, http.MethodGet, "/archive?list-type=2", ""); w.Code != http.StatusOK {
+		t.Fatalf("listing failed with %d: %s", w.Code, w.Body.String())
+	}
+	f.put("/archive/behind-cache.txt", "written directly")
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		want   int
+	}{
+		{"new object", http.MethodPut, "/archive/new.txt", "first", http.StatusOK},
+		{"overwrite", http.MethodPut, "/archive/existing.txt", "replaced", http.StatusForbidden},
+		{"overwrite of a staged object", http.MethodPut, "/archive/new.txt", "second", http.StatusForbidden},
+		{"overwrite behind a cached listing", http.MethodPut, "/archive/behind-cache.txt", "replaced", http.StatusForbidden},
+		{"traversal into the bucket", http.MethodPut, "/scratch/../archive/existing.txt", "replaced", http.StatusBadRequest},
+		{"premature delete", http.MethodDelete, "/archive/existing.txt", "", http.StatusForbidden},
+		{"premature delete of a staged object", http.MethodDelete, "/archive/new.txt", "", http.StatusForbidden},
+		{"delete without retention", http.MethodDelete, "/logs/old.log", "", http.StatusNoContent},
+		{"overwrite outside write-once buckets", http.MethodPut, "/scratch/file.txt", "replaced", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(s, tt.method, tt.target, tt.body)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+
+	for name, want := range map[string]string{
+		"/archive/existing.txt":     "kept",
+		"/archive/behind-cache.txt": "written directly",
+	} {
+		if body, _ := f.file(name); body != want {
+			t.Errorf("write-once object %s was changed to %q", name, body)
+		}
+	}
+}
+
+func TestWORMConcurrentPuts(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/archive/other.txt": "other"})
+	s := newTestServer(t, f, "-subdir-buckets", "-worm-buckets", "archive=1h")
+
+	const writers = 8
+	var wg sync.WaitGroup
+	codes := make(chan int, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- serve(s, http.MethodPut, "/archive/race.txt", "body").Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			created++
+		case http.StatusForbidden:
+		default:
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d concurrent PUTs created the write-once object, want 1", created)
+	}
+}
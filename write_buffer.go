@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// writeBufferQueueSize bounds the staged uploads waiting for a worker
+	writeBufferQueueSize = 1024
+	// writeBufferAttempts is how often a flush is tried before the upload is
+	// moved to the dead-letter files
+	writeBufferAttempts = 5
+)
+
+// writeBufferRetryDelay is multiplied by the attempt number to wait between
+// flush attempts, taken by each write buffer when it starts
+var writeBufferRetryDelay = time.Second
+
+// Staging file suffixes, every upload is an id.data file with an id.json
+// manifest. Uploads that kept failing are renamed to id.failed.json.
+const (
+	stagedDataSuffix     = ".data"
+	stagedManifestSuffix = ".json"
+	stagedFailedSuffix   = ".failed.json"
+)
+
+// stagedUpload is the manifest of a buffered upload
+type stagedUpload struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Received time.Time `json:"received"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// writeBuffer acknowledges small uploads once they are staged on local disk
+// and flushes them to FTP in the background. Staged uploads survive a
+// restart and are flushed at least once; a newer upload of the same key
+// supersedes an older one still waiting. Until then, reads are served from
+// the staged copy.
+type writeBuffer struct {
+	dir    string
+	sync   bool
+	verify bool
+	queue  chan stagedUpload
+	// flushed runs after an upload reached the FTP server
+	flushed    func(ftpPath string)
+	retryDelay time.Duration
+
+	mu      sync.Mutex
+	latest  map[string]string
+	counter uint64
+}
+
+// newWriteBuffer starts the workers flushing through client, sharing its
+// connection pools with the requests
+func newWriteBuffer(config *Config, client *FTPClient, flushed func(ftpPath string)) (*writeBuffer, error) {
+	if err := os.MkdirAll(config.WriteBufferDir, 0o700); err != nil {
+		return nil, err
+	}
+	b := &writeBuffer{
+		dir:        config.WriteBufferDir,
+		sync:       config.WriteBufferSync,
+		verify:     config.VerifyUploads,
+		queue:      make(chan stagedUpload, writeBufferQueueSize),
+		flushed:    flushed,
+		retryDelay: writeBufferRetryDelay,
+		latest:     make(map[string]string),
+	}
+
+	pending, err := b.recover()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < config.WriteBufferWorkers; i++ {
+		go b.work(client)
+	}
+	// Recovered uploads may exceed the queue, so feed them without blocking
+	// startup
+	go func() {
+		for _, upload := range pending {
+			b.queue <- upload
+		}
+	}()
+	return b, nil
+}
+
+// recover loads the uploads a previous run staged but didn't flush
+func (b *writeBuffer) recover() ([]stagedUpload, error) {
+	manifests, err := filepath.Glob(filepath.Join(b.dir, "*"+stagedManifestSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var pending []stagedUpload
+	for _, manifest := range manifests {
+		if strings.HasSuffix(manifest, stagedFailedSuffix) {
+			continue
+		}
+		data, err := os.ReadFile(manifest)
+		if err != nil {
+			return nil, err
+		}
+		var upload stagedUpload
+		if err := json.Unmarshal(data, &upload); err != nil {
+			slog.Error("skipping unreadable staged upload", "manifest", manifest, "error", err)
+			continue
+		}
+		// Manifests are named after sortable ids, later ones win
+		b.latest[upload.Path] = upload.ID
+		pending = append(pending, upload)
+	}
+	if len(pending) > 0 {
+		slog.Info("recovered staged uploads", "count", len(pending))
+	}
+	return pending, nil
+}
+
+func (b *writeBuffer) dataFile(id string) string {
+	return filepath.Join(b.dir, id+stagedDataSuffix)
+}
+
+func (b *writeBuffer) manifestFile(id string) string {
+	return filepath.Join(b.dir, id+stagedManifestSuffix)
+}
+
+// Stage writes the upload to disk and queues the flush. It returns false
+// without consuming the body when the queue is full, the caller then uploads
+// synchronously.
+func (b *writeBuffer) Stage(ftpPath string, body io.Reader) (bool, int64, error) {
+	if len(b.queue) == cap(b.queue) {
+		return false, 0, nil
+	}
+
+	b.mu.Lock()
+	b.counter++
+	id := fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), b.counter%1000000)
+	b.mu.Unlock()
+
+	upload := stagedUpload{ID: id, Path: ftpPath, Received: time.Now().UTC()}
+	size, err := writeStaged(b.dataFile(id), body, b.sync)
+	upload.Size = size
+	if err == nil {
+		var manifest []byte
+		manifest, err = json.Marshal(upload)
+		if err == nil {
+			_, err = writeStaged(b.manifestFile(id), bytes.NewReader(manifest), b.sync)
+		}
+	}
+	if err != nil {
+		b.discard(id)
+		return true, size, err
+	}
+
+	b.mu.Lock()
+	b.latest[ftpPath] = id
+	b.mu.Unlock()
+
+	select {
+	case b.queue <- upload:
+	default:
+		// Filled up meanwhile, the files stay and are flushed after a restart
+		slog.Warn("write buffer queue full, upload stays staged until restart", "path", ftpPath, "id", id)
+	}
+	return true, size, nil
+}
+
+// Cancel drops any staged upload of ftpPath, so a later direct write or
+// delete isn't overwritten by a late flush
+func (b *writeBuffer) Cancel(ftpPath string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.latest, ftpPath)
+}
+
+// Staged reports whether an upload of ftpPath waits to be flushed
+func (b *writeBuffer) Staged(ftpPath string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.latest[ftpPath]
+	return ok
+}
+
+// Open opens the staged copy of ftpPath, false when no upload of ftpPath
+// waits to be flushed
+func (b *writeBuffer) Open(ftpPath string) (*os.File, bool) {
+	if b == nil {
+		return nil, false
+	}
+	// A staged copy is only discarded once it stopped being the latest
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id, ok := b.latest[ftpPath]
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(b.dataFile(id))
+	if err != nil {
+		slog.Warn("failed to open staged upload", "path", ftpPath, "id", id, "error", err)
+		return nil, false
+	}
+	return f, true
+}
+
+// superseded reports whether upload was cancelled or replaced by a newer one
+func (b *writeBuffer) superseded(upload stagedUpload) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.latest[upload.Path] != upload.ID
+}
+
+func (b *writeBuffer) work(client *FTPClient) {
+	for upload := range b.queue {
+		b.flush(client, upload)
+	}
+}
+
+func (b *writeBuffer) flush(client *FTPClient, upload stagedUpload) {
+	var err error
+	for attempt := 1; attempt <= writeBufferAttempts; attempt++ {
+		if b.superseded(upload) {
+			slog.Debug("dropping superseded staged upload", "path", upload.Path, "id", upload.ID)
+			b.discard(upload.ID)
+			return
+		}
+
+		err = b.put(client, upload)
+		if err == nil {
+			slog.Debug("flushed staged upload", "path", upload.Path, "id", upload.ID, "size", upload.Size)
+			b.mu.Lock()
+			if b.latest[upload.Path] == upload.ID {
+				delete(b.latest, upload.Path)
+			}
+			b.mu.Unlock()
+			b.discard(upload.ID)
+			b.flushed(upload.Path)
+			return
+		}
+		slog.Warn("failed to flush staged upload", "path", upload.Path, "id", upload.ID, "attempt", attempt, "error", err)
+		time.Sleep(time.Duration(attempt) * b.retryDelay)
+	}
+
+	// Dead letter: keep the data for an operator and record why it failed
+	upload.Error = err.Error()
+	slog.Error("giving up on staged upload, kept as dead letter",
+		"path", upload.Path,
+		"id", upload.ID,
+		"data", b.dataFile(upload.ID),
+		"error", err,
+	)
+	if manifest, jsonErr := json.Marshal(upload); jsonErr == nil {
+		os.WriteFile(filepath.Join(b.dir, upload.ID+stagedFailedSuffix), manifest, 0o600)
+	}
+	os.Remove(b.manifestFile(upload.ID))
+}
+
+func (b *writeBuffer) put(client *FTPClient, upload stagedUpload) error {
+	f, err := os.Open(b.dataFile(upload.ID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := client.Put(upload.Path, f); err != nil {
+		return err
+	}
+	// A mismatching object is removed and the staged copy flushed again
+	if b.verify {
+		return client.VerifyUpload(upload.Path, upload.Size)
+	}
+	return nil
+}
+
+func (b *writeBuffer) discard(id string) {
+	os.Remove(b.manifestFile(id))
+	os.Remove(b.dataFile(id))
+}
+
+// writeStaged writes r to a new file, syncing it to disk when sync is set
+func writeStaged(name string, r io.Reader, sync bool) (int64, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(f, r)
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return size, err
+}
+
+// bufferable reports whether a PUT may go through the write buffer: only
+// small uploads of known size with nothing to do after the transfer. Metadata
+// only matters when sidecars store it.
+func (s *S3Server) bufferable(r *http.Request, meta objectMetadata) bool {
+	return s.writeBuffer != nil &&
+		r.ContentLength >= 0 && r.ContentLength <= s.config.WriteBufferMaxSize &&
+		(meta.empty() || !s.config.SidecarMetadata) && s.config.UploadChmod == "" &&
+		s.config.PostUploadSite == ""
+}
+
+// handleBufferedPut acknowledges a small upload once it is staged. It
+// returns false when the buffer is full and the upload must go to FTP
+// directly.
+func (s *S3Server) handleBufferedPut(w http.ResponseWriter, r *http.Request, ftpPath string) bool {
+	digest := newDigestReader(r.Body)
+	staged, size, err := s.writeBuffer.Stage(ftpPath, digest)
+	if !staged {
+		slog.Debug("write buffer full, uploading directly", "path", ftpPath)
+		return false
+	}
+	if err != nil {
+		if payloadMismatch(r) {
+			writePayloadMismatch(w, r)
+			return true
+		}
+		if size != r.ContentLength {
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody",
+				"You did not provide the number of bytes specified by the Content-Length HTTP header", r.URL.Path)
+			return true
+		}
+		slog.Error("failed to stage upload", "path", ftpPath, "error", err)
+		writeInternalError(w, r, err)
+		return true
+	}
+
+	// The digest only matches once the flushed object has its size
+	sum := digest.digest()
+	s.digests.put(ftpPath, sum)
+	s.rangeCache.invalidate(ftpPath)
+	w.Header().Set("ETag", digestETag(sum.md5))
+	w.Header().Set("x-amz-version-id", "null") // Buckets are unversioned
+	slog.Debug("staged upload for asynchronous flush", "path", ftpPath, "size", size)
+	w.WriteHeader(http.StatusOK)
+	return true
+}
+
+// serveStaged answers a GET or HEAD of an upload still waiting in the write
+// buffer from its staged copy, the FTP server has the previous object or none
+// yet. It returns false when nothing of ftpPath is staged.
+func (s *S3Server) serveStaged(w http.ResponseWriter, r *http.Request, ftpPath string) bool {
+	f, ok := s.writeBuffer.Open(ftpPath)
+	if !ok {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		slog.Warn("failed to stat staged upload", "path", ftpPath, "error", err)
+		return false
+	}
+
+	slog.Debug("serving staged upload", "path", ftpPath, "size", info.Size())
+	if sum, ok := s.digests.get(ftpPath, info.Size()); ok {
+		w.Header().Set("ETag", digestETag(sum))
+	}
+	w.Header().Set("x-amz-version-id", "null") // Buckets are unversioned
+	http.ServeContent(w, r, path.Base(ftpPath), info.ModTime(), f)
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriteBufferServesStagedUntilFlushed(t *testing.T) {
+	f := startFakeFTP(t, map[string]string{"/bucket/object.txt": "old"})
+	gate := make(chan struct{})
+	f.setStorHook(func(string) error {
+		<-gate
+		return nil
+	})
+	s := newTestServer(t, f, "-subdir-buckets", "-write-buffer-dir", t.TempDir(), "-max-ftp-conns", "2")
+
+	if w := serve(s, http.MethodPut, "/bucket/object.txt", "new"); w.Code != http.StatusOK {
+		t.Fatalf("PUT failed with %d: %s", w.Code, w.Body.String())
+	}
+
+	// The flush is held up, so the FTP server still has the old object
+	tests := []struct {
+		method string
+		target string
+		want   int
+		body   string
+	}{
+		{http.MethodGet, "/bucket/object.txt", http.StatusOK, "new"},
+		{http.MethodHead, "/bucket/object.txt", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		w := serve(s, tt.method, tt.target, "")
+		if w.Code != tt.want || w.Body.String() != tt.body {
+			t.Errorf("%s before the flush = %d %q, want %d %q", tt.method, w.Code, w.Body.String(), tt.want, tt.body)
+		}
+		if w.Header().Get("Content-Length") != "3" {
+			t.Errorf("%s before the flush has Content-Length %q, want 3", tt.method, w.Header().Get("Content-Length"))
+		}
+	}
+	if body, _ := f.file("/bucket/object.txt"); body != "old" {
+		t.Fatalf("object was flushed early: %q", body)
+	}
+
+	close(gate)
+	waitFor(t, "the flush", func() bool { return !s.writeBuffer.Staged("bucket/object.txt") })
+	if body, _ := f.file("/bucket/object.txt"); body != "new" {
+		t.Fatalf("flushed object is %q, want new", body)
+	}
+	if w := serve(s, http.MethodGet, "/bucket/object.txt", ""); w.Body.String() != "new" {
+		t.Errorf("GET after the flush = %q, want new", w.Body.String())
+	}
+}
+
+func TestWriteBufferFlushFailure(t *testing.T) {
+	saved := writeBufferRetryDelay
+	writeBufferRetryDelay = time.Millisecond
+	t.Cleanup(func() { writeBufferRetryDelay = saved })
+
+	f := startFakeFTP(t, map[string]string{"/bucket/other.txt": "other"})
+	f.setStorHook(func(string) error { return errors.New("permission denied") })
+	dir := t.TempDir()
+	s := newTestServer(t, f, "-subdir-buckets", "-write-buffer-dir", dir)
+
+	if w := serve(s, http.MethodPut, "/bucket/object.txt", "kept"); w.Code != http.StatusOK {
+		t.Fatalf("PUT failed with %d: %s", w.Code, w.Body.String())
+	}
+	waitFor(t, "the dead letter", func() bool {
+		failed, _ := filepath.Glob(filepath.Join(dir, "*"+stagedFailedSuffix))
+		return len(failed) == 1
+	})
+
+	if _, ok := f.file("/bucket/object.txt"); ok {
+		t.Error("rejected flush stored the object")
+	}
+	data, _ := filepath.Glob(filepath.Join(dir, "*"+stagedDataSuffix))
+	if len(data) != 1 {
+		t.Fatalf("dead letter kept %d data files, want 1", len(data))
+	}
+	if body, _ := os.ReadFile(data[0]); string(body) != "kept" {
+		t.Errorf("dead letter data is %q", body)
+	}
+	// The acknowledged upload stays readable from its staged copy
+	if w := serve(s, http.MethodGet, "/bucket/object.txt", ""); w.Code != http.StatusOK || w.Body.String() != "kept" {
+		t.Errorf("GET of the dead letter = %d %q", w.Code, w.Body.String())
+	}
+}